@@ -33,6 +33,107 @@ func (m *MockStore) EXPECT() *MockStoreMockRecorder {
 	return m.recorder
 }
 
+// AddUserSession mocks base method
+func (m *MockStore) AddUserSession(arg0 string, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddUserSession", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddUserSession indicates an expected call of AddUserSession
+func (mr *MockStoreMockRecorder) AddUserSession(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddUserSession", reflect.TypeOf((*MockStore)(nil).AddUserSession), arg0, arg1)
+}
+
+// ClaimWebhookResponse mocks base method
+func (m *MockStore) ClaimWebhookResponse(arg0 string, arg1 int) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimWebhookResponse", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimWebhookResponse indicates an expected call of ClaimWebhookResponse
+func (mr *MockStoreMockRecorder) ClaimWebhookResponse(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimWebhookResponse", reflect.TypeOf((*MockStore)(nil).ClaimWebhookResponse), arg0, arg1)
+}
+
+// CompareAndStoreConversationState mocks base method
+func (m *MockStore) CompareAndStoreConversationState(arg0 string, arg1 []byte, arg2 *serializer.ConversationState) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompareAndStoreConversationState", arg0, arg1, arg2)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CompareAndStoreConversationState indicates an expected call of CompareAndStoreConversationState
+func (mr *MockStoreMockRecorder) CompareAndStoreConversationState(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompareAndStoreConversationState", reflect.TypeOf((*MockStore)(nil).CompareAndStoreConversationState), arg0, arg1, arg2)
+}
+
+// CompareAndStoreUser mocks base method
+func (m *MockStore) CompareAndStoreUser(arg0 []byte, arg1 *serializer.User) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompareAndStoreUser", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CompareAndStoreUser indicates an expected call of CompareAndStoreUser
+func (mr *MockStoreMockRecorder) CompareAndStoreUser(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompareAndStoreUser", reflect.TypeOf((*MockStore)(nil).CompareAndStoreUser), arg0, arg1)
+}
+
+// DeleteLiveAgentChat mocks base method
+func (m *MockStore) DeleteLiveAgentChat(arg0 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteLiveAgentChat", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteLiveAgentChat indicates an expected call of DeleteLiveAgentChat
+func (mr *MockStoreMockRecorder) DeleteLiveAgentChat(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteLiveAgentChat", reflect.TypeOf((*MockStore)(nil).DeleteLiveAgentChat), arg0)
+}
+
+// DeleteMaskedInputPrompt mocks base method
+func (m *MockStore) DeleteMaskedInputPrompt(arg0 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteMaskedInputPrompt", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteMaskedInputPrompt indicates an expected call of DeleteMaskedInputPrompt
+func (mr *MockStoreMockRecorder) DeleteMaskedInputPrompt(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMaskedInputPrompt", reflect.TypeOf((*MockStore)(nil).DeleteMaskedInputPrompt), arg0)
+}
+
+// DeleteSessionState mocks base method
+func (m *MockStore) DeleteSessionState(arg0 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteSessionState", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteSessionState indicates an expected call of DeleteSessionState
+func (mr *MockStoreMockRecorder) DeleteSessionState(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteSessionState", reflect.TypeOf((*MockStore)(nil).DeleteSessionState), arg0)
+}
+
 // DeleteUser mocks base method
 func (m *MockStore) DeleteUser(arg0 string) error {
 	m.ctrl.T.Helper()
@@ -47,6 +148,111 @@ func (mr *MockStoreMockRecorder) DeleteUser(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUser", reflect.TypeOf((*MockStore)(nil).DeleteUser), arg0)
 }
 
+// DeleteUserSessions mocks base method
+func (m *MockStore) DeleteUserSessions(arg0 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteUserSessions", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteUserSessions indicates an expected call of DeleteUserSessions
+func (mr *MockStoreMockRecorder) DeleteUserSessions(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUserSessions", reflect.TypeOf((*MockStore)(nil).DeleteUserSessions), arg0)
+}
+
+// GetAllUsers mocks base method
+func (m *MockStore) GetAllUsers() ([]*serializer.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAllUsers")
+	ret0, _ := ret[0].([]*serializer.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAllUsers indicates an expected call of GetAllUsers
+func (mr *MockStoreMockRecorder) GetAllUsers() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllUsers", reflect.TypeOf((*MockStore)(nil).GetAllUsers))
+}
+
+// LoadConversationState mocks base method
+func (m *MockStore) LoadConversationState(arg0 string) (*serializer.ConversationState, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadConversationState", arg0)
+	ret0, _ := ret[0].(*serializer.ConversationState)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadConversationState indicates an expected call of LoadConversationState
+func (mr *MockStoreMockRecorder) LoadConversationState(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadConversationState", reflect.TypeOf((*MockStore)(nil).LoadConversationState), arg0)
+}
+
+// LoadConversationStateRecord mocks base method
+func (m *MockStore) LoadConversationStateRecord(arg0 string) (*serializer.ConversationState, []byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadConversationStateRecord", arg0)
+	ret0, _ := ret[0].(*serializer.ConversationState)
+	ret1, _ := ret[1].([]byte)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// LoadConversationStateRecord indicates an expected call of LoadConversationStateRecord
+func (mr *MockStoreMockRecorder) LoadConversationStateRecord(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadConversationStateRecord", reflect.TypeOf((*MockStore)(nil).LoadConversationStateRecord), arg0)
+}
+
+// LoadDMMaskedInputSession mocks base method
+func (m *MockStore) LoadDMMaskedInputSession(arg0 string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadDMMaskedInputSession", arg0)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadDMMaskedInputSession indicates an expected call of LoadDMMaskedInputSession
+func (mr *MockStoreMockRecorder) LoadDMMaskedInputSession(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadDMMaskedInputSession", reflect.TypeOf((*MockStore)(nil).LoadDMMaskedInputSession), arg0)
+}
+
+// LoadLiveAgentChat mocks base method
+func (m *MockStore) LoadLiveAgentChat(arg0 string) (*serializer.LiveAgentChat, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadLiveAgentChat", arg0)
+	ret0, _ := ret[0].(*serializer.LiveAgentChat)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadLiveAgentChat indicates an expected call of LoadLiveAgentChat
+func (mr *MockStoreMockRecorder) LoadLiveAgentChat(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadLiveAgentChat", reflect.TypeOf((*MockStore)(nil).LoadLiveAgentChat), arg0)
+}
+
+// LoadMaskedInputPrompt mocks base method
+func (m *MockStore) LoadMaskedInputPrompt(arg0 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadMaskedInputPrompt", arg0)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadMaskedInputPrompt indicates an expected call of LoadMaskedInputPrompt
+func (mr *MockStoreMockRecorder) LoadMaskedInputPrompt(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadMaskedInputPrompt", reflect.TypeOf((*MockStore)(nil).LoadMaskedInputPrompt), arg0)
+}
+
 // LoadUser mocks base method
 func (m *MockStore) LoadUser(arg0 string) (*serializer.User, error) {
 	m.ctrl.T.Helper()
@@ -62,6 +268,37 @@ func (mr *MockStoreMockRecorder) LoadUser(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadUser", reflect.TypeOf((*MockStore)(nil).LoadUser), arg0)
 }
 
+// LoadUserRecord mocks base method
+func (m *MockStore) LoadUserRecord(arg0 string) (*serializer.User, []byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadUserRecord", arg0)
+	ret0, _ := ret[0].(*serializer.User)
+	ret1, _ := ret[1].([]byte)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// LoadUserRecord indicates an expected call of LoadUserRecord
+func (mr *MockStoreMockRecorder) LoadUserRecord(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadUserRecord", reflect.TypeOf((*MockStore)(nil).LoadUserRecord), arg0)
+}
+
+// LoadUserSessions mocks base method
+func (m *MockStore) LoadUserSessions(arg0 string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadUserSessions", arg0)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadUserSessions indicates an expected call of LoadUserSessions
+func (mr *MockStoreMockRecorder) LoadUserSessions(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadUserSessions", reflect.TypeOf((*MockStore)(nil).LoadUserSessions), arg0)
+}
+
 // LoadUserWithSysID mocks base method
 func (m *MockStore) LoadUserWithSysID(arg0 string) (*serializer.User, error) {
 	m.ctrl.T.Helper()
@@ -77,6 +314,77 @@ func (mr *MockStoreMockRecorder) LoadUserWithSysID(arg0 interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadUserWithSysID", reflect.TypeOf((*MockStore)(nil).LoadUserWithSysID), arg0)
 }
 
+// LoadWebhookSecretRotation mocks base method
+func (m *MockStore) LoadWebhookSecretRotation() (*serializer.WebhookSecretRotation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadWebhookSecretRotation")
+	ret0, _ := ret[0].(*serializer.WebhookSecretRotation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadWebhookSecretRotation indicates an expected call of LoadWebhookSecretRotation
+func (mr *MockStoreMockRecorder) LoadWebhookSecretRotation() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadWebhookSecretRotation", reflect.TypeOf((*MockStore)(nil).LoadWebhookSecretRotation))
+}
+
+// ReleaseWebhookResponse mocks base method
+func (m *MockStore) ReleaseWebhookResponse(arg0 string, arg1 int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseWebhookResponse", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseWebhookResponse indicates an expected call of ReleaseWebhookResponse
+func (mr *MockStoreMockRecorder) ReleaseWebhookResponse(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseWebhookResponse", reflect.TypeOf((*MockStore)(nil).ReleaseWebhookResponse), arg0, arg1)
+}
+
+// StoreDMMaskedInputSession mocks base method
+func (m *MockStore) StoreDMMaskedInputSession(arg0 string, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StoreDMMaskedInputSession", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StoreDMMaskedInputSession indicates an expected call of StoreDMMaskedInputSession
+func (mr *MockStoreMockRecorder) StoreDMMaskedInputSession(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreDMMaskedInputSession", reflect.TypeOf((*MockStore)(nil).StoreDMMaskedInputSession), arg0, arg1)
+}
+
+// StoreLiveAgentChat mocks base method
+func (m *MockStore) StoreLiveAgentChat(arg0 string, arg1 *serializer.LiveAgentChat) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StoreLiveAgentChat", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StoreLiveAgentChat indicates an expected call of StoreLiveAgentChat
+func (mr *MockStoreMockRecorder) StoreLiveAgentChat(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreLiveAgentChat", reflect.TypeOf((*MockStore)(nil).StoreLiveAgentChat), arg0, arg1)
+}
+
+// StoreMaskedInputPrompt mocks base method
+func (m *MockStore) StoreMaskedInputPrompt(arg0 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StoreMaskedInputPrompt", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StoreMaskedInputPrompt indicates an expected call of StoreMaskedInputPrompt
+func (mr *MockStoreMockRecorder) StoreMaskedInputPrompt(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreMaskedInputPrompt", reflect.TypeOf((*MockStore)(nil).StoreMaskedInputPrompt), arg0)
+}
+
 // StoreOAuth2State mocks base method
 func (m *MockStore) StoreOAuth2State(arg0 string) error {
 	m.ctrl.T.Helper()
@@ -105,6 +413,64 @@ func (mr *MockStoreMockRecorder) StoreUser(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreUser", reflect.TypeOf((*MockStore)(nil).StoreUser), arg0)
 }
 
+// StoreWebhookNonce mocks base method
+func (m *MockStore) StoreWebhookNonce(arg0 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StoreWebhookNonce", arg0)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// StoreWebhookNonce indicates an expected call of StoreWebhookNonce
+func (mr *MockStoreMockRecorder) StoreWebhookNonce(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreWebhookNonce", reflect.TypeOf((*MockStore)(nil).StoreWebhookNonce), arg0)
+}
+
+// StoreWebhookSecretRotation mocks base method
+func (m *MockStore) StoreWebhookSecretRotation(arg0 *serializer.WebhookSecretRotation) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StoreWebhookSecretRotation", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StoreWebhookSecretRotation indicates an expected call of StoreWebhookSecretRotation
+func (mr *MockStoreMockRecorder) StoreWebhookSecretRotation(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreWebhookSecretRotation", reflect.TypeOf((*MockStore)(nil).StoreWebhookSecretRotation), arg0)
+}
+
+// TryLock mocks base method
+func (m *MockStore) TryLock(arg0 string, arg1 []byte, arg2 int64) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TryLock", arg0, arg1, arg2)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TryLock indicates an expected call of TryLock
+func (mr *MockStoreMockRecorder) TryLock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TryLock", reflect.TypeOf((*MockStore)(nil).TryLock), arg0, arg1, arg2)
+}
+
+// Unlock mocks base method
+func (m *MockStore) Unlock(arg0 string, arg1 []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unlock", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Unlock indicates an expected call of Unlock
+func (mr *MockStoreMockRecorder) Unlock(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unlock", reflect.TypeOf((*MockStore)(nil).Unlock), arg0, arg1)
+}
+
 // VerifyOAuth2State mocks base method
 func (m *MockStore) VerifyOAuth2State(arg0 string) error {
 	m.ctrl.T.Helper()
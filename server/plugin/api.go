@@ -1,8 +1,12 @@
 package plugin
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +14,7 @@ import (
 	"net/url"
 	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
@@ -43,6 +48,10 @@ func (p *Plugin) initializeAPI() *mux.Router {
 	apiRouter.HandleFunc(PathActionOptions, p.checkAuth(p.checkOAuth(p.handlePickerSelection))).Methods(http.MethodPost)
 	apiRouter.HandleFunc(PathSetDateTimeDialog, p.checkAuth(p.checkOAuth(p.handleSetDateTimeDialog))).Methods(http.MethodPost)
 	apiRouter.HandleFunc(PathSetDateTime, p.checkAuth(p.checkOAuth(p.handleSetDateTime))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(PathMultiSelectDialog, p.checkAuth(p.checkOAuth(p.handleMultiSelectDialog))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(PathMultiSelect, p.checkAuth(p.checkOAuth(p.handleMultiSelect))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(PathMaskedInputDialog, p.checkAuth(p.checkOAuth(p.handleMaskedInputDialog))).Methods(http.MethodPost)
+	apiRouter.HandleFunc(PathMaskedInput, p.checkAuth(p.checkOAuth(p.handleMaskedInput))).Methods(http.MethodPost)
 	apiRouter.HandleFunc(PathVirtualAgentWebhook, p.checkAuthBySecret(p.handleVirtualAgentWebhook)).Methods(http.MethodPost)
 	apiRouter.HandleFunc(fmt.Sprintf("/file/{%s}", PathParamEncryptedFileInfo), p.handleFileAttachments).Methods(http.MethodGet)
 
@@ -70,18 +79,118 @@ func (p *Plugin) handleAPIError(w http.ResponseWriter, apiErr *serializer.APIErr
 
 func (p *Plugin) checkAuthBySecret(handleFunc http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Replace all occurrences of " " with "+" in WebhookSecret.
-		webhookSecret := strings.ReplaceAll(r.FormValue(SecretParam), " ", "+")
-		if statusCode, err := verifyHTTPSecret(p.getConfiguration().WebhookSecret, webhookSecret); err != nil {
+		config := p.getConfiguration()
+		instance, err := config.getInstance(r.URL.Query().Get(InstanceParam))
+		// The default instance is not configured when only the additional instances are used
+		if err == nil && instance.URL == "" {
+			err = errors.Wrap(ErrInstanceNotFound, "the ServiceNow instance is not configured")
+		}
+		if err != nil {
+			p.API.LogError("Invalid ServiceNow instance", "Error", err.Error())
+			p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusForbidden, Message: "Invalid ServiceNow instance."})
+			return
+		}
+		secrets := config.getInstanceWebhookSecrets(instance)
+		if len(secrets) == 0 {
+			p.API.LogError("Webhook secret is not configured for the ServiceNow instance", "Instance", instance.Name)
+			p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusForbidden, Message: "Webhook secret is not configured."})
+			return
+		}
+
+		var matchedSecret *webhookSecret
+		var statusCode int
+		if config.WebhookAuthenticationMode == WebhookAuthenticationModeSignature {
+			matchedSecret, statusCode, err = p.verifyWebhookSignature(r, secrets)
+		} else {
+			// Replace all occurrences of " " with "+" in WebhookSecret.
+			webhookSecret := strings.ReplaceAll(r.FormValue(SecretParam), " ", "+")
+			for i := range secrets {
+				if statusCode, err = verifyHTTPSecret(secrets[i].value, webhookSecret); err == nil {
+					matchedSecret = &secrets[i]
+					break
+				}
+			}
+		}
+
+		if err == nil && matchedSecret == nil {
+			statusCode, err = http.StatusForbidden, errors.New("no webhook secret matched")
+		}
+
+		if err != nil {
 			p.API.LogError("Invalid secret", "Error", err.Error())
 			p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: statusCode, Message: fmt.Sprintf("Invalid Secret. Error: %s", err.Error())})
 			return
 		}
 
+		if matchedSecret.name == WebhookSecretPrevious {
+			p.API.LogWarn("Webhook request authenticated with the previous webhook secret. Update the webhook secret in ServiceNow before the grace period ends.",
+				"GracePeriodEndsAt", config.getWebhookSecretGracePeriodEnd().Format(time.RFC3339))
+		} else {
+			p.API.LogDebug("Webhook request authenticated", "Secret", matchedSecret.name, "Instance", instance.Name)
+		}
+
 		handleFunc(w, r)
 	}
 }
 
+// verifyWebhookSignature verifies the HMAC-SHA256 signature of the webhook request, which is computed over
+// the timestamp, the nonce and the body of the request as "<timestamp>.<nonce>.<body>" using one of the webhook secrets.
+// Requests outside the allowed time window or with an already used nonce are rejected to prevent replays.
+func (p *Plugin) verifyWebhookSignature(r *http.Request, secrets []webhookSecret) (matchedSecret *webhookSecret, status int, err error) {
+	signature := r.Header.Get(HeaderWebhookSignature)
+	timestamp := r.Header.Get(HeaderWebhookTimestamp)
+	nonce := r.Header.Get(HeaderWebhookNonce)
+	if signature == "" || timestamp == "" || nonce == "" {
+		return nil, http.StatusForbidden, errors.New("request headers: signature, timestamp or nonce is missing")
+	}
+
+	requestTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, http.StatusForbidden, errors.New("request headers: invalid timestamp")
+	}
+
+	if age := time.Now().Unix() - requestTime; age > WebhookSignatureTolerance || age < -WebhookSignatureTolerance {
+		return nil, http.StatusForbidden, errors.New("request headers: timestamp is outside the allowed window")
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.Wrap(err, "failed to read the request body")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expectedSignature, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, http.StatusForbidden, errors.New("request headers: invalid signature")
+	}
+
+	for i := range secrets {
+		mac := hmac.New(sha256.New, []byte(secrets[i].value))
+		_, _ = mac.Write([]byte(fmt.Sprintf("%s.%s.", timestamp, nonce)))
+		_, _ = mac.Write(body)
+		if hmac.Equal(mac.Sum(nil), expectedSignature) {
+			matchedSecret = &secrets[i]
+			break
+		}
+	}
+
+	if matchedSecret == nil {
+		return nil, http.StatusForbidden, errors.New("request headers: signature did not match")
+	}
+
+	// The nonce is stored only after the signature is verified, so that unsigned requests cannot use up nonces.
+	stored, err := p.store.StoreWebhookNonce(nonce)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "failed to store the request nonce")
+	}
+
+	if !stored {
+		return nil, http.StatusForbidden, errors.New("request headers: nonce is already used")
+	}
+
+	return matchedSecret, 0, nil
+}
+
 // Ref: mattermost plugin confluence(https://github.com/mattermost/mattermost-plugin-confluence/blob/3ee2aa149b6807d14fe05772794c04448a17e8be/server/controller/main.go#L97)
 func verifyHTTPSecret(expected, got string) (status int, err error) {
 	for {
@@ -123,7 +232,7 @@ func (p *Plugin) handleFileAttachments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsonBytes, err := decrypt(decoded, []byte(p.getConfiguration().EncryptionSecret))
+	jsonBytes, _, err := decryptWithKeyRing(decoded, p.getConfiguration().getEncryptionKeyRing())
 	if err != nil {
 		p.API.LogError("Error occurred while decrypting the file. Error: %s", err.Error())
 		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusInternalServerError, Message: "Error occurred while decrypting the file."})
@@ -202,7 +311,14 @@ func (p *Plugin) checkOAuth(handler http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		instance, err := p.getConfiguration().getInstance(user.InstanceName)
+		if err != nil {
+			p.API.LogError("Error getting the ServiceNow instance of the user.", "Error", err.Error())
+			return
+		}
+
 		ctx := context.WithValue(r.Context(), ContextTokenKey, token)
+		ctx = context.WithValue(ctx, ContextInstanceKey, instance)
 		r = r.Clone(ctx)
 		handler(w, r)
 	}
@@ -281,6 +397,12 @@ func (p *Plugin) handleSetDateTimeDialog(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if _, message := p.checkActivePrompt(r.Header.Get(HeaderMattermostUserID), postActionIntegrationRequest.PostId); message != "" {
+		response.EphemeralText = message
+		p.returnPostActionIntegrationResponse(w, response)
+		return
+	}
+
 	var elements []model.DialogElement
 	date := model.DialogElement{
 		DisplayName: "Date:",
@@ -327,7 +449,8 @@ func (p *Plugin) handleSetDateTimeDialog(w http.ResponseWriter, r *http.Request)
 
 	ctx := r.Context()
 	token := ctx.Value(ContextTokenKey).(*oauth2.Token)
-	client := p.MakeClient(r.Context(), token)
+	instance := ctx.Value(ContextInstanceKey).(*ServiceNowInstance)
+	client := p.MakeClient(r.Context(), instance, token, r.Header.Get(HeaderMattermostUserID))
 	if err := client.OpenDialogRequest(&requestBody); err != nil {
 		p.API.LogError("Error opening date-time selction dialog.", "Error", err.Error())
 		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusInternalServerError, Message: "Error in opening date-time selection dialog."})
@@ -360,6 +483,13 @@ func (p *Plugin) handleSetDateTime(w http.ResponseWriter, r *http.Request) {
 
 	postID := strings.Split(submitRequest.CallbackId, "__")[0]
 	inputType := strings.Split(submitRequest.CallbackId, "__")[1]
+	mattermostUserID := r.Header.Get(HeaderMattermostUserID)
+	sessionID, message := p.checkActivePrompt(mattermostUserID, postID)
+	if message != "" {
+		response.Error = message
+		p.returnSubmitDialogResponse(w, response)
+		return
+	}
 
 	var dateValidationError, timeValidationError string
 	switch inputType {
@@ -403,13 +533,16 @@ func (p *Plugin) handleSetDateTime(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := p.MakeClient(r.Context(), token)
-	if err := client.SendMessageToVirtualAgentAPI(userID, selectedOption, true, &MessageAttachment{}); err != nil {
+	instance := ctx.Value(ContextInstanceKey).(*ServiceNowInstance)
+	client := p.MakeClient(r.Context(), instance, token, mattermostUserID)
+	if err := client.SendMessageToVirtualAgentAPI(userID, sessionID, selectedOption, true, &MessageAttachment{}); err != nil {
 		p.API.LogError("Error sending message to VA.", "Error", err.Error())
 		p.returnSubmitDialogResponse(w, response)
 		return
 	}
 
+	p.answeredActivePrompt(mattermostUserID, sessionID, postID)
+
 	newAttachment := []*model.SlackAttachment{}
 	newAttachment = append(newAttachment, &model.SlackAttachment{
 		Text:  fmt.Sprintf("You selected %s: %s", inputType, selectedOption),
@@ -433,6 +566,268 @@ func (p *Plugin) handleSetDateTime(w http.ResponseWriter, r *http.Request) {
 	p.returnSubmitDialogResponse(w, response)
 }
 
+// multiSelectDialogState is passed along with the multi-select dialog to know the options behind the submitted checkboxes.
+type multiSelectDialogState struct {
+	Options  []Option `json:"options"`
+	Required bool     `json:"required"`
+}
+
+// handleMultiSelectDialog opens a dialog with a checkbox for each option of a multi-select picker.
+func (p *Plugin) handleMultiSelectDialog(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	response := &model.PostActionIntegrationResponse{}
+	postActionIntegrationRequest := &model.PostActionIntegrationRequest{}
+	if err := decoder.Decode(&postActionIntegrationRequest); err != nil {
+		p.API.LogError("Error decoding PostActionIntegrationRequest.", "Error", err.Error())
+		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusBadRequest, Message: "Error in decoding PostActionIntegrationRequest."})
+		return
+	}
+
+	if _, message := p.checkActivePrompt(r.Header.Get(HeaderMattermostUserID), postActionIntegrationRequest.PostId); message != "" {
+		response.EphemeralText = message
+		p.returnPostActionIntegrationResponse(w, response)
+		return
+	}
+
+	state := multiSelectDialogState{}
+	state.Required, _ = postActionIntegrationRequest.Context[MultiSelectRequiredContextKey].(bool)
+	options := fmt.Sprintf("%v", postActionIntegrationRequest.Context[MultiSelectOptionsContextKey])
+	if err := json.Unmarshal([]byte(options), &state.Options); err != nil {
+		p.API.LogError("Error decoding the picker options.", "Error", err.Error())
+		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusBadRequest, Message: "Error in decoding the picker options."})
+		return
+	}
+
+	if len(state.Options) == 0 {
+		response.EphemeralText = NoOptionAvailableError
+		p.returnPostActionIntegrationResponse(w, response)
+		return
+	}
+
+	elements := make([]model.DialogElement, 0, len(state.Options))
+	for index, option := range state.Options {
+		elements = append(elements, model.DialogElement{
+			DisplayName: truncate(option.Label, DialogElementDisplayNameMaxLength),
+			Name:        fmt.Sprintf("%s%d", MultiSelectElementPrefix, index),
+			Type:        "bool",
+			Placeholder: option.Label,
+			Optional:    true,
+		})
+	}
+
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		p.API.LogError("Error encoding the multi-select dialog state.", "Error", err.Error())
+		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusInternalServerError, Message: "Error in encoding the multi-select dialog state."})
+		return
+	}
+
+	requestBody := model.OpenDialogRequest{
+		TriggerId: postActionIntegrationRequest.TriggerId,
+		URL:       fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathMultiSelect),
+		Dialog: model.Dialog{
+			Title:       "Select options",
+			CallbackId:  postActionIntegrationRequest.PostId,
+			State:       string(stateBytes),
+			SubmitLabel: "Submit",
+			Elements:    elements,
+		},
+	}
+
+	ctx := r.Context()
+	token := ctx.Value(ContextTokenKey).(*oauth2.Token)
+	instance := ctx.Value(ContextInstanceKey).(*ServiceNowInstance)
+	client := p.MakeClient(r.Context(), instance, token, r.Header.Get(HeaderMattermostUserID))
+	if err := client.OpenDialogRequest(&requestBody); err != nil {
+		p.API.LogError("Error opening multi-select dialog.", "Error", err.Error())
+		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusInternalServerError, Message: "Error in opening multi-select dialog."})
+		return
+	}
+	p.returnPostActionIntegrationResponse(w, response)
+}
+
+// handleMultiSelect sends the values of the options selected in the multi-select dialog to the Virtual Agent.
+func (p *Plugin) handleMultiSelect(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	response := &model.SubmitDialogResponse{}
+	submitRequest := &model.SubmitDialogRequest{}
+	if err := decoder.Decode(&submitRequest); err != nil {
+		p.API.LogError("Error decoding SubmitDialogRequest.", "Error", err.Error())
+		p.returnSubmitDialogResponse(w, response)
+		return
+	}
+
+	mattermostUserID := r.Header.Get(HeaderMattermostUserID)
+	sessionID, message := p.checkActivePrompt(mattermostUserID, submitRequest.CallbackId)
+	if message != "" {
+		response.Error = message
+		p.returnSubmitDialogResponse(w, response)
+		return
+	}
+
+	state := &multiSelectDialogState{}
+	if err := json.Unmarshal([]byte(submitRequest.State), state); err != nil {
+		p.API.LogError("Error decoding the multi-select dialog state.", "Error", err.Error())
+		response.Error = GenericErrorMessage
+		p.returnSubmitDialogResponse(w, response)
+		return
+	}
+
+	var values, labels []string
+	for index, option := range state.Options {
+		if selected, _ := submitRequest.Submission[fmt.Sprintf("%s%d", MultiSelectElementPrefix, index)].(bool); selected {
+			values = append(values, option.Value)
+			labels = append(labels, option.Label)
+		}
+	}
+
+	if len(values) == 0 && state.Required {
+		response.Error = NoOptionSelectedError
+		p.returnSubmitDialogResponse(w, response)
+		return
+	}
+
+	ctx := r.Context()
+	token := ctx.Value(ContextTokenKey).(*oauth2.Token)
+	instance := ctx.Value(ContextInstanceKey).(*ServiceNowInstance)
+	userID := r.Header.Get(HeaderServiceNowUserID)
+	client := p.MakeClient(r.Context(), instance, token, mattermostUserID)
+	if err := client.SendMessageToVirtualAgentAPI(userID, sessionID, strings.Join(values, MultiSelectSeparator), true, &MessageAttachment{}); err != nil {
+		p.API.LogError("Error sending message to VA.", "Error", err.Error())
+		p.returnSubmitDialogResponse(w, response)
+		return
+	}
+
+	p.answeredActivePrompt(mattermostUserID, sessionID, submitRequest.CallbackId)
+
+	newAttachment := []*model.SlackAttachment{}
+	newAttachment = append(newAttachment, &model.SlackAttachment{
+		Text:  fmt.Sprintf("You selected: %s", strings.Join(labels, ", ")),
+		Color: updatedPostBorderColor,
+	})
+
+	newPost := &model.Post{
+		Id:        submitRequest.CallbackId,
+		ChannelId: submitRequest.ChannelId,
+		UserId:    p.botUserID,
+	}
+
+	model.ParseSlackAttachment(newPost, newAttachment)
+
+	if _, appErr := p.API.UpdatePost(newPost); appErr != nil {
+		p.API.LogError("Error updating the post.", "Error", appErr.Message)
+	}
+
+	p.returnSubmitDialogResponse(w, response)
+}
+
+// handleMaskedInputDialog opens a dialog with a password field for answering a masked prompt.
+func (p *Plugin) handleMaskedInputDialog(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	response := &model.PostActionIntegrationResponse{}
+	postActionIntegrationRequest := &model.PostActionIntegrationRequest{}
+	if err := decoder.Decode(&postActionIntegrationRequest); err != nil {
+		p.API.LogError("Error decoding PostActionIntegrationRequest.", "Error", err.Error())
+		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusBadRequest, Message: "Error in decoding PostActionIntegrationRequest."})
+		return
+	}
+
+	if _, message := p.checkActivePrompt(r.Header.Get(HeaderMattermostUserID), postActionIntegrationRequest.PostId); message != "" {
+		response.EphemeralText = message
+		p.returnPostActionIntegrationResponse(w, response)
+		return
+	}
+
+	label, _ := postActionIntegrationRequest.Context[MaskedInputLabelContextKey].(string)
+	requestBody := model.OpenDialogRequest{
+		TriggerId: postActionIntegrationRequest.TriggerId,
+		URL:       fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathMaskedInput),
+		Dialog: model.Dialog{
+			Title:       "Enter value",
+			CallbackId:  postActionIntegrationRequest.PostId,
+			SubmitLabel: "Submit",
+			Elements: []model.DialogElement{
+				{
+					DisplayName: "Value:",
+					Name:        MaskedInputElementName,
+					Type:        "text",
+					SubType:     "password",
+					HelpText:    label,
+				},
+			},
+		},
+	}
+
+	ctx := r.Context()
+	token := ctx.Value(ContextTokenKey).(*oauth2.Token)
+	instance := ctx.Value(ContextInstanceKey).(*ServiceNowInstance)
+	client := p.MakeClient(r.Context(), instance, token, r.Header.Get(HeaderMattermostUserID))
+	if err := client.OpenDialogRequest(&requestBody); err != nil {
+		p.API.LogError("Error opening masked input dialog.", "Error", err.Error())
+		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusInternalServerError, Message: "Error in opening masked input dialog."})
+		return
+	}
+	p.returnPostActionIntegrationResponse(w, response)
+}
+
+// handleMaskedInput sends the value entered in the masked input dialog straight to the Virtual Agent without posting it.
+func (p *Plugin) handleMaskedInput(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	response := &model.SubmitDialogResponse{}
+	submitRequest := &model.SubmitDialogRequest{}
+	if err := decoder.Decode(&submitRequest); err != nil {
+		p.API.LogError("Error decoding SubmitDialogRequest.", "Error", err.Error())
+		p.returnSubmitDialogResponse(w, response)
+		return
+	}
+
+	mattermostUserID := r.Header.Get(HeaderMattermostUserID)
+	sessionID, message := p.checkActivePrompt(mattermostUserID, submitRequest.CallbackId)
+	if message != "" {
+		response.Error = message
+		p.returnSubmitDialogResponse(w, response)
+		return
+	}
+
+	value, _ := submitRequest.Submission[MaskedInputElementName].(string)
+	ctx := r.Context()
+	token := ctx.Value(ContextTokenKey).(*oauth2.Token)
+	instance := ctx.Value(ContextInstanceKey).(*ServiceNowInstance)
+	userID := r.Header.Get(HeaderServiceNowUserID)
+	client := p.MakeClient(r.Context(), instance, token, mattermostUserID)
+	if err := client.SendMessageToVirtualAgentAPI(userID, sessionID, value, true, &MessageAttachment{}); err != nil {
+		p.API.LogError("Error sending message to VA.", "Error", err.Error())
+		p.returnSubmitDialogResponse(w, response)
+		return
+	}
+
+	if err := p.store.DeleteMaskedInputPrompt(getSessionKey(mattermostUserID, sessionID)); err != nil {
+		p.API.LogWarn("Failed to delete the masked input prompt", "UserID", mattermostUserID, "Error", err.Error())
+	}
+
+	p.answeredActivePrompt(mattermostUserID, sessionID, submitRequest.CallbackId)
+
+	newAttachment := []*model.SlackAttachment{}
+	newAttachment = append(newAttachment, &model.SlackAttachment{
+		Text:  MaskedInputSubmittedMessage,
+		Color: updatedPostBorderColor,
+	})
+
+	newPost := &model.Post{
+		Id:        submitRequest.CallbackId,
+		ChannelId: submitRequest.ChannelId,
+		UserId:    p.botUserID,
+	}
+
+	model.ParseSlackAttachment(newPost, newAttachment)
+
+	if _, appErr := p.API.UpdatePost(newPost); appErr != nil {
+		p.API.LogError("Error updating the post.", "Error", appErr.Message)
+	}
+
+	p.returnSubmitDialogResponse(w, response)
+}
+
 func (p *Plugin) handlePickerSelection(w http.ResponseWriter, r *http.Request) {
 	response := &model.PostActionIntegrationResponse{}
 	decoder := json.NewDecoder(r.Body)
@@ -443,22 +838,45 @@ func (p *Plugin) handlePickerSelection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	mattermostUserID := r.Header.Get(HeaderMattermostUserID)
+	sessionID, message := p.checkActivePrompt(mattermostUserID, postActionIntegrationRequest.PostId)
+	if message != "" {
+		response.EphemeralText = message
+		p.returnPostActionIntegrationResponse(w, response)
+		return
+	}
+
 	ctx := r.Context()
 	token := ctx.Value(ContextTokenKey).(*oauth2.Token)
 	userID := r.Header.Get(HeaderServiceNowUserID)
-	selectedOption := postActionIntegrationRequest.Context["selected_option"].(string)
+	selectedOption := postActionIntegrationRequest.Context[PickerSelectedOptionContextKey].(string)
 	attachment := &MessageAttachment{}
 
-	client := p.MakeClient(r.Context(), token)
-	if err := client.SendMessageToVirtualAgentAPI(userID, selectedOption, true, attachment); err != nil {
+	// Posts created before the option values were used have the label as the value and no labels in the context
+	selectedLabel := selectedOption
+	if labels, ok := postActionIntegrationRequest.Context[PickerOptionLabelsContextKey].(map[string]interface{}); ok {
+		label, found := labels[selectedOption].(string)
+		if !found {
+			p.API.LogError(OptionNotAvailableError, "Option", selectedOption)
+			p.returnPostActionIntegrationResponse(w, response)
+			return
+		}
+		selectedLabel = label
+	}
+
+	instance := ctx.Value(ContextInstanceKey).(*ServiceNowInstance)
+	client := p.MakeClient(r.Context(), instance, token, mattermostUserID)
+	if err := client.SendMessageToVirtualAgentAPI(userID, sessionID, selectedOption, true, attachment); err != nil {
 		p.API.LogError("Error sending message to VA.", "Error", err.Error())
 		p.returnPostActionIntegrationResponse(w, response)
 		return
 	}
 
+	p.answeredActivePrompt(mattermostUserID, sessionID, postActionIntegrationRequest.PostId)
+
 	newAttachment := []*model.SlackAttachment{}
 	newAttachment = append(newAttachment, &model.SlackAttachment{
-		Text:  fmt.Sprintf("You selected: %s", selectedOption),
+		Text:  fmt.Sprintf("You selected: %s", selectedLabel),
 		Color: updatedPostBorderColor,
 	})
 
@@ -484,11 +902,31 @@ func (p *Plugin) handleVirtualAgentWebhook(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err = p.ProcessResponse(data); err != nil {
-		p.API.LogError("Error occurred while processing response body.", "Error", err.Error())
-		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusInternalServerError, Message: "Error occurred while processing response body."})
+	webhookBody := &VirtualAgentRequestBody{}
+	if err = json.Unmarshal(data, webhookBody); err != nil {
+		p.API.LogError("Error occurred while decoding webhook body.", "Error", err.Error())
+		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusBadRequest, Message: "Error occurred while decoding webhook body."})
 		return
 	}
+
+	if webhookBody.UserID == "" {
+		p.API.LogError("Webhook body does not contain the ServiceNow user ID.", "RequestID", webhookBody.RequestID)
+		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusBadRequest, Message: "Webhook body does not contain the user ID."})
+		return
+	}
+
+	// The response is acknowledged as soon as it is queued, so that slow Mattermost writes do not make ServiceNow retry the request.
+	// A response which fails to be processed is retried by the queue instead.
+	request := &webhookRequest{
+		instanceName: r.URL.Query().Get(InstanceParam),
+		data:         data,
+	}
+	if err = p.webhookQueue.Enqueue(webhookBody.UserID, request); err != nil {
+		p.API.LogError("Error occurred while queueing webhook body.", "UserID", webhookBody.UserID, "Error", err.Error())
+		p.handleAPIError(w, &serializer.APIErrorResponse{StatusCode: http.StatusServiceUnavailable, Message: "Error occurred while queueing webhook body."})
+		return
+	}
+
 	ReturnStatusOK(w)
 }
 
@@ -1,6 +1,9 @@
 package plugin
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +12,8 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -272,13 +277,18 @@ func TestPlugin_handleVirtualAgentWebhook(t *testing.T) {
 		request          testutils.Request
 		expectedResponse testutils.ExpectedResponse
 		isErrorExpected  bool
+		isQueueClosed    bool
 	}{
 		"Webhook secret is present": {
 			httpTest: httpTestJSON,
 			request: testutils.Request{
 				Method: http.MethodPost,
 				URL:    fmt.Sprintf("%s%s?secret=mockWebhookSecret", pathPrefix, PathVirtualAgentWebhook),
-				Body:   VirtualAgentResponse{},
+				Body: VirtualAgentResponse{
+					VirtualAgentRequestBody: VirtualAgentRequestBody{
+						UserID: "mock-userId",
+					},
+				},
 			},
 			expectedResponse: testutils.ExpectedResponse{
 				StatusCode: http.StatusOK,
@@ -296,6 +306,18 @@ func TestPlugin_handleVirtualAgentWebhook(t *testing.T) {
 			},
 			isErrorExpected: true,
 		},
+		"Webhook instance is unknown": {
+			httpTest: httpTestJSON,
+			request: testutils.Request{
+				Method: http.MethodPost,
+				URL:    fmt.Sprintf("%s%s?secret=mockWebhookSecret&instance=mock-instance", pathPrefix, PathVirtualAgentWebhook),
+				Body:   VirtualAgentResponse{},
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusForbidden,
+			},
+			isErrorExpected: true,
+		},
 		"handleVirtualAgentWebhook empty body": {
 			httpTest: httpTestJSON,
 			request: testutils.Request{
@@ -304,9 +326,38 @@ func TestPlugin_handleVirtualAgentWebhook(t *testing.T) {
 				Body:   nil,
 			},
 			expectedResponse: testutils.ExpectedResponse{
-				StatusCode: http.StatusInternalServerError,
+				StatusCode: http.StatusBadRequest,
+			},
+			isErrorExpected: true,
+		},
+		"handleVirtualAgentWebhook body without user ID": {
+			httpTest: httpTestJSON,
+			request: testutils.Request{
+				Method: http.MethodPost,
+				URL:    fmt.Sprintf("%s%s?secret=mockWebhookSecret", pathPrefix, PathVirtualAgentWebhook),
+				Body:   VirtualAgentResponse{},
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusBadRequest,
+			},
+			isErrorExpected: true,
+		},
+		"handleVirtualAgentWebhook queue is closed": {
+			httpTest: httpTestJSON,
+			request: testutils.Request{
+				Method: http.MethodPost,
+				URL:    fmt.Sprintf("%s%s?secret=mockWebhookSecret", pathPrefix, PathVirtualAgentWebhook),
+				Body: VirtualAgentResponse{
+					VirtualAgentRequestBody: VirtualAgentRequestBody{
+						UserID: "mock-userId",
+					},
+				},
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusServiceUnavailable,
 			},
 			isErrorExpected: true,
+			isQueueClosed:   true,
 		},
 		"OutputLink response received from Virtual Agent": {
 			httpTest: httpTestString,
@@ -520,6 +571,16 @@ func TestPlugin_handleVirtualAgentWebhook(t *testing.T) {
 
 			mockAPI.On("DMWithAttachments", mock.AnythingOfType("string"), &model.SlackAttachment{}).Return(nil, nil)
 
+			mockAPI.On("LogDebug", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+
+			mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+
+			mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+
+			mockAPI.On("GetDirectChannel", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(&model.Channel{Id: "mockChannelID"}, nil)
+
+			mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "mockPostID"}, nil)
+
 			p.SetAPI(mockAPI)
 
 			p.initializeAPI()
@@ -529,14 +590,26 @@ func TestPlugin_handleVirtualAgentWebhook(t *testing.T) {
 
 			if !test.isErrorExpected {
 				mockedStore.EXPECT().LoadUserWithSysID(gomock.Any()).Return(&serializer.User{}, nil)
+				mockedStore.EXPECT().ClaimWebhookResponse(gomock.Any(), gomock.Any()).Return(true, nil).AnyTimes()
+				mockedStore.EXPECT().LoadLiveAgentChat(gomock.Any()).Return(nil, ErrNotFound)
+				mockedStore.EXPECT().LoadConversationStateRecord(gomock.Any()).Return(nil, nil, ErrNotFound).AnyTimes()
+				mockedStore.EXPECT().CompareAndStoreConversationState(gomock.Any(), gomock.Any(), gomock.Any()).Return(true, nil).AnyTimes()
 			}
 
 			p.store = mockedStore
 
+			p.webhookQueue = newWebhookQueue(WebhookQueueSize, WebhookWorkerIdleTimeout*time.Second, p.processWebhookRequest, p.failWebhookRequest)
+			if test.isQueueClosed {
+				p.webhookQueue.Close(time.Second)
+			}
+
 			req := test.httpTest.CreateHTTPRequest(test.request)
 			rr := httptest.NewRecorder()
 			p.ServeHTTP(&plugin.Context{}, rr, req)
 			test.httpTest.CompareHTTPResponse(rr, test.expectedResponse)
+
+			// Wait for the queued response to be processed
+			require.True(t, p.webhookQueue.Close(time.Second))
 		})
 	}
 }
@@ -544,6 +617,18 @@ func TestPlugin_handleVirtualAgentWebhook(t *testing.T) {
 func TestPlugin_handlePickerSelection(t *testing.T) {
 	defer monkey.UnpatchAll()
 
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "ClearActivePrompt", func(_ *Plugin, _, _, _ string) error {
+		return nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "GetPostSession", func(_ *Plugin, _ string) (string, string, error) {
+		return "", "mockChannelID", nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "IsSessionOwner", func(_ *Plugin, _, _, _ string) (bool, error) {
+		return true, nil
+	})
+
 	httpTestJSON := testutils.HTTPTest{
 		T:       t,
 		Encoder: testutils.EncodeJSON,
@@ -557,7 +642,64 @@ func TestPlugin_handlePickerSelection(t *testing.T) {
 		LoadUserErr           error
 		getDirectChannelError *model.AppError
 		callError             error
+		expectedMessage       string
+		isErrorLogged         bool
+		isStalePrompt         bool
 	}{
+		"Answer to a stale prompt is rejected": {
+			httpTest: httpTestJSON,
+			request: testutils.Request{
+				Method: http.MethodPost,
+				URL:    fmt.Sprintf("%s%s", pathPrefix, PathActionOptions),
+				Body: model.PostActionIntegrationRequest{
+					PostId: "mockPostID",
+					Context: map[string]interface{}{
+						"selected_option":            "mockValue",
+						PickerOptionLabelsContextKey: map[string]interface{}{"mockValue": "mockLabel"},
+					},
+				},
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode:   http.StatusOK,
+				ResponseType: "application/json",
+				Body:         model.PostActionIntegrationResponse{EphemeralText: StalePromptMessage},
+			},
+			isStalePrompt: true,
+		},
+		"Value of the selected option is sent to virtual Agent": {
+			httpTest: httpTestJSON,
+			request: testutils.Request{
+				Method: http.MethodPost,
+				URL:    fmt.Sprintf("%s%s", pathPrefix, PathActionOptions),
+				Body: model.PostActionIntegrationRequest{
+					Context: map[string]interface{}{
+						"selected_option":            "mockValue",
+						PickerOptionLabelsContextKey: map[string]interface{}{"mockValue": "mockLabel"},
+					},
+				},
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+			},
+			expectedMessage: "mockValue",
+		},
+		"Selected option is not available": {
+			httpTest: httpTestJSON,
+			request: testutils.Request{
+				Method: http.MethodPost,
+				URL:    fmt.Sprintf("%s%s", pathPrefix, PathActionOptions),
+				Body: model.PostActionIntegrationRequest{
+					Context: map[string]interface{}{
+						"selected_option":            "mockDisabledValue",
+						PickerOptionLabelsContextKey: map[string]interface{}{"mockValue": "mockLabel"},
+					},
+				},
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+			},
+			isErrorLogged: true,
+		},
 		"Selected option is successfully sent to virtual Agent": {
 			httpTest: httpTestJSON,
 			request: testutils.Request{
@@ -572,6 +714,7 @@ func TestPlugin_handlePickerSelection(t *testing.T) {
 			expectedResponse: testutils.ExpectedResponse{
 				StatusCode: http.StatusOK,
 			},
+			expectedMessage: "mockOption",
 		},
 		"Error while decoding response body": {
 			httpTest: httpTestJSON,
@@ -686,8 +829,14 @@ func TestPlugin_handlePickerSelection(t *testing.T) {
 				return &oauth2.Token{}, test.ParseAuthTokenErr
 			})
 
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "IsActivePrompt", func(_ *Plugin, _, _, _ string) (bool, error) {
+				return !test.isStalePrompt, nil
+			})
+
 			var c client
-			monkey.PatchInstanceMethod(reflect.TypeOf(&c), "Call", func(_ *client, _, _, _ string, _ io.Reader, _ interface{}, _ url.Values) (responseData []byte, err error) {
+			var message string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&c), "CallJSON", func(_ *client, _, _ string, in, _ interface{}, _ url.Values) (responseData []byte, err error) {
+				message = in.(*VirtualAgentRequestBody).Message.Text
 				return nil, test.callError
 			})
 
@@ -704,9 +853,15 @@ func TestPlugin_handlePickerSelection(t *testing.T) {
 			p.ServeHTTP(&plugin.Context{}, rr, req)
 			test.httpTest.CompareHTTPResponse(rr, test.expectedResponse)
 
-			if test.ParseAuthTokenErr != nil || test.callError != nil || test.LoadUserErr != nil {
+			if test.ParseAuthTokenErr != nil || test.callError != nil || test.LoadUserErr != nil || test.isErrorLogged {
 				mockAPI.AssertNumberOfCalls(t, "LogError", 1)
 			}
+			if test.expectedMessage != "" {
+				require.Equal(t, test.expectedMessage, message)
+			}
+			if test.isStalePrompt {
+				require.Empty(t, message)
+			}
 		})
 	}
 }
@@ -725,6 +880,22 @@ func getHandleDateTimeSelectionRequestBody(date, time, dialogType string) *model
 func Test_handleDateTimeSelection(t *testing.T) {
 	defer monkey.UnpatchAll()
 
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "IsActivePrompt", func(_ *Plugin, _, _, _ string) (bool, error) {
+		return true, nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "ClearActivePrompt", func(_ *Plugin, _, _, _ string) error {
+		return nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "GetPostSession", func(_ *Plugin, _ string) (string, string, error) {
+		return "", "mockChannelID", nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "IsSessionOwner", func(_ *Plugin, _, _, _ string) (bool, error) {
+		return true, nil
+	})
+
 	httpTestJSON := testutils.HTTPTest{
 		T:       t,
 		Encoder: testutils.EncodeJSON,
@@ -874,7 +1045,7 @@ func Test_handleDateTimeSelection(t *testing.T) {
 			p.initializeAPI()
 
 			var c client
-			monkey.PatchInstanceMethod(reflect.TypeOf(&c), "SendMessageToVirtualAgentAPI", func(_ *client, _, _ string, _ bool, _ *MessageAttachment) error {
+			monkey.PatchInstanceMethod(reflect.TypeOf(&c), "SendMessageToVirtualAgentAPI", func(_ *client, _, _, _ string, _ bool, _ *MessageAttachment) error {
 				return nil
 			})
 
@@ -900,9 +1071,377 @@ func Test_handleDateTimeSelection(t *testing.T) {
 	}
 }
 
+func Test_handleMultiSelect(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "IsActivePrompt", func(_ *Plugin, _, _, _ string) (bool, error) {
+		return true, nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "ClearActivePrompt", func(_ *Plugin, _, _, _ string) error {
+		return nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "GetPostSession", func(_ *Plugin, _ string) (string, string, error) {
+		return "", "mockChannelID", nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "IsSessionOwner", func(_ *Plugin, _, _, _ string) (bool, error) {
+		return true, nil
+	})
+
+	httpTestJSON := testutils.HTTPTest{
+		T:       t,
+		Encoder: testutils.EncodeJSON,
+	}
+
+	state := `{"options":[{"label":"mockLabel-1","value":"mockValue-1"},{"label":"mockLabel-2","value":"mockValue-2"},{"label":"mockLabel-3","value":"mockValue-3"}],"required":true}`
+	for name, test := range map[string]struct {
+		submission       map[string]interface{}
+		state            string
+		expectedResponse *model.SubmitDialogResponse
+		expectedMessage  string
+		isMessageSent    bool
+	}{
+		"Values of the selected options are sent to the Virtual Agent": {
+			submission:       map[string]interface{}{"option_0": true, "option_1": false, "option_2": true},
+			state:            state,
+			expectedResponse: &model.SubmitDialogResponse{},
+			expectedMessage:  "mockValue-1,mockValue-3",
+			isMessageSent:    true,
+		},
+		"No option is selected for a required picker": {
+			submission:       map[string]interface{}{"option_0": false},
+			state:            state,
+			expectedResponse: &model.SubmitDialogResponse{Error: NoOptionSelectedError},
+		},
+		"Empty selection is sent for an optional picker": {
+			submission:       map[string]interface{}{},
+			state:            `{"options":[{"label":"mockLabel-1","value":"mockValue-1"}],"required":false}`,
+			expectedResponse: &model.SubmitDialogResponse{},
+			isMessageSent:    true,
+		},
+		"Invalid dialog state": {
+			submission:       map[string]interface{}{"option_0": true},
+			state:            "invalid",
+			expectedResponse: &model.SubmitDialogResponse{Error: GenericErrorMessage},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := new(Plugin)
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("GetBundlePath").Return("mockString", nil)
+			mockAPI.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+			mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+			mockAPI.On("UpdatePost", mock.AnythingOfType("*model.Post")).Return(nil, nil)
+			p.SetAPI(mockAPI)
+
+			var c client
+			var message string
+			isMessageSent := false
+			monkey.PatchInstanceMethod(reflect.TypeOf(&c), "SendMessageToVirtualAgentAPI", func(_ *client, _, _, messageText string, _ bool, _ *MessageAttachment) error {
+				isMessageSent = true
+				message = messageText
+				return nil
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "ParseAuthToken", func(_ *Plugin, _ string) (*oauth2.Token, error) {
+				return &oauth2.Token{}, nil
+			})
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().LoadUser("mock-userID").Return(&serializer.User{}, nil)
+			p.store = mockedStore
+
+			req := httpTestJSON.CreateHTTPRequest(testutils.Request{
+				Method: http.MethodPost,
+				URL:    fmt.Sprintf("/api/v1%s", PathMultiSelect),
+				Body: &model.SubmitDialogRequest{
+					CallbackId: "mockPostID",
+					ChannelId:  "mockChannelID",
+					State:      test.state,
+					Submission: test.submission,
+				},
+			})
+			req.Header.Add(HeaderMattermostUserID, "mock-userID")
+			resp := httptest.NewRecorder()
+			p.ServeHTTP(&plugin.Context{}, resp, req)
+			httpTestJSON.CompareHTTPResponse(resp, testutils.ExpectedResponse{
+				StatusCode:   http.StatusOK,
+				Body:         test.expectedResponse,
+				ResponseType: "application/json",
+			})
+			require.Equal(t, test.isMessageSent, isMessageSent)
+			require.Equal(t, test.expectedMessage, message)
+		})
+	}
+}
+
+func Test_handleMultiSelectDialog(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "GetPostSession", func(_ *Plugin, _ string) (string, string, error) {
+		return "mockSessionID", "mockChannelID", nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "IsSessionOwner", func(_ *Plugin, _, _, _ string) (bool, error) {
+		return true, nil
+	})
+
+	httpTestJSON := testutils.HTTPTest{
+		T:       t,
+		Encoder: testutils.EncodeJSON,
+	}
+
+	options := `[{"label":"mockLabel-1","value":"mockValue-1"},{"label":"mockLabel-with-a-long-name","value":"mockValue-2"}]`
+	for name, test := range map[string]struct {
+		options              string
+		isStalePrompt        bool
+		openDialogRequestErr error
+		expectedResponse     testutils.ExpectedResponse
+		expectedElements     []string
+	}{
+		"Multi-select dialog is opened with a checkbox for each option": {
+			options: options,
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode:   http.StatusOK,
+				Body:         &model.PostActionIntegrationResponse{},
+				ResponseType: "application/json",
+			},
+			expectedElements: []string{"mockLabel-1", "mockLabel-with-a-long..."},
+		},
+		"Multi-select dialog is not opened without options": {
+			options: "[]",
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode:   http.StatusOK,
+				Body:         &model.PostActionIntegrationResponse{EphemeralText: NoOptionAvailableError},
+				ResponseType: "application/json",
+			},
+		},
+		"Multi-select dialog is not opened for a stale prompt": {
+			options:       options,
+			isStalePrompt: true,
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode:   http.StatusOK,
+				Body:         &model.PostActionIntegrationResponse{EphemeralText: StalePromptMessage},
+				ResponseType: "application/json",
+			},
+		},
+		"Invalid picker options": {
+			options: "invalid",
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusBadRequest,
+				Body: &serializer.APIErrorResponse{
+					StatusCode: http.StatusBadRequest,
+					Message:    "Error in decoding the picker options.",
+				},
+				ResponseType: "application/json",
+			},
+		},
+		"Error in opening multi-select dialog": {
+			options:              options,
+			openDialogRequestErr: errors.New("request failed to open the multi-select dialog"),
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body: &serializer.APIErrorResponse{
+					StatusCode: http.StatusInternalServerError,
+					Message:    "Error in opening multi-select dialog.",
+				},
+				ResponseType: "application/json",
+			},
+			expectedElements: []string{"mockLabel-1", "mockLabel-with-a-long..."},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := new(Plugin)
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("GetBundlePath").Return("mockString", nil)
+			mockAPI.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+			mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+			p.SetAPI(mockAPI)
+
+			p.initializeAPI()
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "IsActivePrompt", func(_ *Plugin, _, _, _ string) (bool, error) {
+				return !test.isStalePrompt, nil
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "ParseAuthToken", func(_ *Plugin, _ string) (*oauth2.Token, error) {
+				return &oauth2.Token{}, nil
+			})
+
+			var dialogRequest *model.OpenDialogRequest
+			monkey.PatchInstanceMethod(reflect.TypeOf(&client{}), "OpenDialogRequest", func(_ *client, body *model.OpenDialogRequest) error {
+				dialogRequest = body
+				return test.openDialogRequestErr
+			})
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().LoadUser("mock-userID").Return(&serializer.User{}, nil)
+			p.store = mockedStore
+
+			req := httpTestJSON.CreateHTTPRequest(testutils.Request{
+				Method: http.MethodPost,
+				URL:    fmt.Sprintf("/api/v1%s", PathMultiSelectDialog),
+				Body: model.PostActionIntegrationRequest{
+					TriggerId: "mockTriggerId",
+					PostId:    "mockPostId",
+					Context: map[string]interface{}{
+						MultiSelectOptionsContextKey:  test.options,
+						MultiSelectRequiredContextKey: true,
+					},
+				},
+			})
+			req.Header.Add(HeaderMattermostUserID, "mock-userID")
+			resp := httptest.NewRecorder()
+			p.ServeHTTP(&plugin.Context{}, resp, req)
+			httpTestJSON.CompareHTTPResponse(resp, test.expectedResponse)
+
+			if test.expectedElements == nil {
+				require.Nil(t, dialogRequest)
+				return
+			}
+
+			require.Equal(t, "mockPostId", dialogRequest.Dialog.CallbackId)
+			var elements []string
+			for index, element := range dialogRequest.Dialog.Elements {
+				require.Equal(t, fmt.Sprintf("%s%d", MultiSelectElementPrefix, index), element.Name)
+				require.Equal(t, "bool", element.Type)
+				elements = append(elements, element.DisplayName)
+			}
+			require.Equal(t, test.expectedElements, elements)
+
+			state := multiSelectDialogState{}
+			require.NoError(t, json.Unmarshal([]byte(dialogRequest.Dialog.State), &state))
+			require.True(t, state.Required)
+			require.Len(t, state.Options, 2)
+		})
+	}
+}
+
+func Test_handleMaskedInput(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "IsActivePrompt", func(_ *Plugin, _, _, _ string) (bool, error) {
+		return true, nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "ClearActivePrompt", func(_ *Plugin, _, _, _ string) error {
+		return nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "GetPostSession", func(_ *Plugin, _ string) (string, string, error) {
+		return "", "mockChannelID", nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "IsSessionOwner", func(_ *Plugin, _, _, _ string) (bool, error) {
+		return true, nil
+	})
+
+	httpTestJSON := testutils.HTTPTest{
+		T:       t,
+		Encoder: testutils.EncodeJSON,
+	}
+
+	for name, test := range map[string]struct {
+		sendMessageError  error
+		deletePromptError error
+		isPromptDeleted   bool
+		isPostUpdated     bool
+	}{
+		"Value is sent to the Virtual Agent and the prompt is deleted": {
+			isPromptDeleted: true,
+			isPostUpdated:   true,
+		},
+		"Error while deleting the prompt": {
+			deletePromptError: errors.New("error in deleting the prompt"),
+			isPromptDeleted:   true,
+			isPostUpdated:     true,
+		},
+		"Error while sending the value to the Virtual Agent": {
+			sendMessageError: errors.New("error in sending the message"),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := new(Plugin)
+
+			isPostUpdated := false
+			mockAPI := &plugintest.API{}
+			mockAPI.On("GetBundlePath").Return("mockString", nil)
+			mockAPI.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+			mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+			mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			mockAPI.On("UpdatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+				isPostUpdated = true
+				require.NotContains(t, args.Get(0).(*model.Post).Attachments()[0].Text, "mock-secret")
+			}).Return(nil, nil)
+			p.SetAPI(mockAPI)
+
+			var c client
+			var message string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&c), "SendMessageToVirtualAgentAPI", func(_ *client, _, _, messageText string, _ bool, _ *MessageAttachment) error {
+				message = messageText
+				return test.sendMessageError
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "ParseAuthToken", func(_ *Plugin, _ string) (*oauth2.Token, error) {
+				return &oauth2.Token{}, nil
+			})
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().LoadUser("mock-userID").Return(&serializer.User{}, nil)
+			if test.isPromptDeleted {
+				mockedStore.EXPECT().DeleteMaskedInputPrompt("mock-userID").Return(test.deletePromptError)
+			}
+			p.store = mockedStore
+
+			req := httpTestJSON.CreateHTTPRequest(testutils.Request{
+				Method: http.MethodPost,
+				URL:    fmt.Sprintf("/api/v1%s", PathMaskedInput),
+				Body: &model.SubmitDialogRequest{
+					CallbackId: "mockPostID",
+					ChannelId:  "mockChannelID",
+					Submission: map[string]interface{}{MaskedInputElementName: "mock-secret"},
+				},
+			})
+			req.Header.Add(HeaderMattermostUserID, "mock-userID")
+			resp := httptest.NewRecorder()
+			p.ServeHTTP(&plugin.Context{}, resp, req)
+			httpTestJSON.CompareHTTPResponse(resp, testutils.ExpectedResponse{
+				StatusCode:   http.StatusOK,
+				Body:         &model.SubmitDialogResponse{},
+				ResponseType: "application/json",
+			})
+			require.Equal(t, "mock-secret", message)
+			require.Equal(t, test.isPostUpdated, isPostUpdated)
+		})
+	}
+}
+
 func Test_handleDateTimeSelectionDialog(t *testing.T) {
 	defer monkey.UnpatchAll()
 
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "IsActivePrompt", func(_ *Plugin, _, _, _ string) (bool, error) {
+		return true, nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "ClearActivePrompt", func(_ *Plugin, _, _, _ string) error {
+		return nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "GetPostSession", func(_ *Plugin, _ string) (string, string, error) {
+		return "", "mockChannelID", nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "IsSessionOwner", func(_ *Plugin, _, _, _ string) (bool, error) {
+		return true, nil
+	})
+
 	httpTestJSON := testutils.HTTPTest{
 		T:       t,
 		Encoder: testutils.EncodeJSON,
@@ -1016,6 +1555,129 @@ func Test_handleDateTimeSelectionDialog(t *testing.T) {
 	}
 }
 
+func Test_handleMaskedInputDialog(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "GetPostSession", func(_ *Plugin, _ string) (string, string, error) {
+		return "mockSessionID", "mockChannelID", nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "IsSessionOwner", func(_ *Plugin, _, _, _ string) (bool, error) {
+		return true, nil
+	})
+
+	httpTestJSON := testutils.HTTPTest{
+		T:       t,
+		Encoder: testutils.EncodeJSON,
+	}
+
+	request := testutils.Request{
+		Method: http.MethodPost,
+		URL:    fmt.Sprintf("/api/v1%s", PathMaskedInputDialog),
+		Body: model.PostActionIntegrationRequest{
+			TriggerId: "mockTriggerId",
+			PostId:    "mockPostId",
+			Context: map[string]interface{}{
+				MaskedInputLabelContextKey: "mockLabel",
+			},
+		},
+	}
+
+	for name, test := range map[string]struct {
+		expectedResponse     testutils.ExpectedResponse
+		userID               string
+		isStalePrompt        bool
+		openDialogRequestErr error
+		isDialogOpened       bool
+	}{
+		"User is unauthorized": {
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusUnauthorized,
+			},
+		},
+		"Masked input dialog is opened with a password field": {
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode:   http.StatusOK,
+				Body:         &model.PostActionIntegrationResponse{},
+				ResponseType: "application/json",
+			},
+			userID:         "mock-userID",
+			isDialogOpened: true,
+		},
+		"Masked input dialog is not opened for a stale prompt": {
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode:   http.StatusOK,
+				Body:         &model.PostActionIntegrationResponse{EphemeralText: StalePromptMessage},
+				ResponseType: "application/json",
+			},
+			userID:        "mock-userID",
+			isStalePrompt: true,
+		},
+		"Error in opening masked input dialog": {
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body: &serializer.APIErrorResponse{
+					StatusCode: http.StatusInternalServerError,
+					Message:    "Error in opening masked input dialog.",
+				},
+				ResponseType: "application/json",
+			},
+			userID:               "mock-userID",
+			openDialogRequestErr: errors.New("request failed to open the masked input dialog"),
+			isDialogOpened:       true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := new(Plugin)
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("GetBundlePath").Return("mockString", nil)
+			mockAPI.On("LogDebug", testutils.GetMockArgumentsWithType("string", 7)...).Return("LogDebug error")
+			mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 3)...).Return("LogError error")
+			p.SetAPI(mockAPI)
+
+			p.initializeAPI()
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "IsActivePrompt", func(_ *Plugin, _, _, _ string) (bool, error) {
+				return !test.isStalePrompt, nil
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "ParseAuthToken", func(_ *Plugin, _ string) (*oauth2.Token, error) {
+				return &oauth2.Token{}, nil
+			})
+
+			var dialogRequest *model.OpenDialogRequest
+			monkey.PatchInstanceMethod(reflect.TypeOf(&client{}), "OpenDialogRequest", func(_ *client, body *model.OpenDialogRequest) error {
+				dialogRequest = body
+				return test.openDialogRequestErr
+			})
+
+			if test.userID != "" {
+				mockCtrl := gomock.NewController(t)
+				mockedStore := mock_plugin.NewMockStore(mockCtrl)
+				mockedStore.EXPECT().LoadUser(test.userID).Return(&serializer.User{}, nil)
+				p.store = mockedStore
+			}
+
+			req := httpTestJSON.CreateHTTPRequest(request)
+			req.Header.Add(HeaderMattermostUserID, test.userID)
+			resp := httptest.NewRecorder()
+			p.ServeHTTP(&plugin.Context{}, resp, req)
+			httpTestJSON.CompareHTTPResponse(resp, test.expectedResponse)
+
+			if !test.isDialogOpened {
+				require.Nil(t, dialogRequest)
+				return
+			}
+
+			require.Equal(t, "mockPostId", dialogRequest.Dialog.CallbackId)
+			require.Len(t, dialogRequest.Dialog.Elements, 1)
+			require.Equal(t, "password", dialogRequest.Dialog.Elements[0].SubType)
+			require.Equal(t, "mockLabel", dialogRequest.Dialog.Elements[0].HelpText)
+		})
+	}
+}
+
 func TestPlugin_handleFileAttachments(t *testing.T) {
 	defer monkey.UnpatchAll()
 
@@ -1167,3 +1829,263 @@ func TestPlugin_handleFileAttachments(t *testing.T) {
 		})
 	}
 }
+
+func TestPlugin_verifyWebhookSignature(t *testing.T) {
+	sign := func(secret, timestamp, nonce, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		_, _ = mac.Write([]byte(fmt.Sprintf("%s.%s.%s", timestamp, nonce, body)))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	for _, testCase := range []struct {
+		description     string
+		signature       string
+		timestamp       string
+		nonce           string
+		isNonceChecked  bool
+		isNonceStored   bool
+		nonceStoreError error
+		expectedStatus  int
+		expectedSecret  string
+		expectedErr     string
+	}{
+		{
+			description:    "Request with a valid signature",
+			signature:      sign("mockWebhookSecret", now, "mock-nonce", "mock-body"),
+			timestamp:      now,
+			nonce:          "mock-nonce",
+			isNonceChecked: true,
+			isNonceStored:  true,
+			expectedSecret: WebhookSecretCurrent,
+		},
+		{
+			description:    "Request signed with the previous secret",
+			signature:      sign("mockPreviousWebhookSecret", now, "mock-nonce", "mock-body"),
+			timestamp:      now,
+			nonce:          "mock-nonce",
+			isNonceChecked: true,
+			isNonceStored:  true,
+			expectedSecret: WebhookSecretPrevious,
+		},
+		{
+			description:    "Request without signature headers",
+			expectedStatus: http.StatusForbidden,
+			expectedErr:    "request headers: signature, timestamp or nonce is missing",
+		},
+		{
+			description:    "Request with an invalid timestamp",
+			signature:      sign("mockWebhookSecret", now, "mock-nonce", "mock-body"),
+			timestamp:      "mock-timestamp",
+			nonce:          "mock-nonce",
+			expectedStatus: http.StatusForbidden,
+			expectedErr:    "request headers: invalid timestamp",
+		},
+		{
+			description:    "Request with a timestamp outside the allowed window",
+			signature:      sign("mockWebhookSecret", expired, "mock-nonce", "mock-body"),
+			timestamp:      expired,
+			nonce:          "mock-nonce",
+			expectedStatus: http.StatusForbidden,
+			expectedErr:    "request headers: timestamp is outside the allowed window",
+		},
+		{
+			description:    "Request signed with a different secret",
+			signature:      sign("mockOtherSecret", now, "mock-nonce", "mock-body"),
+			timestamp:      now,
+			nonce:          "mock-nonce",
+			expectedStatus: http.StatusForbidden,
+			expectedErr:    "request headers: signature did not match",
+		},
+		{
+			description:    "Request with a malformed signature",
+			signature:      "mock-signature",
+			timestamp:      now,
+			nonce:          "mock-nonce",
+			expectedStatus: http.StatusForbidden,
+			expectedErr:    "request headers: invalid signature",
+		},
+		{
+			description:    "Replayed request with an already used nonce",
+			signature:      sign("mockWebhookSecret", now, "mock-nonce", "mock-body"),
+			timestamp:      now,
+			nonce:          "mock-nonce",
+			isNonceChecked: true,
+			expectedStatus: http.StatusForbidden,
+			expectedErr:    "request headers: nonce is already used",
+		},
+		{
+			description:     "Error while storing the nonce",
+			signature:       sign("mockWebhookSecret", now, "mock-nonce", "mock-body"),
+			timestamp:       now,
+			nonce:           "mock-nonce",
+			isNonceChecked:  true,
+			nonceStoreError: errors.New("error in storing the nonce in KVstore"),
+			expectedStatus:  http.StatusInternalServerError,
+			expectedErr:     "failed to store the request nonce: error in storing the nonce in KVstore",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			if testCase.isNonceChecked {
+				mockedStore.EXPECT().StoreWebhookNonce(testCase.nonce).Return(testCase.isNonceStored, testCase.nonceStoreError)
+			}
+			p.store = mockedStore
+
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s%s", pathPrefix, PathVirtualAgentWebhook), strings.NewReader("mock-body"))
+			req.Header.Set(HeaderWebhookSignature, testCase.signature)
+			req.Header.Set(HeaderWebhookTimestamp, testCase.timestamp)
+			req.Header.Set(HeaderWebhookNonce, testCase.nonce)
+
+			matchedSecret, status, err := p.verifyWebhookSignature(req, []webhookSecret{
+				{name: WebhookSecretCurrent, value: "mockWebhookSecret"},
+				{name: WebhookSecretPrevious, value: "mockPreviousWebhookSecret"},
+			})
+			require.Equal(t, testCase.expectedStatus, status)
+			if testCase.expectedErr != "" {
+				require.EqualError(t, err, testCase.expectedErr)
+				require.Nil(t, matchedSecret)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedSecret, matchedSecret.name)
+
+			// The request body can still be read by the next handler
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			require.Equal(t, "mock-body", string(body))
+		})
+	}
+}
+
+func TestPlugin_checkAuthBySecret(t *testing.T) {
+	defaultConfig := &configuration{
+		ServiceNowURL:             "mockURL",
+		WebhookSecret:             "mockWebhookSecret",
+		WebhookAuthenticationMode: WebhookAuthenticationModeSecret,
+	}
+
+	instancesConfig := &configuration{
+		WebhookAuthenticationMode: WebhookAuthenticationModeSecret,
+		Instances: []*ServiceNowInstance{
+			{Name: "mock-instance", URL: "mockInstanceURL", WebhookSecret: "mockInstanceSecret"},
+			{Name: "mock-instance-without-secret", URL: "mockInstanceURL"},
+		},
+	}
+
+	for _, testCase := range []struct {
+		description        string
+		config             *configuration
+		query              string
+		isSignatureMode    bool
+		expectedStatusCode int
+	}{
+		{
+			description:        "Request with the webhook secret of the default instance",
+			config:             defaultConfig,
+			query:              "secret=mockWebhookSecret",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			description:        "Request with a wrong webhook secret",
+			config:             defaultConfig,
+			query:              "secret=mockOtherSecret",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			description: "Request with the previous webhook secret during the grace period",
+			config: &configuration{
+				ServiceNowURL:             "mockURL",
+				WebhookSecret:             "mockWebhookSecret",
+				WebhookAuthenticationMode: WebhookAuthenticationModeSecret,
+				PreviousWebhookSecret:     "mockPreviousSecret",
+				WebhookSecretRotatedAt:    time.Now(),
+				WebhookSecretGracePeriod:  10,
+			},
+			query:              "secret=mockPreviousSecret",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			description: "Request with the previous webhook secret after the grace period",
+			config: &configuration{
+				ServiceNowURL:             "mockURL",
+				WebhookSecret:             "mockWebhookSecret",
+				WebhookAuthenticationMode: WebhookAuthenticationModeSecret,
+				PreviousWebhookSecret:     "mockPreviousSecret",
+				WebhookSecretRotatedAt:    time.Now().Add(-time.Hour),
+				WebhookSecretGracePeriod:  10,
+			},
+			query:              "secret=mockPreviousSecret",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			description:        "Request with the webhook secret of an additional instance",
+			config:             instancesConfig,
+			query:              "instance=mock-instance&secret=mockInstanceSecret",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			description:        "Request with the webhook secret of another instance",
+			config:             instancesConfig,
+			query:              "instance=mock-instance&secret=mockWebhookSecret",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			description:        "Request without a secret to the default instance when only the additional instances are configured",
+			config:             instancesConfig,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			description:        "Request without a secret to an instance without a webhook secret",
+			config:             instancesConfig,
+			query:              "instance=mock-instance-without-secret",
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			description: "Request signed with an empty secret when the webhook secret is not configured",
+			config: &configuration{
+				ServiceNowURL:             "mockURL",
+				WebhookAuthenticationMode: WebhookAuthenticationModeSignature,
+			},
+			isSignatureMode:    true,
+			expectedStatusCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+			p.setConfiguration(testCase.config)
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+			mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+			mockAPI.On("LogDebug", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			p.SetAPI(mockAPI)
+
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s%s?%s", pathPrefix, PathVirtualAgentWebhook, testCase.query), strings.NewReader("mock-body"))
+			if testCase.isSignatureMode {
+				timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+				mac := hmac.New(sha256.New, []byte(""))
+				_, _ = mac.Write([]byte(fmt.Sprintf("%s.%s.%s", timestamp, "mock-nonce", "mock-body")))
+				req.Header.Set(HeaderWebhookSignature, hex.EncodeToString(mac.Sum(nil)))
+				req.Header.Set(HeaderWebhookTimestamp, timestamp)
+				req.Header.Set(HeaderWebhookNonce, "mock-nonce")
+			}
+
+			isHandlerCalled := false
+			rr := httptest.NewRecorder()
+			p.checkAuthBySecret(func(w http.ResponseWriter, _ *http.Request) {
+				isHandlerCalled = true
+				w.WriteHeader(http.StatusOK)
+			})(rr, req)
+
+			require.Equal(t, testCase.expectedStatusCode, rr.Code)
+			require.Equal(t, testCase.expectedStatusCode == http.StatusOK, isHandlerCalled)
+		})
+	}
+}
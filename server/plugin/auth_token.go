@@ -7,6 +7,8 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"io"
@@ -15,6 +17,12 @@ import (
 	"golang.org/x/oauth2"
 )
 
+const (
+	// encryptionVersion is the version of the format of the encrypted data: <version><key ID><nonce><ciphertext>
+	encryptionVersion   byte = 1
+	encryptionKeyIDSize      = 8
+)
+
 type AuthToken struct {
 	Token *oauth2.Token `json:"token,omitempty"`
 }
@@ -36,7 +44,7 @@ func (p *Plugin) NewEncodedAuthToken(token *oauth2.Token) (returnToken string, r
 		return "", err
 	}
 
-	encrypted, err := encrypt(jsonBytes, []byte(p.getConfiguration().EncryptionSecret))
+	encrypted, err := encryptWithKeyRing(jsonBytes, p.getConfiguration().getEncryptionKeyRing())
 	if err != nil {
 		return "", err
 	}
@@ -52,7 +60,7 @@ func (p *Plugin) ParseAuthToken(encoded string) (*oauth2.Token, error) {
 		return nil, err
 	}
 
-	jsonBytes, err := decrypt(decoded, []byte(p.getConfiguration().EncryptionSecret))
+	jsonBytes, _, err := decryptWithKeyRing(decoded, p.getConfiguration().getEncryptionKeyRing())
 	if err != nil {
 		return nil, err
 	}
@@ -65,6 +73,21 @@ func (p *Plugin) ParseAuthToken(encoded string) (*oauth2.Token, error) {
 	return t.Token, nil
 }
 
+// IsAuthTokenEncryptedWithCurrentKey checks if the encoded auth token is encrypted with the current encryption secret.
+func (p *Plugin) IsAuthTokenEncryptedWithCurrentKey(encoded string) (bool, error) {
+	decoded, err := decode(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	_, isCurrentKey, err := decryptWithKeyRing(decoded, p.getConfiguration().getEncryptionKeyRing())
+	if err != nil {
+		return false, err
+	}
+
+	return isCurrentKey, nil
+}
+
 func encode(encrypted []byte) string {
 	encoded := make([]byte, base64.URLEncoding.EncodedLen(len(encrypted)))
 	base64.URLEncoding.Encode(encoded, encrypted)
@@ -96,6 +119,55 @@ func encrypt(plain, secret []byte) ([]byte, error) {
 	return append(nonce, sealed...), nil
 }
 
+// encryptWithKeyRing encrypts the data with the current key of the key ring.
+// The ciphertext is prefixed with the version and the ID of the key, so that it can be decrypted after the key is rotated.
+func encryptWithKeyRing(plain []byte, keyRing [][]byte) ([]byte, error) {
+	if len(keyRing) == 0 || len(keyRing[0]) == 0 {
+		return plain, nil
+	}
+
+	encrypted, err := encrypt(plain, keyRing[0])
+	if err != nil {
+		return nil, err
+	}
+
+	versioned := append([]byte{encryptionVersion}, getEncryptionKeyID(keyRing[0])...)
+	return append(versioned, encrypted...), nil
+}
+
+// decryptWithKeyRing decrypts the data encrypted with any key of the key ring.
+// Data encrypted before the ciphertexts were versioned is decrypted by trying every key.
+// It also returns whether the data was encrypted with the current key.
+func decryptWithKeyRing(encrypted []byte, keyRing [][]byte) (plain []byte, isCurrentKey bool, err error) {
+	if len(keyRing) == 0 || len(keyRing[0]) == 0 {
+		return encrypted, true, nil
+	}
+
+	if len(encrypted) > encryptionKeyIDSize && encrypted[0] == encryptionVersion {
+		keyID := encrypted[1 : encryptionKeyIDSize+1]
+		for index, key := range keyRing {
+			if subtle.ConstantTimeCompare(keyID, getEncryptionKeyID(key)) == 1 {
+				plain, err = decrypt(encrypted[encryptionKeyIDSize+1:], key)
+				return plain, err == nil && index == 0, err
+			}
+		}
+	}
+
+	for _, key := range keyRing {
+		if plain, err = decrypt(encrypted, key); err == nil {
+			// Unversioned ciphertexts are always re-encrypted with the current key
+			return plain, false, nil
+		}
+	}
+
+	return nil, false, err
+}
+
+func getEncryptionKeyID(key []byte) []byte {
+	hash := sha256.Sum256(key)
+	return hash[:encryptionKeyIDSize]
+}
+
 func decode(encoded string) ([]byte, error) {
 	decoded := make([]byte, base64.URLEncoding.DecodedLen(len(encoded)))
 	n, err := base64.URLEncoding.Decode(decoded, []byte(encoded))
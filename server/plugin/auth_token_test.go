@@ -164,3 +164,69 @@ func Test_ParseAuthToken(t *testing.T) {
 		})
 	}
 }
+
+func Test_decryptWithKeyRing(t *testing.T) {
+	currentKey := []byte("mockCurrentEncryptionSecret12345")
+	previousKey := []byte("mockPreviousEncryptionSecret1234")
+	otherKey := []byte("mockOtherEncryptionSecret1234567")
+
+	encryptVersioned := func(key []byte) []byte {
+		encrypted, err := encryptWithKeyRing([]byte("mockData"), [][]byte{key})
+		require.NoError(t, err)
+		return encrypted
+	}
+
+	encryptLegacy := func(key []byte) []byte {
+		encrypted, err := encrypt([]byte("mockData"), key)
+		require.NoError(t, err)
+		return encrypted
+	}
+
+	for _, testCase := range []struct {
+		description  string
+		encrypted    []byte
+		isCurrentKey bool
+		isError      bool
+	}{
+		{
+			description:  "Data encrypted with the current key",
+			encrypted:    encryptVersioned(currentKey),
+			isCurrentKey: true,
+		},
+		{
+			description: "Data encrypted with a previous key",
+			encrypted:   encryptVersioned(previousKey),
+		},
+		{
+			description: "Unversioned data encrypted with the current key",
+			encrypted:   encryptLegacy(currentKey),
+		},
+		{
+			description: "Unversioned data encrypted with a previous key",
+			encrypted:   encryptLegacy(previousKey),
+		},
+		{
+			description: "Data encrypted with a key which is not in the key ring",
+			encrypted:   encryptVersioned(otherKey),
+			isError:     true,
+		},
+		{
+			description: "Unversioned data encrypted with a key which is not in the key ring",
+			encrypted:   encryptLegacy(otherKey),
+			isError:     true,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			plain, isCurrentKey, err := decryptWithKeyRing(testCase.encrypted, [][]byte{currentKey, previousKey})
+			if testCase.isError {
+				require.Error(t, err)
+				require.Nil(t, plain)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "mockData", string(plain))
+			require.Equal(t, testCase.isCurrentKey, isCurrentKey)
+		})
+	}
+}
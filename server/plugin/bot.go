@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	"github.com/mattermost/mattermost-server/v5/model"
+
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
 )
 
 // Ephemeral sends an ephemeral message to a user
@@ -16,10 +18,16 @@ func (p *Plugin) Ephemeral(userID, channelID, format string, args ...interface{}
 	_ = p.API.SendEphemeralPost(userID, post)
 }
 
-// DM posts a simple Direct Message to the specified user
+// DM posts a simple Direct Message to the specified user.
+// The message is posted as it is when there are no args, so that messages containing "%" are not mangled.
 func (p *Plugin) DM(mattermostUserID, format string, args ...interface{}) (string, error) {
+	message := format
+	if len(args) > 0 {
+		message = fmt.Sprintf(format, args...)
+	}
+
 	postID, err := p.dm(mattermostUserID, &model.Post{
-		Message: fmt.Sprintf(format, args...),
+		Message: message,
 	})
 	if err != nil {
 		return "", err
@@ -35,6 +43,36 @@ func (p *Plugin) DMWithAttachments(mattermostUserID string, attachments ...*mode
 	return p.dm(mattermostUserID, &post)
 }
 
+// DMInThread posts a Direct Message as a reply in the thread of the root post. The post is not threaded when rootID is empty.
+func (p *Plugin) DMInThread(mattermostUserID, rootID string, post *model.Post) (string, error) {
+	post.RootId = rootID
+	return p.dm(mattermostUserID, post)
+}
+
+// PostInChannel posts a reply of the bot in the thread of the root post in a channel.
+func (p *Plugin) PostInChannel(channelID, rootID string, post *model.Post) (string, error) {
+	post.ChannelId = channelID
+	post.RootId = rootID
+	post.UserId = p.botUserID
+	sentPost, err := p.API.CreatePost(post)
+	if err != nil {
+		p.API.LogError("Error occurred while creating post", "ChannelID", channelID, "Error", err.Error())
+		return "", err
+	}
+
+	return sentPost.Id, nil
+}
+
+// setLiveAgentIdentity makes the post shown with the name and the avatar of the live agent.
+// The avatar is only used when it is safe to load, otherwise the avatar of the bot is kept.
+func setLiveAgentIdentity(post *model.Post, chat *serializer.LiveAgentChat) {
+	post.AddProp(PostPropFromWebhook, "true")
+	post.AddProp(PostPropOverrideUsername, chat.AgentName)
+	if chat.AgentAvatar != "" && isSafeURL(chat.AgentAvatar) {
+		post.AddProp(model.POST_PROPS_OVERRIDE_ICON_URL, chat.AgentAvatar)
+	}
+}
+
 func (p *Plugin) dm(mattermostUserID string, post *model.Post) (string, error) {
 	channel, err := p.API.GetDirectChannel(mattermostUserID, p.botUserID)
 	if err != nil {
@@ -14,7 +14,8 @@ import (
 type Client interface {
 	GetMe(mattermostUserID string) (*serializer.ServiceNowUser, error)
 	StartConverstaionWithVirtualAgent(userID string) error
-	SendMessageToVirtualAgentAPI(serviceNowUserID, messageText string, typed bool, attachment *MessageAttachment) error
+	EndConversationWithVirtualAgent(userID, sessionID string) error
+	SendMessageToVirtualAgentAPI(serviceNowUserID, sessionID, messageText string, typed bool, attachment *MessageAttachment) error
 	OpenDialogRequest(body *model.OpenDialogRequest) error
 }
 
@@ -22,14 +23,25 @@ type client struct {
 	ctx        context.Context
 	httpClient *http.Client
 	plugin     *Plugin
+	instance   *ServiceNowInstance
 }
 
-func (p *Plugin) MakeClient(ctx context.Context, token *oauth2.Token) Client {
-	httpClient := p.NewOAuth2Config().Client(ctx, token)
+// MakeClient creates a client of the ServiceNow instance for the given token.
+// If mattermostUserID is not empty, every refreshed token is saved to the user's record in the KV store.
+func (p *Plugin) MakeClient(ctx context.Context, instance *ServiceNowInstance, token *oauth2.Token, mattermostUserID string) Client {
+	var tokenSource oauth2.TokenSource
+	if mattermostUserID == "" {
+		tokenSource = p.NewOAuth2Config(instance).TokenSource(ctx, token)
+	} else {
+		tokenSource = p.NewUserTokenSource(ctx, token, mattermostUserID)
+	}
+
+	httpClient := oauth2.NewClient(ctx, tokenSource)
 	c := &client{
 		ctx:        ctx,
 		httpClient: httpClient,
 		plugin:     p,
+		instance:   instance,
 	}
 	return c
 }
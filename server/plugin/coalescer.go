@@ -0,0 +1,115 @@
+package plugin
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// CoalescingRenderer is implemented by the renderers which add their text and attachments to the pending post of the render context,
+// so that the consecutive non-interactive parts of a response are posted together.
+// The pending post is posted before a part is rendered by any other renderer.
+type CoalescingRenderer interface {
+	Renderer
+	Coalescing() bool
+}
+
+func isCoalescing(renderer Renderer) bool {
+	coalescingRenderer, ok := renderer.(CoalescingRenderer)
+	return ok && coalescingRenderer.Coalescing()
+}
+
+// postCoalescer merges the text and the attachments of the consecutive parts of a response into a single post,
+// up to the size limits of a Mattermost post.
+type postCoalescer struct {
+	ctx         *RenderContext
+	message     string
+	attachments []*model.SlackAttachment
+	// index is the index of the part of the response being rendered
+	index int
+	// indexes are the indexes of the parts of the response contained in the pending post
+	indexes []int
+}
+
+func (c *postCoalescer) AddText(text string) error {
+	if text == "" {
+		return nil
+	}
+
+	// Text after the attachments is added as an attachment, so that the order of the parts is kept
+	if len(c.attachments) > 0 {
+		return c.AddAttachments(&model.SlackAttachment{Text: text})
+	}
+
+	message := text
+	if c.message != "" {
+		message = c.message + "\n\n" + text
+	}
+
+	if utf8.RuneCountInString(message) > model.POST_MESSAGE_MAX_RUNES_V2 && c.message != "" {
+		if err := c.Flush(); err != nil {
+			return err
+		}
+		message = text
+	}
+
+	c.message = message
+	c.addIndex()
+	return nil
+}
+
+func (c *postCoalescer) AddAttachments(attachments ...*model.SlackAttachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+
+	merged := append(append([]*model.SlackAttachment{}, c.attachments...), attachments...)
+	if getAttachmentsSize(merged) > model.POST_PROPS_MAX_USER_RUNES && len(c.attachments) > 0 {
+		if err := c.Flush(); err != nil {
+			return err
+		}
+		merged = attachments
+	}
+
+	c.attachments = merged
+	c.addIndex()
+	return nil
+}
+
+// Flush posts the pending post.
+func (c *postCoalescer) Flush() error {
+	if c.message == "" && len(c.attachments) == 0 {
+		return nil
+	}
+
+	post := &model.Post{
+		Message: c.message,
+	}
+	if len(c.attachments) > 0 {
+		model.ParseSlackAttachment(post, c.attachments)
+	}
+
+	if _, err := c.ctx.Post(post); err != nil {
+		return err
+	}
+
+	c.message = ""
+	c.attachments = nil
+	c.indexes = nil
+	return nil
+}
+
+func (c *postCoalescer) addIndex() {
+	if len(c.indexes) == 0 || c.indexes[len(c.indexes)-1] != c.index {
+		c.indexes = append(c.indexes, c.index)
+	}
+}
+
+func getAttachmentsSize(attachments []*model.SlackAttachment) int {
+	data, err := json.Marshal(attachments)
+	if err != nil {
+		return 0
+	}
+	return utf8.RuneCount(data)
+}
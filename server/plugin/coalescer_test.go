@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_postCoalescer(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	type post struct {
+		message     string
+		attachments int
+	}
+
+	for _, testCase := range []struct {
+		description   string
+		add           func(c *postCoalescer)
+		expectedPosts []post
+	}{
+		{
+			description: "Text and attachments are posted together",
+			add: func(c *postCoalescer) {
+				require.NoError(t, c.AddText("mockHeader"))
+				require.NoError(t, c.AddAttachments(&model.SlackAttachment{Text: "mockPart-1"}, &model.SlackAttachment{Text: "mockPart-2"}))
+			},
+			expectedPosts: []post{{message: "mockHeader", attachments: 2}},
+		},
+		{
+			description: "Text after the attachments is added as an attachment",
+			add: func(c *postCoalescer) {
+				require.NoError(t, c.AddAttachments(&model.SlackAttachment{Text: "mockPart"}))
+				require.NoError(t, c.AddText("mockText"))
+			},
+			expectedPosts: []post{{attachments: 2}},
+		},
+		{
+			description: "Text longer than the limit of a post is split into multiple posts",
+			add: func(c *postCoalescer) {
+				require.NoError(t, c.AddText(strings.Repeat("a", model.POST_MESSAGE_MAX_RUNES_V2-5)))
+				require.NoError(t, c.AddText("mockText"))
+			},
+			expectedPosts: []post{{message: strings.Repeat("a", model.POST_MESSAGE_MAX_RUNES_V2-5)}, {message: "mockText"}},
+		},
+		{
+			description: "Attachments larger than the limit of a post are split into multiple posts",
+			add: func(c *postCoalescer) {
+				require.NoError(t, c.AddAttachments(&model.SlackAttachment{Text: strings.Repeat("a", model.POST_PROPS_MAX_USER_RUNES-100)}))
+				require.NoError(t, c.AddAttachments(&model.SlackAttachment{Text: "mockPart"}))
+			},
+			expectedPosts: []post{{attachments: 1}, {attachments: 1}},
+		},
+		{
+			description: "Nothing is posted when nothing is added",
+			add:         func(c *postCoalescer) {},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := &Plugin{}
+
+			var posts []post
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "DMInThread", func(_ *Plugin, _, rootID string, mmPost *model.Post) (string, error) {
+				require.Equal(t, "mockRootID", rootID)
+				posts = append(posts, post{message: mmPost.Message, attachments: len(mmPost.Attachments())})
+				return "mockPostID", nil
+			})
+
+			c := p.newRenderContext("mock-userID", "mockRootID").posts
+			testCase.add(c)
+			require.NoError(t, c.Flush())
+			require.Equal(t, testCase.expectedPosts, posts)
+			require.Empty(t, c.indexes)
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+)
+
+func (p *Plugin) getCommand() *model.Command {
+	return &model.Command{
+		Trigger:          CommandTrigger,
+		DisplayName:      CommandDisplayName,
+		Description:      CommandDescription,
+		AutoComplete:     true,
+		AutoCompleteDesc: CommandAutocompleteDescription,
+		AutoCompleteHint: CommandAutocompleteHint,
+		AutocompleteData: getAutocompleteData(),
+	}
+}
+
+func getAutocompleteData() *model.AutocompleteData {
+	command := model.NewAutocompleteData(CommandTrigger, CommandAutocompleteHint, CommandAutocompleteDescription)
+
+	connect := model.NewAutocompleteData(SubCommandConnect, "", "Connect your Mattermost account to your ServiceNow account")
+	command.AddCommand(connect)
+
+	disconnect := model.NewAutocompleteData(SubCommandDisconnect, "", "Disconnect your Mattermost account from your ServiceNow account")
+	command.AddCommand(disconnect)
+
+	status := model.NewAutocompleteData(SubCommandStatus, "", "Check if your Mattermost account is connected to ServiceNow")
+	command.AddCommand(status)
+
+	help := model.NewAutocompleteData(SubCommandHelp, "", "Show the help text")
+	command.AddCommand(help)
+
+	return command
+}
+
+// ExecuteCommand executes the commands registered by the plugin.
+func (p *Plugin) ExecuteCommand(_ *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	fields := strings.Fields(args.Command)
+	if len(fields) == 0 || fields[0] != fmt.Sprintf("/%s", CommandTrigger) {
+		return &model.CommandResponse{}, nil
+	}
+
+	subCommand := SubCommandHelp
+	if len(fields) > 1 {
+		subCommand = strings.ToLower(fields[1])
+	}
+
+	var message string
+	switch subCommand {
+	case SubCommandConnect:
+		message = p.executeConnectCommand(args)
+	case SubCommandDisconnect:
+		message = p.executeDisconnectCommand(args)
+	case SubCommandStatus:
+		message = p.executeStatusCommand(args)
+	case SubCommandHelp:
+		message = CommandHelpText
+	default:
+		message = fmt.Sprintf(CommandInvalidSubCommandMessage, subCommand)
+	}
+
+	p.Ephemeral(args.UserId, args.ChannelId, "%s", message)
+	return &model.CommandResponse{}, nil
+}
+
+func (p *Plugin) executeConnectCommand(args *model.CommandArgs) string {
+	user, err := p.GetUser(args.UserId)
+	if err == nil && !user.ReauthorizationRequired {
+		return fmt.Sprintf(CommandAlreadyConnectedMessage, user.Email)
+	}
+	if err != nil && err != ErrNotFound {
+		p.API.LogError("Error occurred while fetching user by ID", "UserID", args.UserId, "Error", err.Error())
+		return GenericErrorMessage
+	}
+
+	redirectURL, err := p.InitOAuth2(args.UserId)
+	if err != nil {
+		p.API.LogError("Error occurred while initializing OAuth2", "UserID", args.UserId, "Error", err.Error())
+		return GenericErrorMessage
+	}
+
+	return fmt.Sprintf(CommandConnectMessage, redirectURL)
+}
+
+func (p *Plugin) executeDisconnectCommand(args *model.CommandArgs) string {
+	if _, err := p.GetUser(args.UserId); err != nil {
+		if err == ErrNotFound {
+			return AlreadyDisconnectedMessage
+		}
+
+		p.API.LogError("Error occurred while fetching user by ID", "UserID", args.UserId, "Error", err.Error())
+		return GenericErrorMessage
+	}
+
+	if err := p.DisconnectUser(args.UserId); err != nil {
+		p.API.LogError("Error occurred while disconnecting user", "UserID", args.UserId, "Error", err.Error())
+		return GenericErrorMessage
+	}
+
+	return DisconnectUserSuccessMessage
+}
+
+func (p *Plugin) executeStatusCommand(args *model.CommandArgs) string {
+	user, err := p.GetUser(args.UserId)
+	if err != nil {
+		if err == ErrNotFound {
+			return CommandNotConnectedStatusMessage
+		}
+
+		p.API.LogError("Error occurred while fetching user by ID", "UserID", args.UserId, "Error", err.Error())
+		return GenericErrorMessage
+	}
+
+	if user.ReauthorizationRequired {
+		return fmt.Sprintf(CommandReauthorizationStatusMessage, user.Email)
+	}
+
+	return fmt.Sprintf(CommandConnectedStatusMessage, user.Email)
+}
@@ -0,0 +1,208 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/testutils"
+)
+
+func Test_ExecuteCommand(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description       string
+		command           string
+		getUserError      error
+		initOAuth2Error   error
+		disconnectError   error
+		expectedMessage   string
+		isErrorLogged     bool
+		isDisconnectCall  bool
+		isInitOAuth2Call  bool
+		connectedUserMail string
+		reauthorization   bool
+	}{
+		{
+			description:     "Help text is shown when no subcommand is passed",
+			command:         "/servicenow",
+			expectedMessage: CommandHelpText,
+		},
+		{
+			description:     "Help text is shown for the help subcommand",
+			command:         "/servicenow help",
+			expectedMessage: CommandHelpText,
+		},
+		{
+			description:     "Invalid subcommand",
+			command:         "/servicenow invalid",
+			expectedMessage: fmt.Sprintf(CommandInvalidSubCommandMessage, "invalid"),
+		},
+		{
+			description:      "Connect: user is not connected",
+			command:          "/servicenow connect",
+			getUserError:     ErrNotFound,
+			isInitOAuth2Call: true,
+			expectedMessage:  fmt.Sprintf(CommandConnectMessage, "mockRedirectURL"),
+		},
+		{
+			description:       "Connect: user is already connected",
+			command:           "/servicenow connect",
+			connectedUserMail: "mock@email.com",
+			expectedMessage:   fmt.Sprintf(CommandAlreadyConnectedMessage, "mock@email.com"),
+		},
+		{
+			description:      "Connect: error while initializing OAuth2",
+			command:          "/servicenow connect",
+			getUserError:     ErrNotFound,
+			initOAuth2Error:  errors.New("error storing OAuth2 state"),
+			isInitOAuth2Call: true,
+			isErrorLogged:    true,
+			expectedMessage:  GenericErrorMessage,
+		},
+		{
+			description:     "Connect: error while fetching the user",
+			command:         "/servicenow connect",
+			getUserError:    errors.New("error in loading the user from KVstore"),
+			isErrorLogged:   true,
+			expectedMessage: GenericErrorMessage,
+		},
+		{
+			description:      "Disconnect: user is disconnected successfully",
+			command:          "/servicenow disconnect",
+			isDisconnectCall: true,
+			expectedMessage:  DisconnectUserSuccessMessage,
+		},
+		{
+			description:     "Disconnect: user is already disconnected",
+			command:         "/servicenow disconnect",
+			getUserError:    ErrNotFound,
+			expectedMessage: AlreadyDisconnectedMessage,
+		},
+		{
+			description:      "Disconnect: error while disconnecting the user",
+			command:          "/servicenow disconnect",
+			disconnectError:  errors.New("error in deleting the user from KVstore"),
+			isDisconnectCall: true,
+			isErrorLogged:    true,
+			expectedMessage:  GenericErrorMessage,
+		},
+		{
+			description:       "Status: user is connected",
+			command:           "/servicenow status",
+			connectedUserMail: "mock@email.com",
+			expectedMessage:   fmt.Sprintf(CommandConnectedStatusMessage, "mock@email.com"),
+		},
+		{
+			description:       "Status: user needs re-authorization",
+			command:           "/servicenow status",
+			connectedUserMail: "mock@email.com",
+			reauthorization:   true,
+			expectedMessage:   fmt.Sprintf(CommandReauthorizationStatusMessage, "mock@email.com"),
+		},
+		{
+			description:       "Connect: user needs re-authorization",
+			command:           "/servicenow connect",
+			connectedUserMail: "mock@email.com",
+			reauthorization:   true,
+			isInitOAuth2Call:  true,
+			expectedMessage:   fmt.Sprintf(CommandConnectMessage, "mockRedirectURL"),
+		},
+		{
+			description:     "Status: user is not connected",
+			command:         "/servicenow status",
+			getUserError:    ErrNotFound,
+			expectedMessage: CommandNotConnectedStatusMessage,
+		},
+		{
+			description:     "Status: error while fetching the user",
+			command:         "/servicenow status",
+			getUserError:    errors.New("error in loading the user from KVstore"),
+			isErrorLogged:   true,
+			expectedMessage: GenericErrorMessage,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockAPI := &plugintest.API{}
+			if testCase.isErrorLogged {
+				mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			}
+
+			p.SetAPI(mockAPI)
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "GetUser", func(_ *Plugin, _ string) (*serializer.User, error) {
+				if testCase.getUserError != nil {
+					return nil, testCase.getUserError
+				}
+				return &serializer.User{
+					ServiceNowUser: serializer.ServiceNowUser{
+						Email: testCase.connectedUserMail,
+					},
+					ReauthorizationRequired: testCase.reauthorization,
+				}, nil
+			})
+
+			initOAuth2Called := false
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "InitOAuth2", func(_ *Plugin, _ string) (string, error) {
+				initOAuth2Called = true
+				if testCase.initOAuth2Error != nil {
+					return "", testCase.initOAuth2Error
+				}
+				return "mockRedirectURL", nil
+			})
+
+			disconnectCalled := false
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DisconnectUser", func(_ *Plugin, _ string) error {
+				disconnectCalled = true
+				return testCase.disconnectError
+			})
+
+			var message string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "Ephemeral", func(_ *Plugin, _, _, format string, args ...interface{}) {
+				message = fmt.Sprintf(format, args...)
+			})
+
+			res, appErr := p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{
+				Command:   testCase.command,
+				UserId:    "mock-userID",
+				ChannelId: "mock-channelID",
+			})
+
+			require.Nil(t, appErr)
+			require.NotNil(t, res)
+			require.Equal(t, testCase.expectedMessage, message)
+			require.Equal(t, testCase.isInitOAuth2Call, initOAuth2Called)
+			require.Equal(t, testCase.isDisconnectCall, disconnectCalled)
+			mockAPI.AssertExpectations(t)
+		})
+	}
+}
+
+func Test_getCommand(t *testing.T) {
+	t.Run("Command is created with autocomplete data for all subcommands", func(t *testing.T) {
+		p := Plugin{}
+
+		command := p.getCommand()
+
+		require.Equal(t, CommandTrigger, command.Trigger)
+		require.True(t, command.AutoComplete)
+		require.NotNil(t, command.AutocompleteData)
+
+		var subCommands []string
+		for _, subCommand := range command.AutocompleteData.SubCommands {
+			subCommands = append(subCommands, subCommand.Trigger)
+		}
+		require.Equal(t, []string{SubCommandConnect, SubCommandDisconnect, SubCommandStatus, SubCommandHelp}, subCommands)
+	})
+}
@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
+	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
 )
 
 // configuration captures the plugin's external configuration as exposed in the Mattermost server
@@ -24,12 +28,33 @@ type configuration struct {
 	ServiceNowOAuthClientID     string `json:"ServiceNowOAuthClientID"`
 	ServiceNowOAuthClientSecret string `json:"ServiceNowOAuthClientSecret"`
 	EncryptionSecret            string `json:"EncryptionSecret"`
+	PreviousEncryptionSecrets   string `json:"PreviousEncryptionSecrets"`
 	WebhookSecret               string `json:"WebhookSecret"`
+	WebhookAuthenticationMode   string `json:"WebhookAuthenticationMode"`
+	WebhookSecretGracePeriod    int    `json:"WebhookSecretGracePeriod"`
 	ChannelCacheSize            int    `json:"ChannelCacheSize"`
+	ServiceNowInstances         string `json:"ServiceNowInstances"`
+	MentionChannels             string `json:"MentionChannels"`
+	MentionTeams                string `json:"MentionTeams"`
+	AttachmentLinkExpiryTime    int    `json:"AttachmentLinkExpiryTime"`
+	MaxAttachmentSize           int    `json:"MaxAttachmentSize"`
+	AllowedAttachmentTypes      string `json:"AllowedAttachmentTypes"`
 	MattermostSiteURL           string
 	PluginID                    string
 	PluginURL                   string
 	PluginURLPath               string
+	// PreviousWebhookSecret is the webhook secret which was replaced at WebhookSecretRotatedAt.
+	// It is accepted along with the current secret until the grace period ends.
+	PreviousWebhookSecret  string
+	WebhookSecretRotatedAt time.Time
+	// Instances are the additional ServiceNow instances parsed from ServiceNowInstances. They must not be modified once parsed.
+	Instances []*ServiceNowInstance
+}
+
+// webhookSecret is a webhook secret accepted for authenticating the ServiceNow requests.
+type webhookSecret struct {
+	name  string
+	value string
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -81,32 +106,191 @@ func (p *Plugin) setConfiguration(configuration *configuration) {
 }
 
 // IsValid checks if all needed fields are set.
+// The default instance is optional when additional ServiceNow instances are configured.
 func (c *configuration) IsValid() error {
-	if c.ServiceNowURL == "" {
-		return fmt.Errorf(EmptyServiceNowURLErrorMessage)
-	}
-	if c.ServiceNowOAuthClientID == "" {
-		return fmt.Errorf(EmptyServiceNowOAuthClientIDErrorMessage)
-	}
-	if c.ServiceNowOAuthClientSecret == "" {
-		return fmt.Errorf(EmptyServiceNowOAuthClientSecretErrorMessage)
+	hasDefaultInstance := len(c.Instances) == 0 || c.ServiceNowURL != ""
+	if hasDefaultInstance {
+		if c.ServiceNowURL == "" {
+			return fmt.Errorf(EmptyServiceNowURLErrorMessage)
+		}
+		if c.ServiceNowOAuthClientID == "" {
+			return fmt.Errorf(EmptyServiceNowOAuthClientIDErrorMessage)
+		}
+		if c.ServiceNowOAuthClientSecret == "" {
+			return fmt.Errorf(EmptyServiceNowOAuthClientSecretErrorMessage)
+		}
 	}
 	if c.EncryptionSecret == "" {
 		return fmt.Errorf(EmptyEncryptionSecretErrorMessage)
 	}
-	if c.WebhookSecret == "" {
+	if hasDefaultInstance && c.WebhookSecret == "" {
 		return fmt.Errorf(EmptyWebhookSecretErrorMessage)
 	}
+	names := map[string]bool{}
+	for _, instance := range c.Instances {
+		if err := instance.IsValid(); err != nil {
+			return err
+		}
+		if names[instance.Name] {
+			return fmt.Errorf(DuplicateInstanceNameErrorMessage)
+		}
+		names[instance.Name] = true
+	}
+	if c.WebhookAuthenticationMode != WebhookAuthenticationModeSecret && c.WebhookAuthenticationMode != WebhookAuthenticationModeSignature {
+		return fmt.Errorf(InvalidWebhookAuthenticationModeErrorMessage)
+	}
+	if c.WebhookSecretGracePeriod < 0 {
+		return fmt.Errorf(InvalidWebhookSecretGracePeriodErrorMessage)
+	}
 	if c.ChannelCacheSize <= 0 {
 		return fmt.Errorf(InvalidChannelCacheSizeErrorMessage)
 	}
+	if c.AttachmentLinkExpiryTime < 0 {
+		return fmt.Errorf(InvalidAttachmentLinkExpiryTimeErrorMessage)
+	}
+	if c.MaxAttachmentSize < 0 {
+		return fmt.Errorf(InvalidMaxAttachmentSizeErrorMessage)
+	}
 	return nil
 }
 
+// getEncryptionKeyRing returns the encryption secrets used for decrypting the stored data.
+// The current secret comes first and is the only one used for encrypting new data.
+func (c *configuration) getEncryptionKeyRing() [][]byte {
+	keyRing := [][]byte{[]byte(c.EncryptionSecret)}
+	for _, secret := range strings.Split(c.PreviousEncryptionSecrets, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" && secret != c.EncryptionSecret {
+			keyRing = append(keyRing, []byte(secret))
+		}
+	}
+
+	return keyRing
+}
+
+// isMentionEnabled returns whether the users can talk to the Virtual Agent by mentioning the bot in any channel.
+func (c *configuration) isMentionEnabled() bool {
+	return len(parseListSetting(c.MentionChannels)) > 0 || len(parseListSetting(c.MentionTeams)) > 0
+}
+
+// getAttachmentLinkExpiryTime returns the time for which the links of the files sent to ServiceNow can be downloaded.
+// The default time is used when the setting is not set, as it was not configurable before.
+func (c *configuration) getAttachmentLinkExpiryTime() time.Duration {
+	minutes := c.AttachmentLinkExpiryTime
+	if minutes <= 0 {
+		minutes = DefaultAttachmentLinkExpiryTime
+	}
+
+	return time.Duration(minutes) * time.Minute
+}
+
+// checkAttachmentPolicy returns an error explaining why the file can not be sent to ServiceNow, if it breaks the size limit
+// or is not one of the allowed types. The allowed types are MIME types like "application/pdf" or "image/*", or file extensions like ".pdf".
+func (c *configuration) checkAttachmentPolicy(fileInfo *model.FileInfo) error {
+	if c.MaxAttachmentSize > 0 && fileInfo.Size > int64(c.MaxAttachmentSize)*1024*1024 {
+		return fmt.Errorf(AttachmentTooLargeError, c.MaxAttachmentSize)
+	}
+
+	allowedTypes := parseListSetting(strings.ToLower(c.AllowedAttachmentTypes))
+	if len(allowedTypes) == 0 {
+		return nil
+	}
+
+	mimeType := strings.ToLower(fileInfo.MimeType)
+	extension := strings.ToLower(strings.TrimPrefix(fileInfo.Extension, "."))
+	for allowedType := range allowedTypes {
+		switch {
+		case strings.HasSuffix(allowedType, "/*"):
+			if strings.HasPrefix(mimeType, strings.TrimSuffix(allowedType, "*")) {
+				return nil
+			}
+		case strings.Contains(allowedType, "/"):
+			if mimeType == allowedType {
+				return nil
+			}
+		case extension != "" && strings.TrimPrefix(allowedType, ".") == extension:
+			return nil
+		}
+	}
+
+	return fmt.Errorf(AttachmentTypeNotAllowedError, c.AllowedAttachmentTypes)
+}
+
+// parseListSetting returns the set of the values of a comma-separated setting.
+func parseListSetting(value string) map[string]bool {
+	values := map[string]bool{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values[item] = true
+		}
+	}
+
+	return values
+}
+
+// getWebhookSecrets returns the webhook secrets which are currently accepted.
+// The previous secret is accepted only until the grace period after the rotation ends.
+// Empty secrets are never accepted, as they would let anyone send webhook requests.
+func (c *configuration) getWebhookSecrets() []webhookSecret {
+	var secrets []webhookSecret
+	if c.WebhookSecret != "" {
+		secrets = append(secrets, webhookSecret{name: WebhookSecretCurrent, value: c.WebhookSecret})
+	}
+	if c.PreviousWebhookSecret != "" && time.Now().Before(c.getWebhookSecretGracePeriodEnd()) {
+		secrets = append(secrets, webhookSecret{name: WebhookSecretPrevious, value: c.PreviousWebhookSecret})
+	}
+
+	return secrets
+}
+
+// getInstanceWebhookSecrets returns the webhook secrets which are currently accepted for the instance.
+// The rotation of the webhook secret is tracked only for the default instance.
+func (c *configuration) getInstanceWebhookSecrets(instance *ServiceNowInstance) []webhookSecret {
+	if instance.Name == DefaultInstanceName {
+		return c.getWebhookSecrets()
+	}
+
+	if instance.WebhookSecret == "" {
+		return nil
+	}
+
+	return []webhookSecret{{name: WebhookSecretCurrent, value: instance.WebhookSecret}}
+}
+
+// getInstance returns the ServiceNow instance with the given name.
+// The default instance is built from the top level settings.
+func (c *configuration) getInstance(name string) (*ServiceNowInstance, error) {
+	if name == DefaultInstanceName {
+		return &ServiceNowInstance{
+			Name:              DefaultInstanceName,
+			URL:               c.ServiceNowURL,
+			OAuthClientID:     c.ServiceNowOAuthClientID,
+			OAuthClientSecret: c.ServiceNowOAuthClientSecret,
+			WebhookSecret:     c.WebhookSecret,
+		}, nil
+	}
+
+	for _, instance := range c.Instances {
+		if instance.Name == name {
+			return instance, nil
+		}
+	}
+
+	return nil, errors.Wrap(ErrInstanceNotFound, name)
+}
+
+func (c *configuration) getWebhookSecretGracePeriodEnd() time.Time {
+	return c.WebhookSecretRotatedAt.Add(time.Duration(c.WebhookSecretGracePeriod) * time.Minute)
+}
+
 func (c *configuration) sanitize() {
 	c.ServiceNowURL = strings.TrimRight(strings.TrimSpace(c.ServiceNowURL), "/")
 	c.ServiceNowOAuthClientID = strings.TrimSpace(c.ServiceNowOAuthClientID)
 	c.ServiceNowOAuthClientSecret = strings.TrimSpace(c.ServiceNowOAuthClientSecret)
+
+	// Configurations saved before the authentication mode was introduced use the query parameter secret
+	if c.WebhookAuthenticationMode == "" {
+		c.WebhookAuthenticationMode = WebhookAuthenticationModeSecret
+	}
 }
 
 // OnConfigurationChange is invoked when configuration changes may have been made.
@@ -120,6 +304,12 @@ func (p *Plugin) OnConfigurationChange() error {
 
 	configuration.sanitize()
 
+	instances, err := parseServiceNowInstances(configuration.ServiceNowInstances)
+	if err != nil {
+		return err
+	}
+	configuration.Instances = instances
+
 	mattermostSiteURL := p.API.GetConfig().ServiceSettings.SiteURL
 	if mattermostSiteURL == nil {
 		return errors.New("plugin requires Mattermost Site URL to be set")
@@ -130,7 +320,57 @@ func (p *Plugin) OnConfigurationChange() error {
 	configuration.PluginURLPath = p.GetPluginURLPath()
 	configuration.PluginID = manifest.ID
 
+	previous := p.getConfiguration()
+	p.updateWebhookSecretRotation(previous, configuration)
+
 	p.setConfiguration(configuration)
 
+	// Tokens encrypted with the previous secret are re-encrypted in the background when the encryption secret changes
+	if p.store != nil && previous.EncryptionSecret != "" && previous.EncryptionSecret != configuration.EncryptionSecret {
+		go p.ReencryptUsers()
+	}
+
 	return nil
 }
+
+// updateWebhookSecretRotation keeps track of the previous webhook secret when the webhook secret is regenerated,
+// so that ServiceNow can keep using it until it is updated there.
+func (p *Plugin) updateWebhookSecretRotation(previous, configuration *configuration) {
+	switch {
+	case previous.WebhookSecret != "" && previous.WebhookSecret != configuration.WebhookSecret:
+		configuration.PreviousWebhookSecret = previous.WebhookSecret
+		configuration.WebhookSecretRotatedAt = time.Now()
+
+		if p.store == nil {
+			return
+		}
+
+		if err := p.store.StoreWebhookSecretRotation(&serializer.WebhookSecretRotation{
+			PreviousSecret: configuration.PreviousWebhookSecret,
+			RotatedAt:      configuration.WebhookSecretRotatedAt,
+		}); err != nil {
+			p.API.LogWarn("Failed to store the webhook secret rotation", "Error", err.Error())
+		}
+	case previous.PreviousWebhookSecret != "":
+		configuration.PreviousWebhookSecret = previous.PreviousWebhookSecret
+		configuration.WebhookSecretRotatedAt = previous.WebhookSecretRotatedAt
+	default:
+		// The last rotation is not known yet, e.g. when the plugin is being activated, so it is loaded from the KV store
+		if p.store == nil {
+			return
+		}
+
+		rotation, err := p.store.LoadWebhookSecretRotation()
+		if err != nil {
+			if err != ErrNotFound {
+				p.API.LogWarn("Failed to load the webhook secret rotation", "Error", err.Error())
+			}
+			return
+		}
+
+		if rotation.PreviousSecret != configuration.WebhookSecret {
+			configuration.PreviousWebhookSecret = rotation.PreviousSecret
+			configuration.WebhookSecretRotatedAt = rotation.RotatedAt
+		}
+	}
+}
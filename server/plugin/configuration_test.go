@@ -1,10 +1,19 @@
 package plugin
 
 import (
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/golang/mock/gomock"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	mock_plugin "github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/mocks"
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/testutils"
 )
 
 func TestIsValid(t *testing.T) {
@@ -21,8 +30,74 @@ func TestIsValid(t *testing.T) {
 				ServiceNowOAuthClientSecret: "mockServiceNowOAuthClientSecret",
 				EncryptionSecret:            "mockEncryptionSecret",
 				WebhookSecret:               "mockWebhookSecret",
+				WebhookAuthenticationMode:   WebhookAuthenticationModeSecret,
+				ChannelCacheSize:            10000,
+			},
+		},
+		{
+			description: "valid configuration: webhook signature authentication",
+			config: &configuration{
+				ServiceNowURL:               "mockServiceNowURL",
+				ServiceNowOAuthClientID:     "mockServiceNowOAuthClientID",
+				ServiceNowOAuthClientSecret: "mockServiceNowOAuthClientSecret",
+				EncryptionSecret:            "mockEncryptionSecret",
+				WebhookSecret:               "mockWebhookSecret",
+				WebhookAuthenticationMode:   WebhookAuthenticationModeSignature,
+				ChannelCacheSize:            10000,
+			},
+		},
+		{
+			description: "invalid configuration: WebhookAuthenticationMode invalid",
+			config: &configuration{
+				ServiceNowURL:               "mockServiceNowURL",
+				ServiceNowOAuthClientID:     "mockServiceNowOAuthClientID",
+				ServiceNowOAuthClientSecret: "mockServiceNowOAuthClientSecret",
+				EncryptionSecret:            "mockEncryptionSecret",
+				WebhookSecret:               "mockWebhookSecret",
+				WebhookAuthenticationMode:   "mockMode",
+			},
+			errMsg: InvalidWebhookAuthenticationModeErrorMessage,
+		},
+		{
+			description: "invalid configuration: WebhookSecretGracePeriod negative",
+			config: &configuration{
+				ServiceNowURL:               "mockServiceNowURL",
+				ServiceNowOAuthClientID:     "mockServiceNowOAuthClientID",
+				ServiceNowOAuthClientSecret: "mockServiceNowOAuthClientSecret",
+				EncryptionSecret:            "mockEncryptionSecret",
+				WebhookSecret:               "mockWebhookSecret",
+				WebhookAuthenticationMode:   WebhookAuthenticationModeSecret,
+				WebhookSecretGracePeriod:    -1,
+			},
+			errMsg: InvalidWebhookSecretGracePeriodErrorMessage,
+		},
+		{
+			description: "invalid configuration: AttachmentLinkExpiryTime negative",
+			config: &configuration{
+				ServiceNowURL:               "mockServiceNowURL",
+				ServiceNowOAuthClientID:     "mockServiceNowOAuthClientID",
+				ServiceNowOAuthClientSecret: "mockServiceNowOAuthClientSecret",
+				EncryptionSecret:            "mockEncryptionSecret",
+				WebhookSecret:               "mockWebhookSecret",
+				WebhookAuthenticationMode:   WebhookAuthenticationModeSecret,
+				ChannelCacheSize:            10000,
+				AttachmentLinkExpiryTime:    -1,
+			},
+			errMsg: InvalidAttachmentLinkExpiryTimeErrorMessage,
+		},
+		{
+			description: "invalid configuration: MaxAttachmentSize negative",
+			config: &configuration{
+				ServiceNowURL:               "mockServiceNowURL",
+				ServiceNowOAuthClientID:     "mockServiceNowOAuthClientID",
+				ServiceNowOAuthClientSecret: "mockServiceNowOAuthClientSecret",
+				EncryptionSecret:            "mockEncryptionSecret",
+				WebhookSecret:               "mockWebhookSecret",
+				WebhookAuthenticationMode:   WebhookAuthenticationModeSecret,
 				ChannelCacheSize:            10000,
+				MaxAttachmentSize:           -1,
 			},
+			errMsg: InvalidMaxAttachmentSizeErrorMessage,
 		},
 		{
 			description: "invalid configuration: ServiceNow URL empty",
@@ -77,10 +152,43 @@ func TestIsValid(t *testing.T) {
 				ServiceNowOAuthClientSecret: "mockServiceNowOAuthClientSecret",
 				EncryptionSecret:            "mockEncryptionSecret",
 				WebhookSecret:               "mockWebhookSecret",
+				WebhookAuthenticationMode:   WebhookAuthenticationModeSecret,
 				ChannelCacheSize:            -1,
 			},
 			errMsg: InvalidChannelCacheSizeErrorMessage,
 		},
+		{
+			description: "valid configuration: only additional instances",
+			config: &configuration{
+				EncryptionSecret:          "mockEncryptionSecret",
+				WebhookAuthenticationMode: WebhookAuthenticationModeSecret,
+				ChannelCacheSize:          10000,
+				Instances: []*ServiceNowInstance{
+					{Name: "mock-instance", URL: "mockURL", OAuthClientID: "mockClientID", OAuthClientSecret: "mockClientSecret", WebhookSecret: "mockWebhookSecret"},
+				},
+			},
+		},
+		{
+			description: "invalid configuration: instance URL empty",
+			config: &configuration{
+				EncryptionSecret: "mockEncryptionSecret",
+				Instances: []*ServiceNowInstance{
+					{Name: "mock-instance", OAuthClientID: "mockClientID", OAuthClientSecret: "mockClientSecret", WebhookSecret: "mockWebhookSecret"},
+				},
+			},
+			errMsg: "mock-instance: " + EmptyServiceNowURLErrorMessage,
+		},
+		{
+			description: "invalid configuration: instance names duplicated",
+			config: &configuration{
+				EncryptionSecret: "mockEncryptionSecret",
+				Instances: []*ServiceNowInstance{
+					{Name: "mock-instance", URL: "mockURL", OAuthClientID: "mockClientID", OAuthClientSecret: "mockClientSecret", WebhookSecret: "mockWebhookSecret"},
+					{Name: "mock-instance", URL: "mockURL", OAuthClientID: "mockClientID", OAuthClientSecret: "mockClientSecret", WebhookSecret: "mockWebhookSecret"},
+				},
+			},
+			errMsg: DuplicateInstanceNameErrorMessage,
+		},
 	} {
 		t.Run(testCase.description, func(t *testing.T) {
 			err := testCase.config.IsValid()
@@ -93,3 +201,221 @@ func TestIsValid(t *testing.T) {
 		})
 	}
 }
+
+func Test_getWebhookSecrets(t *testing.T) {
+	for _, testCase := range []struct {
+		description     string
+		config          *configuration
+		expectedSecrets []webhookSecret
+	}{
+		{
+			description: "Only the current secret is accepted when the secret was never rotated",
+			config: &configuration{
+				WebhookSecret:            "mockWebhookSecret",
+				WebhookSecretGracePeriod: 60,
+			},
+			expectedSecrets: []webhookSecret{{name: WebhookSecretCurrent, value: "mockWebhookSecret"}},
+		},
+		{
+			description: "Previous secret is accepted during the grace period",
+			config: &configuration{
+				WebhookSecret:            "mockWebhookSecret",
+				WebhookSecretGracePeriod: 60,
+				PreviousWebhookSecret:    "mockPreviousWebhookSecret",
+				WebhookSecretRotatedAt:   time.Now().Add(-30 * time.Minute),
+			},
+			expectedSecrets: []webhookSecret{
+				{name: WebhookSecretCurrent, value: "mockWebhookSecret"},
+				{name: WebhookSecretPrevious, value: "mockPreviousWebhookSecret"},
+			},
+		},
+		{
+			description: "Previous secret is not accepted after the grace period",
+			config: &configuration{
+				WebhookSecret:            "mockWebhookSecret",
+				WebhookSecretGracePeriod: 60,
+				PreviousWebhookSecret:    "mockPreviousWebhookSecret",
+				WebhookSecretRotatedAt:   time.Now().Add(-90 * time.Minute),
+			},
+			expectedSecrets: []webhookSecret{{name: WebhookSecretCurrent, value: "mockWebhookSecret"}},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			require.Equal(t, testCase.expectedSecrets, testCase.config.getWebhookSecrets())
+		})
+	}
+}
+
+func Test_updateWebhookSecretRotation(t *testing.T) {
+	rotatedAt := time.Now().Add(-time.Minute).UTC()
+
+	for _, testCase := range []struct {
+		description            string
+		previous               *configuration
+		storedRotation         *serializer.WebhookSecretRotation
+		loadRotationError      error
+		isRotationStored       bool
+		expectedPreviousSecret string
+		isRotatedNow           bool
+	}{
+		{
+			description:            "Previous secret is tracked when the secret is regenerated",
+			previous:               &configuration{WebhookSecret: "mockPreviousWebhookSecret"},
+			isRotationStored:       true,
+			expectedPreviousSecret: "mockPreviousWebhookSecret",
+			isRotatedNow:           true,
+		},
+		{
+			description: "Previous secret is carried over when the secret is not changed",
+			previous: &configuration{
+				WebhookSecret:          "mockWebhookSecret",
+				PreviousWebhookSecret:  "mockPreviousWebhookSecret",
+				WebhookSecretRotatedAt: rotatedAt,
+			},
+			expectedPreviousSecret: "mockPreviousWebhookSecret",
+		},
+		{
+			description: "Last rotation is loaded from the KV store on activation",
+			previous:    &configuration{},
+			storedRotation: &serializer.WebhookSecretRotation{
+				PreviousSecret: "mockPreviousWebhookSecret",
+				RotatedAt:      rotatedAt,
+			},
+			expectedPreviousSecret: "mockPreviousWebhookSecret",
+		},
+		{
+			description: "Stored rotation is ignored when its previous secret is the current secret",
+			previous:    &configuration{},
+			storedRotation: &serializer.WebhookSecretRotation{
+				PreviousSecret: "mockWebhookSecret",
+				RotatedAt:      rotatedAt,
+			},
+		},
+		{
+			description:       "Secret was never rotated",
+			previous:          &configuration{},
+			loadRotationError: ErrNotFound,
+		},
+		{
+			description:       "Error while loading the last rotation",
+			previous:          &configuration{},
+			loadRotationError: errors.New("error in loading the rotation from KVstore"),
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := &Plugin{}
+
+			mockAPI := &plugintest.API{}
+			defer mockAPI.AssertExpectations(t)
+			if testCase.loadRotationError != nil && testCase.loadRotationError != ErrNotFound {
+				mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+			}
+			p.SetAPI(mockAPI)
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			if testCase.isRotationStored {
+				mockedStore.EXPECT().StoreWebhookSecretRotation(gomock.Any()).Return(nil)
+			}
+			if testCase.storedRotation != nil || testCase.loadRotationError != nil {
+				mockedStore.EXPECT().LoadWebhookSecretRotation().Return(testCase.storedRotation, testCase.loadRotationError)
+			}
+			p.store = mockedStore
+
+			config := &configuration{WebhookSecret: "mockWebhookSecret"}
+			p.updateWebhookSecretRotation(testCase.previous, config)
+
+			require.Equal(t, testCase.expectedPreviousSecret, config.PreviousWebhookSecret)
+			switch {
+			case testCase.isRotatedNow:
+				require.WithinDuration(t, time.Now(), config.WebhookSecretRotatedAt, time.Second)
+			case testCase.expectedPreviousSecret != "":
+				require.Equal(t, rotatedAt, config.WebhookSecretRotatedAt)
+			default:
+				require.True(t, config.WebhookSecretRotatedAt.IsZero())
+			}
+		})
+	}
+}
+
+func Test_getEncryptionKeyRing(t *testing.T) {
+	t.Run("Current secret comes first followed by the previous secrets", func(t *testing.T) {
+		config := &configuration{
+			EncryptionSecret:          "mockEncryptionSecret",
+			PreviousEncryptionSecrets: " mockPreviousSecret1, ,mockEncryptionSecret,mockPreviousSecret2 ",
+		}
+
+		require.Equal(t, [][]byte{
+			[]byte("mockEncryptionSecret"),
+			[]byte("mockPreviousSecret1"),
+			[]byte("mockPreviousSecret2"),
+		}, config.getEncryptionKeyRing())
+	})
+}
+
+func Test_getAttachmentLinkExpiryTime(t *testing.T) {
+	t.Run("Default expiry time is used when the setting is not set", func(t *testing.T) {
+		require.Equal(t, DefaultAttachmentLinkExpiryTime*time.Minute, (&configuration{}).getAttachmentLinkExpiryTime())
+	})
+
+	t.Run("Configured expiry time is used", func(t *testing.T) {
+		require.Equal(t, 60*time.Minute, (&configuration{AttachmentLinkExpiryTime: 60}).getAttachmentLinkExpiryTime())
+	})
+}
+
+func Test_checkAttachmentPolicy(t *testing.T) {
+	for _, testCase := range []struct {
+		description   string
+		config        *configuration
+		fileInfo      *model.FileInfo
+		expectedError string
+	}{
+		{
+			description: "Any file is allowed without a policy",
+			config:      &configuration{},
+			fileInfo:    &model.FileInfo{Size: 100 * 1024 * 1024, MimeType: "application/zip", Extension: "zip"},
+		},
+		{
+			description: "File within the size limit is allowed",
+			config:      &configuration{MaxAttachmentSize: 10},
+			fileInfo:    &model.FileInfo{Size: 10 * 1024 * 1024, MimeType: "application/pdf", Extension: "pdf"},
+		},
+		{
+			description:   "File larger than the size limit is refused",
+			config:        &configuration{MaxAttachmentSize: 10},
+			fileInfo:      &model.FileInfo{Size: 10*1024*1024 + 1, MimeType: "application/pdf", Extension: "pdf"},
+			expectedError: "the file is larger than the maximum allowed size of 10 MB",
+		},
+		{
+			description: "File allowed by its MIME type",
+			config:      &configuration{AllowedAttachmentTypes: "application/pdf"},
+			fileInfo:    &model.FileInfo{MimeType: "application/pdf", Extension: "pdf"},
+		},
+		{
+			description: "File allowed by a wildcard MIME type",
+			config:      &configuration{AllowedAttachmentTypes: "Image/*"},
+			fileInfo:    &model.FileInfo{MimeType: "image/png", Extension: "png"},
+		},
+		{
+			description: "File allowed by its extension",
+			config:      &configuration{AllowedAttachmentTypes: "image/*, .DOCX"},
+			fileInfo:    &model.FileInfo{MimeType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Extension: "docx"},
+		},
+		{
+			description:   "File of a type which is not allowed is refused",
+			config:        &configuration{AllowedAttachmentTypes: "image/*, .docx"},
+			fileInfo:      &model.FileInfo{MimeType: "application/zip", Extension: "zip"},
+			expectedError: "files of this type are not allowed. Allowed types: image/*, .docx",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			err := testCase.config.checkAttachmentPolicy(testCase.fileInfo)
+			if testCase.expectedError != "" {
+				require.EqualError(t, err, testCase.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
@@ -6,12 +6,18 @@ const (
 	// Used for storing the token in the request context to pass from one middleware to another
 	// #nosec G101 -- This is a false positive. The below line is not a hardcoded credential
 	ContextTokenKey ServiceNowOAuthToken = "ServiceNow-Oauth-Token"
+	// Used for storing the ServiceNow instance of the user in the request context
+	ContextInstanceKey ServiceNowOAuthToken = "ServiceNow-Instance"
 
 	ConnectSuccessMessage = "Thanks for linking your ServiceNow account!\n" +
 		"Your ServiceNow account (*%s*) has been connected to Mattermost."
 	WelcomePretextMessage = "Welcome to the Mattermost ServiceNow Virtual Agent.\n" +
 		"I'm here to help you. Let's start by linking your ServiceNow account.\n[Link to ServiceNow](%s)"
-	GenericErrorMessage = "Something went wrong. Please try again later."
+	GenericErrorMessage    = "Something went wrong. Please try again later."
+	ReauthorizationMessage = "Your ServiceNow session has expired or has been revoked. Please reconnect your ServiceNow account to continue.\n" +
+		"Your last message will be sent to the Virtual Agent once you reconnect.\n[Link to ServiceNow](%s)"
+	PendingPostNotSentMessage      = "Your last message could not be sent to the Virtual Agent. Please send it again."
+	WebhookResponseNotShownMessage = "A response of the Virtual Agent could not be shown. Please try again later."
 
 	PathOAuth2Connect              = "/oauth2/connect"
 	PathOAuth2Complete             = "/oauth2/complete"
@@ -21,12 +27,31 @@ const (
 	PathVirtualAgentBotIntegration = "/api/sn_va_as_service/bot/integration"
 	PathActionOptions              = "/action_options"
 	PathOpenDialog                 = "/api/v4/actions/dialogs/open"
+	PathOAuth2Revoke               = "/oauth_revoke_token.do"
 	PathSetDateTimeDialog          = "/date_time"
 	PathSetDateTime                = "/selected_date_time"
+	PathMultiSelectDialog          = "/multi_select"
+	PathMultiSelect                = "/selected_options"
+	PathMaskedInputDialog          = "/masked_input"
+	PathMaskedInput                = "/submitted_masked_input"
 
 	SysQueryParam   = "sysparm_query"
 	VideoQueryParam = "target_url"
 	SecretParam     = "secret"
+	InstanceParam   = "instance"
+
+	HeaderWebhookSignature = "X-ServiceNow-Signature"
+	HeaderWebhookTimestamp = "X-ServiceNow-Timestamp"
+	HeaderWebhookNonce     = "X-ServiceNow-Nonce"
+
+	WebhookAuthenticationModeSecret    = "secret"
+	WebhookAuthenticationModeSignature = "signature"
+	WebhookSecretCurrent               = "current"
+	WebhookSecretPrevious              = "previous"
+	// WebhookSignatureTolerance is the maximum allowed difference between the webhook request timestamp and the current time. This value is in seconds.
+	WebhookSignatureTolerance = 300
+
+	InvalidGrantErrorCode = "invalid_grant"
 
 	BotUsername    = "servicenow-virtual-agent"
 	BotDisplayName = "ServiceNow Virtual Agent"
@@ -40,6 +65,7 @@ const (
 	AlreadyDisconnectedMessage       = "You're already disconnected from your ServiceNow account."
 
 	StartConversationAction         = "START_CONVERSATION"
+	EndConversationAction           = "END_CONVERSATION"
 	OutputTextUIType                = "OutputText"
 	InputTextUIType                 = "InputText"
 	FileUploadUIType                = "FileUpload"
@@ -53,10 +79,28 @@ const (
 	DateUIType                      = "Date"
 	TimeUIType                      = "Time"
 	DateTimeUIType                  = "DateTime"
+	ActionMsgUIType                 = "ActionMsg"
+	OutputHTMLUIType                = "OutputHtml"
 	OutputCardSmallImageType        = "Small image with text"
 	OutputCardLargeImageType        = "Large image with text"
 	OutputCardVideoType             = "Youtube Video Card"
 	OutputCardRecordType            = "Card"
+	PickerStyleCarousel             = "carousel"
+	CarouselSelectButtonName        = "Select"
+
+	ActionTypeStartSpinner      = "StartSpinner"
+	ActionTypeEndSpinner        = "EndSpinner"
+	ActionTypeTopicFinished     = "TopicFinished"
+	ActionTypeSwitchToLiveAgent = "SwitchToLiveAgent"
+	ActionTypeQueuePosition     = "QueuePosition"
+	LiveAgentTransferMessage    = "You are being transferred to a live agent. Please wait for the agent to join the conversation."
+	LiveAgentJoinedMessage      = "**%s** joined the conversation."
+	LiveAgentLeftMessage        = "**%s** left the conversation. You are chatting with the Virtual Agent again."
+	LiveAgentQueueMessage       = "You are number %d in the queue."
+
+	// Props of the posts which show the name and the avatar of the live agent instead of the bot
+	PostPropFromWebhook      = "from_webhook"
+	PostPropOverrideUsername = "override_username"
 
 	InvalidImageLinkError = "Invalid image link."
 	ItemTypeImage         = "image"
@@ -66,23 +110,124 @@ const (
 	DateTimeDialogType    = "type"
 	DateLayout            = "2006-01-02"
 
-	DateValidationError    = "Please enter a valid date"
-	TimeValidationError    = "Please enter a valid time"
-	InvalidCallbackIDError = "Invalid callback ID."
-	NotAuthorizedError     = "Not authorized"
+	// MaskTypeNone is the mask type of the input prompts which do not ask for a sensitive value.
+	MaskTypeNone                = "NONE"
+	MaskedInputLabelContextKey  = "label"
+	MaskedInputElementName      = "value"
+	MaskedInputMessage          = "\n(**Note:** Please use the button below to enter the value securely. Messages typed here are sent to the Virtual Agent as the value without being posted.)"
+	MaskedInputSubmittedMessage = "Value submitted."
+	MaskedInputDeletedMessage   = "Your message was not posted because the Virtual Agent asked for a sensitive value. It has been sent to the Virtual Agent."
+	MaskedInputNotSentMessage   = "Your message was not posted because the Virtual Agent asked for a sensitive value, and it could not be sent to the Virtual Agent. Please use the button of the question to enter the value."
+	MaskedInputRejectionReason  = "The message answers a question asking for a sensitive value and has been sent to the Virtual Agent without being posted."
+
+	StalePromptMessage     = "This question is no longer active. Please answer the latest question of the Virtual Agent."
+	StalePromptPostMessage = "_This question is no longer active._"
+	NotSessionOwnerMessage = "Only the user who started this conversation with the Virtual Agent can answer this question."
+
+	BooleanYesLabel   = "Yes"
+	BooleanNoLabel    = "No"
+	BooleanTrueValue  = "true"
+	BooleanFalseValue = "false"
+
+	PickerOptionLabelsContextKey   = "option_labels"
+	PickerSelectedOptionContextKey = "selected_option"
+	MultiSelectOptionsContextKey   = "options"
+	MultiSelectRequiredContextKey  = "required"
+	MultiSelectElementPrefix       = "option_"
+	// MultiSelectSeparator separates the values of the selected options sent to the Virtual Agent.
+	MultiSelectSeparator = ","
+	// DialogElementDisplayNameMaxLength is the maximum length of the display name of an interactive dialog element.
+	DialogElementDisplayNameMaxLength = 24
+
+	DateValidationError     = "Please enter a valid date"
+	TimeValidationError     = "Please enter a valid time"
+	InvalidCallbackIDError  = "Invalid callback ID."
+	NoOptionSelectedError   = "Please select at least one option."
+	NoOptionAvailableError  = "There are no options to select."
+	OptionNotAvailableError = "The selected option is not available."
+	NotAuthorizedError      = "Not authorized"
 
 	UploadImageMessage = "\n(**Note:** Please upload an image using the Mattermost `Upload files` option OR use the shorthand `Ctrl+U`.)"
 	UploadFileMessage  = "\n(**Note:** Please upload a file using the Mattermost `Upload files` option OR use the shorthand `Ctrl+U`.)"
 
+	FileSendReportMessage = "Files attached to your message:"
+	FileSentMessage       = "- **%s**: Sent to the Virtual Agent."
+	FileNotSentMessage    = "- **%s**: Not sent (%s)."
+	FileSendError         = "error in sending the file to the Virtual Agent"
+
+	AttachmentTooLargeError       = "the file is larger than the maximum allowed size of %d MB"
+	AttachmentTypeNotAllowedError = "files of this type are not allowed. Allowed types: %s"
+
 	PathParamEncryptedFileInfo = "encryptedFileInfo"
 
-	updatedPostBorderColor            = "#74ccac"
-	AttachmentLinkExpiryTimeInMinutes = 15
+	updatedPostBorderColor = "#74ccac"
+	// DefaultAttachmentLinkExpiryTime is the time in minutes for which the links of the files sent to ServiceNow can be downloaded,
+	// when it is not configured.
+	DefaultAttachmentLinkExpiryTime = 15
 
 	YoutubeURL = "https://www.youtube.com/watch?v=%s"
 
 	// ChannelCacheTTL contains the value after which cache entries are expired. This value is in minutes.
 	ChannelCacheTTL = 1440
+
+	// WebhookQueueSize is the maximum number of webhook requests waiting to be processed for a single user.
+	WebhookQueueSize = 100
+	// WebhookWorkerIdleTimeout is the time after which the worker of an idle user queue is stopped. This value is in seconds.
+	WebhookWorkerIdleTimeout = 60
+	// ClusterLockTTL is the time after which a cluster lock expires, if the node holding it doesn't release it. This value is in seconds.
+	ClusterLockTTL = 30
+	// ClusterLockWaitTimeout is the maximum time to wait for acquiring a cluster lock. This value is in seconds.
+	ClusterLockWaitTimeout = 20
+	// ClusterLockMinRetryInterval and ClusterLockMaxRetryInterval bound the wait between the attempts to acquire a cluster lock.
+	// These values are in milliseconds.
+	ClusterLockMinRetryInterval = 50
+	ClusterLockMaxRetryInterval = 1000
+	// TokenRefreshLockKey is the key of the cluster lock for refreshing the OAuth2 token of a user.
+	TokenRefreshLockKey = "token_refresh_%s"
+	// ReencryptionLockKey is the key of the cluster lock for re-encrypting the stored OAuth2 tokens.
+	ReencryptionLockKey = "reencryption"
+	// ReencryptionLockTTL is the time after which the re-encryption lock expires. A run waits for the lock for the same time.
+	// This value is in seconds.
+	ReencryptionLockTTL = 10 * 60
+	// ReencryptionMaxAttempts is the maximum number of attempts to re-encrypt the token of a user which is changed concurrently.
+	ReencryptionMaxAttempts = 3
+	// TokenStoreMaxAttempts is the maximum number of attempts to store the refreshed token of a user which is changed concurrently.
+	TokenStoreMaxAttempts = 3
+	// ConversationStateMaxAttempts is the maximum number of attempts to update the conversation state of a session which is changed concurrently.
+	ConversationStateMaxAttempts = 3
+
+	// WebhookMaxAttempts is the maximum number of attempts to process a webhook request which fails.
+	WebhookMaxAttempts = 3
+	// WebhookRetryInterval is the wait before retrying a failed webhook request, multiplied by the number of attempts. This value is in seconds.
+	WebhookRetryInterval = 2
+	// WebhookQueueDrainTimeout is the maximum time to wait for the queued webhook requests while deactivating the plugin. This value is in seconds.
+	WebhookQueueDrainTimeout = 30
+	// EndConversationBatchSize is the number of conversations with the Virtual Agent which are ended concurrently while disconnecting a user.
+	EndConversationBatchSize = 10
+
+	CommandTrigger                 = "servicenow"
+	CommandDisplayName             = "ServiceNow Virtual Agent"
+	CommandDescription             = "Connect to and interact with the ServiceNow Virtual Agent."
+	CommandAutocompleteHint        = "[command]"
+	CommandAutocompleteDescription = "Available commands: connect, disconnect, status, help"
+
+	SubCommandConnect    = "connect"
+	SubCommandDisconnect = "disconnect"
+	SubCommandStatus     = "status"
+	SubCommandHelp       = "help"
+
+	CommandHelpText = "###### Mattermost ServiceNow Virtual Agent Plugin - Slash Command Help\n" +
+		"* `/servicenow connect` - Connect your Mattermost account to your ServiceNow account\n" +
+		"* `/servicenow disconnect` - Disconnect your Mattermost account from your ServiceNow account\n" +
+		"* `/servicenow status` - Check if your Mattermost account is connected to ServiceNow\n" +
+		"* `/servicenow help` - Show this help text"
+
+	CommandConnectMessage               = "[Click here to link your ServiceNow account.](%s)"
+	CommandAlreadyConnectedMessage      = "You're already connected to your ServiceNow account (*%s*)."
+	CommandConnectedStatusMessage       = "Your Mattermost account is connected to your ServiceNow account (*%s*)."
+	CommandReauthorizationStatusMessage = "Your ServiceNow account (*%s*) needs to be reconnected. Use `/servicenow connect` to reconnect your account."
+	CommandNotConnectedStatusMessage    = "Your Mattermost account is not connected to ServiceNow. Use `/servicenow connect` to connect your account."
+	CommandInvalidSubCommandMessage     = "Unknown command: `%s`. Use `/servicenow help` to see the available commands."
 )
 
 // #nosec G101 -- This is a false positive. The below line is not a hardcoded credential
@@ -93,6 +238,12 @@ const (
 	EmptyEncryptionSecretErrorMessage            = "encryption secret should not be empty"
 	EmptyWebhookSecretErrorMessage               = "webhook secret should not be empty"
 	InvalidChannelCacheSizeErrorMessage          = "direct message channel cache size should be greater than zero"
+	InvalidWebhookAuthenticationModeErrorMessage = "webhook authentication mode should be either secret or signature"
+	InvalidWebhookSecretGracePeriodErrorMessage  = "webhook secret grace period should not be negative"
+	InvalidAttachmentLinkExpiryTimeErrorMessage  = "attachment link expiry time should not be negative"
+	InvalidMaxAttachmentSizeErrorMessage         = "maximum attachment size should not be negative"
+	EmptyInstanceNameErrorMessage                = "serviceNow instance name should not be empty"
+	DuplicateInstanceNameErrorMessage            = "serviceNow instance names should be unique"
 )
 
 type ServiceNowOAuthToken string
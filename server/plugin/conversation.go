@@ -0,0 +1,274 @@
+package plugin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
+)
+
+// getSessionID returns the ID of the Virtual Agent session of a post of the user.
+// Each thread is a separate session, identified by the ID of its root post, so a post outside of a thread starts a new session.
+func getSessionID(post *model.Post) string {
+	if post.RootId != "" {
+		return post.RootId
+	}
+	return post.Id
+}
+
+// getSessionKey returns the key of the state of a Virtual Agent session of the user.
+// The state of the conversation outside of the threads is kept with the user ID, as it was before the threads were supported.
+func getSessionKey(mattermostUserID, sessionID string) string {
+	if sessionID == "" {
+		return mattermostUserID
+	}
+	return fmt.Sprintf("%s__%s", mattermostUserID, sessionID)
+}
+
+// GetPostSession returns the ID of the Virtual Agent session which a post of the bot belongs to, along with the ID of its channel.
+func (p *Plugin) GetPostSession(postID string) (sessionID, channelID string, err error) {
+	post, appErr := p.API.GetPost(postID)
+	if appErr != nil {
+		return "", "", errors.Wrap(appErr, "failed to get the post")
+	}
+	return post.RootId, post.ChannelId, nil
+}
+
+// SetSessionChannel records the channel of a session started by mentioning the bot in a channel,
+// so that the responses of the Virtual Agent are posted in the thread of the channel.
+func (p *Plugin) SetSessionChannel(mattermostUserID, sessionID, channelID string) error {
+	return p.updateConversationState(getSessionKey(mattermostUserID, sessionID), true, func(state *serializer.ConversationState) bool {
+		if state.ChannelID == channelID {
+			return false
+		}
+
+		state.ChannelID = channelID
+		return true
+	})
+}
+
+// updateConversationState applies the update to the conversation state of the session and stores it with compare-and-set,
+// as the state can be changed on different nodes at the same time. The update is applied again to the reloaded state when it has changed,
+// so it must not have any side effects. The state is not stored if the update returns false. A missing state is created only if create is true.
+func (p *Plugin) updateConversationState(sessionKey string, create bool, update func(state *serializer.ConversationState) bool) error {
+	for attempt := 0; attempt < ConversationStateMaxAttempts; attempt++ {
+		state, oldData, err := p.store.LoadConversationStateRecord(sessionKey)
+		if err != nil {
+			if err != ErrNotFound {
+				return errors.Wrap(err, "failed to load the conversation state")
+			}
+			if !create {
+				return nil
+			}
+			state = &serializer.ConversationState{}
+		}
+
+		if !update(state) {
+			return nil
+		}
+
+		state.UpdatedAt = time.Now()
+		stored, err := p.store.CompareAndStoreConversationState(sessionKey, oldData, state)
+		if err != nil {
+			return errors.Wrap(err, "failed to store the conversation state")
+		}
+		if stored {
+			return nil
+		}
+	}
+
+	return errors.New("the conversation state was changed while storing it")
+}
+
+// GetSessionChannelID returns the channel of a session started by mentioning the bot in a channel.
+// It returns an empty string for the sessions in the DM with the bot.
+func (p *Plugin) GetSessionChannelID(mattermostUserID, sessionID string) (string, error) {
+	state, err := p.store.LoadConversationState(getSessionKey(mattermostUserID, sessionID))
+	if err != nil {
+		if err == ErrNotFound {
+			return "", nil
+		}
+		return "", errors.Wrap(err, "failed to load the conversation state")
+	}
+
+	return state.ChannelID, nil
+}
+
+// IsSessionOwner returns whether the user has started the session in the channel.
+// Only the owner of a session in a channel can continue it, as the other members of the channel can see its posts as well.
+func (p *Plugin) IsSessionOwner(mattermostUserID, sessionID, channelID string) (bool, error) {
+	isBotDMChannel, err := p.isBotDMChannel(channelID)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get the channel")
+	}
+
+	if isBotDMChannel {
+		return true, nil
+	}
+
+	state, err := p.store.LoadConversationState(getSessionKey(mattermostUserID, sessionID))
+	if err != nil {
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "failed to load the conversation state")
+	}
+
+	return state.ChannelID == channelID, nil
+}
+
+// SetActivePrompt marks the post as the latest question of the Virtual Agent in the session.
+// The buttons of the previous question are removed, as it can no longer be answered.
+func (p *Plugin) SetActivePrompt(mattermostUserID, sessionID, postID string) error {
+	var previousPostID string
+	err := p.updateConversationState(getSessionKey(mattermostUserID, sessionID), true, func(state *serializer.ConversationState) bool {
+		previousPostID = state.ActivePromptPostID
+		state.ActivePromptPostID = postID
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if previousPostID != "" && previousPostID != postID {
+		p.DisablePromptPost(previousPostID)
+	}
+
+	return nil
+}
+
+// IsActivePrompt returns whether the post is the latest question of the Virtual Agent in the session.
+// Posts of the sessions without a conversation state are allowed, as they were created before the state was tracked.
+// Once the state is tracked, only the unanswered latest question can be answered.
+func (p *Plugin) IsActivePrompt(mattermostUserID, sessionID, postID string) (bool, error) {
+	state, err := p.store.LoadConversationState(getSessionKey(mattermostUserID, sessionID))
+	if err != nil {
+		if err == ErrNotFound {
+			return true, nil
+		}
+		return false, errors.Wrap(err, "failed to load the conversation state")
+	}
+
+	return state.ActivePromptPostID == postID, nil
+}
+
+// ClearActivePrompt marks the post as answered, so that it is not disabled when the next question arrives.
+func (p *Plugin) ClearActivePrompt(mattermostUserID, sessionID, postID string) error {
+	return p.updateConversationState(getSessionKey(mattermostUserID, sessionID), false, func(state *serializer.ConversationState) bool {
+		if state.ActivePromptPostID != postID {
+			return false
+		}
+
+		state.ActivePromptPostID = ""
+		return true
+	})
+}
+
+// EndActivePrompt disables the unanswered question of the session, as it can no longer be answered once the topic has finished.
+func (p *Plugin) EndActivePrompt(mattermostUserID, sessionID string) error {
+	var activePostID string
+	err := p.updateConversationState(getSessionKey(mattermostUserID, sessionID), false, func(state *serializer.ConversationState) bool {
+		activePostID = state.ActivePromptPostID
+		if activePostID == "" {
+			return false
+		}
+
+		state.ActivePromptPostID = ""
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if activePostID != "" {
+		p.DisablePromptPost(activePostID)
+	}
+
+	return nil
+}
+
+// DeleteUserSessions deletes the state of the Virtual Agent sessions of the user, so that a new connection of the user does not
+// continue a live agent chat or answer a masked input prompt of the old one. The buttons of the unanswered questions are removed.
+// Failures are only logged, so that the state of the other sessions is still deleted.
+func (p *Plugin) DeleteUserSessions(mattermostUserID string, sessionIDs []string) {
+	for _, sessionID := range sessionIDs {
+		sessionKey := getSessionKey(mattermostUserID, sessionID)
+		if state, err := p.store.LoadConversationState(sessionKey); err == nil && state.ActivePromptPostID != "" {
+			p.DisablePromptPost(state.ActivePromptPostID)
+		}
+
+		if err := p.store.DeleteSessionState(sessionKey); err != nil {
+			p.API.LogWarn("Failed to delete the state of the session", "UserID", mattermostUserID, "SessionID", sessionID, "Error", err.Error())
+		}
+	}
+
+	if err := p.store.DeleteUserSessions(mattermostUserID); err != nil {
+		p.API.LogWarn("Failed to delete the sessions of the user", "UserID", mattermostUserID, "Error", err.Error())
+	}
+}
+
+// DisablePromptPost removes the buttons of an unanswered question and marks it as no longer active.
+func (p *Plugin) DisablePromptPost(postID string) {
+	post, appErr := p.API.GetPost(postID)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get the post of the previous question", "PostID", postID, "Error", appErr.Message)
+		return
+	}
+
+	attachments := post.Attachments()
+	for _, attachment := range attachments {
+		attachment.Actions = nil
+	}
+	attachments = append(attachments, &model.SlackAttachment{
+		Text:  StalePromptPostMessage,
+		Color: updatedPostBorderColor,
+	})
+
+	model.ParseSlackAttachment(post, attachments)
+	if _, appErr = p.API.UpdatePost(post); appErr != nil {
+		p.API.LogWarn("Failed to disable the post of the previous question", "PostID", postID, "Error", appErr.Message)
+	}
+}
+
+// checkActivePrompt returns the ID of the Virtual Agent session of the post, along with the message to show to the user
+// when the post can not be answered. Answers are allowed when the conversation state can not be loaded,
+// so that the conversation is not blocked.
+func (p *Plugin) checkActivePrompt(mattermostUserID, postID string) (string, string) {
+	sessionID, channelID, err := p.GetPostSession(postID)
+	if err != nil {
+		p.API.LogError("Failed to get the session of the post", "PostID", postID, "Error", err.Error())
+		return "", GenericErrorMessage
+	}
+
+	isOwner, err := p.IsSessionOwner(mattermostUserID, sessionID, channelID)
+	if err != nil {
+		p.API.LogError("Failed to check the owner of the session", "UserID", mattermostUserID, "PostID", postID, "Error", err.Error())
+		return "", GenericErrorMessage
+	}
+
+	if !isOwner {
+		return sessionID, NotSessionOwnerMessage
+	}
+
+	active, err := p.IsActivePrompt(mattermostUserID, sessionID, postID)
+	if err != nil {
+		p.API.LogWarn("Failed to check the active prompt", "UserID", mattermostUserID, "PostID", postID, "Error", err.Error())
+		return sessionID, ""
+	}
+
+	if !active {
+		return sessionID, StalePromptMessage
+	}
+
+	return sessionID, ""
+}
+
+// answeredActivePrompt clears the active prompt of the session after the question has been answered.
+func (p *Plugin) answeredActivePrompt(mattermostUserID, sessionID, postID string) {
+	if err := p.ClearActivePrompt(mattermostUserID, sessionID, postID); err != nil {
+		p.API.LogWarn("Failed to clear the active prompt", "UserID", mattermostUserID, "PostID", postID, "Error", err.Error())
+	}
+}
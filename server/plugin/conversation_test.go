@@ -0,0 +1,446 @@
+package plugin
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/bluele/gcache"
+	"github.com/golang/mock/gomock"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	mock_plugin "github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/mocks"
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/testutils"
+)
+
+func TestPlugin_SetActivePrompt(t *testing.T) {
+	for _, testCase := range []struct {
+		description        string
+		state              *serializer.ConversationState
+		loadStateError     error
+		storeStateError    error
+		changedState       *serializer.ConversationState
+		isNotStored        bool
+		isPreviousDisabled bool
+		expectedError      string
+	}{
+		{
+			description: "Active prompt is set for a new conversation",
+			state:       nil,
+		},
+		{
+			description:        "Previous prompt is disabled",
+			state:              &serializer.ConversationState{ActivePromptPostID: "mockPreviousPostID"},
+			isPreviousDisabled: true,
+		},
+		{
+			description: "Answered prompt is not disabled",
+			state:       &serializer.ConversationState{},
+		},
+		{
+			description:    "Error while loading the conversation state",
+			loadStateError: errors.New("error in loading the state"),
+			expectedError:  "failed to load the conversation state: error in loading the state",
+		},
+		{
+			description:     "Error while storing the conversation state",
+			state:           &serializer.ConversationState{},
+			storeStateError: errors.New("error in storing the state"),
+			expectedError:   "failed to store the conversation state: error in storing the state",
+		},
+		{
+			description:        "Prompt is set on the conversation state changed in the meantime",
+			state:              &serializer.ConversationState{},
+			changedState:       &serializer.ConversationState{ActivePromptPostID: "mockPreviousPostID", ChannelID: "mockChannelID"},
+			isPreviousDisabled: true,
+		},
+		{
+			description:   "Error when the conversation state keeps being changed",
+			state:         &serializer.ConversationState{},
+			isNotStored:   true,
+			expectedError: "the conversation state was changed while storing it",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			mockAPI.On("GetPost", "mockPreviousPostID").Return(&model.Post{
+				Id: "mockPreviousPostID",
+				Props: model.StringInterface{
+					"attachments": []*model.SlackAttachment{
+						{
+							Text:    "mockText",
+							Actions: []*model.PostAction{{Name: "mockAction"}},
+						},
+					},
+				},
+			}, nil)
+			mockAPI.On("UpdatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+			p.SetAPI(mockAPI)
+
+			loadStateError := testCase.loadStateError
+			if testCase.state == nil && loadStateError == nil {
+				loadStateError = ErrNotFound
+			}
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			var oldData []byte
+			if testCase.state != nil {
+				oldData = []byte("mockOldData")
+			}
+			switch {
+			case testCase.loadStateError != nil:
+				mockedStore.EXPECT().LoadConversationStateRecord("mock-userID").Return(nil, nil, loadStateError)
+			case testCase.isNotStored:
+				mockedStore.EXPECT().LoadConversationStateRecord("mock-userID").Return(testCase.state, oldData, nil).Times(ConversationStateMaxAttempts)
+				mockedStore.EXPECT().CompareAndStoreConversationState("mock-userID", oldData, gomock.Any()).Return(false, nil).Times(ConversationStateMaxAttempts)
+			case testCase.changedState != nil:
+				// The state is stored only if it is not changed since it was loaded, otherwise the prompt is set on the reloaded state
+				gomock.InOrder(
+					mockedStore.EXPECT().LoadConversationStateRecord("mock-userID").Return(testCase.state, oldData, nil),
+					mockedStore.EXPECT().CompareAndStoreConversationState("mock-userID", oldData, gomock.Any()).Return(false, nil),
+					mockedStore.EXPECT().LoadConversationStateRecord("mock-userID").Return(testCase.changedState, []byte("mockChangedData"), nil),
+					mockedStore.EXPECT().CompareAndStoreConversationState("mock-userID", []byte("mockChangedData"), gomock.Any()).DoAndReturn(func(_ string, _ []byte, state *serializer.ConversationState) (bool, error) {
+						require.Equal(t, "mockPostID", state.ActivePromptPostID)
+						require.Equal(t, "mockChannelID", state.ChannelID)
+						return true, nil
+					}),
+				)
+			default:
+				mockedStore.EXPECT().LoadConversationStateRecord("mock-userID").Return(testCase.state, oldData, loadStateError)
+				mockedStore.EXPECT().CompareAndStoreConversationState("mock-userID", oldData, gomock.Any()).DoAndReturn(func(_ string, _ []byte, state *serializer.ConversationState) (bool, error) {
+					require.Equal(t, "mockPostID", state.ActivePromptPostID)
+					return testCase.storeStateError == nil, testCase.storeStateError
+				})
+			}
+			p.store = mockedStore
+
+			err := p.SetActivePrompt("mock-userID", "", "mockPostID")
+			if testCase.expectedError != "" {
+				require.EqualError(t, err, testCase.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+
+			if !testCase.isPreviousDisabled {
+				mockAPI.AssertNotCalled(t, "UpdatePost", mock.Anything)
+				return
+			}
+
+			updatedPost := mockAPI.Calls[len(mockAPI.Calls)-1].Arguments.Get(0).(*model.Post)
+			attachments := updatedPost.Attachments()
+			require.Len(t, attachments, 2)
+			require.Empty(t, attachments[0].Actions)
+			require.Equal(t, StalePromptPostMessage, attachments[1].Text)
+		})
+	}
+}
+
+func TestPlugin_IsActivePrompt(t *testing.T) {
+	for _, testCase := range []struct {
+		description    string
+		state          *serializer.ConversationState
+		loadStateError error
+		expectedActive bool
+		expectedError  string
+	}{
+		{
+			description:    "Prompt is active when the conversation state is not tracked",
+			loadStateError: ErrNotFound,
+			expectedActive: true,
+		},
+		{
+			description:    "Prompt is active when it is the latest prompt",
+			state:          &serializer.ConversationState{ActivePromptPostID: "mockPostID"},
+			expectedActive: true,
+		},
+		{
+			description: "Prompt is not active when it has already been answered",
+			state:       &serializer.ConversationState{},
+		},
+		{
+			description: "Prompt is stale when a newer prompt has been posted",
+			state:       &serializer.ConversationState{ActivePromptPostID: "mockNewPostID"},
+		},
+		{
+			description:    "Error while loading the conversation state",
+			loadStateError: errors.New("error in loading the state"),
+			expectedError:  "failed to load the conversation state: error in loading the state",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().LoadConversationState("mock-userID").Return(testCase.state, testCase.loadStateError)
+			p.store = mockedStore
+
+			active, err := p.IsActivePrompt("mock-userID", "", "mockPostID")
+			if testCase.expectedError != "" {
+				require.EqualError(t, err, testCase.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, testCase.expectedActive, active)
+		})
+	}
+}
+
+func TestPlugin_ClearActivePrompt(t *testing.T) {
+	for _, testCase := range []struct {
+		description     string
+		state           *serializer.ConversationState
+		loadStateError  error
+		isStoreExpected bool
+	}{
+		{
+			description:    "Nothing is done when the conversation state is not tracked",
+			loadStateError: ErrNotFound,
+		},
+		{
+			description: "Nothing is done when another prompt is active",
+			state:       &serializer.ConversationState{ActivePromptPostID: "mockNewPostID"},
+		},
+		{
+			description:     "Answered prompt is cleared",
+			state:           &serializer.ConversationState{ActivePromptPostID: "mockPostID", ChannelID: "mockChannelID"},
+			isStoreExpected: true,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().LoadConversationStateRecord("mock-userID__mockSessionID").Return(testCase.state, []byte("mockOldData"), testCase.loadStateError)
+			if testCase.isStoreExpected {
+				mockedStore.EXPECT().CompareAndStoreConversationState("mock-userID__mockSessionID", []byte("mockOldData"), gomock.Any()).DoAndReturn(func(_ string, _ []byte, state *serializer.ConversationState) (bool, error) {
+					require.Empty(t, state.ActivePromptPostID)
+					require.Equal(t, "mockChannelID", state.ChannelID)
+					return true, nil
+				})
+			}
+			p.store = mockedStore
+
+			require.NoError(t, p.ClearActivePrompt("mock-userID", "mockSessionID", "mockPostID"))
+		})
+	}
+}
+
+func TestPlugin_EndActivePrompt(t *testing.T) {
+	for _, testCase := range []struct {
+		description     string
+		state           *serializer.ConversationState
+		loadStateError  error
+		storeStateError error
+		isStoreExpected bool
+		isDisabled      bool
+		expectedError   string
+	}{
+		{
+			description:    "Nothing is done when the conversation state is not tracked",
+			loadStateError: ErrNotFound,
+		},
+		{
+			description: "Nothing is done when there is no unanswered prompt",
+			state:       &serializer.ConversationState{},
+		},
+		{
+			description: "Active prompt is disabled and cleared",
+			state:       &serializer.ConversationState{ActivePromptPostID: "mockPostID"},
+			isDisabled:  true,
+		},
+		{
+			description:    "Error while loading the conversation state",
+			loadStateError: errors.New("error in loading the state"),
+			expectedError:  "failed to load the conversation state: error in loading the state",
+		},
+		{
+			description:     "Prompt is not disabled when the conversation state can not be stored",
+			state:           &serializer.ConversationState{ActivePromptPostID: "mockPostID"},
+			storeStateError: errors.New("error in storing the state"),
+			isStoreExpected: true,
+			expectedError:   "failed to store the conversation state: error in storing the state",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("GetPost", "mockPostID").Return(&model.Post{
+				Id: "mockPostID",
+				Props: model.StringInterface{
+					"attachments": []*model.SlackAttachment{
+						{
+							Text:    "mockText",
+							Actions: []*model.PostAction{{Name: "mockAction"}},
+						},
+					},
+				},
+			}, nil)
+			mockAPI.On("UpdatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+			p.SetAPI(mockAPI)
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().LoadConversationStateRecord("mock-userID__mockSessionID").Return(testCase.state, []byte("mockOldData"), testCase.loadStateError)
+			if testCase.isDisabled || testCase.isStoreExpected {
+				mockedStore.EXPECT().CompareAndStoreConversationState("mock-userID__mockSessionID", []byte("mockOldData"), gomock.Any()).DoAndReturn(func(_ string, _ []byte, state *serializer.ConversationState) (bool, error) {
+					require.Empty(t, state.ActivePromptPostID)
+					return testCase.storeStateError == nil, testCase.storeStateError
+				})
+			}
+			p.store = mockedStore
+
+			err := p.EndActivePrompt("mock-userID", "mockSessionID")
+			if testCase.expectedError != "" {
+				require.EqualError(t, err, testCase.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+
+			if !testCase.isDisabled {
+				mockAPI.AssertNotCalled(t, "UpdatePost", mock.Anything)
+				return
+			}
+
+			updatedPost := mockAPI.Calls[len(mockAPI.Calls)-1].Arguments.Get(0).(*model.Post)
+			attachments := updatedPost.Attachments()
+			require.Len(t, attachments, 2)
+			require.Empty(t, attachments[0].Actions)
+			require.Equal(t, StalePromptPostMessage, attachments[1].Text)
+		})
+	}
+}
+
+func Test_getSessionKey(t *testing.T) {
+	for _, testCase := range []struct {
+		description string
+		post        *model.Post
+		expectedKey string
+	}{
+		{
+			description: "Post outside of a thread starts a new session",
+			post:        &model.Post{Id: "mockPostID", UserId: "mock-userID"},
+			expectedKey: "mock-userID__mockPostID",
+		},
+		{
+			description: "Reply in a thread belongs to the session of the thread",
+			post:        &model.Post{Id: "mockPostID", RootId: "mockRootID", UserId: "mock-userID"},
+			expectedKey: "mock-userID__mockRootID",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			require.Equal(t, testCase.expectedKey, getSessionKey(testCase.post.UserId, getSessionID(testCase.post)))
+		})
+	}
+
+	t.Run("Conversation outside of the threads is kept with the user ID", func(t *testing.T) {
+		require.Equal(t, "mock-userID", getSessionKey("mock-userID", ""))
+	})
+}
+
+func TestPlugin_IsSessionOwner(t *testing.T) {
+	for _, testCase := range []struct {
+		description     string
+		channelName     string
+		state           *serializer.ConversationState
+		loadStateError  error
+		expectedIsOwner bool
+		expectedError   string
+	}{
+		{
+			description:     "User owns the sessions in the DM with the bot",
+			channelName:     "mock-botID__mock-userID",
+			expectedIsOwner: true,
+		},
+		{
+			description:     "User owns the session started in the channel",
+			channelName:     "mock-channel",
+			state:           &serializer.ConversationState{ChannelID: "mockChannelID"},
+			expectedIsOwner: true,
+		},
+		{
+			description: "User does not own the session started in another channel",
+			channelName: "mock-channel",
+			state:       &serializer.ConversationState{ChannelID: "mockOtherChannelID"},
+		},
+		{
+			description:    "User has not started the session",
+			channelName:    "mock-channel",
+			loadStateError: ErrNotFound,
+		},
+		{
+			description:    "Error while loading the conversation state",
+			channelName:    "mock-channel",
+			loadStateError: errors.New("error in loading the state"),
+			expectedError:  "failed to load the conversation state: error in loading the state",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{
+				channelCache: gcache.New(1).Build(),
+				botUserID:    "mock-botID",
+			}
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("GetChannel", "mockChannelID").Return(&model.Channel{Id: "mockChannelID", Name: testCase.channelName}, nil)
+			p.SetAPI(mockAPI)
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().LoadConversationState("mock-userID__mockSessionID").Return(testCase.state, testCase.loadStateError).MaxTimes(1)
+			p.store = mockedStore
+
+			isOwner, err := p.IsSessionOwner("mock-userID", "mockSessionID", "mockChannelID")
+			if testCase.expectedError != "" {
+				require.EqualError(t, err, testCase.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedIsOwner, isOwner)
+		})
+	}
+}
+
+func TestPlugin_DeleteUserSessions(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	t.Run("State of all the sessions is deleted and the unanswered questions are disabled", func(t *testing.T) {
+		p := Plugin{}
+
+		mockAPI := &plugintest.API{}
+		defer mockAPI.AssertExpectations(t)
+		mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 7)...).Return().Once()
+		p.SetAPI(mockAPI)
+
+		mockCtrl := gomock.NewController(t)
+		mockedStore := mock_plugin.NewMockStore(mockCtrl)
+		mockedStore.EXPECT().LoadConversationState("mock-userID").Return(nil, ErrNotFound)
+		mockedStore.EXPECT().LoadConversationState("mock-userID__mockSessionID").Return(&serializer.ConversationState{ActivePromptPostID: "mockPromptPostID"}, nil)
+		mockedStore.EXPECT().DeleteSessionState("mock-userID").Return(errors.New("error in deleting the state"))
+		mockedStore.EXPECT().DeleteSessionState("mock-userID__mockSessionID").Return(nil)
+		mockedStore.EXPECT().DeleteUserSessions("mock-userID").Return(nil)
+		p.store = mockedStore
+
+		var disabledPostIDs []string
+		monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DisablePromptPost", func(_ *Plugin, postID string) {
+			disabledPostIDs = append(disabledPostIDs, postID)
+		})
+
+		// A failure in one session does not stop deleting the state of the others
+		p.DeleteUserSessions("mock-userID", []string{"", "mockSessionID"})
+
+		require.Equal(t, []string{"mockPromptPostID"}, disabledPostIDs)
+	})
+}
@@ -8,6 +8,9 @@ import (
 
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
 )
 
 type FileStruct struct {
@@ -21,31 +24,25 @@ func (p *Plugin) MessageHasBeenPosted(_ *plugin.Context, post *model.Post) {
 		return
 	}
 
-	isBotDMChannel := true
-	cacheVal, err := p.channelCache.Get(post.ChannelId)
-	if err == nil {
-		isBotDMChannel, _ = cacheVal.(bool)
-	} else {
-		channel, channelErr := p.API.GetChannel(post.ChannelId)
-		if channelErr != nil {
-			p.API.LogError("Error occurred while fetching the channel by ID. ChannelID: %s. Error: %s", post.ChannelId, channelErr.Error())
-			return
-		}
+	isBotDMChannel, err := p.isBotDMChannel(post.ChannelId)
+	if err != nil {
+		p.API.LogError("Error occurred while fetching the channel by ID. ChannelID: %s. Error: %s", post.ChannelId, err.Error())
+		return
+	}
 
-		channelNameArr := strings.Split(channel.Name, "__")
-		if len(channelNameArr) != 2 || (channelNameArr[0] != p.botUserID && channelNameArr[1] != p.botUserID) {
-			isBotDMChannel = false
+	// Posts of the other channels are sent to the Virtual Agent only when the user talks to the bot by mentioning it
+	if !isBotDMChannel {
+		isSessionPost, sessionErr := p.IsChannelSessionPost(post)
+		if sessionErr != nil {
+			p.API.LogError("Error occurred while checking the post of the channel", "PostID", post.Id, "Error", sessionErr.Error())
+			return
 		}
 
-		if err = p.channelCache.SetWithExpire(post.ChannelId, isBotDMChannel, time.Minute*time.Duration(ChannelCacheTTL)); err != nil {
-			p.API.LogDebug("Failed to add channel in cache", "Error", err.Error())
+		if !isSessionPost {
+			return
 		}
 	}
 
-	if !isBotDMChannel {
-		return
-	}
-
 	mattermostUserID := post.UserId
 	// Check if the user is connected to ServiceNow
 	user, err := p.GetUser(mattermostUserID)
@@ -58,13 +55,15 @@ func (p *Plugin) MessageHasBeenPosted(_ *plugin.Context, post *model.Post) {
 		return
 	}
 
-	if strings.ToLower(post.Message) == DisconnectKeyword {
+	if isBotDMChannel && strings.ToLower(post.Message) == DisconnectKeyword {
 		_, _ = p.DMWithAttachments(post.UserId, p.CreateDisconnectUserAttachment())
 		return
 	}
 
-	if len(post.FileIds) > 1 {
-		p.logAndSendErrorToUser(mattermostUserID, post.ChannelId, "Cannot send more than one file attachment at a time.")
+	if user.ReauthorizationRequired {
+		if err = p.RequestReauthorization(user, post.Id, nil); err != nil {
+			p.logAndSendErrorToUser(mattermostUserID, post.ChannelId, fmt.Sprintf("Error occurred while requesting re-authorization. Error: %s", err.Error()))
+		}
 		return
 	}
 
@@ -74,17 +73,270 @@ func (p *Plugin) MessageHasBeenPosted(_ *plugin.Context, post *model.Post) {
 		return
 	}
 
-	var attachment *MessageAttachment
-	if len(post.FileIds) == 1 {
-		attachment, err = p.CreateMessageAttachment(post.FileIds[0], mattermostUserID)
-		if err != nil {
-			p.logAndSendErrorToUser(mattermostUserID, post.ChannelId, err.Error())
+	instance, err := p.getConfiguration().getInstance(user.InstanceName)
+	if err != nil {
+		p.logAndSendErrorToUser(mattermostUserID, post.ChannelId, fmt.Sprintf("Error occurred while getting the ServiceNow instance. Error: %s", err.Error()))
+		return
+	}
+
+	if !isBotDMChannel {
+		if err = p.SetSessionChannel(mattermostUserID, getSessionID(post), post.ChannelId); err != nil {
+			p.logAndSendErrorToUser(mattermostUserID, post.ChannelId, fmt.Sprintf("Error occurred while starting the conversation in the channel. Error: %s", err.Error()))
 			return
 		}
+
+		post = post.Clone()
+		post.Message = removeBotMention(post.Message)
 	}
 
-	client := p.MakeClient(context.Background(), token)
-	if err = client.SendMessageToVirtualAgentAPI(user.UserID, post.Message, true, attachment); err != nil {
+	client := p.MakeClient(context.Background(), instance, token, mattermostUserID)
+	if err = p.SendPostToVirtualAgent(client, user, post); err != nil {
+		var unauthorizedErr *UnauthorizedError
+		if errors.As(err, &unauthorizedErr) {
+			var progress *serializer.PendingPostProgress
+			var partiallySentErr *PartiallySentPostError
+			if errors.As(err, &partiallySentErr) {
+				progress = partiallySentErr.Progress
+			}
+
+			if err = p.RequestReauthorization(user, post.Id, progress); err == nil {
+				return
+			}
+		}
+
 		p.logAndSendErrorToUser(mattermostUserID, post.ChannelId, err.Error())
 	}
 }
+
+// isBotDMChannel returns whether the channel is the DM of a user with the bot.
+// The result is cached, as it is checked for every post.
+func (p *Plugin) isBotDMChannel(channelID string) (bool, error) {
+	if cacheVal, err := p.channelCache.Get(channelID); err == nil {
+		isBotDMChannel, _ := cacheVal.(bool)
+		return isBotDMChannel, nil
+	}
+
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return false, appErr
+	}
+
+	isBotDMChannel := true
+	channelNameArr := strings.Split(channel.Name, "__")
+	if len(channelNameArr) != 2 || (channelNameArr[0] != p.botUserID && channelNameArr[1] != p.botUserID) {
+		isBotDMChannel = false
+	}
+
+	if err := p.channelCache.SetWithExpire(channelID, isBotDMChannel, time.Minute*time.Duration(ChannelCacheTTL)); err != nil {
+		p.API.LogDebug("Failed to add channel in cache", "Error", err.Error())
+	}
+
+	return isBotDMChannel, nil
+}
+
+// MessageWillBePosted rejects the post when it answers a question asking for a sensitive value, so that the value is never stored
+// on the server nor shown in the channel. The value is sent to the Virtual Agent in the background, so that posting is not held up.
+func (p *Plugin) MessageWillBePosted(_ *plugin.Context, post *model.Post) (*model.Post, string) {
+	if post.UserId == p.botUserID {
+		return post, ""
+	}
+
+	sessionID, isMasked := p.GetMaskedInputSession(post)
+	if !isMasked {
+		return post, ""
+	}
+
+	go p.SendMaskedInputPost(post.Clone(), sessionID)
+	return nil, MaskedInputRejectionReason
+}
+
+// GetMaskedInputSession returns the Virtual Agent session which is waiting for a sensitive value from the user, if the post answers it.
+// Only the posts of the DM with the bot and the thread replies of the channels allowed for mentions can answer a question.
+// A reply answers the prompt of its thread. Any other post of the DM answers the latest prompt of the DM wherever it is posted,
+// as the ID of a root post is not assigned yet when the post is checked.
+func (p *Plugin) GetMaskedInputSession(post *model.Post) (string, bool) {
+	isBotDMChannel, err := p.isBotDMChannel(post.ChannelId)
+	if err != nil {
+		p.API.LogWarn("Failed to get the channel of the post", "ChannelID", post.ChannelId, "Error", err.Error())
+		return "", false
+	}
+
+	if !isBotDMChannel && (post.RootId == "" || !p.getConfiguration().isMentionEnabled()) {
+		return "", false
+	}
+
+	if post.RootId != "" {
+		isMasked, loadErr := p.store.LoadMaskedInputPrompt(getSessionKey(post.UserId, post.RootId))
+		if loadErr != nil {
+			p.API.LogWarn("Failed to load the masked input prompt", "UserID", post.UserId, "Error", loadErr.Error())
+			return "", false
+		}
+
+		if isMasked || !isBotDMChannel {
+			return post.RootId, isMasked
+		}
+	}
+
+	sessionID, err := p.store.LoadDMMaskedInputSession(post.UserId)
+	if err != nil {
+		if err != ErrNotFound {
+			p.API.LogWarn("Failed to load the session of the masked input prompt", "UserID", post.UserId, "Error", err.Error())
+		}
+		return "", false
+	}
+
+	isMasked, err := p.store.LoadMaskedInputPrompt(getSessionKey(post.UserId, sessionID))
+	if err != nil {
+		p.API.LogWarn("Failed to load the masked input prompt", "UserID", post.UserId, "Error", err.Error())
+		return "", false
+	}
+
+	return sessionID, isMasked
+}
+
+// SendMaskedInputPost sends the message of a post answering a question asking for a sensitive value to the Virtual Agent session.
+// The post itself is rejected, so the user is told whether the value could be sent.
+// The post is never stored for being sent again after the user reconnects their account.
+func (p *Plugin) SendMaskedInputPost(post *model.Post, sessionID string) {
+	mattermostUserID := post.UserId
+	user, err := p.GetUser(mattermostUserID)
+	if err != nil {
+		p.API.LogError("Error occurred while fetching the user", "UserID", mattermostUserID, "Error", err.Error())
+		p.Ephemeral(mattermostUserID, post.ChannelId, MaskedInputNotSentMessage)
+		return
+	}
+
+	// The user has already been asked to reconnect their account
+	if user.ReauthorizationRequired {
+		p.Ephemeral(mattermostUserID, post.ChannelId, MaskedInputNotSentMessage)
+		return
+	}
+
+	token, err := p.ParseAuthToken(user.OAuth2Token)
+	if err != nil {
+		p.API.LogError("Error occurred while decrypting token", "UserID", mattermostUserID, "Error", err.Error())
+		p.Ephemeral(mattermostUserID, post.ChannelId, MaskedInputNotSentMessage)
+		return
+	}
+
+	instance, err := p.getConfiguration().getInstance(user.InstanceName)
+	if err != nil {
+		p.API.LogError("Error occurred while getting the ServiceNow instance", "UserID", mattermostUserID, "Error", err.Error())
+		p.Ephemeral(mattermostUserID, post.ChannelId, MaskedInputNotSentMessage)
+		return
+	}
+
+	message := post.Message
+	if isBotDMChannel, _ := p.isBotDMChannel(post.ChannelId); !isBotDMChannel {
+		message = removeBotMention(message)
+	}
+
+	client := p.MakeClient(context.Background(), instance, token, mattermostUserID)
+	if err = client.SendMessageToVirtualAgentAPI(user.UserID, sessionID, message, true, nil); err != nil {
+		p.API.LogError("Error occurred while sending the masked input to the Virtual Agent", "UserID", mattermostUserID, "Error", err.Error())
+		var unauthorizedErr *UnauthorizedError
+		if errors.As(err, &unauthorizedErr) {
+			if err = p.RequestReauthorization(user, user.PendingPostID, user.PendingPostProgress); err != nil {
+				p.API.LogError("Error occurred while requesting re-authorization", "UserID", mattermostUserID, "Error", err.Error())
+			}
+		}
+		p.Ephemeral(mattermostUserID, post.ChannelId, MaskedInputNotSentMessage)
+		return
+	}
+
+	if err = p.store.DeleteMaskedInputPrompt(getSessionKey(mattermostUserID, sessionID)); err != nil {
+		p.API.LogWarn("Failed to delete the masked input prompt", "UserID", mattermostUserID, "Error", err.Error())
+	}
+
+	p.Ephemeral(mattermostUserID, post.ChannelId, MaskedInputDeletedMessage)
+}
+
+// PartiallySentPostError is returned when sending a post to the Virtual Agent is stopped after a part of the post was sent.
+// It keeps the parts of the post which are not sent yet.
+type PartiallySentPostError struct {
+	Err      error
+	Progress *serializer.PendingPostProgress
+}
+
+func (e *PartiallySentPostError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartiallySentPostError) Unwrap() error {
+	return e.Err
+}
+
+// SendPostToVirtualAgent sends the message and the file attachments of the post to the Virtual Agent session of the thread of the post.
+// The Virtual Agent accepts a single attachment in a message, so each file is sent in a separate message and the text of the post is sent
+// along with the first file. The files which fail to be sent are reported to the user, and the remaining files are still sent.
+func (p *Plugin) SendPostToVirtualAgent(client Client, user *serializer.User, post *model.Post) error {
+	sessionID := getSessionID(post)
+	// The sessions are kept track of, so that all of them are ended when the user disconnects
+	if err := p.store.AddUserSession(user.MattermostUserID, sessionID); err != nil {
+		p.API.LogWarn("Failed to add the session of the user", "UserID", user.MattermostUserID, "SessionID", sessionID, "Error", err.Error())
+	}
+
+	if len(post.FileIds) == 0 {
+		return client.SendMessageToVirtualAgentAPI(user.UserID, sessionID, post.Message, true, nil)
+	}
+
+	message := post.Message
+	isFailed := false
+	report := []string{FileSendReportMessage}
+	for index, fileID := range post.FileIds {
+		attachment, err := p.CreateMessageAttachment(fileID, post.UserId)
+		if err != nil {
+			p.API.LogWarn("Failed to create the attachment of the file", "FileID", fileID, "Error", err.Error())
+			report = append(report, fmt.Sprintf(FileNotSentMessage, p.getFileName(fileID), err.Error()))
+			isFailed = true
+			continue
+		}
+
+		if err = client.SendMessageToVirtualAgentAPI(user.UserID, sessionID, message, true, attachment); err != nil {
+			var unauthorizedErr *UnauthorizedError
+			if errors.As(err, &unauthorizedErr) {
+				// The files which failed before are already reported to the user, so only this and the next files are unsent
+				return &PartiallySentPostError{
+					Err: err,
+					Progress: &serializer.PendingPostProgress{
+						UnsentFileIDs: post.FileIds[index:],
+						IsMessageSent: message == "",
+					},
+				}
+			}
+
+			p.API.LogWarn("Failed to send the file to the Virtual Agent", "FileID", fileID, "Error", err.Error())
+			report = append(report, fmt.Sprintf(FileNotSentMessage, attachment.FileName, FileSendError))
+			isFailed = true
+			continue
+		}
+
+		message = ""
+		report = append(report, fmt.Sprintf(FileSentMessage, attachment.FileName))
+	}
+
+	if isFailed || len(post.FileIds) > 1 {
+		p.Ephemeral(post.UserId, post.ChannelId, strings.Join(report, "\n"))
+	}
+
+	// The text of the post is sent by itself when none of the files could be sent
+	if message != "" {
+		if err := client.SendMessageToVirtualAgentAPI(user.UserID, sessionID, message, true, nil); err != nil {
+			return &PartiallySentPostError{
+				Err:      err,
+				Progress: &serializer.PendingPostProgress{},
+			}
+		}
+	}
+
+	return nil
+}
+
+// getFileName returns the name of the file, or its ID when the file info can not be fetched.
+func (p *Plugin) getFileName(fileID string) string {
+	fileInfo, appErr := p.API.GetFileInfo(fileID)
+	if appErr != nil {
+		return fileID
+	}
+	return fileInfo.Name
+}
@@ -4,16 +4,20 @@ import (
 	"context"
 	"errors"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"bou.ke/monkey"
 	"github.com/bluele/gcache"
+	"github.com/golang/mock/gomock"
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
 	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/oauth2"
 
+	mock_plugin "github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/mocks"
 	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
 	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/testutils"
 )
@@ -31,6 +35,12 @@ func Test_MessageHasBeenPosted(t *testing.T) {
 		parseAuthTokenError               error
 		sendMessageToVirtualAgentAPIError error
 		createMessageAttachmentError      error
+		reauthorizationRequired           bool
+		requestReauthorizationError       error
+		isReauthorizationRequested        bool
+		isChannelPost                     bool
+		isChannelSessionPost              bool
+		expectedMessage                   string
 	}{
 		{
 			description: "Message is successfully sent to Virtual Agent when the channel is found in cache",
@@ -73,10 +83,41 @@ func Test_MessageHasBeenPosted(t *testing.T) {
 			Message:                           "mockMessage",
 		},
 		{
-			description:                  "Message is posted but failed to create message attachment",
+			description:                  "Message is sent to Virtual Agent but failed to create message attachment",
 			createMessageAttachmentError: errors.New("error in creating message attachment"),
 			Message:                      "mockMessage",
 		},
+		{
+			description:                "Message is posted but user needs re-authorization",
+			reauthorizationRequired:    true,
+			isReauthorizationRequested: true,
+			Message:                    "mockMessage",
+		},
+		{
+			description:                       "Message is posted but ServiceNow rejected the OAuth2 token",
+			sendMessageToVirtualAgentAPIError: &UnauthorizedError{Err: errors.New("token expired")},
+			isReauthorizationRequested:        true,
+			Message:                           "mockMessage",
+		},
+		{
+			description:                       "Message is posted, ServiceNow rejected the OAuth2 token and re-authorization failed",
+			sendMessageToVirtualAgentAPIError: &UnauthorizedError{Err: errors.New("token expired")},
+			requestReauthorizationError:       errors.New("error in storing the user in KVstore"),
+			isReauthorizationRequested:        true,
+			Message:                           "mockMessage",
+		},
+		{
+			description:          "Message mentioning the bot in a channel is sent to Virtual Agent without the mention",
+			Message:              "@servicenow-virtual-agent mockMessage",
+			isChannelPost:        true,
+			isChannelSessionPost: true,
+			expectedMessage:      "mockMessage",
+		},
+		{
+			description:   "Message of a channel which is not sent to Virtual Agent",
+			Message:       "mockMessage",
+			isChannelPost: true,
+		},
 	} {
 		t.Run(testCase.description, func(t *testing.T) {
 			p := Plugin{
@@ -87,15 +128,30 @@ func Test_MessageHasBeenPosted(t *testing.T) {
 			mockAPI := &plugintest.API{}
 			defer mockAPI.AssertExpectations(t)
 
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().AddUserSession(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+			p.store = mockedStore
+
 			monkey.PatchInstanceMethod(reflect.TypeOf(p.channelCache), "Get", func(_ *gcache.SimpleCache, _ interface{}) (interface{}, error) {
-				return true, testCase.cacheGetError
+				return !testCase.isChannelPost, testCase.cacheGetError
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "IsChannelSessionPost", func(_ *Plugin, _ *model.Post) (bool, error) {
+				return testCase.isChannelSessionPost, nil
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "SetSessionChannel", func(_ *Plugin, _, _, channelID string) error {
+				require.Equal(t, "mockChannelID", channelID)
+				return nil
 			})
 
 			monkey.PatchInstanceMethod(reflect.TypeOf(p.channelCache), "SetWithExpire", func(_ *gcache.SimpleCache, _ interface{}, _ interface{}, _ time.Duration) error {
 				return testCase.cacheSetError
 			})
 
-			if testCase.getChannelError != nil || testCase.parseAuthTokenError != nil || testCase.sendMessageToVirtualAgentAPIError != nil || (testCase.getUserError != nil && testCase.getUserError != ErrNotFound || testCase.createMessageAttachmentError != nil) {
+			isUnauthorizedError := testCase.sendMessageToVirtualAgentAPIError != nil && testCase.requestReauthorizationError == nil && testCase.isReauthorizationRequested
+			if testCase.getChannelError != nil || testCase.parseAuthTokenError != nil || (testCase.sendMessageToVirtualAgentAPIError != nil && !isUnauthorizedError) || (testCase.getUserError != nil && testCase.getUserError != ErrNotFound) {
 				mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 6)...).Return()
 			}
 
@@ -106,6 +162,15 @@ func Test_MessageHasBeenPosted(t *testing.T) {
 				}, testCase.getChannelError)
 			}
 
+			var unauthorizedErr *UnauthorizedError
+			if testCase.createMessageAttachmentError != nil || (testCase.sendMessageToVirtualAgentAPIError != nil && !errors.As(testCase.sendMessageToVirtualAgentAPIError, &unauthorizedErr)) {
+				mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			}
+
+			if testCase.createMessageAttachmentError != nil {
+				mockAPI.On("GetFileInfo", "mockFileID").Return(&model.FileInfo{Name: "mockFileName"}, nil)
+			}
+
 			if testCase.cacheSetError != nil {
 				mockAPI.On("LogDebug", testutils.GetMockArgumentsWithType("string", 3)...).Return()
 			}
@@ -113,7 +178,13 @@ func Test_MessageHasBeenPosted(t *testing.T) {
 			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "Ephemeral", func(_ *Plugin, _, _, _ string, _ ...interface{}) {})
 
 			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "GetUser", func(_ *Plugin, _ string) (*serializer.User, error) {
-				return &serializer.User{}, testCase.getUserError
+				return &serializer.User{ReauthorizationRequired: testCase.reauthorizationRequired}, testCase.getUserError
+			})
+
+			isReauthorizationRequested := false
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "RequestReauthorization", func(_ *Plugin, _ *serializer.User, _ string, _ *serializer.PendingPostProgress) error {
+				isReauthorizationRequested = true
+				return testCase.requestReauthorizationError
 			})
 
 			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DM", func(_ *Plugin, _, _ string, _ ...interface{}) (string, error) {
@@ -128,7 +199,7 @@ func Test_MessageHasBeenPosted(t *testing.T) {
 				return &oauth2.Token{}, testCase.parseAuthTokenError
 			})
 
-			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "MakeClient", func(_ *Plugin, _ context.Context, _ *oauth2.Token) Client {
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "MakeClient", func(_ *Plugin, _ context.Context, _ *ServiceNowInstance, _ *oauth2.Token, _ string) Client {
 				return &client{}
 			})
 
@@ -136,7 +207,9 @@ func Test_MessageHasBeenPosted(t *testing.T) {
 				return &MessageAttachment{}, testCase.createMessageAttachmentError
 			})
 
-			monkey.PatchInstanceMethod(reflect.TypeOf(&client{}), "SendMessageToVirtualAgentAPI", func(_ *client, _, _ string, _ bool, _ *MessageAttachment) error {
+			var sentMessage string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&client{}), "SendMessageToVirtualAgentAPI", func(_ *client, _, _, messageText string, _ bool, _ *MessageAttachment) error {
+				sentMessage = messageText
 				return testCase.sendMessageToVirtualAgentAPIError
 			})
 
@@ -150,6 +223,384 @@ func Test_MessageHasBeenPosted(t *testing.T) {
 			}
 
 			p.MessageHasBeenPosted(&plugin.Context{}, post)
+			require.Equal(t, testCase.isReauthorizationRequested, isReauthorizationRequested)
+			if testCase.isChannelPost {
+				require.Equal(t, testCase.expectedMessage, sentMessage)
+			}
+		})
+	}
+}
+
+func TestPlugin_MessageWillBePosted(t *testing.T) {
+	for _, testCase := range []struct {
+		description             string
+		userID                  string
+		rootID                  string
+		message                 string
+		isChannelPost           bool
+		isMentionEnabled        bool
+		isThreadChecked         bool
+		isThreadMasked          bool
+		isDMChecked             bool
+		dmSessionID             string
+		dmSessionError          error
+		isDMSessionMasked       bool
+		loadPromptError         error
+		reauthorizationRequired bool
+		sendMessageError        error
+		isPostRejected          bool
+		expectedSessionID       string
+		expectedSentMessage     string
+		expectedEphemeral       string
+	}{
+		{
+			description: "Post of the bot is not checked",
+			userID:      "mock-botID",
+		},
+		{
+			description:    "Post is kept when no masked input is requested in the DM",
+			isDMChecked:    true,
+			dmSessionError: ErrNotFound,
+		},
+		{
+			description:     "Post is kept when the masked input prompt can not be loaded",
+			isDMChecked:     true,
+			dmSessionID:     "mockSessionID",
+			loadPromptError: errors.New("error in loading the prompt"),
+		},
+		{
+			description: "Post is kept when the masked input prompt of the DM is already answered",
+			isDMChecked: true,
+			dmSessionID: "mockSessionID",
+		},
+		{
+			description:         "Root post of the DM is rejected and sent to the session of the masked input prompt of the DM",
+			message:             "mockSecret",
+			isDMChecked:         true,
+			dmSessionID:         "mockSessionID",
+			isDMSessionMasked:   true,
+			isPostRejected:      true,
+			expectedSessionID:   "mockSessionID",
+			expectedSentMessage: "mockSecret",
+			expectedEphemeral:   MaskedInputDeletedMessage,
+		},
+		{
+			description:         "Reply of the DM is rejected and sent to the session of its thread",
+			rootID:              "mockRootID",
+			message:             "mockSecret",
+			isThreadChecked:     true,
+			isThreadMasked:      true,
+			isPostRejected:      true,
+			expectedSessionID:   "mockRootID",
+			expectedSentMessage: "mockSecret",
+			expectedEphemeral:   MaskedInputDeletedMessage,
+		},
+		{
+			description:         "Reply in another thread of the DM is sent to the session of the masked input prompt of the DM",
+			rootID:              "mockRootID",
+			message:             "mockSecret",
+			isThreadChecked:     true,
+			isDMChecked:         true,
+			dmSessionID:         "mockSessionID",
+			isDMSessionMasked:   true,
+			isPostRejected:      true,
+			expectedSessionID:   "mockSessionID",
+			expectedSentMessage: "mockSecret",
+			expectedEphemeral:   MaskedInputDeletedMessage,
+		},
+		{
+			description:         "Thread reply of a channel is sent without the mention of the bot",
+			rootID:              "mockRootID",
+			message:             "@servicenow-virtual-agent mockSecret",
+			isChannelPost:       true,
+			isMentionEnabled:    true,
+			isThreadChecked:     true,
+			isThreadMasked:      true,
+			isPostRejected:      true,
+			expectedSessionID:   "mockRootID",
+			expectedSentMessage: "mockSecret",
+			expectedEphemeral:   MaskedInputDeletedMessage,
+		},
+		{
+			description:      "Thread reply of a channel is not matched with the masked input prompt of the DM",
+			rootID:           "mockRootID",
+			isChannelPost:    true,
+			isMentionEnabled: true,
+			isThreadChecked:  true,
+		},
+		{
+			description:      "Post of a channel outside of a thread is not checked",
+			isChannelPost:    true,
+			isMentionEnabled: true,
+		},
+		{
+			description:   "Post of a channel is not checked when mentions are disabled",
+			rootID:        "mockRootID",
+			isChannelPost: true,
+		},
+		{
+			description:             "Post is rejected without being sent when the user needs re-authorization",
+			message:                 "mockSecret",
+			isDMChecked:             true,
+			dmSessionID:             "mockSessionID",
+			isDMSessionMasked:       true,
+			reauthorizationRequired: true,
+			isPostRejected:          true,
+			expectedEphemeral:       MaskedInputNotSentMessage,
+		},
+		{
+			description:       "Post is rejected when it can not be sent to the Virtual Agent",
+			message:           "mockSecret",
+			isDMChecked:       true,
+			dmSessionID:       "mockSessionID",
+			isDMSessionMasked: true,
+			sendMessageError:  errors.New("error in sending the message"),
+			isPostRejected:    true,
+			expectedEphemeral: MaskedInputNotSentMessage,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			defer monkey.UnpatchAll()
+			p := Plugin{
+				channelCache: &gcache.SimpleCache{},
+				botUserID:    "mock-botID",
+			}
+
+			config := &configuration{}
+			if testCase.isMentionEnabled {
+				config.MentionChannels = "mockChannelID"
+			}
+			p.setConfiguration(config)
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			p.SetAPI(mockAPI)
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p.channelCache), "Get", func(_ *gcache.SimpleCache, _ interface{}) (interface{}, error) {
+				return !testCase.isChannelPost, nil
+			})
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			if testCase.isThreadChecked {
+				mockedStore.EXPECT().LoadMaskedInputPrompt("mock-userID__mockRootID").Return(testCase.isThreadMasked, nil)
+			}
+			if testCase.isDMChecked {
+				mockedStore.EXPECT().LoadDMMaskedInputSession("mock-userID").Return(testCase.dmSessionID, testCase.dmSessionError)
+				if testCase.dmSessionError == nil {
+					mockedStore.EXPECT().LoadMaskedInputPrompt(getSessionKey("mock-userID", testCase.dmSessionID)).Return(testCase.isDMSessionMasked, testCase.loadPromptError)
+				}
+			}
+			if testCase.expectedSentMessage != "" {
+				mockedStore.EXPECT().DeleteMaskedInputPrompt(getSessionKey("mock-userID", testCase.expectedSessionID)).Return(nil)
+			}
+			p.store = mockedStore
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "GetUser", func(_ *Plugin, _ string) (*serializer.User, error) {
+				return &serializer.User{ReauthorizationRequired: testCase.reauthorizationRequired}, nil
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "ParseAuthToken", func(_ *Plugin, _ string) (*oauth2.Token, error) {
+				return &oauth2.Token{}, nil
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "MakeClient", func(_ *Plugin, _ context.Context, _ *ServiceNowInstance, _ *oauth2.Token, _ string) Client {
+				return &client{}
+			})
+
+			var sentMessage, sentSessionID string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&client{}), "SendMessageToVirtualAgentAPI", func(_ *client, _, sessionID, messageText string, _ bool, _ *MessageAttachment) error {
+				if testCase.sendMessageError != nil {
+					return testCase.sendMessageError
+				}
+				sentMessage, sentSessionID = messageText, sessionID
+				return nil
+			})
+
+			// The value is sent in the background, and the user is always told about the result
+			ephemerals := make(chan string, 1)
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "Ephemeral", func(_ *Plugin, _, _, format string, _ ...interface{}) {
+				ephemerals <- format
+			})
+
+			userID := testCase.userID
+			if userID == "" {
+				userID = "mock-userID"
+			}
+			// The ID of a post is not assigned yet when the hook is run
+			post := &model.Post{
+				RootId:    testCase.rootID,
+				ChannelId: "mockChannelID",
+				UserId:    userID,
+				Message:   testCase.message,
+			}
+
+			returnedPost, reason := p.MessageWillBePosted(&plugin.Context{}, post)
+			if testCase.isPostRejected {
+				require.Nil(t, returnedPost)
+				require.Equal(t, MaskedInputRejectionReason, reason)
+				require.Equal(t, testCase.expectedEphemeral, <-ephemerals)
+			} else {
+				require.Equal(t, post, returnedPost)
+				require.Empty(t, reason)
+				require.Empty(t, ephemerals)
+			}
+			require.Equal(t, testCase.expectedSentMessage, sentMessage)
+			if testCase.expectedSentMessage != "" {
+				require.Equal(t, testCase.expectedSessionID, sentSessionID)
+			}
+		})
+	}
+}
+
+func TestPlugin_SendPostToVirtualAgent(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description       string
+		message           string
+		fileIDs           []string
+		attachmentErrors  map[string]error
+		sendErrors        map[string]error
+		expectedSent      []string
+		expectedReport    string
+		expectedError     string
+		expectedProgress  *serializer.PendingPostProgress
+		isLogWarnExpected bool
+	}{
+		{
+			description:  "Message without files is sent",
+			message:      "mockMessage",
+			expectedSent: []string{"mockMessage:"},
+		},
+		{
+			description:  "Single file is sent along with the message without a report",
+			message:      "mockMessage",
+			fileIDs:      []string{"mockFileID-1"},
+			expectedSent: []string{"mockMessage:mockFileName-1"},
+		},
+		{
+			description:  "Each file is sent in a separate message and reported",
+			message:      "mockMessage",
+			fileIDs:      []string{"mockFileID-1", "mockFileID-2"},
+			expectedSent: []string{"mockMessage:mockFileName-1", ":mockFileName-2"},
+			expectedReport: FileSendReportMessage +
+				"\n- **mockFileName-1**: Sent to the Virtual Agent." +
+				"\n- **mockFileName-2**: Sent to the Virtual Agent.",
+		},
+		{
+			description:       "Failed files are reported and the remaining files are sent",
+			message:           "mockMessage",
+			fileIDs:           []string{"mockFileID-1", "mockFileID-2", "mockFileID-3"},
+			attachmentErrors:  map[string]error{"mockFileID-1": errors.New("file is deleted from the server")},
+			sendErrors:        map[string]error{"mockFileName-3": errors.New("error in sending the message")},
+			expectedSent:      []string{"mockMessage:mockFileName-2"},
+			isLogWarnExpected: true,
+			expectedReport: FileSendReportMessage +
+				"\n- **mockFileName-1**: Not sent (file is deleted from the server)." +
+				"\n- **mockFileName-2**: Sent to the Virtual Agent." +
+				"\n- **mockFileName-3**: Not sent (error in sending the file to the Virtual Agent).",
+		},
+		{
+			description:       "Message is sent by itself when none of the files could be sent",
+			message:           "mockMessage",
+			fileIDs:           []string{"mockFileID-1"},
+			attachmentErrors:  map[string]error{"mockFileID-1": errors.New("file is deleted from the server")},
+			expectedSent:      []string{"mockMessage:"},
+			isLogWarnExpected: true,
+			expectedReport:    FileSendReportMessage + "\n- **mockFileName-1**: Not sent (file is deleted from the server).",
+		},
+		{
+			description:   "Sending is stopped when ServiceNow rejects the OAuth2 token",
+			message:       "mockMessage",
+			fileIDs:       []string{"mockFileID-1", "mockFileID-2"},
+			sendErrors:    map[string]error{"mockFileName-1": &UnauthorizedError{Err: errors.New("token expired")}},
+			expectedError: "serviceNow rejected the OAuth2 token: token expired",
+			expectedProgress: &serializer.PendingPostProgress{
+				UnsentFileIDs: []string{"mockFileID-1", "mockFileID-2"},
+			},
+		},
+		{
+			description:   "Files which are already sent are not kept when ServiceNow rejects the OAuth2 token",
+			message:       "mockMessage",
+			fileIDs:       []string{"mockFileID-1", "mockFileID-2"},
+			sendErrors:    map[string]error{"mockFileName-2": &UnauthorizedError{Err: errors.New("token expired")}},
+			expectedError: "serviceNow rejected the OAuth2 token: token expired",
+			expectedProgress: &serializer.PendingPostProgress{
+				UnsentFileIDs: []string{"mockFileID-2"},
+				IsMessageSent: true,
+			},
+		},
+		{
+			description:       "Message is kept when ServiceNow rejects the OAuth2 token after the files failed",
+			message:           "mockMessage",
+			fileIDs:           []string{"mockFileID-1"},
+			attachmentErrors:  map[string]error{"mockFileID-1": errors.New("file is deleted from the server")},
+			sendErrors:        map[string]error{"": &UnauthorizedError{Err: errors.New("token expired")}},
+			isLogWarnExpected: true,
+			expectedError:     "serviceNow rejected the OAuth2 token: token expired",
+			expectedProgress:  &serializer.PendingPostProgress{},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockAPI := &plugintest.API{}
+			defer mockAPI.AssertExpectations(t)
+			if testCase.isLogWarnExpected {
+				mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			}
+			mockAPI.On("GetFileInfo", "mockFileID-1").Return(&model.FileInfo{Name: "mockFileName-1"}, nil).Maybe()
+			p.SetAPI(mockAPI)
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().AddUserSession("mock-userID", "mockPostID").Return(nil)
+			p.store = mockedStore
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "CreateMessageAttachment", func(_ *Plugin, fileID, _ string) (*MessageAttachment, error) {
+				if err := testCase.attachmentErrors[fileID]; err != nil {
+					return nil, err
+				}
+				return &MessageAttachment{FileName: strings.Replace(fileID, "mockFileID", "mockFileName", 1)}, nil
+			})
+
+			var report string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "Ephemeral", func(_ *Plugin, _, _, format string, _ ...interface{}) {
+				report = format
+			})
+
+			var sent []string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&client{}), "SendMessageToVirtualAgentAPI", func(_ *client, _, _, messageText string, _ bool, attachment *MessageAttachment) error {
+				fileName := ""
+				if attachment != nil {
+					fileName = attachment.FileName
+				}
+				if err := testCase.sendErrors[fileName]; err != nil {
+					return err
+				}
+				sent = append(sent, messageText+":"+fileName)
+				return nil
+			})
+
+			err := p.SendPostToVirtualAgent(&client{}, &serializer.User{MattermostUserID: "mock-userID"}, &model.Post{
+				Id:      "mockPostID",
+				UserId:  "mock-userID",
+				Message: testCase.message,
+				FileIds: testCase.fileIDs,
+			})
+			if testCase.expectedError != "" {
+				require.EqualError(t, err, testCase.expectedError)
+				var partiallySentErr *PartiallySentPostError
+				require.True(t, errors.As(err, &partiallySentErr))
+				require.Equal(t, testCase.expectedProgress, partiallySentErr.Progress)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedSent, sent)
+			require.Equal(t, testCase.expectedReport, report)
 		})
 	}
 }
@@ -0,0 +1,337 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	htmlTagRegex          = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)([^<>]*>)?`)
+	htmlEntityRegex       = regexp.MustCompile(`&(#[0-9]+|#x[0-9a-fA-F]+|[a-zA-Z][a-zA-Z0-9]*);`)
+	htmlWhitespaceRegex   = regexp.MustCompile(`[ \t\r\n\f]+`)
+	markdownNewLinesRegex = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlElements are the elements which are parsed as HTML. Anything else which looks like a tag, e.g. "Press <Enter> to continue",
+// is kept as text.
+var htmlElements = map[atom.Atom]bool{
+	atom.A: true, atom.Abbr: true, atom.Article: true, atom.Aside: true, atom.B: true, atom.Big: true, atom.Blockquote: true,
+	atom.Body: true, atom.Br: true, atom.Button: true, atom.Caption: true, atom.Center: true, atom.Cite: true, atom.Code: true,
+	atom.Col: true, atom.Colgroup: true, atom.Dd: true, atom.Del: true, atom.Div: true, atom.Dl: true, atom.Dt: true, atom.Em: true,
+	atom.Embed: true, atom.Figcaption: true, atom.Figure: true, atom.Font: true, atom.Footer: true, atom.Form: true, atom.H1: true,
+	atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true, atom.Head: true, atom.Header: true, atom.Hr: true,
+	atom.Html: true, atom.I: true, atom.Iframe: true, atom.Img: true, atom.Input: true, atom.Ins: true, atom.Kbd: true, atom.Label: true,
+	atom.Li: true, atom.Link: true, atom.Main: true, atom.Mark: true, atom.Math: true, atom.Meta: true, atom.Nav: true,
+	atom.Noscript: true, atom.Object: true, atom.Ol: true, atom.P: true, atom.Pre: true, atom.Q: true, atom.S: true, atom.Samp: true,
+	atom.Script: true, atom.Section: true, atom.Select: true, atom.Small: true, atom.Span: true, atom.Strike: true, atom.Strong: true,
+	atom.Style: true, atom.Sub: true, atom.Sup: true, atom.Svg: true, atom.Table: true, atom.Tbody: true, atom.Td: true,
+	atom.Template: true, atom.Textarea: true, atom.Tfoot: true, atom.Th: true, atom.Thead: true, atom.Title: true, atom.Tr: true,
+	atom.Tt: true, atom.U: true, atom.Ul: true, atom.Var: true,
+}
+
+// htmlToMarkdown converts the HTML sent by ServiceNow to Mattermost Markdown.
+// Relative links are resolved against baseURL, which is the URL of the ServiceNow instance.
+// Unsafe markup like scripts, forms and links with other schemes than http, https and mailto is dropped.
+// Text which does not contain any HTML is returned as it is.
+func htmlToMarkdown(text, baseURL string) string {
+	isHTML := false
+	escaped := htmlTagRegex.ReplaceAllStringFunc(text, func(tag string) string {
+		match := htmlTagRegex.FindStringSubmatch(tag)
+		if match[3] != "" && htmlElements[atom.Lookup([]byte(strings.ToLower(match[2])))] {
+			isHTML = true
+			return tag
+		}
+		return "&lt;" + tag[1:]
+	})
+
+	if !isHTML && !htmlEntityRegex.MatchString(text) {
+		return text
+	}
+
+	nodes, err := html.ParseFragment(strings.NewReader(escaped), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return text
+	}
+
+	c := &htmlConverter{baseURL: baseURL}
+	for _, node := range nodes {
+		c.convert(node)
+	}
+
+	return strings.TrimSpace(markdownNewLinesRegex.ReplaceAllString(c.buffer.String(), "\n\n"))
+}
+
+type htmlConverter struct {
+	buffer    bytes.Buffer
+	baseURL   string
+	listDepth int
+	linkDepth int
+	inPre     bool
+}
+
+func (c *htmlConverter) convert(node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		c.writeText(node.Data)
+	case html.ElementNode:
+		c.convertElement(node)
+	case html.DocumentNode:
+		c.convertChildren(node)
+	}
+}
+
+func (c *htmlConverter) convertChildren(node *html.Node) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		c.convert(child)
+	}
+}
+
+func (c *htmlConverter) convertElement(node *html.Node) {
+	switch node.DataAtom {
+	case atom.Script, atom.Style, atom.Iframe, atom.Object, atom.Embed, atom.Form, atom.Input, atom.Button,
+		atom.Select, atom.Textarea, atom.Head, atom.Title, atom.Noscript, atom.Svg, atom.Math, atom.Template:
+		return
+	case atom.B, atom.Strong:
+		c.wrap(node, "**")
+	case atom.I, atom.Em:
+		c.wrap(node, "_")
+	case atom.S, atom.Strike, atom.Del:
+		c.wrap(node, "~~")
+	case atom.Code:
+		if c.inPre {
+			c.convertChildren(node)
+			return
+		}
+		c.wrap(node, "`")
+	case atom.Pre:
+		c.block()
+		c.buffer.WriteString("```\n")
+		c.inPre = true
+		c.convertChildren(node)
+		c.inPre = false
+		c.newLine()
+		c.buffer.WriteString("```")
+		c.block()
+	case atom.Br:
+		c.buffer.WriteString("\n")
+	case atom.Hr:
+		c.block()
+		c.buffer.WriteString("---")
+		c.block()
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		c.block()
+		c.buffer.WriteString(strings.Repeat("#", int(node.Data[1]-'0')) + " ")
+		c.convertChildren(node)
+		c.block()
+	case atom.Ul, atom.Ol:
+		c.convertList(node)
+	case atom.Li:
+		c.newLine()
+		c.buffer.WriteString("- ")
+		c.convertChildren(node)
+		c.newLine()
+	case atom.A:
+		c.convertLink(node)
+	case atom.Img:
+		src := resolveURL(getHTMLAttribute(node, "src"), c.baseURL)
+		alt := getHTMLAttribute(node, "alt")
+		if src != "" {
+			c.buffer.WriteString(fmt.Sprintf("![%s](%s)", escapeMarkdownLinkText(alt), escapeMarkdownURL(src)))
+		} else {
+			c.writeText(alt)
+		}
+	case atom.Blockquote:
+		c.block()
+		start := c.buffer.Len()
+		c.convertChildren(node)
+		quote := strings.TrimSpace(c.buffer.String()[start:])
+		c.buffer.Truncate(start)
+		c.buffer.WriteString("> " + strings.ReplaceAll(quote, "\n", "\n> "))
+		c.block()
+	case atom.Tr:
+		c.newLine()
+		c.convertChildren(node)
+		c.newLine()
+	case atom.Td, atom.Th:
+		c.convertChildren(node)
+		c.buffer.WriteString(" ")
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Table:
+		c.block()
+		c.convertChildren(node)
+		c.block()
+	default:
+		c.convertChildren(node)
+	}
+}
+
+func (c *htmlConverter) convertList(node *html.Node) {
+	if c.listDepth == 0 {
+		c.block()
+	}
+
+	indent := strings.Repeat("  ", c.listDepth)
+	c.listDepth++
+	index := 1
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.DataAtom != atom.Li {
+			c.convert(child)
+			continue
+		}
+
+		c.newLine()
+		if node.DataAtom == atom.Ol {
+			c.buffer.WriteString(fmt.Sprintf("%s%d. ", indent, index))
+			index++
+		} else {
+			c.buffer.WriteString(indent + "- ")
+		}
+		c.convertChildren(child)
+		c.newLine()
+	}
+	c.listDepth--
+
+	if c.listDepth == 0 {
+		c.block()
+	}
+}
+
+func (c *htmlConverter) convertLink(node *html.Node) {
+	start := c.buffer.Len()
+	c.linkDepth++
+	c.convertChildren(node)
+	c.linkDepth--
+	text := strings.TrimSpace(c.buffer.String()[start:])
+
+	href := resolveURL(getHTMLAttribute(node, "href"), c.baseURL)
+	if href == "" {
+		return
+	}
+
+	if text == "" {
+		text = escapeMarkdownLinkText(href)
+	}
+
+	c.buffer.Truncate(start)
+	c.buffer.WriteString(fmt.Sprintf("[%s](%s)", text, escapeMarkdownURL(href)))
+}
+
+// wrap surrounds the Markdown of the children of the node with the marker, e.g. "**" for bold text.
+func (c *htmlConverter) wrap(node *html.Node, marker string) {
+	start := c.buffer.Len()
+	c.convertChildren(node)
+	inner := c.buffer.String()[start:]
+	trimmed := strings.TrimSpace(inner)
+	if trimmed == "" {
+		return
+	}
+
+	// Markdown emphasis does not work when the marker is next to a space
+	leading := inner[:strings.Index(inner, trimmed)]
+	trailing := inner[len(leading)+len(trimmed):]
+	c.buffer.Truncate(start)
+	c.buffer.WriteString(leading + marker + trimmed + marker + trailing)
+}
+
+func (c *htmlConverter) writeText(text string) {
+	if c.inPre {
+		c.buffer.WriteString(text)
+		return
+	}
+
+	text = htmlWhitespaceRegex.ReplaceAllString(text, " ")
+	if c.linkDepth > 0 {
+		// Brackets in the text of a link would end the Markdown link early
+		text = escapeMarkdownLinkText(text)
+	}
+	if c.buffer.Len() == 0 || bytes.HasSuffix(c.buffer.Bytes(), []byte("\n")) {
+		text = strings.TrimLeft(text, " ")
+	}
+	c.buffer.WriteString(text)
+}
+
+// newLine makes sure that the next content starts on a new line.
+func (c *htmlConverter) newLine() {
+	if c.buffer.Len() > 0 && !bytes.HasSuffix(c.buffer.Bytes(), []byte("\n")) {
+		c.buffer.WriteString("\n")
+	}
+}
+
+// block makes sure that the next content is separated from the previous content by an empty line.
+func (c *htmlConverter) block() {
+	if c.buffer.Len() == 0 {
+		return
+	}
+
+	c.newLine()
+	if !bytes.HasSuffix(c.buffer.Bytes(), []byte("\n\n")) {
+		c.buffer.WriteString("\n")
+	}
+}
+
+func getHTMLAttribute(node *html.Node, key string) string {
+	for _, attribute := range node.Attr {
+		if attribute.Key == key {
+			return strings.TrimSpace(attribute.Val)
+		}
+	}
+	return ""
+}
+
+func isSafeURL(link string) bool {
+	parsedURL, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(parsedURL.Scheme) {
+	case "http", "https", "mailto":
+		return true
+	default:
+		return false
+	}
+}
+
+// resolveURL resolves the relative link against the base URL, which is the URL of the ServiceNow instance.
+// It returns an empty string if the link is not safe to show.
+func resolveURL(link, baseURL string) string {
+	if link == "" {
+		return ""
+	}
+
+	parsedURL, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+
+	if !parsedURL.IsAbs() && baseURL != "" {
+		parsedBaseURL, err := url.Parse(baseURL)
+		if err != nil {
+			return ""
+		}
+		parsedURL = parsedBaseURL.ResolveReference(parsedURL)
+	}
+
+	if !isSafeURL(parsedURL.String()) {
+		return ""
+	}
+
+	return parsedURL.String()
+}
+
+func escapeMarkdownLinkText(text string) string {
+	return strings.NewReplacer("[", "\\[", "]", "\\]").Replace(text)
+}
+
+func escapeMarkdownURL(link string) string {
+	return strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(link)
+}
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_htmlToMarkdown(t *testing.T) {
+	for _, testCase := range []struct {
+		description string
+		html        string
+		expected    string
+	}{
+		{
+			description: "Text without HTML is not changed",
+			html:        "mockText\nwith *Markdown* & 100% more",
+			expected:    "mockText\nwith *Markdown* & 100% more",
+		},
+		{
+			description: "Bold, italic and strikethrough text",
+			html:        "<b>bold</b> <em>italic </em><del>removed</del>",
+			expected:    "**bold** _italic_ ~~removed~~",
+		},
+		{
+			description: "Links with safe schemes are converted",
+			html:        `Open <a href="https://mock.service-now.com/incident?id=1">the incident</a> or <a href="mailto:mock@example.com"></a>`,
+			expected:    "Open [the incident](https://mock.service-now.com/incident?id=1) or [mailto:mock@example.com](mailto:mock@example.com)",
+		},
+		{
+			description: "Links with unsafe schemes are dropped",
+			html:        `<a href="javascript:alert(1)">Click here</a>`,
+			expected:    "Click here",
+		},
+		{
+			description: "Paragraphs and line breaks",
+			html:        "<p>First paragraph</p><p>Second<br>line</p>",
+			expected:    "First paragraph\n\nSecond\nline",
+		},
+		{
+			description: "Unordered and ordered lists",
+			html:        "Steps:<ol><li>Open the portal</li><li>Select <b>Report</b><ul><li>Nested</li></ul></li></ol>Done",
+			expected:    "Steps:\n\n1. Open the portal\n2. Select **Report**\n  - Nested\n\nDone",
+		},
+		{
+			description: "Headings and code",
+			html:        "<h3>Title</h3><pre><code>line 1\nline 2</code></pre>Use <code>reset</code>",
+			expected:    "### Title\n\n```\nline 1\nline 2\n```\n\nUse `reset`",
+		},
+		{
+			description: "Unsafe markup is stripped",
+			html:        `<script>alert("mock")</script><style>p {}</style><iframe src="https://mock.com"></iframe><form><input value="mock"></form>Safe text`,
+			expected:    "Safe text",
+		},
+		{
+			description: "Entities are decoded and whitespace is collapsed",
+			html:        "<div>Tom &amp;   Jerry\n  &lt;3</div>",
+			expected:    "Tom & Jerry <3",
+		},
+		{
+			description: "Images with safe links are converted",
+			html:        `<img src="https://mock.com/image.png" alt="mockImage"><img src="data:image/png;base64,mock" alt="mockData">`,
+			expected:    "![mockImage](https://mock.com/image.png)mockData",
+		},
+		{
+			description: "Relative links and images are resolved against the instance URL",
+			html:        `<a href="/sp?id=kb_article&sys_id=1">the article</a> <img src="image.png" alt="mockImage">`,
+			expected:    "[the article](https://mock.service-now.com/sp?id=kb_article&sys_id=1) ![mockImage](https://mock.service-now.com/image.png)",
+		},
+		{
+			description: "Brackets in the text of links are escaped",
+			html:        `<a href="https://mock.com">[INC0010001] <b>Printer</b></a>`,
+			expected:    "[\\[INC0010001\\] **Printer**](https://mock.com)",
+		},
+		{
+			description: "Image inside a link is kept",
+			html:        `<a href="https://mock.com"><img src="https://mock.com/image.png" alt="[mockImage]"></a>`,
+			expected:    "[![\\[mockImage\\]](https://mock.com/image.png)](https://mock.com)",
+		},
+		{
+			description: "Text which only looks like a tag is kept",
+			html:        "Press <Enter> to continue",
+			expected:    "Press <Enter> to continue",
+		},
+		{
+			description: "Text which looks like a tag is kept along with HTML",
+			html:        "<p>Press <Enter> to <b>continue</b></p>",
+			expected:    "Press <Enter> to **continue**",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			require.Equal(t, testCase.expected, htmlToMarkdown(testCase.html, "https://mock.service-now.com"))
+		})
+	}
+}
@@ -7,9 +7,11 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
 )
 
 type ErrorResponse struct {
@@ -21,6 +23,20 @@ type Error struct {
 	Message string `json:"message"`
 }
 
+// UnauthorizedError is returned when ServiceNow rejects the OAuth2 token of the user,
+// either because the access token is not accepted or because it can no longer be refreshed.
+type UnauthorizedError struct {
+	Err error
+}
+
+func (e *UnauthorizedError) Error() string {
+	return fmt.Sprintf("serviceNow rejected the OAuth2 token: %s", e.Err.Error())
+}
+
+func (e *UnauthorizedError) Unwrap() error {
+	return e.Err
+}
+
 func (c *client) CallJSON(method, path string, in, out interface{}, params url.Values) (responseData []byte, err error) {
 	contentType := "application/json"
 	buf := &bytes.Buffer{}
@@ -40,7 +56,7 @@ func (c *client) Call(method, path, contentType string, inBody io.Reader, out in
 
 	if pathURL.Scheme == "" || pathURL.Host == "" {
 		var baseURL *url.URL
-		baseURL, err = url.Parse(c.plugin.getConfiguration().ServiceNowURL)
+		baseURL, err = url.Parse(c.instance.URL)
 		if err != nil {
 			return nil, errors.WithMessage(err, errContext)
 		}
@@ -62,6 +78,9 @@ func (c *client) Call(method, path, contentType string, inBody io.Reader, out in
 	}
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		if isInvalidGrantError(err) {
+			return nil, &UnauthorizedError{Err: err}
+		}
 		return nil, err
 	}
 
@@ -92,9 +111,29 @@ func (c *client) Call(method, path, contentType string, inBody io.Reader, out in
 	errResp := ErrorResponse{}
 	err = json.Unmarshal(responseData, &errResp)
 	if err != nil {
-		return responseData, errors.WithMessagef(err, "status: %s", resp.Status)
+		err = errors.WithMessagef(err, "status: %s", resp.Status)
+	} else {
+		err = fmt.Errorf("errorMessage %s. errorDetail: %s", errResp.Error.Message, errResp.Error.Detail)
 	}
-	return responseData, fmt.Errorf("errorMessage %s. errorDetail: %s", errResp.Error.Message, errResp.Error.Detail)
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return responseData, &UnauthorizedError{Err: err}
+	}
+	return responseData, err
+}
+
+// isInvalidGrantError checks if the error occurred because ServiceNow refused to refresh the OAuth2 token.
+func isInvalidGrantError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+
+	if retrieveErr.Response != nil && retrieveErr.Response.StatusCode == http.StatusUnauthorized {
+		return true
+	}
+
+	return strings.Contains(string(retrieveErr.Body), InvalidGrantErrorCode)
 }
 
 func ReturnStatusOK(w io.Writer) {
@@ -1,7 +1,10 @@
 package plugin
 
 import (
+	"errors"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"testing"
@@ -9,6 +12,7 @@ import (
 	"bou.ke/monkey"
 	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 )
 
 func Test_CallJSON(t *testing.T) {
@@ -37,3 +41,100 @@ func Test_CallJSON(t *testing.T) {
 		})
 	}
 }
+
+func Test_Call(t *testing.T) {
+	for _, testCase := range []struct {
+		description    string
+		statusCode     int
+		responseBody   string
+		expectedErr    string
+		isUnauthorized bool
+	}{
+		{
+			description:  "Request is sent successfully",
+			statusCode:   http.StatusOK,
+			responseBody: `{}`,
+		},
+		{
+			description:    "ServiceNow rejects the OAuth2 token",
+			statusCode:     http.StatusUnauthorized,
+			responseBody:   `{"error": {"message": "User Not Authenticated", "detail": "Required to provide Auth information"}}`,
+			expectedErr:    "serviceNow rejected the OAuth2 token: errorMessage User Not Authenticated. errorDetail: Required to provide Auth information",
+			isUnauthorized: true,
+		},
+		{
+			description:  "ServiceNow returns an error",
+			statusCode:   http.StatusBadRequest,
+			responseBody: `{"error": {"message": "Invalid request", "detail": "mockDetail"}}`,
+			expectedErr:  "errorMessage Invalid request. errorDetail: mockDetail",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(testCase.statusCode)
+				_, _ = w.Write([]byte(testCase.responseBody))
+			}))
+			defer server.Close()
+
+			c := client{
+				httpClient: server.Client(),
+				plugin:     &Plugin{},
+			}
+
+			_, err := c.Call(http.MethodGet, server.URL, "", nil, nil, nil)
+			if testCase.expectedErr != "" {
+				require.EqualError(t, err, testCase.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			var unauthorizedErr *UnauthorizedError
+			require.Equal(t, testCase.isUnauthorized, errors.As(err, &unauthorizedErr))
+		})
+	}
+}
+
+func Test_isInvalidGrantError(t *testing.T) {
+	for _, testCase := range []struct {
+		description string
+		err         error
+		expected    bool
+	}{
+		{
+			description: "Refresh token is rejected with invalid_grant",
+			err: &url.Error{
+				Op:  "Get",
+				URL: "mockURL",
+				Err: &oauth2.RetrieveError{
+					Response: &http.Response{StatusCode: http.StatusBadRequest},
+					Body:     []byte(`{"error_description":"access_denied","error":"invalid_grant"}`),
+				},
+			},
+			expected: true,
+		},
+		{
+			description: "Refresh token is rejected with unauthorized status",
+			err: &oauth2.RetrieveError{
+				Response: &http.Response{StatusCode: http.StatusUnauthorized},
+			},
+			expected: true,
+		},
+		{
+			description: "Token endpoint returns a server error",
+			err: &oauth2.RetrieveError{
+				Response: &http.Response{StatusCode: http.StatusInternalServerError},
+				Body:     []byte("mockError"),
+			},
+			expected: false,
+		},
+		{
+			description: "Error is not related to the OAuth2 token",
+			err:         errors.New("connection refused"),
+			expected:    false,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			require.Equal(t, testCase.expected, isInvalidGrantError(testCase.err))
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultInstanceName is the name of the ServiceNow instance configured with the top level plugin settings.
+// Users connected before multiple instances were supported are connected to this instance.
+const DefaultInstanceName = ""
+
+var ErrInstanceNotFound = errors.New("ServiceNow instance not found")
+
+// ServiceNowInstance is a ServiceNow instance which the users of the configured teams and groups are connected to.
+type ServiceNowInstance struct {
+	Name              string   `json:"name"`
+	URL               string   `json:"url"`
+	OAuthClientID     string   `json:"oauth_client_id"`
+	OAuthClientSecret string   `json:"oauth_client_secret"`
+	WebhookSecret     string   `json:"webhook_secret"`
+	Teams             []string `json:"teams"`
+	Groups            []string `json:"groups"`
+}
+
+func (i *ServiceNowInstance) sanitize() {
+	i.Name = strings.TrimSpace(i.Name)
+	i.URL = strings.TrimRight(strings.TrimSpace(i.URL), "/")
+	i.OAuthClientID = strings.TrimSpace(i.OAuthClientID)
+	i.OAuthClientSecret = strings.TrimSpace(i.OAuthClientSecret)
+	i.WebhookSecret = strings.TrimSpace(i.WebhookSecret)
+}
+
+// IsValid checks if all needed fields of the instance are set.
+func (i *ServiceNowInstance) IsValid() error {
+	if i.Name == "" {
+		return fmt.Errorf(EmptyInstanceNameErrorMessage)
+	}
+	if i.URL == "" {
+		return fmt.Errorf("%s: %s", i.Name, EmptyServiceNowURLErrorMessage)
+	}
+	if i.OAuthClientID == "" {
+		return fmt.Errorf("%s: %s", i.Name, EmptyServiceNowOAuthClientIDErrorMessage)
+	}
+	if i.OAuthClientSecret == "" {
+		return fmt.Errorf("%s: %s", i.Name, EmptyServiceNowOAuthClientSecretErrorMessage)
+	}
+	if i.WebhookSecret == "" {
+		return fmt.Errorf("%s: %s", i.Name, EmptyWebhookSecretErrorMessage)
+	}
+	return nil
+}
+
+// parseServiceNowInstances parses the JSON list of the additional ServiceNow instances from the plugin settings.
+func parseServiceNowInstances(data string) ([]*ServiceNowInstance, error) {
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+
+	var instances []*ServiceNowInstance
+	if err := json.Unmarshal([]byte(data), &instances); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the ServiceNow instances")
+	}
+
+	for _, instance := range instances {
+		instance.sanitize()
+	}
+
+	return instances, nil
+}
+
+// GetInstanceForUser returns the ServiceNow instance which the user should connect to.
+// The first instance mapped to one of the teams or groups of the user is used, otherwise the user connects to the default instance.
+func (p *Plugin) GetInstanceForUser(mattermostUserID string) (*ServiceNowInstance, error) {
+	config := p.getConfiguration()
+	if len(config.Instances) == 0 {
+		return config.getInstance(DefaultInstanceName)
+	}
+
+	teams, groups, err := p.getUserTeamsAndGroups(mattermostUserID, config.Instances)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instance := range config.Instances {
+		for _, team := range instance.Teams {
+			if teams[team] {
+				return instance, nil
+			}
+		}
+
+		for _, group := range instance.Groups {
+			if groups[group] {
+				return instance, nil
+			}
+		}
+	}
+
+	if config.ServiceNowURL == "" {
+		return nil, errors.Wrap(ErrInstanceNotFound, "no ServiceNow instance is configured for the teams and groups of the user")
+	}
+
+	return config.getInstance(DefaultInstanceName)
+}
+
+// getUserTeamsAndGroups returns the names and IDs of the teams and groups of the user.
+// The teams and groups are fetched only if any instance is mapped to them.
+func (p *Plugin) getUserTeamsAndGroups(mattermostUserID string, instances []*ServiceNowInstance) (teams, groups map[string]bool, err error) {
+	teams = map[string]bool{}
+	groups = map[string]bool{}
+
+	var hasTeams, hasGroups bool
+	for _, instance := range instances {
+		hasTeams = hasTeams || len(instance.Teams) > 0
+		hasGroups = hasGroups || len(instance.Groups) > 0
+	}
+
+	if hasTeams {
+		userTeams, appErr := p.API.GetTeamsForUser(mattermostUserID)
+		if appErr != nil {
+			return nil, nil, errors.Wrap(appErr, fmt.Sprintf("failed to get the teams of the user. UserID: %s", mattermostUserID))
+		}
+
+		for _, team := range userTeams {
+			teams[team.Id] = true
+			teams[team.Name] = true
+		}
+	}
+
+	if hasGroups {
+		userGroups, appErr := p.API.GetGroupsForUser(mattermostUserID)
+		if appErr != nil {
+			return nil, nil, errors.Wrap(appErr, fmt.Sprintf("failed to get the groups of the user. UserID: %s", mattermostUserID))
+		}
+
+		for _, group := range userGroups {
+			groups[group.Id] = true
+			if group.Name != nil {
+				groups[*group.Name] = true
+			}
+		}
+	}
+
+	return teams, groups, nil
+}
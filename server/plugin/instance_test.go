@@ -0,0 +1,122 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseServiceNowInstances(t *testing.T) {
+	for _, testCase := range []struct {
+		description       string
+		data              string
+		expectedInstances []*ServiceNowInstance
+		expectedErr       bool
+	}{
+		{
+			description: "No instances are configured",
+			data:        " ",
+		},
+		{
+			description: "Instances are parsed and sanitized",
+			data:        `[{"name": " mock-instance ", "url": "https://mock.service-now.com/", "oauth_client_id": "mockClientID", "teams": ["mock-team"]}]`,
+			expectedInstances: []*ServiceNowInstance{
+				{Name: "mock-instance", URL: "https://mock.service-now.com", OAuthClientID: "mockClientID", Teams: []string{"mock-team"}},
+			},
+		},
+		{
+			description: "Invalid JSON",
+			data:        `{"name": "mock-instance"}`,
+			expectedErr: true,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			instances, err := parseServiceNowInstances(testCase.data)
+			if testCase.expectedErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedInstances, instances)
+		})
+	}
+}
+
+func TestPlugin_GetInstanceForUser(t *testing.T) {
+	groupName := "mock-group"
+	instances := []*ServiceNowInstance{
+		{Name: "team-instance", Teams: []string{"mock-team"}},
+		{Name: "group-instance", Groups: []string{groupName}},
+	}
+
+	for _, testCase := range []struct {
+		description          string
+		defaultURL           string
+		instances            []*ServiceNowInstance
+		teams                []*model.Team
+		groups               []*model.Group
+		teamsError           *model.AppError
+		expectedInstanceName string
+		expectedErr          string
+	}{
+		{
+			description:          "Default instance is used when no instances are configured",
+			defaultURL:           "mockURL",
+			expectedInstanceName: DefaultInstanceName,
+		},
+		{
+			description:          "Instance is chosen by the team of the user",
+			instances:            instances,
+			teams:                []*model.Team{{Id: "mock-teamID", Name: "mock-team"}},
+			expectedInstanceName: "team-instance",
+		},
+		{
+			description:          "Instance is chosen by the group of the user",
+			instances:            instances,
+			groups:               []*model.Group{{Id: "mock-groupID", Name: &groupName}},
+			expectedInstanceName: "group-instance",
+		},
+		{
+			description:          "Default instance is used when no instance matches",
+			defaultURL:           "mockURL",
+			instances:            instances,
+			expectedInstanceName: DefaultInstanceName,
+		},
+		{
+			description: "Error when no instance matches and there is no default instance",
+			instances:   instances,
+			expectedErr: "no ServiceNow instance is configured for the teams and groups of the user: ServiceNow instance not found",
+		},
+		{
+			description: "Error while getting the teams of the user",
+			instances:   instances,
+			teamsError:  &model.AppError{Message: "mockError"},
+			expectedErr: "failed to get the teams of the user. UserID: mock-userID: : mockError, ",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := &Plugin{}
+			p.setConfiguration(&configuration{
+				ServiceNowURL: testCase.defaultURL,
+				Instances:     testCase.instances,
+			})
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("GetTeamsForUser", "mock-userID").Return(testCase.teams, testCase.teamsError)
+			mockAPI.On("GetGroupsForUser", "mock-userID").Return(testCase.groups, nil)
+			p.SetAPI(mockAPI)
+
+			instance, err := p.GetInstanceForUser("mock-userID")
+			if testCase.expectedErr != "" {
+				require.EqualError(t, err, testCase.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedInstanceName, instance.Name)
+		})
+	}
+}
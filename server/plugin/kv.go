@@ -1,8 +1,12 @@
 package plugin
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
 	"github.com/pkg/errors"
 
@@ -11,13 +15,36 @@ import (
 )
 
 const (
-	UserKeyPrefix   = "user_"
-	OAuth2KeyPrefix = "oauth2_"
+	UserKeyPrefix         = "user_"
+	OAuth2KeyPrefix       = "oauth2_"
+	WebhookKeyPrefix      = "webhook_"
+	PromptKeyPrefix       = "prompt_"
+	LiveAgentPrefix       = "live_agent_"
+	ConversationKeyPrefix = "conversation_"
+	LockKeyPrefix         = "lock_"
+
+	WebhookSecretRotationKey = "webhook_secret_rotation"
 )
 
 const (
 	OAuth2KeyExpiration   = 15 * time.Minute
 	oAuth2StateTimeToLive = 300 // seconds
+
+	kvListPerPage = 100
+
+	// webhookResponseTimeToLive is the time for which the rendered parts of a webhook response are remembered.
+	webhookResponseTimeToLive = 24 * 60 * 60 // seconds
+
+	// webhookNonceTimeToLive covers the whole window in which a signed webhook request is accepted.
+	webhookNonceTimeToLive = 2 * WebhookSignatureTolerance // seconds
+
+	// maskedInputPromptTimeToLive is the time for which the messages of a user are treated as the answer to a masked prompt.
+	maskedInputPromptTimeToLive = 60 * 60 // seconds
+
+	// maxUserSessions is the number of the latest sessions of a user which are kept track of, to end them when the user disconnects.
+	maxUserSessions = 500
+	// userSessionsMaxAttempts is the maximum number of attempts to add a session of a user which are changed concurrently.
+	userSessionsMaxAttempts = 3
 )
 
 var ErrNotFound = kvstore.ErrNotFound
@@ -25,13 +52,21 @@ var ErrNotFound = kvstore.ErrNotFound
 type Store interface {
 	UserStore
 	OAuth2StateStore
+	WebhookStore
+	PromptStore
+	LiveAgentStore
+	ConversationStore
+	LockStore
 }
 
 type UserStore interface {
 	LoadUser(mattermostUserID string) (*serializer.User, error)
+	LoadUserRecord(mattermostUserID string) (*serializer.User, []byte, error)
 	StoreUser(user *serializer.User) error
 	DeleteUser(mattermostUserID string) error
+	CompareAndStoreUser(oldData []byte, user *serializer.User) (bool, error)
 	LoadUserWithSysID(mattermostUserID string) (*serializer.User, error)
+	GetAllUsers() ([]*serializer.User, error)
 }
 
 // OAuth2StateStore manages OAuth2 state
@@ -40,20 +75,74 @@ type OAuth2StateStore interface {
 	StoreOAuth2State(state string) error
 }
 
+// WebhookStore keeps track of the parts of the webhook responses which are already rendered
+type WebhookStore interface {
+	ClaimWebhookResponse(requestID string, index int) (bool, error)
+	ReleaseWebhookResponse(requestID string, index int) error
+	StoreWebhookNonce(nonce string) (bool, error)
+	LoadWebhookSecretRotation() (*serializer.WebhookSecretRotation, error)
+	StoreWebhookSecretRotation(rotation *serializer.WebhookSecretRotation) error
+}
+
+// PromptStore keeps track of the prompts of the Virtual Agent which are waiting for an answer from the user.
+// The prompts are kept per Virtual Agent session, with the key returned by getSessionKey.
+type PromptStore interface {
+	StoreMaskedInputPrompt(sessionKey string) error
+	LoadMaskedInputPrompt(sessionKey string) (bool, error)
+	DeleteMaskedInputPrompt(sessionKey string) error
+	StoreDMMaskedInputSession(mattermostUserID, sessionID string) error
+	LoadDMMaskedInputSession(mattermostUserID string) (string, error)
+}
+
+// LiveAgentStore keeps track of the chats of the users with the live agents, per Virtual Agent session
+type LiveAgentStore interface {
+	LoadLiveAgentChat(sessionKey string) (*serializer.LiveAgentChat, error)
+	StoreLiveAgentChat(sessionKey string, chat *serializer.LiveAgentChat) error
+	DeleteLiveAgentChat(sessionKey string) error
+}
+
+// ConversationStore keeps track of the state of the conversations of the users with the Virtual Agent, per Virtual Agent session,
+// along with the sessions of each user.
+type ConversationStore interface {
+	LoadConversationState(sessionKey string) (*serializer.ConversationState, error)
+	LoadConversationStateRecord(sessionKey string) (*serializer.ConversationState, []byte, error)
+	CompareAndStoreConversationState(sessionKey string, oldData []byte, state *serializer.ConversationState) (bool, error)
+	DeleteSessionState(sessionKey string) error
+	AddUserSession(mattermostUserID, sessionID string) error
+	LoadUserSessions(mattermostUserID string) ([]string, error)
+	DeleteUserSessions(mattermostUserID string) error
+}
+
+// LockStore keeps the locks shared by all the nodes of the cluster. Each lock expires by itself, in case its node dies while holding it.
+type LockStore interface {
+	TryLock(key string, value []byte, ttlSeconds int64) (bool, error)
+	Unlock(key string, value []byte) error
+}
+
 type pluginStore struct {
-	plugin   *Plugin
-	basicKV  kvstore.KVStore
-	oauth2KV kvstore.KVStore
-	userKV   kvstore.KVStore
+	plugin         *Plugin
+	basicKV        kvstore.KVStore
+	oauth2KV       kvstore.KVStore
+	userKV         kvstore.KVStore
+	webhookKV      kvstore.KVStore
+	promptKV       kvstore.KVStore
+	agentKV        kvstore.KVStore
+	conversationKV kvstore.KVStore
+	lockKV         kvstore.KVStore
 }
 
 func (p *Plugin) NewStore(api plugin.API) Store {
 	basicKV := kvstore.NewPluginStore(api)
 	return &pluginStore{
-		plugin:   p,
-		basicKV:  basicKV,
-		userKV:   kvstore.NewHashedKeyStore(basicKV, UserKeyPrefix),
-		oauth2KV: kvstore.NewHashedKeyStore(kvstore.NewOneTimePluginStore(api, OAuth2KeyExpiration), OAuth2KeyPrefix),
+		plugin:         p,
+		basicKV:        basicKV,
+		userKV:         kvstore.NewHashedKeyStore(basicKV, UserKeyPrefix),
+		oauth2KV:       kvstore.NewHashedKeyStore(kvstore.NewOneTimePluginStore(api, OAuth2KeyExpiration), OAuth2KeyPrefix),
+		webhookKV:      kvstore.NewHashedKeyStore(basicKV, WebhookKeyPrefix),
+		promptKV:       kvstore.NewHashedKeyStore(basicKV, PromptKeyPrefix),
+		agentKV:        kvstore.NewHashedKeyStore(basicKV, LiveAgentPrefix),
+		conversationKV: kvstore.NewHashedKeyStore(basicKV, ConversationKeyPrefix),
+		lockKV:         kvstore.NewHashedKeyStore(basicKV, LockKeyPrefix),
 	}
 }
 
@@ -66,6 +155,21 @@ func (s *pluginStore) LoadUser(mattermostUserID string) (*serializer.User, error
 	return &user, nil
 }
 
+// LoadUserRecord returns the user along with the stored record, which CompareAndStoreUser compares with.
+// The record is kept as stored, as the records written by the older versions of the plugin lack the newer fields.
+func (s *pluginStore) LoadUserRecord(mattermostUserID string) (*serializer.User, []byte, error) {
+	data, err := s.userKV.Load(mattermostUserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := serializer.User{}
+	if err = json.Unmarshal(data, &user); err != nil {
+		return nil, nil, err
+	}
+	return &user, data, nil
+}
+
 func (s *pluginStore) LoadUserWithSysID(userID string) (*serializer.User, error) {
 	user := serializer.User{}
 	err := kvstore.LoadJSON(s.userKV, userID, &user)
@@ -89,6 +193,30 @@ func (s *pluginStore) StoreUser(user *serializer.User) error {
 	return nil
 }
 
+// CompareAndStoreUser stores the user only if the stored record is still oldData, as returned by LoadUserRecord,
+// so that a change made in the meantime, like a refreshed OAuth2 token, is not overwritten.
+// It returns false if the stored record has changed.
+func (s *pluginStore) CompareAndStoreUser(oldData []byte, user *serializer.User) (bool, error) {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return false, err
+	}
+
+	stored, err := s.userKV.StoreWithOptions(user.MattermostUserID, data, model.PluginKVSetOptions{
+		Atomic:   true,
+		OldValue: oldData,
+	})
+	if err != nil || !stored {
+		return false, err
+	}
+
+	if err = kvstore.StoreJSON(s.userKV, user.UserID, user); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
 func (s *pluginStore) DeleteUser(mattermostUserID string) error {
 	u, err := s.LoadUser(mattermostUserID)
 	if err != nil {
@@ -99,9 +227,54 @@ func (s *pluginStore) DeleteUser(mattermostUserID string) error {
 		return err
 	}
 
+	if u.UserID != "" {
+		err = s.userKV.Delete(u.UserID)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// GetAllUsers returns all the connected users.
+// Each user is stored under both the Mattermost and the ServiceNow user ID, so the duplicate entries are skipped.
+func (s *pluginStore) GetAllUsers() ([]*serializer.User, error) {
+	var users []*serializer.User
+	loaded := map[string]bool{}
+	for page := 0; ; page++ {
+		keys, appErr := s.plugin.API.KVList(page, kvListPerPage)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to list the keys from KV store")
+		}
+
+		for _, key := range keys {
+			if !strings.HasPrefix(key, UserKeyPrefix) {
+				continue
+			}
+
+			user := serializer.User{}
+			if err := kvstore.LoadJSON(s.basicKV, key, &user); err != nil {
+				if err == ErrNotFound {
+					continue
+				}
+				return nil, err
+			}
+
+			if loaded[user.MattermostUserID] {
+				continue
+			}
+
+			loaded[user.MattermostUserID] = true
+			users = append(users, &user)
+		}
+
+		if len(keys) < kvListPerPage {
+			return users, nil
+		}
+	}
+}
+
 func (s *pluginStore) VerifyOAuth2State(state string) error {
 	data, err := s.oauth2KV.Load(state)
 	if err != nil {
@@ -120,3 +293,245 @@ func (s *pluginStore) VerifyOAuth2State(state string) error {
 func (s *pluginStore) StoreOAuth2State(state string) error {
 	return s.oauth2KV.StoreTTL(state, []byte(state), oAuth2StateTimeToLive)
 }
+
+// ClaimWebhookResponse atomically marks the part of the webhook response at the given index as rendered.
+// It returns false if the part was already claimed by an earlier delivery of the same response.
+func (s *pluginStore) ClaimWebhookResponse(requestID string, index int) (bool, error) {
+	return s.webhookKV.StoreWithOptions(getWebhookResponseKey(requestID, index), []byte{1}, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: webhookResponseTimeToLive,
+	})
+}
+
+// ReleaseWebhookResponse removes the claim on a part of the webhook response, so that it can be rendered by a retried delivery.
+func (s *pluginStore) ReleaseWebhookResponse(requestID string, index int) error {
+	return s.webhookKV.Delete(getWebhookResponseKey(requestID, index))
+}
+
+// StoreWebhookNonce atomically stores the nonce of a signed webhook request.
+// It returns false if the nonce was already used by another request.
+func (s *pluginStore) StoreWebhookNonce(nonce string) (bool, error) {
+	return s.webhookKV.StoreWithOptions(fmt.Sprintf("nonce_%s", nonce), []byte{1}, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: webhookNonceTimeToLive,
+	})
+}
+
+func (s *pluginStore) LoadWebhookSecretRotation() (*serializer.WebhookSecretRotation, error) {
+	rotation := serializer.WebhookSecretRotation{}
+	if err := kvstore.LoadJSON(s.basicKV, WebhookSecretRotationKey, &rotation); err != nil {
+		return nil, err
+	}
+	return &rotation, nil
+}
+
+func (s *pluginStore) StoreWebhookSecretRotation(rotation *serializer.WebhookSecretRotation) error {
+	return kvstore.StoreJSON(s.basicKV, WebhookSecretRotationKey, rotation)
+}
+
+// StoreMaskedInputPrompt marks that the Virtual Agent asked the user for a sensitive value in the session.
+func (s *pluginStore) StoreMaskedInputPrompt(sessionKey string) error {
+	return s.promptKV.StoreTTL(getMaskedInputPromptKey(sessionKey), []byte{1}, maskedInputPromptTimeToLive)
+}
+
+// LoadMaskedInputPrompt returns true if the Virtual Agent is waiting for a sensitive value from the user in the session.
+func (s *pluginStore) LoadMaskedInputPrompt(sessionKey string) (bool, error) {
+	if _, err := s.promptKV.Load(getMaskedInputPromptKey(sessionKey)); err != nil {
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *pluginStore) DeleteMaskedInputPrompt(sessionKey string) error {
+	return s.promptKV.Delete(getMaskedInputPromptKey(sessionKey))
+}
+
+// StoreDMMaskedInputSession keeps the session of the latest masked input prompt in the DM of the user with the bot.
+// The session ID is stored as JSON, as the conversation outside of the threads has an empty session ID.
+func (s *pluginStore) StoreDMMaskedInputSession(mattermostUserID, sessionID string) error {
+	data, err := json.Marshal(sessionID)
+	if err != nil {
+		return err
+	}
+	return s.promptKV.StoreTTL(getDMMaskedInputSessionKey(mattermostUserID), data, maskedInputPromptTimeToLive)
+}
+
+// LoadDMMaskedInputSession returns the session of the latest masked input prompt in the DM of the user with the bot.
+// The prompt of the session may already be answered, so it needs to be checked with LoadMaskedInputPrompt.
+func (s *pluginStore) LoadDMMaskedInputSession(mattermostUserID string) (string, error) {
+	var sessionID string
+	if err := kvstore.LoadJSON(s.promptKV, getDMMaskedInputSessionKey(mattermostUserID), &sessionID); err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+func (s *pluginStore) LoadLiveAgentChat(sessionKey string) (*serializer.LiveAgentChat, error) {
+	chat := serializer.LiveAgentChat{}
+	if err := kvstore.LoadJSON(s.agentKV, sessionKey, &chat); err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
+
+func (s *pluginStore) StoreLiveAgentChat(sessionKey string, chat *serializer.LiveAgentChat) error {
+	return kvstore.StoreJSON(s.agentKV, sessionKey, chat)
+}
+
+func (s *pluginStore) DeleteLiveAgentChat(sessionKey string) error {
+	return s.agentKV.Delete(sessionKey)
+}
+
+func (s *pluginStore) LoadConversationState(sessionKey string) (*serializer.ConversationState, error) {
+	state := serializer.ConversationState{}
+	if err := kvstore.LoadJSON(s.conversationKV, sessionKey, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// LoadConversationStateRecord returns the conversation state of the session along with its stored data,
+// which is passed to CompareAndStoreConversationState for updating the state.
+func (s *pluginStore) LoadConversationStateRecord(sessionKey string) (*serializer.ConversationState, []byte, error) {
+	data, err := s.conversationKV.Load(sessionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state := serializer.ConversationState{}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, nil, err
+	}
+	return &state, data, nil
+}
+
+// CompareAndStoreConversationState stores the conversation state of the session only if its stored data is still oldData.
+// A nil oldData stores the state only if there is none. It returns false if the state was changed in the meantime.
+func (s *pluginStore) CompareAndStoreConversationState(sessionKey string, oldData []byte, state *serializer.ConversationState) (bool, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return false, err
+	}
+
+	return s.conversationKV.StoreWithOptions(sessionKey, data, model.PluginKVSetOptions{
+		Atomic:   true,
+		OldValue: oldData,
+	})
+}
+
+// DeleteSessionState deletes the conversation state, the live agent chat and the masked input prompt of the session.
+func (s *pluginStore) DeleteSessionState(sessionKey string) error {
+	if err := s.conversationKV.Delete(sessionKey); err != nil {
+		return err
+	}
+
+	if err := s.agentKV.Delete(sessionKey); err != nil {
+		return err
+	}
+
+	return s.promptKV.Delete(getMaskedInputPromptKey(sessionKey))
+}
+
+// AddUserSession adds the session to the list of the sessions of the user, keeping the latest maxUserSessions of them.
+// The list is updated with compare-and-set, as the posts of a user can be handled on different nodes at the same time.
+func (s *pluginStore) AddUserSession(mattermostUserID, sessionID string) error {
+	key := getUserSessionsKey(mattermostUserID)
+	for attempt := 0; attempt < userSessionsMaxAttempts; attempt++ {
+		oldData, err := s.conversationKV.Load(key)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		var sessionIDs []string
+		if oldData != nil {
+			if err = json.Unmarshal(oldData, &sessionIDs); err != nil {
+				return err
+			}
+		}
+
+		for _, storedSessionID := range sessionIDs {
+			if storedSessionID == sessionID {
+				return nil
+			}
+		}
+
+		sessionIDs = append(sessionIDs, sessionID)
+		if len(sessionIDs) > maxUserSessions {
+			sessionIDs = sessionIDs[len(sessionIDs)-maxUserSessions:]
+		}
+
+		data, err := json.Marshal(sessionIDs)
+		if err != nil {
+			return err
+		}
+
+		stored, err := s.conversationKV.StoreWithOptions(key, data, model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: oldData,
+		})
+		if err != nil {
+			return err
+		}
+
+		if stored {
+			return nil
+		}
+	}
+
+	return errors.New("the sessions of the user were changed while adding the session")
+}
+
+func (s *pluginStore) LoadUserSessions(mattermostUserID string) ([]string, error) {
+	var sessionIDs []string
+	if err := kvstore.LoadJSON(s.conversationKV, getUserSessionsKey(mattermostUserID), &sessionIDs); err != nil {
+		if err == ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return sessionIDs, nil
+}
+
+func (s *pluginStore) DeleteUserSessions(mattermostUserID string) error {
+	return s.conversationKV.Delete(getUserSessionsKey(mattermostUserID))
+}
+
+func getUserSessionsKey(mattermostUserID string) string {
+	return fmt.Sprintf("sessions_%s", mattermostUserID)
+}
+
+func getMaskedInputPromptKey(sessionKey string) string {
+	return fmt.Sprintf("masked_%s", sessionKey)
+}
+
+func getDMMaskedInputSessionKey(mattermostUserID string) string {
+	return fmt.Sprintf("masked_dm_%s", mattermostUserID)
+}
+
+func getWebhookResponseKey(requestID string, index int) string {
+	return fmt.Sprintf("%s_%d", requestID, index)
+}
+
+// TryLock atomically stores the lock with the value identifying its holder. It returns false if the lock is already held.
+func (s *pluginStore) TryLock(key string, value []byte, ttlSeconds int64) (bool, error) {
+	return s.lockKV.StoreWithOptions(key, value, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: ttlSeconds,
+	})
+}
+
+// Unlock deletes the lock only if it is still held with the value, so that a lock which has expired and
+// has been acquired by another node is not released.
+func (s *pluginStore) Unlock(key string, value []byte) error {
+	_, err := s.lockKV.StoreWithOptions(key, nil, model.PluginKVSetOptions{
+		Atomic:   true,
+		OldValue: value,
+	})
+	return err
+}
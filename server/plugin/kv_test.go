@@ -1,9 +1,12 @@
 package plugin
 
 import (
+	"encoding/json"
 	"testing"
 
 	"bou.ke/monkey"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
 	"github.com/stretchr/testify/require"
 
 	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
@@ -80,3 +83,302 @@ func Test_StoreUser(t *testing.T) {
 		})
 	}
 }
+
+type mockKVStore struct {
+	kvstore.KVStore
+	values      map[string][]byte
+	deletedKeys []string
+	storedKeys  []string
+	storeOpts   model.PluginKVSetOptions
+	storedValue []byte
+	isStored    bool
+}
+
+func (m *mockKVStore) Load(key string) ([]byte, error) {
+	value, ok := m.values[key]
+	if !ok {
+		return nil, kvstore.ErrNotFound
+	}
+	return value, nil
+}
+
+func (m *mockKVStore) StoreWithOptions(key string, value []byte, opts model.PluginKVSetOptions) (bool, error) {
+	m.storedKeys = append(m.storedKeys, key)
+	m.storedValue = value
+	m.storeOpts = opts
+	return m.isStored, nil
+}
+
+func (m *mockKVStore) Delete(key string) error {
+	m.deletedKeys = append(m.deletedKeys, key)
+	return nil
+}
+
+func Test_DeleteUser(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description  string
+		user         serializer.User
+		expectedKeys []string
+	}{
+		{
+			description: "User is deleted from KV store using both mattermostID and ServiceNow ID",
+			user: serializer.User{
+				MattermostUserID: "mock-userID",
+				ServiceNowUser: serializer.ServiceNowUser{
+					UserID: "mock-sysID",
+				},
+			},
+			expectedKeys: []string{"mock-userID", "mock-sysID"},
+		},
+		{
+			description: "User without ServiceNow ID is deleted from KV store using mattermostID",
+			user: serializer.User{
+				MattermostUserID: "mock-userID",
+			},
+			expectedKeys: []string{"mock-userID"},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			userKV := &mockKVStore{}
+			s := pluginStore{
+				userKV: userKV,
+			}
+
+			monkey.Patch(kvstore.LoadJSON, func(_ kvstore.KVStore, _ string, v interface{}) error {
+				*(v.(*serializer.User)) = testCase.user
+				return nil
+			})
+
+			err := s.DeleteUser("mock-userID")
+
+			require.Nil(t, err)
+			require.Equal(t, testCase.expectedKeys, userKV.deletedKeys)
+		})
+	}
+}
+
+func Test_ClaimWebhookResponse(t *testing.T) {
+	for _, testCase := range []struct {
+		description string
+		isStored    bool
+	}{
+		{
+			description: "Webhook response is claimed for the first time",
+			isStored:    true,
+		},
+		{
+			description: "Webhook response is already claimed",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			webhookKV := &mockKVStore{isStored: testCase.isStored}
+			s := pluginStore{
+				webhookKV: webhookKV,
+			}
+
+			claimed, err := s.ClaimWebhookResponse("mock-requestID", 1)
+
+			require.Nil(t, err)
+			require.Equal(t, testCase.isStored, claimed)
+			require.Equal(t, []string{"mock-requestID_1"}, webhookKV.storedKeys)
+			require.True(t, webhookKV.storeOpts.Atomic)
+			require.Nil(t, webhookKV.storeOpts.OldValue)
+			require.Equal(t, int64(webhookResponseTimeToLive), webhookKV.storeOpts.ExpireInSeconds)
+		})
+	}
+}
+
+func Test_ReleaseWebhookResponse(t *testing.T) {
+	t.Run("Webhook response claim is deleted from KV store", func(t *testing.T) {
+		webhookKV := &mockKVStore{}
+		s := pluginStore{
+			webhookKV: webhookKV,
+		}
+
+		err := s.ReleaseWebhookResponse("mock-requestID", 1)
+
+		require.Nil(t, err)
+		require.Equal(t, []string{"mock-requestID_1"}, webhookKV.deletedKeys)
+	})
+}
+
+func Test_GetAllUsers(t *testing.T) {
+	t.Run("Users are listed from KV store without duplicates", func(t *testing.T) {
+		userJSON, err := json.Marshal(&serializer.User{
+			MattermostUserID: "mock-userID",
+			ServiceNowUser: serializer.ServiceNowUser{
+				UserID: "mock-sysID",
+			},
+		})
+		require.NoError(t, err)
+
+		// The first page is full, so the next page is requested as well
+		firstPage := []string{UserKeyPrefix + "mattermostID", UserKeyPrefix + "sysID"}
+		for len(firstPage) < kvListPerPage {
+			firstPage = append(firstPage, OAuth2KeyPrefix+"mockState")
+		}
+
+		mockAPI := &plugintest.API{}
+		mockAPI.On("KVList", 0, kvListPerPage).Return(firstPage, nil)
+		mockAPI.On("KVList", 1, kvListPerPage).Return([]string{UserKeyPrefix + "deleted"}, nil)
+
+		s := pluginStore{
+			plugin: &Plugin{},
+			basicKV: &mockKVStore{
+				values: map[string][]byte{
+					UserKeyPrefix + "mattermostID": userJSON,
+					UserKeyPrefix + "sysID":        userJSON,
+				},
+			},
+		}
+		s.plugin.SetAPI(mockAPI)
+
+		users, err := s.GetAllUsers()
+
+		require.Nil(t, err)
+		require.Len(t, users, 1)
+		require.Equal(t, "mock-userID", users[0].MattermostUserID)
+		mockAPI.AssertExpectations(t)
+	})
+}
+
+func Test_LoadMaskedInputPrompt(t *testing.T) {
+	for _, testCase := range []struct {
+		description string
+		values      map[string][]byte
+		isMasked    bool
+	}{
+		{
+			description: "Masked input prompt is found",
+			values:      map[string][]byte{"masked_mock-userID": {1}},
+			isMasked:    true,
+		},
+		{
+			description: "Masked input prompt is not found",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			s := pluginStore{
+				promptKV: &mockKVStore{values: testCase.values},
+			}
+
+			isMasked, err := s.LoadMaskedInputPrompt("mock-userID")
+
+			require.Nil(t, err)
+			require.Equal(t, testCase.isMasked, isMasked)
+		})
+	}
+}
+
+func Test_LoadDMMaskedInputSession(t *testing.T) {
+	for _, testCase := range []struct {
+		description       string
+		values            map[string][]byte
+		expectedSessionID string
+		expectedErr       error
+	}{
+		{
+			description:       "Session of the masked input prompt of the DM is found",
+			values:            map[string][]byte{"masked_dm_mock-userID": []byte(`"mockSessionID"`)},
+			expectedSessionID: "mockSessionID",
+		},
+		{
+			description: "Conversation outside of the threads is found",
+			values:      map[string][]byte{"masked_dm_mock-userID": []byte(`""`)},
+		},
+		{
+			description: "Session of the masked input prompt of the DM is not found",
+			expectedErr: ErrNotFound,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			s := pluginStore{
+				promptKV: &mockKVStore{values: testCase.values},
+			}
+
+			sessionID, err := s.LoadDMMaskedInputSession("mock-userID")
+
+			require.Equal(t, testCase.expectedErr, err)
+			require.Equal(t, testCase.expectedSessionID, sessionID)
+		})
+	}
+}
+
+func Test_DeleteSessionState(t *testing.T) {
+	t.Run("Conversation state, live agent chat and masked input prompt of the session are deleted", func(t *testing.T) {
+		conversationKV, agentKV, promptKV := &mockKVStore{}, &mockKVStore{}, &mockKVStore{}
+		s := pluginStore{
+			conversationKV: conversationKV,
+			agentKV:        agentKV,
+			promptKV:       promptKV,
+		}
+
+		err := s.DeleteSessionState("mock-userID__mockSessionID")
+
+		require.Nil(t, err)
+		require.Equal(t, []string{"mock-userID__mockSessionID"}, conversationKV.deletedKeys)
+		require.Equal(t, []string{"mock-userID__mockSessionID"}, agentKV.deletedKeys)
+		require.Equal(t, []string{"masked_mock-userID__mockSessionID"}, promptKV.deletedKeys)
+	})
+}
+
+func Test_AddUserSession(t *testing.T) {
+	for _, testCase := range []struct {
+		description   string
+		values        map[string][]byte
+		isStored      bool
+		expectedStore []string
+		expectedOld   []byte
+		expectedErr   string
+	}{
+		{
+			description:   "First session of the user is added",
+			isStored:      true,
+			expectedStore: []string{"mockSessionID"},
+		},
+		{
+			description:   "Session is added to the sessions of the user",
+			values:        map[string][]byte{"sessions_mock-userID": []byte(`["mockSessionID-1"]`)},
+			isStored:      true,
+			expectedStore: []string{"mockSessionID-1", "mockSessionID"},
+			expectedOld:   []byte(`["mockSessionID-1"]`),
+		},
+		{
+			description: "Session which is already added is not stored again",
+			values:      map[string][]byte{"sessions_mock-userID": []byte(`["mockSessionID"]`)},
+		},
+		{
+			description:   "Error when the sessions keep being changed concurrently",
+			expectedStore: []string{"mockSessionID"},
+			expectedErr:   "the sessions of the user were changed while adding the session",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			conversationKV := &mockKVStore{values: testCase.values, isStored: testCase.isStored}
+			s := pluginStore{
+				conversationKV: conversationKV,
+			}
+
+			err := s.AddUserSession("mock-userID", "mockSessionID")
+			if testCase.expectedErr != "" {
+				require.EqualError(t, err, testCase.expectedErr)
+				require.Len(t, conversationKV.storedKeys, userSessionsMaxAttempts)
+			} else {
+				require.Nil(t, err)
+			}
+
+			if testCase.expectedStore == nil {
+				require.Empty(t, conversationKV.storedKeys)
+				return
+			}
+
+			var stored []string
+			require.NoError(t, json.Unmarshal(conversationKV.storedValue, &stored))
+			require.Equal(t, testCase.expectedStore, stored)
+			require.True(t, conversationKV.storeOpts.Atomic)
+			require.Equal(t, testCase.expectedOld, conversationKV.storeOpts.OldValue)
+		})
+	}
+}
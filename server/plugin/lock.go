@@ -0,0 +1,40 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// lockCluster acquires the lock with the given key, which is shared by all the nodes of the cluster,
+// and returns the function to release it. The lock expires after ttlSeconds if it is not released.
+func (p *Plugin) lockCluster(key string, ttlSeconds int64, waitTimeout time.Duration) (func(), error) {
+	value := []byte(p.generateUUID())
+	deadline := time.Now().Add(waitTimeout)
+	wait := ClusterLockMinRetryInterval * time.Millisecond
+	for {
+		locked, err := p.store.TryLock(key, value, ttlSeconds)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to acquire the cluster lock")
+		}
+
+		if locked {
+			break
+		}
+
+		if time.Now().Add(wait).After(deadline) {
+			return nil, errors.Errorf("timed out waiting for the cluster lock %s", key)
+		}
+
+		time.Sleep(wait)
+		if wait *= 2; wait > ClusterLockMaxRetryInterval*time.Millisecond {
+			wait = ClusterLockMaxRetryInterval * time.Millisecond
+		}
+	}
+
+	return func() {
+		if err := p.store.Unlock(key, value); err != nil {
+			p.API.LogWarn("Failed to release the cluster lock", "Key", key, "Error", err.Error())
+		}
+	}, nil
+}
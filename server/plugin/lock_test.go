@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/require"
+
+	mock_plugin "github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/mocks"
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/testutils"
+)
+
+func Test_lockCluster(t *testing.T) {
+	for _, testCase := range []struct {
+		description     string
+		heldAttempts    int
+		tryLockError    error
+		unlockError     error
+		expectedErr     string
+		isWarningLogged bool
+	}{
+		{
+			description: "Lock is acquired and released",
+		},
+		{
+			description:  "Lock held by another node is acquired after it is released",
+			heldAttempts: 2,
+		},
+		{
+			description:  "Error while acquiring the lock",
+			tryLockError: errors.New("error in storing the lock in KVstore"),
+			expectedErr:  "failed to acquire the cluster lock: error in storing the lock in KVstore",
+		},
+		{
+			description:     "Error while releasing the lock is logged",
+			unlockError:     errors.New("error in deleting the lock from KVstore"),
+			isWarningLogged: true,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := &Plugin{}
+
+			mockAPI := &plugintest.API{}
+			defer mockAPI.AssertExpectations(t)
+			if testCase.isWarningLogged {
+				mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			}
+			p.SetAPI(mockAPI)
+
+			var lockValue []byte
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			if testCase.heldAttempts > 0 {
+				mockedStore.EXPECT().TryLock("mock-key", gomock.Any(), int64(ClusterLockTTL)).Return(false, nil).Times(testCase.heldAttempts)
+			}
+			mockedStore.EXPECT().TryLock("mock-key", gomock.Any(), int64(ClusterLockTTL)).DoAndReturn(func(_ string, value []byte, _ int64) (bool, error) {
+				lockValue = value
+				return testCase.tryLockError == nil, testCase.tryLockError
+			})
+			if testCase.tryLockError == nil {
+				// The lock is released only with the value it was acquired with
+				mockedStore.EXPECT().Unlock("mock-key", gomock.Any()).DoAndReturn(func(_ string, value []byte) error {
+					require.Equal(t, lockValue, value)
+					return testCase.unlockError
+				})
+			}
+			p.store = mockedStore
+
+			unlock, err := p.lockCluster("mock-key", ClusterLockTTL, ClusterLockWaitTimeout*time.Second)
+			if testCase.expectedErr != "" {
+				require.EqualError(t, err, testCase.expectedErr)
+				require.Nil(t, unlock)
+				return
+			}
+
+			require.NoError(t, err)
+			unlock()
+		})
+	}
+}
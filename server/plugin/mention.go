@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// botMentionRegex matches the mentions of the bot, but not of the users whose usernames start with the username of the bot,
+// nor the email addresses containing it. The characters around the mention are captured, so that they are kept when the mention is removed.
+var botMentionRegex = regexp.MustCompile(`(?i)(^|[^\w])@` + regexp.QuoteMeta(BotUsername) + `(\.*)($|[^\w.-])`)
+
+func isBotMentioned(message string) bool {
+	return botMentionRegex.MatchString(message)
+}
+
+// removeBotMention removes the mentions of the bot, so that the Virtual Agent gets only the question of the user.
+// The replacement is repeated, as the matches of the adjacent mentions overlap on the character between them.
+func removeBotMention(message string) string {
+	for botMentionRegex.MatchString(message) {
+		message = botMentionRegex.ReplaceAllString(message, "$1$2$3")
+	}
+	return strings.TrimSpace(message)
+}
+
+// IsChannelSessionPost returns whether a post of a channel other than the DM with the bot is sent to the Virtual Agent.
+// The post needs to mention the bot or to be a reply in a thread in which the user talks to the Virtual Agent,
+// and the channel needs to be allowed for mentions in the configuration.
+func (p *Plugin) IsChannelSessionPost(post *model.Post) (bool, error) {
+	if !p.getConfiguration().isMentionEnabled() {
+		return false, nil
+	}
+
+	isMentioned := isBotMentioned(post.Message)
+	if !isMentioned && post.RootId == "" {
+		return false, nil
+	}
+
+	// The channel is checked first, so that the sessions are not loaded for the posts of the channels which are not allowed
+	channel, appErr := p.API.GetChannel(post.ChannelId)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to get the channel")
+	}
+
+	if !p.IsMentionAllowed(channel) {
+		return false, nil
+	}
+
+	if isMentioned {
+		return true, nil
+	}
+
+	return p.IsSessionOwner(post.UserId, post.RootId, post.ChannelId)
+}
+
+// IsMentionAllowed returns whether the users can talk to the Virtual Agent by mentioning the bot in the channel.
+// Mentions are allowed in the public and private channels listed in the configuration, or belonging to the listed teams.
+func (p *Plugin) IsMentionAllowed(channel *model.Channel) bool {
+	if channel.Type != model.CHANNEL_OPEN && channel.Type != model.CHANNEL_PRIVATE {
+		return false
+	}
+
+	config := p.getConfiguration()
+	channels := parseListSetting(config.MentionChannels)
+	if channels[channel.Id] || channels[channel.Name] {
+		return true
+	}
+
+	teams := parseListSetting(config.MentionTeams)
+	if len(teams) == 0 {
+		return false
+	}
+
+	if teams[channel.TeamId] {
+		return true
+	}
+
+	team, appErr := p.API.GetTeam(channel.TeamId)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get the team of the channel", "ChannelID", channel.Id, "Error", appErr.Error())
+		return false
+	}
+
+	return teams[team.Name]
+}
@@ -0,0 +1,256 @@
+package plugin
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/testutils"
+)
+
+func Test_removeBotMention(t *testing.T) {
+	for _, testCase := range []struct {
+		description     string
+		message         string
+		expectedMessage string
+		isMentioned     bool
+	}{
+		{
+			description:     "Mention at the start of the message is removed",
+			message:         "@servicenow-virtual-agent reset my password",
+			expectedMessage: "reset my password",
+			isMentioned:     true,
+		},
+		{
+			description:     "Mention in a different case is removed",
+			message:         "Hi @ServiceNow-Virtual-Agent",
+			expectedMessage: "Hi",
+			isMentioned:     true,
+		},
+		{
+			description:     "Mention followed by punctuation is removed",
+			message:         "Hi @servicenow-virtual-agent, reset my password",
+			expectedMessage: "Hi , reset my password",
+			isMentioned:     true,
+		},
+		{
+			description:     "Punctuation after the mention is kept",
+			message:         "hi @servicenow-virtual-agent.",
+			expectedMessage: "hi .",
+			isMentioned:     true,
+		},
+		{
+			description:     "Adjacent mentions are removed",
+			message:         "@servicenow-virtual-agent @servicenow-virtual-agent hello",
+			expectedMessage: "hello",
+			isMentioned:     true,
+		},
+		{
+			description:     "Email address containing the username of the bot is kept",
+			message:         "send it to email@servicenow-virtual-agent",
+			expectedMessage: "send it to email@servicenow-virtual-agent",
+		},
+		{
+			description:     "Mention of another user with a dot in the username is kept",
+			message:         "@servicenow-virtual-agent.admin hello",
+			expectedMessage: "@servicenow-virtual-agent.admin hello",
+		},
+		{
+			description:     "Mention of another user is kept",
+			message:         "@servicenow-virtual-agent-admin hello",
+			expectedMessage: "@servicenow-virtual-agent-admin hello",
+		},
+		{
+			description:     "Message without a mention is kept",
+			message:         "hello",
+			expectedMessage: "hello",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			require.Equal(t, testCase.isMentioned, isBotMentioned(testCase.message))
+			require.Equal(t, testCase.expectedMessage, removeBotMention(testCase.message))
+		})
+	}
+}
+
+func TestPlugin_IsMentionAllowed(t *testing.T) {
+	for _, testCase := range []struct {
+		description     string
+		channel         *model.Channel
+		mentionChannels string
+		mentionTeams    string
+		getTeamError    *model.AppError
+		expectedAllowed bool
+	}{
+		{
+			description:     "Channel allowed by its ID",
+			channel:         &model.Channel{Id: "mockChannelID", Name: "mock-channel", TeamId: "mockTeamID", Type: model.CHANNEL_OPEN},
+			mentionChannels: "mockOtherChannelID, mockChannelID",
+			expectedAllowed: true,
+		},
+		{
+			description:     "Private channel allowed by its name",
+			channel:         &model.Channel{Id: "mockChannelID", Name: "mock-channel", TeamId: "mockTeamID", Type: model.CHANNEL_PRIVATE},
+			mentionChannels: "mock-channel",
+			expectedAllowed: true,
+		},
+		{
+			description:     "Channel allowed by the ID of its team",
+			channel:         &model.Channel{Id: "mockChannelID", Name: "mock-channel", TeamId: "mockTeamID", Type: model.CHANNEL_OPEN},
+			mentionTeams:    "mockTeamID",
+			expectedAllowed: true,
+		},
+		{
+			description:     "Channel allowed by the name of its team",
+			channel:         &model.Channel{Id: "mockChannelID", Name: "mock-channel", TeamId: "mockTeamID", Type: model.CHANNEL_OPEN},
+			mentionTeams:    "mock-team",
+			expectedAllowed: true,
+		},
+		{
+			description:  "Channel of a team which is not allowed",
+			channel:      &model.Channel{Id: "mockChannelID", Name: "mock-channel", TeamId: "mockTeamID", Type: model.CHANNEL_OPEN},
+			mentionTeams: "mock-other-team",
+		},
+		{
+			description:  "Error while getting the team",
+			channel:      &model.Channel{Id: "mockChannelID", Name: "mock-channel", TeamId: "mockTeamID", Type: model.CHANNEL_OPEN},
+			mentionTeams: "mock-team",
+			getTeamError: &model.AppError{Message: "error in getting the team"},
+		},
+		{
+			description:     "Group message is not allowed",
+			channel:         &model.Channel{Id: "mockChannelID", Name: "mock-channel", Type: model.CHANNEL_GROUP},
+			mentionChannels: "mockChannelID",
+		},
+		{
+			description: "Mentions are not allowed without any channels or teams",
+			channel:     &model.Channel{Id: "mockChannelID", Name: "mock-channel", TeamId: "mockTeamID", Type: model.CHANNEL_OPEN},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+			p.setConfiguration(&configuration{
+				MentionChannels: testCase.mentionChannels,
+				MentionTeams:    testCase.mentionTeams,
+			})
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("GetTeam", "mockTeamID").Return(&model.Team{Id: "mockTeamID", Name: "mock-team"}, testCase.getTeamError)
+			mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			p.SetAPI(mockAPI)
+
+			require.Equal(t, testCase.expectedAllowed, p.IsMentionAllowed(testCase.channel))
+		})
+	}
+}
+
+func TestPlugin_IsChannelSessionPost(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description       string
+		message           string
+		rootID            string
+		mentionChannels   string
+		getChannelError   *model.AppError
+		isOwner           bool
+		isOwnerError      error
+		isOwnerChecked    bool
+		expectedIsSession bool
+		expectedError     string
+	}{
+		{
+			description:       "Post mentioning the bot in an allowed channel",
+			message:           "@servicenow-virtual-agent hello",
+			mentionChannels:   "mockChannelID",
+			expectedIsSession: true,
+		},
+		{
+			description:       "Reply of the session owner in an allowed channel",
+			message:           "hello",
+			rootID:            "mockRootID",
+			mentionChannels:   "mockChannelID",
+			isOwner:           true,
+			isOwnerChecked:    true,
+			expectedIsSession: true,
+		},
+		{
+			description:     "Reply of another user in an allowed channel",
+			message:         "hello",
+			rootID:          "mockRootID",
+			mentionChannels: "mockChannelID",
+			isOwnerChecked:  true,
+		},
+		{
+			description:     "Sessions are not checked for a reply in a channel which is not allowed",
+			message:         "hello",
+			rootID:          "mockRootID",
+			mentionChannels: "mockOtherChannelID",
+		},
+		{
+			description:     "Post mentioning the bot in a channel which is not allowed",
+			message:         "@servicenow-virtual-agent hello",
+			mentionChannels: "mockOtherChannelID",
+		},
+		{
+			description:     "Post without a mention outside of a thread",
+			message:         "hello",
+			mentionChannels: "mockChannelID",
+		},
+		{
+			description: "Mentions are disabled",
+			message:     "@servicenow-virtual-agent hello",
+		},
+		{
+			description:     "Error while getting the channel",
+			message:         "@servicenow-virtual-agent hello",
+			mentionChannels: "mockChannelID",
+			getChannelError: &model.AppError{Message: "error in getting the channel"},
+			expectedError:   "failed to get the channel: : error in getting the channel, ",
+		},
+		{
+			description:     "Error while checking the owner of the session",
+			message:         "hello",
+			rootID:          "mockRootID",
+			mentionChannels: "mockChannelID",
+			isOwnerError:    errors.New("error in checking the owner"),
+			isOwnerChecked:  true,
+			expectedError:   "error in checking the owner",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+			p.setConfiguration(&configuration{MentionChannels: testCase.mentionChannels})
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("GetChannel", "mockChannelID").Return(&model.Channel{Id: "mockChannelID", Type: model.CHANNEL_OPEN}, testCase.getChannelError)
+			p.SetAPI(mockAPI)
+
+			isOwnerChecked := false
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "IsSessionOwner", func(_ *Plugin, _, sessionID, _ string) (bool, error) {
+				require.Equal(t, "mockRootID", sessionID)
+				isOwnerChecked = true
+				return testCase.isOwner, testCase.isOwnerError
+			})
+
+			isSessionPost, err := p.IsChannelSessionPost(&model.Post{
+				ChannelId: "mockChannelID",
+				RootId:    testCase.rootID,
+				UserId:    "mock-userID",
+				Message:   testCase.message,
+			})
+			if testCase.expectedError != "" {
+				require.EqualError(t, err, testCase.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, testCase.expectedIsSession, isSessionPost)
+			require.Equal(t, testCase.isOwnerChecked, isOwnerChecked)
+		})
+	}
+}
@@ -1,14 +1,23 @@
 package plugin
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 
 	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
 )
 
+// revokeTokenTimeout is the maximum time allowed for revoking an OAuth2 token on ServiceNow.
+const revokeTokenTimeout = 10 * time.Second
+
 func (p *Plugin) httpOAuth2Connect(w http.ResponseWriter, r *http.Request) {
 	mattermostUserID := r.Header.Get(HeaderMattermostUserID)
 	if mattermostUserID == "" {
@@ -70,14 +79,50 @@ func (p *Plugin) httpOAuth2Complete(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (p *Plugin) NewOAuth2Config() *oauth2.Config {
+func (p *Plugin) NewOAuth2Config(instance *ServiceNowInstance) *oauth2.Config {
 	return &oauth2.Config{
-		ClientID:     p.getConfiguration().ServiceNowOAuthClientID,
-		ClientSecret: p.getConfiguration().ServiceNowOAuthClientSecret,
+		ClientID:     instance.OAuthClientID,
+		ClientSecret: instance.OAuthClientSecret,
 		RedirectURL:  fmt.Sprintf("%s%s", p.GetPluginURL(), PathOAuth2Complete),
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  fmt.Sprintf("%s/oauth_auth.do", p.getConfiguration().ServiceNowURL),
-			TokenURL: fmt.Sprintf("%s/oauth_token.do", p.getConfiguration().ServiceNowURL),
+			AuthURL:  fmt.Sprintf("%s/oauth_auth.do", instance.URL),
+			TokenURL: fmt.Sprintf("%s/oauth_token.do", instance.URL),
 		},
 	}
 }
+
+// RevokeOAuth2Token revokes the token on the ServiceNow instance.
+// Revoking the refresh token also revokes all the access tokens issued with it.
+func (p *Plugin) RevokeOAuth2Token(instance *ServiceNowInstance, token *oauth2.Token) error {
+	tokenToRevoke := token.RefreshToken
+	if tokenToRevoke == "" {
+		tokenToRevoke = token.AccessToken
+	}
+
+	params := url.Values{}
+	params.Add("token", tokenToRevoke)
+	params.Add("client_id", instance.OAuthClientID)
+	params.Add("client_secret", instance.OAuthClientSecret)
+
+	ctx, cancel := context.WithTimeout(context.Background(), revokeTokenTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s%s", instance.URL, PathOAuth2Revoke), strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke the OAuth2 token")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to revoke the OAuth2 token. Status: %s. Response: %s", resp.Status, string(body))
+	}
+
+	return nil
+}
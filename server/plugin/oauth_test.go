@@ -11,6 +11,7 @@ import (
 	"github.com/mattermost/mattermost-server/v5/plugin"
 	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 
 	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/testutils"
 )
@@ -234,8 +235,71 @@ func TestPlugin_NewOAuth2Config(t *testing.T) {
 				PluginURLPath:               "mockPluginURLPath",
 			})
 
-		res := p.NewOAuth2Config()
+		res := p.NewOAuth2Config(&ServiceNowInstance{
+			URL:               "mockURL",
+			OAuthClientID:     "mockClientID",
+			OAuthClientSecret: "mockClientSecret",
+		})
 
 		require.NotNil(t, res)
+		require.Equal(t, "mockClientID", res.ClientID)
+		require.Equal(t, "mockURL/oauth_token.do", res.Endpoint.TokenURL)
 	})
 }
+
+func TestPlugin_RevokeOAuth2Token(t *testing.T) {
+	for _, testCase := range []struct {
+		description   string
+		token         *oauth2.Token
+		statusCode    int
+		expectedToken string
+		expectedErr   string
+	}{
+		{
+			description:   "Refresh token is revoked",
+			token:         &oauth2.Token{AccessToken: "mockAccessToken", RefreshToken: "mockRefreshToken"},
+			statusCode:    http.StatusOK,
+			expectedToken: "mockRefreshToken",
+		},
+		{
+			description:   "Access token is revoked when there is no refresh token",
+			token:         &oauth2.Token{AccessToken: "mockAccessToken"},
+			statusCode:    http.StatusOK,
+			expectedToken: "mockAccessToken",
+		},
+		{
+			description:   "ServiceNow fails to revoke the token",
+			token:         &oauth2.Token{AccessToken: "mockAccessToken", RefreshToken: "mockRefreshToken"},
+			statusCode:    http.StatusBadRequest,
+			expectedToken: "mockRefreshToken",
+			expectedErr:   "failed to revoke the OAuth2 token. Status: 400 Bad Request. Response: mockError",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, PathOAuth2Revoke, r.URL.Path)
+				require.Equal(t, testCase.expectedToken, r.FormValue("token"))
+				require.Equal(t, "mockClientID", r.FormValue("client_id"))
+				require.Equal(t, "mockClientSecret", r.FormValue("client_secret"))
+
+				w.WriteHeader(testCase.statusCode)
+				if testCase.statusCode != http.StatusOK {
+					_, _ = w.Write([]byte("mockError"))
+				}
+			}))
+			defer server.Close()
+
+			p := Plugin{}
+			err := p.RevokeOAuth2Token(&ServiceNowInstance{
+				URL:               server.URL,
+				OAuthClientID:     "mockClientID",
+				OAuthClientSecret: "mockClientSecret",
+			}, testCase.token)
+			if testCase.expectedErr != "" {
+				require.EqualError(t, err, testCase.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
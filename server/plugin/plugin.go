@@ -4,6 +4,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bluele/gcache"
 	"github.com/gorilla/mux"
@@ -30,25 +31,46 @@ type Plugin struct {
 	store Store
 
 	channelCache gcache.Cache
+
+	// tokenRefreshLocks holds a mutex per Mattermost user ID, used to synchronize refreshing OAuth2 tokens.
+	tokenRefreshLocks sync.Map
+
+	// reencryptionLock prevents concurrent runs of re-encrypting the stored OAuth2 tokens.
+	reencryptionLock sync.Mutex
+
+	// webhookQueue processes the webhook requests received from ServiceNow in the background.
+	webhookQueue *webhookQueue
 }
 
 func (p *Plugin) OnActivate() error {
+	// The store is created first, as the configuration needs it to load the last webhook secret rotation.
+	p.store = p.NewStore(p.API)
+
 	if err := p.OnConfigurationChange(); err != nil {
 		return err
 	}
 
-	p.store = p.NewStore(p.API)
-
 	if err := p.initBotUser(); err != nil {
 		return err
 	}
 
+	if err := p.API.RegisterCommand(p.getCommand()); err != nil {
+		return errors.Wrap(err, "failed to register command")
+	}
+
 	p.router = p.initializeAPI()
 	p.channelCache = gcache.New(p.getConfiguration().ChannelCacheSize).ARC().Build()
+	p.webhookQueue = newWebhookQueue(WebhookQueueSize, WebhookWorkerIdleTimeout*time.Second, p.processWebhookRequest, p.failWebhookRequest)
+
+	go p.ReencryptUsers()
 	return nil
 }
 
 func (p *Plugin) OnDeactivate() error {
+	if p.webhookQueue != nil && !p.webhookQueue.Close(WebhookQueueDrainTimeout*time.Second) {
+		p.API.LogWarn("Timed out while waiting for the queued webhook requests to be processed")
+	}
+
 	if p.channelCache != nil {
 		p.channelCache.Purge()
 	}
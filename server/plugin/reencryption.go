@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReencryptUsers re-encrypts the stored OAuth2 tokens which are not encrypted with the current encryption secret,
+// so that the previous encryption secrets can be removed from the configuration afterwards.
+func (p *Plugin) ReencryptUsers() {
+	p.reencryptionLock.Lock()
+	defer p.reencryptionLock.Unlock()
+
+	// Every node runs the job, so the runs are serialized across the cluster. The later runs find nothing to re-encrypt.
+	unlock, err := p.lockCluster(ReencryptionLockKey, ReencryptionLockTTL, ReencryptionLockTTL*time.Second)
+	if err != nil {
+		p.API.LogError("Failed to lock re-encrypting the OAuth2 tokens", "Error", err.Error())
+		return
+	}
+	defer unlock()
+
+	users, err := p.store.GetAllUsers()
+	if err != nil {
+		p.API.LogError("Failed to get the users for re-encrypting the OAuth2 tokens", "Error", err.Error())
+		return
+	}
+
+	count := 0
+	for _, user := range users {
+		reencrypted, err := p.reencryptUser(user.MattermostUserID)
+		if err != nil {
+			p.API.LogWarn("Failed to re-encrypt the OAuth2 token of the user", "UserID", user.MattermostUserID, "Error", err.Error())
+			continue
+		}
+
+		if reencrypted {
+			count++
+		}
+	}
+
+	if count > 0 {
+		p.API.LogInfo("Re-encrypted the OAuth2 tokens with the current encryption secret", "Count", count)
+	}
+}
+
+// reencryptUser stores the user only if the record is not changed in the meantime, so that a token refreshed
+// on any node is not overwritten. The user is loaded again and re-encrypted if the record has changed.
+func (p *Plugin) reencryptUser(mattermostUserID string) (bool, error) {
+	for attempt := 0; attempt < ReencryptionMaxAttempts; attempt++ {
+		user, oldData, err := p.store.LoadUserRecord(mattermostUserID)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to load the user")
+		}
+
+		isCurrentKey, err := p.IsAuthTokenEncryptedWithCurrentKey(user.OAuth2Token)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to decrypt the OAuth2 token")
+		}
+
+		if isCurrentKey {
+			return false, nil
+		}
+
+		token, err := p.ParseAuthToken(user.OAuth2Token)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to parse the OAuth2 token")
+		}
+
+		reencryptedUser := *user
+		if reencryptedUser.OAuth2Token, err = p.NewEncodedAuthToken(token); err != nil {
+			return false, err
+		}
+
+		stored, err := p.store.CompareAndStoreUser(oldData, &reencryptedUser)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to store the re-encrypted OAuth2 token")
+		}
+
+		if stored {
+			return true, nil
+		}
+	}
+
+	return false, errors.New("the user was changed while re-encrypting the OAuth2 token")
+}
@@ -0,0 +1,197 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/golang/mock/gomock"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	mock_plugin "github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/mocks"
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/store/kvstore"
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/testutils"
+)
+
+func Test_ReencryptUsers(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description        string
+		lockError          error
+		getAllUsersError   error
+		isCurrentKey       bool
+		isCurrentKeyError  error
+		storeUserError     error
+		isUserChanged      bool
+		isUserStored       bool
+		isErrorLogged      bool
+		isWarningLogged    bool
+		isReencryptedCount bool
+	}{
+		{
+			description:        "Token encrypted with a previous key is re-encrypted",
+			isUserStored:       true,
+			isReencryptedCount: true,
+		},
+		{
+			description:        "Token of a user changed in the meantime is loaded and re-encrypted again",
+			isUserChanged:      true,
+			isUserStored:       true,
+			isReencryptedCount: true,
+		},
+		{
+			description:  "Token encrypted with the current key is not changed",
+			isCurrentKey: true,
+		},
+		{
+			description:   "Error while locking the re-encryption",
+			lockError:     errors.New("error in storing the lock in KVstore"),
+			isErrorLogged: true,
+		},
+		{
+			description:      "Error while getting the users",
+			getAllUsersError: errors.New("error in listing the users from KVstore"),
+			isErrorLogged:    true,
+		},
+		{
+			description:       "Error while decrypting the token",
+			isCurrentKeyError: errors.New("error in decrypting the token"),
+			isWarningLogged:   true,
+		},
+		{
+			description:     "Error while storing the re-encrypted token",
+			storeUserError:  errors.New("error in storing the user in KVstore"),
+			isUserStored:    true,
+			isWarningLogged: true,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := &Plugin{}
+
+			mockAPI := &plugintest.API{}
+			defer mockAPI.AssertExpectations(t)
+			if testCase.isErrorLogged {
+				mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+			}
+			if testCase.isWarningLogged {
+				mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			}
+			if testCase.isReencryptedCount {
+				mockAPI.On("LogInfo", "Re-encrypted the OAuth2 tokens with the current encryption secret", "Count", 1).Return()
+			}
+			p.SetAPI(mockAPI)
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			user := &serializer.User{MattermostUserID: "mock-userID", OAuth2Token: "mockOldToken"}
+			mockedStore.EXPECT().TryLock(ReencryptionLockKey, gomock.Any(), int64(ReencryptionLockTTL)).Return(testCase.lockError == nil, testCase.lockError)
+			if testCase.lockError == nil {
+				mockedStore.EXPECT().Unlock(ReencryptionLockKey, gomock.Any()).Return(nil)
+				mockedStore.EXPECT().GetAllUsers().Return([]*serializer.User{user}, testCase.getAllUsersError)
+			}
+			if testCase.lockError == nil && testCase.getAllUsersError == nil {
+				mockedStore.EXPECT().LoadUserRecord("mock-userID").Return(user, []byte("mockOldData"), nil)
+			}
+			oldData := []byte("mockOldData")
+			reencryptedUser := &serializer.User{MattermostUserID: "mock-userID", OAuth2Token: "mockNewToken"}
+			if testCase.isUserChanged {
+				changedUser := &serializer.User{MattermostUserID: "mock-userID", OAuth2Token: "mockOldToken", PendingPostID: "mock-postID"}
+				mockedStore.EXPECT().CompareAndStoreUser(oldData, reencryptedUser).Return(false, nil)
+				mockedStore.EXPECT().LoadUserRecord("mock-userID").Return(changedUser, []byte("mockChangedData"), nil)
+				reencryptedUser = &serializer.User{MattermostUserID: "mock-userID", OAuth2Token: "mockNewToken", PendingPostID: "mock-postID"}
+				user = changedUser
+				oldData = []byte("mockChangedData")
+			}
+			if testCase.isUserStored {
+				mockedStore.EXPECT().CompareAndStoreUser(oldData, reencryptedUser).Return(testCase.storeUserError == nil, testCase.storeUserError)
+			}
+			p.store = mockedStore
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "IsAuthTokenEncryptedWithCurrentKey", func(_ *Plugin, _ string) (bool, error) {
+				return testCase.isCurrentKey, testCase.isCurrentKeyError
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "ParseAuthToken", func(_ *Plugin, _ string) (*oauth2.Token, error) {
+				return &oauth2.Token{}, nil
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "NewEncodedAuthToken", func(_ *Plugin, _ *oauth2.Token) (string, error) {
+				return "mockNewToken", nil
+			})
+
+			p.ReencryptUsers()
+
+			// The loaded user is never modified, as it is compared with the stored record
+			require.Equal(t, "mockOldToken", user.OAuth2Token)
+		})
+	}
+}
+
+// memoryKVStore keeps the values in memory and compares the old value of the atomic updates like the plugin KV store.
+type memoryKVStore struct {
+	kvstore.KVStore
+	values map[string][]byte
+}
+
+func (m *memoryKVStore) Load(key string) ([]byte, error) {
+	value, ok := m.values[key]
+	if !ok {
+		return nil, kvstore.ErrNotFound
+	}
+	return value, nil
+}
+
+func (m *memoryKVStore) Store(key string, data []byte) error {
+	m.values[key] = data
+	return nil
+}
+
+func (m *memoryKVStore) StoreWithOptions(key string, value []byte, opts model.PluginKVSetOptions) (bool, error) {
+	if opts.Atomic && !bytes.Equal(m.values[key], opts.OldValue) {
+		return false, nil
+	}
+	m.values[key] = value
+	return true, nil
+}
+
+func Test_reencryptUserStoredInBaselineFormat(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	p := &Plugin{}
+
+	// Records stored by the earlier versions of the plugin lack the fields added since then
+	baselineRecord := []byte(`{"MattermostUserID":"mock-userID","OAuth2Token":"mockOldToken","sys_id":"mock-sysID","email":"mock@email.com","user_name":"mock-username"}`)
+	kv := &memoryKVStore{values: map[string][]byte{"mock-userID": baselineRecord}}
+	p.store = &pluginStore{plugin: p, userKV: kv}
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(p), "IsAuthTokenEncryptedWithCurrentKey", func(_ *Plugin, _ string) (bool, error) {
+		return false, nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(p), "ParseAuthToken", func(_ *Plugin, _ string) (*oauth2.Token, error) {
+		return &oauth2.Token{}, nil
+	})
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(p), "NewEncodedAuthToken", func(_ *Plugin, _ *oauth2.Token) (string, error) {
+		return "mockNewToken", nil
+	})
+
+	reencrypted, err := p.reencryptUser("mock-userID")
+	require.NoError(t, err)
+	require.True(t, reencrypted)
+
+	for _, key := range []string{"mock-userID", "mock-sysID"} {
+		user := serializer.User{}
+		require.NoError(t, json.Unmarshal(kv.values[key], &user))
+		require.Equal(t, "mockNewToken", user.OAuth2Token)
+		require.Equal(t, "mock-username", user.Username)
+	}
+}
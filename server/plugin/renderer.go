@@ -0,0 +1,170 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
+)
+
+// RenderContext contains the details of the user and the session, which a part of a Virtual Agent response is rendered for.
+type RenderContext struct {
+	UserID string
+	// SessionID is the ID of the Virtual Agent session of the response. Each session is a thread, identified by the ID of its root post.
+	// It is empty for the responses which are not part of a thread.
+	SessionID string
+	// ChannelID is the channel of the sessions started by mentioning the bot in a channel. It is empty for the DM with the bot.
+	ChannelID string
+	// InstanceURL is the URL of the ServiceNow instance of the user, which the relative links in the response point to.
+	InstanceURL string
+	// LiveAgentChat is set when the response is sent by a live agent.
+	LiveAgentChat *serializer.LiveAgentChat
+
+	plugin *Plugin
+	posts  *postCoalescer
+}
+
+// AddText adds the text to the pending post, which is merged with the other parts of the response.
+func (ctx *RenderContext) AddText(text string) error {
+	return ctx.posts.AddText(text)
+}
+
+// AddAttachments adds the attachments to the pending post, which is merged with the other parts of the response.
+func (ctx *RenderContext) AddAttachments(attachments ...*model.SlackAttachment) error {
+	return ctx.posts.AddAttachments(attachments...)
+}
+
+// Flush posts the pending post. Renderers need to call it before posting anything by themselves.
+func (ctx *RenderContext) Flush() error {
+	if ctx.posts == nil {
+		return nil
+	}
+	return ctx.posts.Flush()
+}
+
+// Post posts the post to the user in the thread of the session.
+// Posts of a response sent by a live agent are shown with the identity of the agent.
+func (ctx *RenderContext) Post(post *model.Post) (string, error) {
+	if ctx.LiveAgentChat != nil {
+		setLiveAgentIdentity(post, ctx.LiveAgentChat)
+	}
+
+	if ctx.ChannelID != "" {
+		return ctx.plugin.PostInChannel(ctx.ChannelID, ctx.SessionID, post)
+	}
+	return ctx.plugin.DMInThread(ctx.UserID, ctx.SessionID, post)
+}
+
+// PostMessage posts the message to the user in the thread of the session.
+func (ctx *RenderContext) PostMessage(message string) (string, error) {
+	return ctx.Post(&model.Post{
+		Message: message,
+	})
+}
+
+// PostPrompt posts a question of the Virtual Agent and makes it the active prompt of the session.
+// Failures to set the active prompt are only logged, as the question has already been posted.
+func (ctx *RenderContext) PostPrompt(attachments ...*model.SlackAttachment) error {
+	post := &model.Post{}
+	model.ParseSlackAttachment(post, attachments)
+	postID, err := ctx.Post(post)
+	if err != nil {
+		return err
+	}
+
+	if err = ctx.plugin.SetActivePrompt(ctx.UserID, ctx.SessionID, postID); err != nil {
+		ctx.plugin.API.LogWarn("Failed to set the active prompt", "UserID", ctx.UserID, "PostID", postID, "Error", err.Error())
+	}
+
+	return nil
+}
+
+// sessionKey returns the key of the state of the session in the KV store.
+func (ctx *RenderContext) sessionKey() string {
+	return getSessionKey(ctx.UserID, ctx.SessionID)
+}
+
+// Renderer parses and renders one kind of the parts of the Virtual Agent responses.
+type Renderer interface {
+	// NewValue returns the value which the part of the response is parsed into.
+	NewValue() interface{}
+	// Render posts the parsed part of the response to the user.
+	Render(p *Plugin, ctx *RenderContext, value interface{}) error
+}
+
+// RendererRegistry finds the renderer of a part of a response by its uiType and template name.
+type RendererRegistry struct {
+	renderers map[string]Renderer
+	fallback  Renderer
+}
+
+func NewRendererRegistry(fallback Renderer) *RendererRegistry {
+	return &RendererRegistry{
+		renderers: map[string]Renderer{},
+		fallback:  fallback,
+	}
+}
+
+// Register registers the renderer for the parts of the responses with any of the uiTypes.
+func (r *RendererRegistry) Register(renderer Renderer, uiTypes ...string) {
+	for _, uiType := range uiTypes {
+		r.renderers[getRendererKey(uiType, "")] = renderer
+	}
+}
+
+// RegisterTemplate registers the renderer for the parts of the responses with the uiType and any of the template names.
+func (r *RendererRegistry) RegisterTemplate(renderer Renderer, uiType string, templateNames ...string) {
+	for _, templateName := range templateNames {
+		r.renderers[getRendererKey(uiType, templateName)] = renderer
+	}
+}
+
+// Get returns the renderer of the template, or the renderer of the uiType if there is none for the template.
+// The fallback renderer is returned for unknown uiTypes.
+func (r *RendererRegistry) Get(uiType, templateName string) Renderer {
+	if templateName != "" {
+		if renderer, ok := r.renderers[getRendererKey(uiType, templateName)]; ok {
+			return renderer
+		}
+	}
+
+	if renderer, ok := r.renderers[getRendererKey(uiType, "")]; ok {
+		return renderer
+	}
+
+	return r.fallback
+}
+
+func getRendererKey(uiType, templateName string) string {
+	if templateName == "" {
+		return uiType
+	}
+	return fmt.Sprintf("%s/%s", uiType, templateName)
+}
+
+// renderers contains the renderers of all the uiTypes supported by the plugin.
+var renderers = newDefaultRendererRegistry()
+
+func newDefaultRendererRegistry() *RendererRegistry {
+	registry := NewRendererRegistry(&fallbackRenderer{})
+	registry.Register(&outputTextRenderer{}, OutputTextUIType, InputTextUIType, FileUploadUIType)
+	registry.Register(&outputHTMLRenderer{}, OutputHTMLUIType)
+	registry.Register(&topicPickerControlRenderer{}, TopicPickerControlUIType)
+	registry.Register(&pickerRenderer{}, PickerUIType)
+	registry.Register(&booleanRenderer{}, BooleanUIType)
+	registry.Register(&outputLinkRenderer{}, OutputLinkUIType)
+	registry.Register(&groupedPartsOutputControlRenderer{}, GroupedPartsOutputControlUIType)
+	registry.Register(&outputCardGenericRenderer{}, OutputCardUIType)
+	registry.RegisterTemplate(&outputCardImageRenderer{}, OutputCardUIType, OutputCardSmallImageType, OutputCardLargeImageType)
+	registry.RegisterTemplate(&outputCardVideoRenderer{}, OutputCardUIType, OutputCardVideoType)
+	registry.RegisterTemplate(&outputCardRecordRenderer{}, OutputCardUIType, OutputCardRecordType)
+	registry.Register(&outputImageRenderer{}, OutputImageUIType)
+	registry.Register(&defaultDateRenderer{}, DateTimeUIType, DateUIType, TimeUIType)
+	registry.Register(&actionMsgRenderer{}, ActionMsgUIType)
+	return registry
+}
+
+func unexpectedValueError(value interface{}) error {
+	return fmt.Errorf("unexpected value of type %T", value)
+}
@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"reflect"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
+)
+
+func Test_RendererRegistryGet(t *testing.T) {
+	fallback := &fallbackRenderer{}
+	genericCard := &outputCardGenericRenderer{}
+	videoCard := &outputCardVideoRenderer{}
+	text := &outputTextRenderer{}
+
+	registry := NewRendererRegistry(fallback)
+	registry.Register(text, OutputTextUIType, InputTextUIType)
+	registry.Register(genericCard, OutputCardUIType)
+	registry.RegisterTemplate(videoCard, OutputCardUIType, OutputCardVideoType)
+
+	for _, testCase := range []struct {
+		description  string
+		uiType       string
+		templateName string
+		expected     Renderer
+	}{
+		{
+			description: "Renderer is found by the uiType",
+			uiType:      InputTextUIType,
+			expected:    text,
+		},
+		{
+			description:  "Renderer is found by the template name",
+			uiType:       OutputCardUIType,
+			templateName: OutputCardVideoType,
+			expected:     videoCard,
+		},
+		{
+			description:  "Renderer of the uiType is used for an unknown template",
+			uiType:       OutputCardUIType,
+			templateName: "mockTemplate",
+			expected:     genericCard,
+		},
+		{
+			description: "Fallback renderer is used for an unknown uiType",
+			uiType:      "mockUIType",
+			expected:    fallback,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			require.Same(t, testCase.expected, registry.Get(testCase.uiType, testCase.templateName))
+		})
+	}
+}
+
+func Test_RenderContextPost(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description      string
+		chat             *serializer.LiveAgentChat
+		expectedUsername interface{}
+		expectedIconURL  interface{}
+	}{
+		{
+			description: "Post of the Virtual Agent is shown as sent by the bot",
+		},
+		{
+			description:      "Post of a live agent is shown with the name and the avatar of the agent",
+			chat:             &serializer.LiveAgentChat{AgentName: "mockAgent", AgentAvatar: "https://mock.url/avatar.png"},
+			expectedUsername: "mockAgent",
+			expectedIconURL:  "https://mock.url/avatar.png",
+		},
+		{
+			description:      "Avatar of a live agent is not used when it is not safe",
+			chat:             &serializer.LiveAgentChat{AgentName: "mockAgent", AgentAvatar: "javascript:alert(1)"},
+			expectedUsername: "mockAgent",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			var posts []*model.Post
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DMInThread", func(_ *Plugin, _, _ string, post *model.Post) (string, error) {
+				posts = append(posts, post)
+				return "mockPostID", nil
+			})
+
+			ctx := p.newRenderContext("mock-userID", "")
+			ctx.LiveAgentChat = testCase.chat
+
+			// Both the coalesced posts and the posts created by the renderers are shown with the same identity
+			require.NoError(t, ctx.AddAttachments(&model.SlackAttachment{Text: "mockText"}))
+			require.NoError(t, ctx.Flush())
+			_, err := ctx.PostMessage("mockMessage")
+			require.NoError(t, err)
+
+			require.Len(t, posts, 2)
+			for _, post := range posts {
+				require.Equal(t, testCase.expectedUsername, post.GetProp(PostPropOverrideUsername))
+				require.Equal(t, testCase.expectedIconURL, post.GetProp(model.POST_PROPS_OVERRIDE_ICON_URL))
+			}
+		})
+	}
+}
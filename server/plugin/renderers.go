@@ -0,0 +1,418 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+type outputTextRenderer struct{}
+
+func (r *outputTextRenderer) NewValue() interface{} {
+	return new(OutputText)
+}
+
+func (r *outputTextRenderer) Coalescing() bool {
+	return true
+}
+
+func (r *outputTextRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*OutputText)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	if body.UIType == InputTextUIType && isMaskedInput(body.MaskType) {
+		if err := ctx.Flush(); err != nil {
+			return err
+		}
+		return p.renderMaskedInput(ctx, body)
+	}
+
+	message := htmlToMarkdown(body.Value, ctx.InstanceURL)
+	if body.Label != "" {
+		message = htmlToMarkdown(body.Label, ctx.InstanceURL)
+		if body.ItemType == ItemTypeImage {
+			message += UploadImageMessage
+		} else if body.ItemType == ItemTypeFile {
+			message += UploadFileMessage
+		}
+	}
+
+	return ctx.AddText(message)
+}
+
+type outputHTMLRenderer struct{}
+
+func (r *outputHTMLRenderer) NewValue() interface{} {
+	return new(OutputHTML)
+}
+
+func (r *outputHTMLRenderer) Coalescing() bool {
+	return true
+}
+
+func (r *outputHTMLRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*OutputHTML)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	return ctx.AddText(htmlToMarkdown(body.Value, ctx.InstanceURL))
+}
+
+type topicPickerControlRenderer struct{}
+
+func (r *topicPickerControlRenderer) NewValue() interface{} {
+	return new(TopicPickerControl)
+}
+
+func (r *topicPickerControlRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*TopicPickerControl)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	if len(body.Options) == 0 {
+		p.API.LogInfo("TopicPickerControl dropdown has no options to display.")
+		return nil
+	}
+
+	return ctx.PostPrompt(p.CreateTopicPickerControlAttachment(body))
+}
+
+type pickerRenderer struct{}
+
+func (r *pickerRenderer) NewValue() interface{} {
+	return new(Picker)
+}
+
+func (r *pickerRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*Picker)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	// Only the label is shown when none of the options can be selected, as the carousel and the dialog would be empty
+	if !hasEnabledOption(body.Options) {
+		p.API.LogInfo("Picker dropdown has no options to display.")
+		if body.Label == "" {
+			return nil
+		}
+
+		_, err := ctx.PostMessage(body.Label)
+		return err
+	}
+
+	var attachments []*model.SlackAttachment
+	switch {
+	case body.MultiSelect:
+		attachment, err := p.CreateMultiSelectPickerAttachment(body)
+		if err != nil {
+			return err
+		}
+		attachments = append(attachments, attachment)
+	case strings.EqualFold(body.Style, PickerStyleCarousel):
+		attachments = p.CreateCarouselAttachments(body, ctx.InstanceURL)
+	default:
+		attachments = append(attachments, p.CreatePickerAttachment(body))
+	}
+
+	// The label is shown above the options, so that the question is posted as a single post
+	attachments[0].Pretext = body.Label
+	return ctx.PostPrompt(attachments...)
+}
+
+func hasEnabledOption(options []Option) bool {
+	for _, option := range options {
+		if option.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+type booleanRenderer struct{}
+
+func (r *booleanRenderer) NewValue() interface{} {
+	return new(Boolean)
+}
+
+func (r *booleanRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*Boolean)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	return ctx.PostPrompt(p.CreateBooleanAttachment(body))
+}
+
+type outputLinkRenderer struct{}
+
+func (r *outputLinkRenderer) NewValue() interface{} {
+	return new(OutputLink)
+}
+
+func (r *outputLinkRenderer) Coalescing() bool {
+	return true
+}
+
+func (r *outputLinkRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*OutputLink)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	return ctx.AddAttachments(p.CreateOutputLinkAttachment(body, ctx.InstanceURL))
+}
+
+// TODO: Modify the UI for this later.
+type groupedPartsOutputControlRenderer struct{}
+
+func (r *groupedPartsOutputControlRenderer) NewValue() interface{} {
+	return new(GroupedPartsOutputControl)
+}
+
+func (r *groupedPartsOutputControlRenderer) Coalescing() bool {
+	return true
+}
+
+func (r *groupedPartsOutputControlRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*GroupedPartsOutputControl)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	if err := ctx.AddText(body.Header); err != nil {
+		return err
+	}
+
+	for _, part := range body.Values {
+		if err := ctx.AddAttachments(p.CreateGroupedPartsOutputControlAttachment(part, ctx.InstanceURL)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type outputCardImageRenderer struct{}
+
+func (r *outputCardImageRenderer) NewValue() interface{} {
+	return new(OutputCard)
+}
+
+func (r *outputCardImageRenderer) Coalescing() bool {
+	return true
+}
+
+func (r *outputCardImageRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*OutputCard)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	var data OutputCardImageData
+	if err := json.Unmarshal([]byte(body.Data), &data); err != nil {
+		return err
+	}
+
+	return ctx.AddAttachments(p.CreateOutputCardImageAttachment(&data, ctx.InstanceURL))
+}
+
+type outputCardVideoRenderer struct{}
+
+func (r *outputCardVideoRenderer) NewValue() interface{} {
+	return new(OutputCard)
+}
+
+func (r *outputCardVideoRenderer) Coalescing() bool {
+	return true
+}
+
+func (r *outputCardVideoRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*OutputCard)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	var data OutputCardVideoData
+	if err := json.Unmarshal([]byte(body.Data), &data); err != nil {
+		return err
+	}
+
+	// The link of the video is added as text, so that its preview is shown
+	if err := ctx.AddText(fmt.Sprintf(YoutubeURL, data.ID)); err != nil {
+		return err
+	}
+
+	return ctx.AddAttachments(p.CreateOutputCardVideoAttachment(&data, ctx.InstanceURL))
+}
+
+type outputCardRecordRenderer struct{}
+
+func (r *outputCardRecordRenderer) NewValue() interface{} {
+	return new(OutputCard)
+}
+
+func (r *outputCardRecordRenderer) Coalescing() bool {
+	return true
+}
+
+func (r *outputCardRecordRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*OutputCard)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	var data OutputCardRecordData
+	if err := json.Unmarshal([]byte(body.Data), &data); err != nil {
+		return err
+	}
+
+	return ctx.AddAttachments(p.CreateOutputCardRecordAttachment(&data, ctx.InstanceURL))
+}
+
+// outputCardGenericRenderer renders the cards with the templates which are not known to the plugin.
+type outputCardGenericRenderer struct{}
+
+func (r *outputCardGenericRenderer) NewValue() interface{} {
+	return new(OutputCard)
+}
+
+func (r *outputCardGenericRenderer) Coalescing() bool {
+	return true
+}
+
+func (r *outputCardGenericRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*OutputCard)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	attachments, err := p.CreateOutputCardGenericAttachments(body.Data, ctx.InstanceURL)
+	if err != nil {
+		return err
+	}
+
+	if len(attachments) == 0 {
+		p.API.LogInfo("OutputCard has no content to display.", "TemplateName", body.TemplateName)
+		return nil
+	}
+
+	return ctx.AddAttachments(attachments...)
+}
+
+type outputImageRenderer struct{}
+
+func (r *outputImageRenderer) NewValue() interface{} {
+	return new(OutputImage)
+}
+
+func (r *outputImageRenderer) Coalescing() bool {
+	return true
+}
+
+func (r *outputImageRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*OutputImage)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	linkContents := strings.Split(body.Value, "/")
+	if len(linkContents) < 1 {
+		if err := ctx.AddText(fmt.Sprintf("Image: %s", body.AltText)); err != nil {
+			return err
+		}
+
+		p.API.LogError(InvalidImageLinkError, "Link", body.Value)
+		return errors.New(InvalidImageLinkError)
+	}
+
+	completeFileName := linkContents[len(linkContents)-1]
+	return ctx.AddText(fmt.Sprintf("![%s](%s)", completeFileName, body.Value))
+}
+
+type defaultDateRenderer struct{}
+
+func (r *defaultDateRenderer) NewValue() interface{} {
+	return new(DefaultDate)
+}
+
+func (r *defaultDateRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*DefaultDate)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	return ctx.PostPrompt(p.CreateDefaultDateAttachment(body))
+}
+
+type actionMsgRenderer struct{}
+
+func (r *actionMsgRenderer) NewValue() interface{} {
+	return new(ActionMsg)
+}
+
+func (r *actionMsgRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*ActionMsg)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	return p.HandleActionMsg(ctx, body)
+}
+
+// UnknownResponse contains the fields common to most of the uiTypes, which are used for summarizing an unknown part of a response.
+type UnknownResponse struct {
+	UIType        string          `json:"uiType"`
+	Label         string          `json:"label"`
+	Header        string          `json:"header"`
+	Title         string          `json:"title"`
+	PromptMessage string          `json:"promptMsg"`
+	Message       string          `json:"message"`
+	Value         json.RawMessage `json:"value"`
+}
+
+// Summary returns the first text of the response which can be shown to the user.
+func (u *UnknownResponse) Summary() string {
+	var value string
+	_ = json.Unmarshal(u.Value, &value)
+
+	for _, text := range []string{u.Label, u.Header, u.Title, u.PromptMessage, u.Message, value} {
+		if strings.TrimSpace(text) != "" {
+			return text
+		}
+	}
+
+	return ""
+}
+
+// fallbackRenderer renders the parts of the responses with the uiTypes which are not supported by the plugin.
+type fallbackRenderer struct{}
+
+func (r *fallbackRenderer) NewValue() interface{} {
+	return new(UnknownResponse)
+}
+
+func (r *fallbackRenderer) Coalescing() bool {
+	return true
+}
+
+func (r *fallbackRenderer) Render(p *Plugin, ctx *RenderContext, value interface{}) error {
+	body, ok := value.(*UnknownResponse)
+	if !ok {
+		return unexpectedValueError(value)
+	}
+
+	p.API.LogWarn("Received an unsupported response from the Virtual Agent", "UIType", body.UIType)
+	summary := body.Summary()
+	if summary == "" {
+		return nil
+	}
+
+	return ctx.AddText(htmlToMarkdown(summary, ctx.InstanceURL))
+}
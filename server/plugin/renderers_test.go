@@ -0,0 +1,347 @@
+package plugin
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/testutils"
+)
+
+func Test_fallbackRenderer(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description     string
+		data            string
+		expectedMessage string
+	}{
+		{
+			description:     "Label of the unknown response is posted",
+			data:            `{"uiType": "mockUIType", "label": "<b>mockLabel</b>", "value": {"mock": "value"}}`,
+			expectedMessage: "**mockLabel**",
+		},
+		{
+			description:     "Value of the unknown response is posted when it is a text",
+			data:            `{"uiType": "mockUIType", "value": "mockValue"}`,
+			expectedMessage: "mockValue",
+		},
+		{
+			description: "Nothing is posted when the unknown response has no text",
+			data:        `{"uiType": "mockUIType", "value": {"mock": "value"}}`,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+			p.SetAPI(mockAPI)
+
+			var message string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DMInThread", func(_ *Plugin, _, _ string, post *model.Post) (string, error) {
+				message = post.Message
+				return "mockPostID", nil
+			})
+
+			var body MessageResponseBody
+			require.NoError(t, json.Unmarshal([]byte(testCase.data), &body))
+			require.IsType(t, &UnknownResponse{}, body.Value)
+
+			ctx := p.newRenderContext("mock-userID", "")
+			require.NoError(t, p.renderMessageResponse(ctx, 0, body))
+			require.NoError(t, ctx.Flush())
+			require.Equal(t, testCase.expectedMessage, message)
+		})
+	}
+}
+
+func Test_pickerRenderer(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	monkey.PatchInstanceMethod(reflect.TypeOf(&Plugin{}), "SetActivePrompt", func(_ *Plugin, _, _, _ string) error {
+		return nil
+	})
+
+	for _, testCase := range []struct {
+		description         string
+		picker              *Picker
+		expectedMessages    []string
+		expectedAttachments int
+	}{
+		{
+			description: "Picker is rendered as a dropdown",
+			picker: &Picker{
+				Label:   "mockLabel",
+				Options: []Option{{Label: "mockLabel-1", Value: "mockValue-1", Enabled: true}},
+			},
+			expectedAttachments: 1,
+		},
+		{
+			description: "Carousel is rendered as a card for each option",
+			picker: &Picker{
+				Label: "mockLabel",
+				Style: PickerStyleCarousel,
+				Options: []Option{
+					{Label: "mockLabel-1", Value: "mockValue-1", Enabled: true},
+					{Label: "mockLabel-2", Value: "mockValue-2", Enabled: true},
+				},
+			},
+			expectedAttachments: 2,
+		},
+		{
+			description: "Multi-select picker is rendered as a button opening the dialog",
+			picker: &Picker{
+				Label:       "mockLabel",
+				MultiSelect: true,
+				Options:     []Option{{Label: "mockLabel-1", Value: "mockValue-1", Enabled: true}},
+			},
+			expectedAttachments: 1,
+		},
+		{
+			description: "Picker without options is rendered as the label only",
+			picker: &Picker{
+				Label: "mockLabel",
+			},
+			expectedMessages: []string{"mockLabel"},
+		},
+		{
+			description: "Picker without options and label is not rendered",
+			picker:      &Picker{},
+		},
+		{
+			description: "Carousel without enabled options is rendered as the label only",
+			picker: &Picker{
+				Label:   "mockLabel",
+				Style:   PickerStyleCarousel,
+				Options: []Option{{Label: "mockLabel-1", Value: "mockValue-1"}},
+			},
+			expectedMessages: []string{"mockLabel"},
+		},
+		{
+			description: "Multi-select picker without enabled options is rendered as the label only",
+			picker: &Picker{
+				Label:       "mockLabel",
+				MultiSelect: true,
+				Options:     []Option{{Label: "mockLabel-1", Value: "mockValue-1"}},
+			},
+			expectedMessages: []string{"mockLabel"},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("LogInfo", "Picker dropdown has no options to display.").Return()
+			p.SetAPI(mockAPI)
+
+			var messages []string
+			var attachments []*model.SlackAttachment
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DMInThread", func(_ *Plugin, _, rootID string, post *model.Post) (string, error) {
+				require.Equal(t, "mockSessionID", rootID)
+				if post.Message != "" {
+					messages = append(messages, post.Message)
+				}
+				if len(post.Attachments()) > 0 {
+					attachments = post.Attachments()
+				}
+				return "mockPostID", nil
+			})
+
+			err := (&pickerRenderer{}).Render(&p, p.newRenderContext("mock-userID", "mockSessionID"), testCase.picker)
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedMessages, messages)
+			require.Len(t, attachments, testCase.expectedAttachments)
+			if testCase.expectedAttachments > 0 {
+				// The label is posted along with the options
+				require.Equal(t, "mockLabel", attachments[0].Pretext)
+			}
+		})
+	}
+}
+
+func Test_outputTextRenderer(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description     string
+		body            *OutputText
+		expectedMessage string
+	}{
+		{
+			description:     "Value of the text is posted",
+			body:            &OutputText{UIType: OutputTextUIType, Value: "<b>mockValue</b>"},
+			expectedMessage: "**mockValue**",
+		},
+		{
+			description:     "Label of the input is posted instead of the value",
+			body:            &OutputText{UIType: InputTextUIType, Value: "mockValue", Label: "mockLabel", MaskType: MaskTypeNone},
+			expectedMessage: "mockLabel",
+		},
+		{
+			description:     "Note about uploading an image is added to the label",
+			body:            &OutputText{UIType: FileUploadUIType, Label: "mockLabel", ItemType: ItemTypeImage},
+			expectedMessage: "mockLabel" + UploadImageMessage,
+		},
+		{
+			description:     "Note about uploading a file is added to the label",
+			body:            &OutputText{UIType: FileUploadUIType, Label: "mockLabel", ItemType: ItemTypeFile},
+			expectedMessage: "mockLabel" + UploadFileMessage,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			var message string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DMInThread", func(_ *Plugin, _, _ string, post *model.Post) (string, error) {
+				message = post.Message
+				return "mockPostID", nil
+			})
+
+			ctx := p.newRenderContext("mock-userID", "")
+			require.NoError(t, (&outputTextRenderer{}).Render(&p, ctx, testCase.body))
+			require.NoError(t, ctx.Flush())
+			require.Equal(t, testCase.expectedMessage, message)
+		})
+	}
+}
+
+func Test_coalescingRenderers(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description         string
+		data                []string
+		expectedMessage     string
+		expectedAttachments []string
+	}{
+		{
+			description:     "Texts are posted together",
+			data:            []string{`{"uiType": "OutputText", "value": "mockText-1"}`, `{"uiType": "OutputHtml", "value": "<i>mockText-2</i>"}`},
+			expectedMessage: "mockText-1\n\n_mockText-2_",
+		},
+		{
+			description:         "Link is posted along with the text",
+			data:                []string{`{"uiType": "OutputText", "value": "mockText"}`, `{"uiType": "OutputLink", "label": "mockLabel", "value": {"action": "https://mock.url"}}`},
+			expectedMessage:     "mockText",
+			expectedAttachments: []string{"[mockLabel](https://mock.url)"},
+		},
+		{
+			description:         "Parts of the grouped output are posted as attachments after the header",
+			data:                []string{`{"uiType": "GroupedPartsOutputControl", "header": "mockHeader", "values": [{"label": "mockLabel", "action": "https://mock.url", "description": "mockDescription"}]}`},
+			expectedMessage:     "mockHeader",
+			expectedAttachments: []string{"mockDescription"},
+		},
+		{
+			description:     "Image is posted as a markdown image",
+			data:            []string{`{"uiType": "OutputImage", "value": "https://mock.url/mockImage.png"}`},
+			expectedMessage: "![mockImage.png](https://mock.url/mockImage.png)",
+		},
+		{
+			description:         "Image card is posted as an attachment",
+			data:                []string{`{"uiType": "OutputCard", "templateName": "Small image with text", "data": "{\"title\": \"mockTitle\", \"description\": \"mockDescription\"}"}`},
+			expectedAttachments: []string{"**mockTitle**\nmockDescription"},
+		},
+		{
+			description:         "Text after an attachment is added as an attachment",
+			data:                []string{`{"uiType": "OutputLink", "label": "mockLabel", "value": {"action": "https://mock.url"}}`, `{"uiType": "OutputText", "value": "mockText"}`},
+			expectedAttachments: []string{"[mockLabel](https://mock.url)", "mockText"},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			var posts []*model.Post
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DMInThread", func(_ *Plugin, _, _ string, post *model.Post) (string, error) {
+				posts = append(posts, post)
+				return "mockPostID", nil
+			})
+
+			ctx := p.newRenderContext("mock-userID", "")
+			for index, data := range testCase.data {
+				var body MessageResponseBody
+				require.NoError(t, json.Unmarshal([]byte(data), &body))
+				require.NoError(t, p.renderMessageResponse(ctx, index, body))
+			}
+			require.NoError(t, ctx.Flush())
+
+			require.Len(t, posts, 1)
+			require.Equal(t, testCase.expectedMessage, posts[0].Message)
+
+			var attachments []string
+			for _, attachment := range posts[0].Attachments() {
+				attachments = append(attachments, attachment.Text)
+			}
+			require.Equal(t, testCase.expectedAttachments, attachments)
+		})
+	}
+}
+
+func Test_promptRenderers(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description     string
+		renderer        Renderer
+		value           interface{}
+		expectedActions []string
+	}{
+		{
+			description:     "Boolean is rendered with the yes and no buttons",
+			renderer:        &booleanRenderer{},
+			value:           &Boolean{Label: "mockLabel"},
+			expectedActions: []string{BooleanYesLabel, BooleanNoLabel},
+		},
+		{
+			description:     "Date is rendered with a button opening the dialog",
+			renderer:        &defaultDateRenderer{},
+			value:           &DefaultDate{UIType: DateUIType, Label: "mockLabel"},
+			expectedActions: []string{"Set Date"},
+		},
+		{
+			description:     "Topic picker is rendered as a dropdown",
+			renderer:        &topicPickerControlRenderer{},
+			value:           &TopicPickerControl{PromptMessage: "mockLabel", Options: []Option{{Label: "mockLabel-1", Value: "mockValue-1", Enabled: true}}},
+			expectedActions: []string{"Select an option..."},
+		},
+		{
+			description: "Topic picker without options is not rendered",
+			renderer:    &topicPickerControlRenderer{},
+			value:       &TopicPickerControl{PromptMessage: "mockLabel"},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("LogInfo", "TopicPickerControl dropdown has no options to display.").Return()
+			p.SetAPI(mockAPI)
+
+			isActivePromptSet := false
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "SetActivePrompt", func(_ *Plugin, _, _, postID string) error {
+				require.Equal(t, "mockPostID", postID)
+				isActivePromptSet = true
+				return nil
+			})
+
+			var actions []string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DMInThread", func(_ *Plugin, _, _ string, post *model.Post) (string, error) {
+				for _, attachment := range post.Attachments() {
+					for _, action := range attachment.Actions {
+						actions = append(actions, action.Name)
+					}
+				}
+				return "mockPostID", nil
+			})
+
+			require.NoError(t, testCase.renderer.Render(&p, p.newRenderContext("mock-userID", ""), testCase.value))
+			require.Equal(t, testCase.expectedActions, actions)
+			require.Equal(t, testCase.expectedActions != nil, isActivePromptSet)
+		})
+	}
+}
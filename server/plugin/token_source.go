@@ -0,0 +1,122 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
+)
+
+// userTokenSource is an oauth2.TokenSource which refreshes the OAuth2 token of a connected user
+// and saves every refreshed token back to the user's record in the KV store.
+type userTokenSource struct {
+	ctx              context.Context
+	plugin           *Plugin
+	mattermostUserID string
+}
+
+// NewUserTokenSource returns a token source which reuses the given token until it expires and
+// then refreshes it, persisting the new token for the user.
+func (p *Plugin) NewUserTokenSource(ctx context.Context, token *oauth2.Token, mattermostUserID string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(token, &userTokenSource{
+		ctx:              ctx,
+		plugin:           p,
+		mattermostUserID: mattermostUserID,
+	})
+}
+
+func (s *userTokenSource) Token() (*oauth2.Token, error) {
+	unlock, err := s.plugin.lockTokenRefresh(s.mattermostUserID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Load the token again from the KV store as another request for the same user
+	// might have already refreshed it while we were waiting for the lock.
+	user, oldData, err := s.plugin.store.LoadUserRecord(s.mattermostUserID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load user for refreshing the OAuth2 token")
+	}
+
+	storedToken, err := s.plugin.ParseAuthToken(user.OAuth2Token)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse the stored OAuth2 token")
+	}
+
+	if storedToken.Valid() {
+		return storedToken, nil
+	}
+
+	instance, err := s.plugin.getConfiguration().getInstance(user.InstanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.plugin.NewOAuth2Config(instance).TokenSource(s.ctx, storedToken).Token()
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedToken, err := s.plugin.NewEncodedAuthToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.storeToken(user, oldData, encryptedToken); err != nil {
+		return nil, errors.Wrap(err, "failed to store the refreshed OAuth2 token")
+	}
+
+	return token, nil
+}
+
+// storeToken stores the refreshed token only if the user is not changed in the meantime, so that the changes made on any node,
+// like a re-authorization request or a re-encryption, are not overwritten. The token is set on the reloaded user if it has changed.
+func (s *userTokenSource) storeToken(user *serializer.User, oldData []byte, encryptedToken string) error {
+	for attempt := 0; attempt < TokenStoreMaxAttempts; attempt++ {
+		if attempt > 0 {
+			var err error
+			if user, oldData, err = s.plugin.store.LoadUserRecord(s.mattermostUserID); err != nil {
+				return err
+			}
+		}
+
+		refreshedUser := *user
+		refreshedUser.OAuth2Token = encryptedToken
+		stored, err := s.plugin.store.CompareAndStoreUser(oldData, &refreshedUser)
+		if err != nil {
+			return err
+		}
+
+		if stored {
+			return nil
+		}
+	}
+
+	return errors.New("the user was changed while storing the refreshed OAuth2 token")
+}
+
+// lockTokenRefresh locks the token refresh for the given user and returns the function to unlock it.
+// The local mutex serializes the requests on this node, so that only one of them polls the cluster lock,
+// which serializes the refreshes across all the nodes of the cluster.
+func (p *Plugin) lockTokenRefresh(mattermostUserID string) (func(), error) {
+	lock, _ := p.tokenRefreshLocks.LoadOrStore(mattermostUserID, &sync.Mutex{})
+	mutex := lock.(*sync.Mutex)
+	mutex.Lock()
+
+	unlockCluster, err := p.lockCluster(fmt.Sprintf(TokenRefreshLockKey, mattermostUserID), ClusterLockTTL, ClusterLockWaitTimeout*time.Second)
+	if err != nil {
+		mutex.Unlock()
+		return nil, errors.Wrap(err, "failed to lock the OAuth2 token refresh")
+	}
+
+	return func() {
+		unlockCluster()
+		mutex.Unlock()
+	}, nil
+}
@@ -0,0 +1,199 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	mock_plugin "github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/mocks"
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
+)
+
+type mockTokenSource struct {
+	token *oauth2.Token
+	err   error
+}
+
+func (m *mockTokenSource) Token() (*oauth2.Token, error) {
+	return m.token, m.err
+}
+
+func Test_userTokenSource_Token(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	validToken := &oauth2.Token{AccessToken: "mockValidAccessToken", Expiry: time.Now().Add(time.Hour)}
+	expiredToken := &oauth2.Token{AccessToken: "mockExpiredAccessToken", RefreshToken: "mockRefreshToken", Expiry: time.Now().Add(-time.Hour)}
+	refreshedToken := &oauth2.Token{AccessToken: "mockRefreshedAccessToken", RefreshToken: "mockNewRefreshToken", Expiry: time.Now().Add(time.Hour)}
+
+	for _, testCase := range []struct {
+		description         string
+		storedToken         *oauth2.Token
+		loadUserError       error
+		parseAuthTokenError error
+		refreshError        error
+		storeUserError      error
+		isUserChanged       bool
+		lockError           error
+		expectedToken       *oauth2.Token
+		expectedErr         string
+		isRefreshed         bool
+	}{
+		{
+			description:   "Token already refreshed by another request is reused",
+			storedToken:   validToken,
+			expectedToken: validToken,
+		},
+		{
+			description:   "Expired token is refreshed and stored",
+			storedToken:   expiredToken,
+			expectedToken: refreshedToken,
+			isRefreshed:   true,
+		},
+		{
+			description: "Error while locking the token refresh",
+			lockError:   errors.New("error in storing the lock in KVstore"),
+			expectedErr: "failed to lock the OAuth2 token refresh: failed to acquire the cluster lock: error in storing the lock in KVstore",
+		},
+		{
+			description:   "Error while loading the user",
+			loadUserError: errors.New("error in loading the user from KVstore"),
+			expectedErr:   "failed to load user for refreshing the OAuth2 token: error in loading the user from KVstore",
+		},
+		{
+			description:         "Error while parsing the stored token",
+			storedToken:         expiredToken,
+			parseAuthTokenError: errors.New("error in parsing the auth token"),
+			expectedErr:         "failed to parse the stored OAuth2 token: error in parsing the auth token",
+		},
+		{
+			description:  "Error while refreshing the token",
+			storedToken:  expiredToken,
+			refreshError: errors.New("error in refreshing the token"),
+			expectedErr:  "error in refreshing the token",
+		},
+		{
+			description:   "Refreshed token is stored in the user changed in the meantime",
+			storedToken:   expiredToken,
+			isUserChanged: true,
+			expectedToken: refreshedToken,
+			isRefreshed:   true,
+		},
+		{
+			description:    "Error while storing the refreshed token",
+			storedToken:    expiredToken,
+			storeUserError: errors.New("error in storing the user in KVstore"),
+			expectedErr:    "failed to store the refreshed OAuth2 token: error in storing the user in KVstore",
+			isRefreshed:    true,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := &Plugin{}
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().TryLock("token_refresh_mock-userID", gomock.Any(), int64(ClusterLockTTL)).Return(testCase.lockError == nil, testCase.lockError)
+			if testCase.lockError == nil {
+				mockedStore.EXPECT().Unlock("token_refresh_mock-userID", gomock.Any()).Return(nil)
+				mockedStore.EXPECT().LoadUserRecord("mock-userID").Return(&serializer.User{
+					MattermostUserID: "mock-userID",
+					OAuth2Token:      "mockStoredToken",
+				}, []byte("mockStoredData"), testCase.loadUserError)
+			}
+
+			if testCase.isUserChanged {
+				mockedStore.EXPECT().CompareAndStoreUser([]byte("mockStoredData"), &serializer.User{
+					MattermostUserID: "mock-userID",
+					OAuth2Token:      "mockEncodedToken",
+				}).Return(false, nil)
+				mockedStore.EXPECT().LoadUserRecord("mock-userID").Return(&serializer.User{
+					MattermostUserID:        "mock-userID",
+					OAuth2Token:             "mockStoredToken",
+					ReauthorizationRequired: true,
+				}, []byte("mockChangedData"), nil)
+				// The change made in the meantime is kept
+				mockedStore.EXPECT().CompareAndStoreUser([]byte("mockChangedData"), &serializer.User{
+					MattermostUserID:        "mock-userID",
+					OAuth2Token:             "mockEncodedToken",
+					ReauthorizationRequired: true,
+				}).Return(true, nil)
+			} else if testCase.isRefreshed {
+				mockedStore.EXPECT().CompareAndStoreUser([]byte("mockStoredData"), &serializer.User{
+					MattermostUserID: "mock-userID",
+					OAuth2Token:      "mockEncodedToken",
+				}).Return(testCase.storeUserError == nil, testCase.storeUserError)
+			}
+
+			p.store = mockedStore
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "ParseAuthToken", func(_ *Plugin, _ string) (*oauth2.Token, error) {
+				return testCase.storedToken, testCase.parseAuthTokenError
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&oauth2.Config{}), "TokenSource", func(_ *oauth2.Config, _ context.Context, _ *oauth2.Token) oauth2.TokenSource {
+				return &mockTokenSource{token: refreshedToken, err: testCase.refreshError}
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "NewEncodedAuthToken", func(_ *Plugin, _ *oauth2.Token) (string, error) {
+				return "mockEncodedToken", nil
+			})
+
+			tokenSource := &userTokenSource{
+				ctx:              context.Background(),
+				plugin:           p,
+				mattermostUserID: "mock-userID",
+			}
+
+			token, err := tokenSource.Token()
+			if testCase.expectedErr != "" {
+				require.EqualError(t, err, testCase.expectedErr)
+				require.Nil(t, token)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, testCase.expectedToken, token)
+			}
+		})
+	}
+}
+
+func Test_lockTokenRefresh(t *testing.T) {
+	t.Run("Token refresh is locked per user", func(t *testing.T) {
+		p := &Plugin{}
+
+		mockCtrl := gomock.NewController(t)
+		mockedStore := mock_plugin.NewMockStore(mockCtrl)
+		mockedStore.EXPECT().TryLock(gomock.Any(), gomock.Any(), gomock.Any()).Return(true, nil).Times(3)
+		mockedStore.EXPECT().Unlock(gomock.Any(), gomock.Any()).Return(nil).Times(3)
+		p.store = mockedStore
+
+		unlock, err := p.lockTokenRefresh("mock-userID")
+		require.NoError(t, err)
+
+		locked := make(chan struct{})
+		go func() {
+			defer close(locked)
+			unlockAgain, _ := p.lockTokenRefresh("mock-userID")
+			unlockAgain()
+		}()
+
+		// A different user must not be blocked by the lock
+		unlockOther, err := p.lockTokenRefresh("mock-userID-2")
+		require.NoError(t, err)
+		unlockOther()
+
+		select {
+		case <-locked:
+			require.Fail(t, "lock acquired while held by another request")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		unlock()
+		<-locked
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/pkg/errors"
@@ -15,12 +16,18 @@ import (
 )
 
 func (p *Plugin) InitOAuth2(mattermostUserID string) (string, error) {
-	if _, err := p.GetUser(mattermostUserID); err == nil {
+	if user, err := p.GetUser(mattermostUserID); err == nil && !user.ReauthorizationRequired {
 		return "", fmt.Errorf("user is already connected to ServiceNow")
 	}
 
-	conf := p.NewOAuth2Config()
-	state := fmt.Sprintf("%v_%v", model.NewId()[0:15], mattermostUserID)
+	instance, err := p.GetInstanceForUser(mattermostUserID)
+	if err != nil {
+		return "", err
+	}
+
+	// The instance is kept in the state, so that the authorization is completed on the same instance
+	conf := p.NewOAuth2Config(instance)
+	state := fmt.Sprintf("%v_%v_%v", model.NewId()[0:15], mattermostUserID, instance.Name)
 	if err := p.store.StoreOAuth2State(state); err != nil {
 		return "", err
 	}
@@ -33,25 +40,41 @@ func (p *Plugin) CompleteOAuth2(authedUserID, code, state string) error {
 		return errors.New("missing user, code or state")
 	}
 
-	oconf := p.NewOAuth2Config()
-
 	err := p.store.VerifyOAuth2State(state)
 	if err != nil {
 		return errors.WithMessage(err, "missing stored state")
 	}
 
-	mattermostUserID := strings.Split(state, "_")[1]
+	// The instance name is the last part of the state, so it may contain underscores
+	stateParts := strings.SplitN(state, "_", 3)
+	if len(stateParts) < 2 {
+		return errors.New("invalid state")
+	}
+
+	mattermostUserID := stateParts[1]
 	if mattermostUserID != authedUserID {
 		return errors.New("not authorized, user ID mismatch")
 	}
 
+	instanceName := DefaultInstanceName
+	if len(stateParts) == 3 {
+		instanceName = stateParts[2]
+	}
+
+	instance, err := p.getConfiguration().getInstance(instanceName)
+	if err != nil {
+		return err
+	}
+
+	oconf := p.NewOAuth2Config(instance)
 	ctx := context.Background()
 	tok, err := oconf.Exchange(ctx, code)
 	if err != nil {
 		return err
 	}
 
-	client := p.MakeClient(context.Background(), tok)
+	// The user is not stored yet, so there is no record to save a refreshed token to.
+	client := p.MakeClient(context.Background(), instance, tok, "")
 	serviceNowUser, err := client.GetMe(mattermostUserID)
 	if err != nil {
 		return err
@@ -62,10 +85,19 @@ func (p *Plugin) CompleteOAuth2(authedUserID, code, state string) error {
 		return err
 	}
 
+	// If the user is reconnecting, the post which was rejected along with the old token is sent again
+	var pendingPostID string
+	var pendingPostProgress *serializer.PendingPostProgress
+	if previousUser, previousUserErr := p.GetUser(mattermostUserID); previousUserErr == nil {
+		pendingPostID = previousUser.PendingPostID
+		pendingPostProgress = previousUser.PendingPostProgress
+	}
+
 	u := &serializer.User{
 		MattermostUserID: mattermostUserID,
 		OAuth2Token:      encryptedToken,
 		ServiceNowUser:   *serviceNowUser,
+		InstanceName:     instance.Name,
 	}
 
 	err = p.store.StoreUser(u)
@@ -78,6 +110,17 @@ func (p *Plugin) CompleteOAuth2(authedUserID, code, state string) error {
 		return err
 	}
 
+	// The user is connected at this point, so a failure of sending the pending post is only reported to the user
+	if pendingPostID != "" {
+		if err = p.ReplayPendingPost(client, u, pendingPostID, pendingPostProgress); err != nil {
+			p.API.LogError("Failed to send the pending post to the Virtual Agent", "UserID", mattermostUserID, "PostID", pendingPostID, "Error", err.Error())
+			if _, err = p.DM(mattermostUserID, PendingPostNotSentMessage); err != nil {
+				p.API.LogWarn("Failed to notify the user about the pending post", "UserID", mattermostUserID, "Error", err.Error())
+			}
+		}
+		return nil
+	}
+
 	err = client.StartConverstaionWithVirtualAgent(mattermostUserID)
 	if err != nil {
 		return err
@@ -86,6 +129,52 @@ func (p *Plugin) CompleteOAuth2(authedUserID, code, state string) error {
 	return nil
 }
 
+// RequestReauthorization marks the user as needing re-authorization, saves the post which couldn't be sent
+// to the Virtual Agent and sends the user a link to reconnect their ServiceNow account.
+// The progress is nil if no part of the post was sent.
+func (p *Plugin) RequestReauthorization(user *serializer.User, postID string, progress *serializer.PendingPostProgress) error {
+	user.ReauthorizationRequired = true
+	user.PendingPostID = postID
+	user.PendingPostProgress = progress
+	if err := p.store.StoreUser(user); err != nil {
+		return err
+	}
+
+	if _, err := p.DM(user.MattermostUserID, ReauthorizationMessage, fmt.Sprintf("%s%s", p.GetPluginURL(), PathOAuth2Connect)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReplayPendingPost sends the post which was rejected before the user reconnected their account to the Virtual Agent.
+// Only the parts of the post which were not sent before are sent, according to the progress.
+func (p *Plugin) ReplayPendingPost(client Client, user *serializer.User, postID string, progress *serializer.PendingPostProgress) error {
+	post, appErr := p.API.GetPost(postID)
+	if appErr != nil {
+		return errors.Wrap(appErr, fmt.Sprintf("failed to get the pending post. PostID: %s", postID))
+	}
+
+	post = post.Clone()
+	if progress != nil {
+		post.FileIds = progress.UnsentFileIDs
+		if progress.IsMessageSent {
+			post.Message = ""
+		}
+	}
+
+	isBotDMChannel, err := p.isBotDMChannel(post.ChannelId)
+	if err != nil {
+		return errors.Wrap(err, "failed to get the channel of the pending post")
+	}
+
+	if !isBotDMChannel {
+		post.Message = removeBotMention(post.Message)
+	}
+
+	return p.SendPostToVirtualAgent(client, user, post)
+}
+
 func (p *Plugin) GetUser(mattermostUserID string) (*serializer.User, error) {
 	storedUser, err := p.store.LoadUser(mattermostUserID)
 	if err != nil {
@@ -95,14 +184,88 @@ func (p *Plugin) GetUser(mattermostUserID string) (*serializer.User, error) {
 	return storedUser, nil
 }
 
+// DisconnectUser ends all the user's conversations with the Virtual Agent, revokes their OAuth2 token on ServiceNow,
+// deletes the state of their sessions and deletes the user from the KV store.
+// The conversations are ended in the background, and failures on ServiceNow are only logged, so that the user is always disconnected at once.
 func (p *Plugin) DisconnectUser(mattermostUserID string) error {
-	if err := p.store.DeleteUser(mattermostUserID); err != nil {
+	user, err := p.GetUser(mattermostUserID)
+	if err != nil {
+		return err
+	}
+
+	// The conversation outside of the threads has no session ID
+	sessionIDs := []string{""}
+	storedSessionIDs, err := p.store.LoadUserSessions(mattermostUserID)
+	if err != nil {
+		p.API.LogWarn("Failed to load the sessions of the user", "UserID", mattermostUserID, "Error", err.Error())
+	}
+	sessionIDs = append(sessionIDs, storedSessionIDs...)
+
+	if err = p.EndSessionOnServiceNow(user, sessionIDs); err != nil {
+		p.API.LogWarn("Failed to end the ServiceNow session of the user", "UserID", mattermostUserID, "Error", err.Error())
+	}
+
+	p.DeleteUserSessions(mattermostUserID, sessionIDs)
+
+	if err = p.store.DeleteUser(mattermostUserID); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// EndSessionOnServiceNow ends the user's conversations with the Virtual Agent in the sessions and revokes their OAuth2 token in the background.
+// The token is refreshed before it returns, so that a refreshed token is stored while the user still exists.
+func (p *Plugin) EndSessionOnServiceNow(user *serializer.User, sessionIDs []string) error {
+	token, err := p.ParseAuthToken(user.OAuth2Token)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse the OAuth2 token")
+	}
+
+	instance, err := p.getConfiguration().getInstance(user.InstanceName)
+	if err != nil {
+		return err
+	}
+
+	// Get a valid token first from the token source of the user, which refreshes it under the lock of the user,
+	// so that the latest refresh token is revoked if the token gets refreshed here
+	token, err = p.NewUserTokenSource(context.Background(), token, user.MattermostUserID).Token()
+	if err != nil {
+		return errors.Wrap(err, "failed to get a valid OAuth2 token")
+	}
+
+	go p.EndConversationsAndRevokeToken(instance, token, user, sessionIDs)
+	return nil
+}
+
+// EndConversationsAndRevokeToken ends the user's conversations with the Virtual Agent in the sessions, a batch of them at a time, and then revokes the token.
+// The user may already be deleted, so the failures are only logged.
+func (p *Plugin) EndConversationsAndRevokeToken(instance *ServiceNowInstance, token *oauth2.Token, user *serializer.User, sessionIDs []string) {
+	client := p.MakeClient(context.Background(), instance, token, "")
+	for start := 0; start < len(sessionIDs); start += EndConversationBatchSize {
+		end := start + EndConversationBatchSize
+		if end > len(sessionIDs) {
+			end = len(sessionIDs)
+		}
+
+		var wg sync.WaitGroup
+		for _, sessionID := range sessionIDs[start:end] {
+			wg.Add(1)
+			go func(sessionID string) {
+				defer wg.Done()
+				if err := client.EndConversationWithVirtualAgent(user.UserID, sessionID); err != nil {
+					p.API.LogWarn("Failed to end the conversation with the Virtual Agent", "UserID", user.MattermostUserID, "SessionID", sessionID, "Error", err.Error())
+				}
+			}(sessionID)
+		}
+		wg.Wait()
+	}
+
+	if err := p.RevokeOAuth2Token(instance, token); err != nil {
+		p.API.LogWarn("Failed to revoke the OAuth2 token of the user", "UserID", user.MattermostUserID, "Error", err.Error())
+	}
+}
+
 func (p *Plugin) CreateDisconnectUserAttachment() *model.SlackAttachment {
 	disconnectUserPath := fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathUserDisconnect)
 	disconnectUserAttachment := &model.SlackAttachment{
@@ -156,7 +319,7 @@ func (c *client) GetMe(mattermostUserID string) (*serializer.ServiceNowUser, err
 	}
 
 	userDetails := &serializer.UserDetails{}
-	path := fmt.Sprintf("%s%s", c.plugin.getConfiguration().ServiceNowURL, PathGetUser)
+	path := fmt.Sprintf("%s%s", c.instance.URL, PathGetUser)
 	params := url.Values{}
 	params.Add(SysQueryParam, fmt.Sprintf("email=%s", mattermostUser.Email))
 
@@ -168,7 +331,7 @@ func (c *client) GetMe(mattermostUserID string) (*serializer.ServiceNowUser, err
 		return nil, fmt.Errorf("user doesn't exist on ServiceNow with email %s", mattermostUser.Email)
 	}
 	if len(userDetails.UserDetails) > 1 {
-		c.plugin.API.LogWarn("Multiple users with the same email address exist on ServiceNow instance", "Email", mattermostUser.Email, "Instance", c.plugin.getConfiguration().ServiceNowURL)
+		c.plugin.API.LogWarn("Multiple users with the same email address exist on ServiceNow instance", "Email", mattermostUser.Email, "Instance", c.instance.URL)
 	}
 
 	return userDetails.UserDetails[0], nil
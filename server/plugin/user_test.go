@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 
 	"bou.ke/monkey"
+	"github.com/bluele/gcache"
 	"github.com/golang/mock/gomock"
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
@@ -63,28 +65,78 @@ func Test_GetUser(t *testing.T) {
 }
 
 func Test_DisconnectUser(t *testing.T) {
+	defer monkey.UnpatchAll()
+
 	for _, testCase := range []struct {
-		description string
-		errMessage  error
-		expectedErr string
+		description       string
+		loadUserError     error
+		loadSessionsError error
+		endSessionError   error
+		errMessage        error
+		expectedErr       string
+		isDeleteExpected  bool
 	}{
 		{
-			description: "User is deleted successfully from KV store using mattermostID",
-			errMessage:  nil,
+			description:      "User is deleted successfully from KV store using mattermostID",
+			isDeleteExpected: true,
+		},
+		{
+			description:      "User is deleted from KV store even if ending the session on ServiceNow fails",
+			endSessionError:  errors.New("error in revoking the token"),
+			isDeleteExpected: true,
+		},
+		{
+			description:       "User is deleted from KV store even if loading the sessions fails",
+			loadSessionsError: errors.New("error in loading the sessions from KVstore"),
+			isDeleteExpected:  true,
+		},
+		{
+			description:   "Error in loading user from KV store using mattermostID",
+			loadUserError: errors.New("error in loading the user from KVstore"),
+			expectedErr:   "error in loading the user from KVstore",
 		},
 		{
-			description: "Error in deleting user from KV store using mattermostID",
-			errMessage:  errors.New("error in deleting the user from KVstore"),
-			expectedErr: "error in deleting the user from KVstore",
+			description:      "Error in deleting user from KV store using mattermostID",
+			errMessage:       errors.New("error in deleting the user from KVstore"),
+			expectedErr:      "error in deleting the user from KVstore",
+			isDeleteExpected: true,
 		},
 	} {
 		t.Run(testCase.description, func(t *testing.T) {
 			p := Plugin{}
 
+			mockAPI := &plugintest.API{}
+			if testCase.endSessionError != nil || testCase.loadSessionsError != nil {
+				mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 5)...).Return()
+			}
+			p.SetAPI(mockAPI)
+
 			mockCtrl := gomock.NewController(t)
 			mockedStore := mock_plugin.NewMockStore(mockCtrl)
 
-			mockedStore.EXPECT().DeleteUser("mock-userID").Return(testCase.errMessage)
+			mockedStore.EXPECT().LoadUser("mock-userID").Return(&serializer.User{MattermostUserID: "mock-userID"}, testCase.loadUserError)
+			expectedSessionIDs := []string{""}
+			if testCase.isDeleteExpected {
+				var storedSessionIDs []string
+				if testCase.loadSessionsError == nil {
+					storedSessionIDs = []string{"mock-sessionID"}
+					expectedSessionIDs = append(expectedSessionIDs, storedSessionIDs...)
+				}
+				mockedStore.EXPECT().LoadUserSessions("mock-userID").Return(storedSessionIDs, testCase.loadSessionsError)
+				mockedStore.EXPECT().DeleteUser("mock-userID").Return(testCase.errMessage)
+			}
+
+			// All the sessions of the user are ended and their state is deleted, including the conversation outside of the threads
+			var endedSessionIDs, deletedSessionIDs []string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "EndSessionOnServiceNow", func(_ *Plugin, _ *serializer.User, sessionIDs []string) error {
+				// The slice is copied, as it may be allocated on the stack of the caller
+				endedSessionIDs = append([]string(nil), sessionIDs...)
+				return testCase.endSessionError
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DeleteUserSessions", func(_ *Plugin, _ string, sessionIDs []string) {
+				deletedSessionIDs = append([]string(nil), sessionIDs...)
+			})
 
 			p.store = mockedStore
 
@@ -95,6 +147,139 @@ func Test_DisconnectUser(t *testing.T) {
 			} else {
 				require.Nil(t, err)
 			}
+			if testCase.isDeleteExpected {
+				require.Equal(t, expectedSessionIDs, endedSessionIDs)
+				require.Equal(t, expectedSessionIDs, deletedSessionIDs)
+			}
+			mockAPI.AssertExpectations(t)
+		})
+	}
+}
+
+func Test_EndSessionOnServiceNow(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description         string
+		parseAuthTokenError error
+		tokenError          error
+		expectedErr         string
+		isEndExpected       bool
+	}{
+		{
+			description:   "Conversations are ended and the token is revoked in the background",
+			isEndExpected: true,
+		},
+		{
+			description:         "Error while parsing the OAuth2 token",
+			parseAuthTokenError: errors.New("error in parsing the auth token"),
+			expectedErr:         "failed to parse the OAuth2 token: error in parsing the auth token",
+		},
+		{
+			description: "Error while refreshing the OAuth2 token",
+			tokenError:  errors.New("invalid_grant"),
+			expectedErr: "failed to get a valid OAuth2 token: invalid_grant",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "ParseAuthToken", func(_ *Plugin, _ string) (*oauth2.Token, error) {
+				return &oauth2.Token{}, testCase.parseAuthTokenError
+			})
+
+			// The token is refreshed by the token source of the user, which stores the refreshed token under the lock of the user
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "NewUserTokenSource", func(_ *Plugin, _ context.Context, _ *oauth2.Token, mattermostUserID string) oauth2.TokenSource {
+				require.Equal(t, "mock-userID", mattermostUserID)
+				return &mockTokenSource{token: &oauth2.Token{RefreshToken: "mockRefreshToken"}, err: testCase.tokenError}
+			})
+
+			ended := make(chan []string, 1)
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "EndConversationsAndRevokeToken", func(_ *Plugin, _ *ServiceNowInstance, token *oauth2.Token, _ *serializer.User, sessionIDs []string) {
+				require.Equal(t, "mockRefreshToken", token.RefreshToken)
+				ended <- append([]string(nil), sessionIDs...)
+			})
+
+			err := p.EndSessionOnServiceNow(&serializer.User{MattermostUserID: "mock-userID"}, []string{"", "mock-sessionID"})
+
+			if testCase.expectedErr != "" {
+				require.EqualError(t, err, testCase.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			if testCase.isEndExpected {
+				require.Equal(t, []string{"", "mock-sessionID"}, <-ended)
+			} else {
+				require.Empty(t, ended)
+			}
+		})
+	}
+}
+
+func Test_EndConversationsAndRevokeToken(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description          string
+		endConversationError error
+		revokeError          error
+	}{
+		{
+			description: "Conversations are ended and the token is revoked",
+		},
+		{
+			description:          "Token is revoked even if ending the conversations fails",
+			endConversationError: errors.New("error in ending the conversation"),
+		},
+		{
+			description: "Error while revoking the OAuth2 token is logged",
+			revokeError: errors.New("error in revoking the token"),
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			// More sessions than a batch are ended
+			sessionIDs := []string{""}
+			for i := 0; i < EndConversationBatchSize+1; i++ {
+				sessionIDs = append(sessionIDs, fmt.Sprintf("mock-sessionID-%d", i))
+			}
+
+			mockAPI := &plugintest.API{}
+			if testCase.endConversationError != nil {
+				mockAPI.On("LogWarn", testutils.GetMockArgumentsWithType("string", 7)...).Return().Times(len(sessionIDs))
+			}
+			if testCase.revokeError != nil {
+				mockAPI.On("LogWarn", "Failed to revoke the OAuth2 token of the user", "UserID", "mock-userID", "Error", "error in revoking the token").Return().Once()
+			}
+			p.SetAPI(mockAPI)
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "MakeClient", func(_ *Plugin, _ context.Context, _ *ServiceNowInstance, _ *oauth2.Token, _ string) Client {
+				return &client{}
+			})
+
+			var lock sync.Mutex
+			var endedSessionIDs []string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&client{}), "EndConversationWithVirtualAgent", func(_ *client, _, sessionID string) error {
+				lock.Lock()
+				defer lock.Unlock()
+				endedSessionIDs = append(endedSessionIDs, sessionID)
+				return testCase.endConversationError
+			})
+
+			isRevoked := false
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "RevokeOAuth2Token", func(_ *Plugin, _ *ServiceNowInstance, token *oauth2.Token) error {
+				isRevoked = true
+				require.Equal(t, "mockRefreshToken", token.RefreshToken)
+				// The token is revoked only after all the conversations are ended
+				require.ElementsMatch(t, sessionIDs, endedSessionIDs)
+				return testCase.revokeError
+			})
+
+			p.EndConversationsAndRevokeToken(&ServiceNowInstance{}, &oauth2.Token{RefreshToken: "mockRefreshToken"}, &serializer.User{MattermostUserID: "mock-userID"}, sessionIDs)
+
+			require.True(t, isRevoked)
+			mockAPI.AssertExpectations(t)
 		})
 	}
 }
@@ -200,6 +385,13 @@ func Test_InitOAuth2(t *testing.T) {
 			expectedErr:   "",
 			loadUserError: errors.New("user is not present in KVstore"),
 		},
+		{
+			description: "OAuth2 is initialized successfully for a user who needs re-authorization",
+			expectedErr: "",
+			loadedUser: &serializer.User{
+				ReauthorizationRequired: true,
+			},
+		},
 		{
 			description:   "Error occurred while storing oauth2 state",
 			errMessage:    errors.New("error storing OAuth2 state"),
@@ -215,7 +407,7 @@ func Test_InitOAuth2(t *testing.T) {
 
 			mockedStore.EXPECT().LoadUser("mock-userID").Return(testCase.loadedUser, testCase.loadUserError)
 
-			if testCase.loadUserError != nil {
+			if testCase.loadUserError != nil || testCase.loadedUser.ReauthorizationRequired {
 				mockedStore.EXPECT().StoreOAuth2State(gomock.Any()).Return(testCase.errMessage)
 			}
 
@@ -249,6 +441,8 @@ func Test_CompleteOAuth2(t *testing.T) {
 		storeUserError                         error
 		dMError                                error
 		startConverstaionWithVirtualAgentError error
+		pendingPostID                          string
+		replayPendingPostError                 error
 	}{
 		{
 			description:  "OAuth2 is completed successfully",
@@ -340,6 +534,21 @@ func Test_CompleteOAuth2(t *testing.T) {
 			expectedErr:                            "error starting conversation with Virtual Agent",
 			startConverstaionWithVirtualAgentError: errors.New("error starting conversation with Virtual Agent"),
 		},
+		{
+			description:   "OAuth2 is completed successfully and the pending post is sent again",
+			authedUserID:  "mock-authedUserID",
+			code:          "mockCode",
+			state:         "mockState_mock-authedUserID",
+			pendingPostID: "mock-postID",
+		},
+		{
+			description:            "Error while sending the pending post again is reported to the user",
+			authedUserID:           "mock-authedUserID",
+			code:                   "mockCode",
+			state:                  "mockState_mock-authedUserID",
+			pendingPostID:          "mock-postID",
+			replayPendingPostError: errors.New("error sending the pending post"),
+		},
 	} {
 		t.Run(testCase.description, func(t *testing.T) {
 			p := Plugin{}
@@ -355,7 +564,7 @@ func Test_CompleteOAuth2(t *testing.T) {
 				return &oauth2.Token{}, testCase.exchangeError
 			})
 
-			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "MakeClient", func(_ *Plugin, _ context.Context, _ *oauth2.Token) Client {
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "MakeClient", func(_ *Plugin, _ context.Context, _ *ServiceNowInstance, _ *oauth2.Token, _ string) Client {
 				return &client{}
 			})
 
@@ -371,14 +580,43 @@ func Test_CompleteOAuth2(t *testing.T) {
 				mockedStore.EXPECT().StoreUser(gomock.Any()).Return(testCase.storeUserError)
 			}
 
-			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DM", func(_ *Plugin, _, _ string, _ ...interface{}) (string, error) {
+			mockAPI := &plugintest.API{}
+			defer mockAPI.AssertExpectations(t)
+			if testCase.replayPendingPostError != nil {
+				mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 7)...).Return()
+			}
+			p.SetAPI(mockAPI)
+
+			var dms []string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DM", func(_ *Plugin, _, format string, _ ...interface{}) (string, error) {
+				dms = append(dms, format)
 				return "mockToken", testCase.dMError
 			})
 
 			monkey.PatchInstanceMethod(reflect.TypeOf(&client{}), "StartConverstaionWithVirtualAgent", func(_ *client, _ string) error {
+				if testCase.pendingPostID != "" {
+					require.Fail(t, "conversation should not be started when a pending post is sent again")
+				}
 				return testCase.startConverstaionWithVirtualAgentError
 			})
 
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "GetUser", func(_ *Plugin, _ string) (*serializer.User, error) {
+				if testCase.pendingPostID == "" {
+					return nil, ErrNotFound
+				}
+				return &serializer.User{
+					ReauthorizationRequired: true,
+					PendingPostID:           testCase.pendingPostID,
+					PendingPostProgress:     &serializer.PendingPostProgress{UnsentFileIDs: []string{"mockFileID"}},
+				}, nil
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "ReplayPendingPost", func(_ *Plugin, _ Client, _ *serializer.User, postID string, progress *serializer.PendingPostProgress) error {
+				require.Equal(t, testCase.pendingPostID, postID)
+				require.Equal(t, []string{"mockFileID"}, progress.UnsentFileIDs)
+				return testCase.replayPendingPostError
+			})
+
 			p.store = mockedStore
 
 			err := p.CompleteOAuth2(testCase.authedUserID, testCase.code, testCase.state)
@@ -387,6 +625,161 @@ func Test_CompleteOAuth2(t *testing.T) {
 			} else {
 				require.Nil(t, err)
 			}
+			if testCase.replayPendingPostError != nil {
+				require.Equal(t, []string{ConnectSuccessMessage, PendingPostNotSentMessage}, dms)
+			}
+		})
+	}
+}
+
+func Test_RequestReauthorization(t *testing.T) {
+	for _, testCase := range []struct {
+		description    string
+		storeUserError error
+		dmError        error
+		expectedErr    string
+	}{
+		{
+			description: "User is marked for re-authorization and the connect link is sent",
+		},
+		{
+			description:    "Error while storing the user",
+			storeUserError: errors.New("error in storing the user in KVstore"),
+			expectedErr:    "error in storing the user in KVstore",
+		},
+		{
+			description: "Error while sending the connect link",
+			dmError:     &model.AppError{Message: "error in sending the DM"},
+			expectedErr: ": error in sending the DM, ",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().StoreUser(&serializer.User{
+				MattermostUserID:        "mock-userID",
+				ReauthorizationRequired: true,
+				PendingPostID:           "mock-postID",
+				PendingPostProgress:     &serializer.PendingPostProgress{UnsentFileIDs: []string{"mockFileID"}},
+			}).Return(testCase.storeUserError)
+			p.store = mockedStore
+
+			mockAPI := &plugintest.API{}
+			if testCase.storeUserError == nil {
+				mockAPI.On("GetDirectChannel", "mock-userID", mock.Anything).Return(&model.Channel{Id: "mock-channelID"}, nil)
+				var appErr *model.AppError
+				if testCase.dmError != nil {
+					appErr = testCase.dmError.(*model.AppError)
+					mockAPI.On("LogError", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+				}
+				mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{Id: "mock-postID"}, appErr)
+			}
+			p.SetAPI(mockAPI)
+
+			err := p.RequestReauthorization(&serializer.User{MattermostUserID: "mock-userID"}, "mock-postID", &serializer.PendingPostProgress{UnsentFileIDs: []string{"mockFileID"}})
+			if testCase.expectedErr != "" {
+				require.EqualError(t, err, testCase.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_ReplayPendingPost(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description     string
+		message         string
+		progress        *serializer.PendingPostProgress
+		isChannelPost   bool
+		getPostError    *model.AppError
+		getChannelError *model.AppError
+		sendError       error
+		expectedMessage string
+		expectedFileIDs []string
+		expectedErr     string
+	}{
+		{
+			description:     "Pending post is sent to the Virtual Agent",
+			message:         "mockMessage",
+			expectedMessage: "mockMessage",
+			expectedFileIDs: []string{"mockFileID-1", "mockFileID-2"},
+		},
+		{
+			description:     "Only the unsent files of the pending post are sent",
+			message:         "mockMessage",
+			progress:        &serializer.PendingPostProgress{UnsentFileIDs: []string{"mockFileID-2"}, IsMessageSent: true},
+			expectedFileIDs: []string{"mockFileID-2"},
+		},
+		{
+			description:     "Message of the pending post is sent when it was not sent before",
+			message:         "mockMessage",
+			progress:        &serializer.PendingPostProgress{},
+			expectedMessage: "mockMessage",
+		},
+		{
+			description:     "Pending post of a channel is sent without the mention of the bot",
+			message:         "@servicenow-virtual-agent mockMessage",
+			isChannelPost:   true,
+			expectedMessage: "mockMessage",
+			expectedFileIDs: []string{"mockFileID-1", "mockFileID-2"},
+		},
+		{
+			description:  "Error while getting the pending post",
+			getPostError: &model.AppError{Message: "error in getting the post"},
+			expectedErr:  "failed to get the pending post. PostID: mock-postID: : error in getting the post, ",
+		},
+		{
+			description:     "Error while getting the channel of the pending post",
+			getChannelError: &model.AppError{Message: "error in getting the channel"},
+			expectedErr:     "failed to get the channel of the pending post: : error in getting the channel, ",
+		},
+		{
+			description: "Error while sending the pending post",
+			sendError:   errors.New("error in sending the post"),
+			expectedErr: "error in sending the post",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{
+				channelCache: gcache.New(1).Build(),
+				botUserID:    "mock-botID",
+			}
+
+			channelName := "mock-botID__mock-userID"
+			if testCase.isChannelPost {
+				channelName = "mock-channelName"
+			}
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("GetPost", "mock-postID").Return(&model.Post{
+				Id:        "mock-postID",
+				ChannelId: "mock-channelID",
+				Message:   testCase.message,
+				FileIds:   []string{"mockFileID-1", "mockFileID-2"},
+			}, testCase.getPostError)
+			mockAPI.On("GetChannel", "mock-channelID").Return(&model.Channel{Name: channelName}, testCase.getChannelError)
+			p.SetAPI(mockAPI)
+
+			var sentPost *model.Post
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "SendPostToVirtualAgent", func(_ *Plugin, _ Client, _ *serializer.User, post *model.Post) error {
+				sentPost = post
+				return testCase.sendError
+			})
+
+			err := p.ReplayPendingPost(&client{}, &serializer.User{}, "mock-postID", testCase.progress)
+			if testCase.expectedErr != "" {
+				require.EqualError(t, err, testCase.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedMessage, sentPost.Message)
+			require.Equal(t, testCase.expectedFileIDs, []string(sentPost.FileIds))
 		})
 	}
 }
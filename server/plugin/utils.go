@@ -43,3 +43,13 @@ func (p *Plugin) validateTime(time string) string {
 
 	return ""
 }
+
+// truncate shortens the text to the given number of characters.
+func truncate(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+
+	return string(runes[:length-3]) + "..."
+}
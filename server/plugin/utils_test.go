@@ -114,3 +114,26 @@ func Test_validateTime(t *testing.T) {
 		})
 	}
 }
+
+func Test_truncate(t *testing.T) {
+	for _, testCase := range []struct {
+		description string
+		text        string
+		expected    string
+	}{
+		{
+			description: "Short text is not truncated",
+			text:        "mockText",
+			expected:    "mockText",
+		},
+		{
+			description: "Long text is truncated",
+			text:        "mock text which is too long",
+			expected:    "mock ...",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, truncate(testCase.text, 8))
+		})
+	}
+}
@@ -4,11 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"runtime/debug"
 	"strings"
 	"time"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
 )
 
 type VirtualAgentRequestBody struct {
@@ -16,6 +19,8 @@ type VirtualAgentRequestBody struct {
 	Message   *MessageBody `json:"message"`
 	RequestID string       `json:"requestId"`
 	UserID    string       `json:"userId"`
+	// ClientSessionID keeps the conversations in different threads apart. It is sent back with the responses of the Virtual Agent.
+	ClientSessionID string `json:"clientSessionId,omitempty"`
 }
 
 type MessageBody struct {
@@ -32,11 +37,33 @@ type MessageAttachment struct {
 
 type VirtualAgentResponse struct {
 	VirtualAgentRequestBody
-	Body []MessageResponseBody `json:"body"`
+	Body      []MessageResponseBody `json:"body"`
+	AgentChat bool                  `json:"agentChat"`
+	AgentInfo *AgentInfo            `json:"agentInfo"`
+}
+
+// AgentInfo identifies the live agent who sent a response during a live agent chat.
+type AgentInfo struct {
+	SentFromAgent bool   `json:"sentFromAgent"`
+	AgentName     string `json:"agentName"`
+	AgentAvatar   string `json:"agentAvatar"`
 }
 
+// MessageResponseBody is a part of a Virtual Agent response.
+// The value is parsed by the renderer of the uiType and the template name of the part.
 type MessageResponseBody struct {
-	Value interface{}
+	UIType       string
+	TemplateName string
+	Value        interface{}
+}
+
+// ActionMsg is a control event of the Virtual Agent, e.g. the start of a spinner or the end of a topic.
+type ActionMsg struct {
+	UIType        string `json:"uiType"`
+	Group         string `json:"group"`
+	ActionType    string `json:"actionType"`
+	Message       string `json:"message"`
+	QueuePosition int    `json:"queuePosition"`
 }
 
 type OutputText struct {
@@ -48,6 +75,12 @@ type OutputText struct {
 	Label    string `json:"label"`
 }
 
+type OutputHTML struct {
+	UIType string `json:"uiType"`
+	Group  string `json:"group"`
+	Value  string `json:"value"`
+}
+
 type OutputLinkValue struct {
 	Action string `json:"action"`
 }
@@ -123,6 +156,17 @@ type OutputCardImageData struct {
 	Target           string `json:"target"`
 }
 
+// OutputCardGenericData contains the common fields of the cards, which are used for the card templates not known to the plugin.
+type OutputCardGenericData struct {
+	Title       string          `json:"title"`
+	Subtitle    string          `json:"subtitle"`
+	Description string          `json:"description"`
+	Image       string          `json:"image"`
+	Link        string          `json:"link"`
+	URL         string          `json:"url"`
+	Fields      []*RecordFields `json:"fields"`
+}
+
 type RecordFields struct {
 	FieldLabel string `json:"fieldLabel"`
 	FieldValue string `json:"fieldValue"`
@@ -140,10 +184,34 @@ type Picker struct {
 	MultiSelect    bool     `json:"multiSelect"`
 }
 
+// Boolean is a yes/no question. The options are optional, as the Virtual Agent expects "true" or "false" as the answer.
+type Boolean struct {
+	UIType         string   `json:"uiType"`
+	Group          string   `json:"group"`
+	Required       bool     `json:"required"`
+	NLUTextEnabled bool     `json:"nluTextEnabled"`
+	Label          string   `json:"label"`
+	Options        []Option `json:"options"`
+}
+
 type Option struct {
-	Label   string `json:"label"`
-	Value   string `json:"value"`
-	Enabled bool   `json:"enabled"`
+	Label       string `json:"label"`
+	Value       string `json:"value"`
+	Enabled     bool   `json:"enabled"`
+	Description string `json:"description,omitempty"`
+	Attachment  string `json:"attachment,omitempty"`
+}
+
+// UnmarshalJSON defaults Enabled to true, so that options sent without the enabled flag can be selected.
+func (o *Option) UnmarshalJSON(data []byte) error {
+	type option Option
+	value := option{Enabled: true}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	*o = Option(value)
+	return nil
 }
 
 type OutputImage struct {
@@ -162,49 +230,31 @@ type DefaultDate struct {
 }
 
 func (m *MessageResponseBody) UnmarshalJSON(data []byte) error {
-	var uiType struct {
-		UIType string `json:"uiType"`
+	var header struct {
+		UIType       string `json:"uiType"`
+		TemplateName string `json:"templateName"`
 	}
 
-	if err := json.Unmarshal(data, &uiType); err != nil {
+	if err := json.Unmarshal(data, &header); err != nil {
 		return err
 	}
 
-	switch uiType.UIType {
-	case OutputTextUIType, InputTextUIType, FileUploadUIType:
-		m.Value = new(OutputText)
-	case TopicPickerControlUIType:
-		m.Value = new(TopicPickerControl)
-	case PickerUIType, BooleanUIType:
-		m.Value = new(Picker)
-	case OutputLinkUIType:
-		m.Value = new(OutputLink)
-	case GroupedPartsOutputControlUIType:
-		m.Value = new(GroupedPartsOutputControl)
-	case OutputCardUIType:
-		m.Value = new(OutputCard)
-	case OutputImageUIType:
-		m.Value = new(OutputImage)
-	case DateTimeUIType, DateUIType, TimeUIType:
-		m.Value = new(DefaultDate)
-	}
-
-	if m.Value != nil {
-		return json.Unmarshal(data, m.Value)
-	}
-
-	return nil
+	m.UIType = header.UIType
+	m.TemplateName = header.TemplateName
+	m.Value = renderers.Get(header.UIType, header.TemplateName).NewValue()
+	return json.Unmarshal(data, m.Value)
 }
 
-func (c *client) SendMessageToVirtualAgentAPI(serviceNowUserID, messageText string, typed bool, attachment *MessageAttachment) error {
+func (c *client) SendMessageToVirtualAgentAPI(serviceNowUserID, sessionID, messageText string, typed bool, attachment *MessageAttachment) error {
 	requestBody := &VirtualAgentRequestBody{
 		Message: &MessageBody{
 			Attachment: attachment,
 			Text:       messageText,
 			Typed:      typed,
 		},
-		RequestID: c.plugin.generateUUID(),
-		UserID:    serviceNowUserID,
+		RequestID:       c.plugin.generateUUID(),
+		UserID:          serviceNowUserID,
+		ClientSessionID: sessionID,
 	}
 
 	if _, err := c.CallJSON(http.MethodPost, PathVirtualAgentBotIntegration, requestBody, nil, nil); err != nil {
@@ -228,7 +278,57 @@ func (c *client) StartConverstaionWithVirtualAgent(userID string) error {
 	return nil
 }
 
-func (p *Plugin) ProcessResponse(data []byte) error {
+func (c *client) EndConversationWithVirtualAgent(userID, sessionID string) error {
+	requestBody := &VirtualAgentRequestBody{
+		Action:          EndConversationAction,
+		RequestID:       c.plugin.generateUUID(),
+		UserID:          userID,
+		ClientSessionID: sessionID,
+	}
+
+	if _, err := c.CallJSON(http.MethodPost, PathVirtualAgentBotIntegration, requestBody, nil, nil); err != nil {
+		return errors.Wrap(err, "failed to end conversation with virtual agent bot")
+	}
+
+	return nil
+}
+
+// webhookResponseError is the error of rendering a response for a known user, who can be told that the response could not be shown.
+type webhookResponseError struct {
+	ctx *RenderContext
+	err error
+}
+
+func (e *webhookResponseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *webhookResponseError) Unwrap() error {
+	return e.err
+}
+
+// processWebhookRequest processes a webhook request taken from the webhook queue.
+// It returns the error of processing the request, so that the queue retries it if the error is transient. A request which panics is not retried.
+func (p *Plugin) processWebhookRequest(request *webhookRequest) error {
+	// The request is processed outside of the HTTP handler, so a panic must be recovered here to keep the worker running.
+	defer func() {
+		if x := recover(); x != nil {
+			p.API.LogError("Recovered from a panic while processing webhook request",
+				"Error", x,
+				"Stack", string(debug.Stack()))
+		}
+	}()
+
+	if err := p.ProcessResponse(request.instanceName, request.data); err != nil {
+		p.API.LogError("Error occurred while processing response body.", "Error", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// ProcessResponse renders the response of the Virtual Agent received from the ServiceNow instance with the name instanceName.
+func (p *Plugin) ProcessResponse(instanceName string, data []byte) error {
 	vaResponse := &VirtualAgentResponse{}
 	if err := json.Unmarshal(data, &vaResponse); err != nil {
 		return err
@@ -239,119 +339,282 @@ func (p *Plugin) ProcessResponse(data []byte) error {
 		return err
 	}
 
-	userID := user.MattermostUserID
-	for _, messageResponse := range vaResponse.Body {
-		switch res := messageResponse.Value.(type) {
-		case *OutputText:
-			message := res.Value
-			if res.Label != "" {
-				message = res.Label
-				if res.ItemType == ItemTypeImage {
-					message += UploadImageMessage
-				} else if res.ItemType == ItemTypeFile {
-					message += UploadFileMessage
-				}
-			}
+	// An instance is only allowed to send messages to the users connected to it
+	if user.InstanceName != instanceName {
+		return fmt.Errorf("the user is not connected to the ServiceNow instance. Instance: %s", instanceName)
+	}
 
-			if _, err = p.DM(userID, message); err != nil {
-				return err
+	ctx := p.newRenderContext(user.MattermostUserID, vaResponse.ClientSessionID)
+	if instance, instanceErr := p.getConfiguration().getInstance(user.InstanceName); instanceErr == nil {
+		ctx.InstanceURL = instance.URL
+	}
+	if err = p.renderResponse(ctx, vaResponse); err != nil {
+		return &webhookResponseError{ctx: ctx, err: err}
+	}
+
+	return nil
+}
+
+// failWebhookRequest tells the user that a response of the Virtual Agent could not be shown, once its webhook request has failed for good.
+// Nobody is told when the user of the response is not known.
+func (p *Plugin) failWebhookRequest(err error) {
+	var responseErr *webhookResponseError
+	if !errors.As(err, &responseErr) {
+		return
+	}
+
+	// The message is posted by the bot, even if the response was sent by a live agent
+	ctx := *responseErr.ctx
+	ctx.LiveAgentChat = nil
+	if _, postErr := ctx.PostMessage(WebhookResponseNotShownMessage); postErr != nil {
+		p.API.LogError("Failed to tell the user that the response could not be shown", "UserID", ctx.UserID, "Error", postErr.Error())
+	}
+}
+
+// renderResponse renders the parts of the response which are not rendered yet by an earlier delivery of the same response.
+func (p *Plugin) renderResponse(ctx *RenderContext, vaResponse *VirtualAgentResponse) error {
+	var err error
+	if ctx.SessionID != "" {
+		if ctx.ChannelID, err = p.GetSessionChannelID(ctx.UserID, ctx.SessionID); err != nil {
+			return err
+		}
+	}
+	if ctx.LiveAgentChat, err = p.UpdateLiveAgentChat(ctx, vaResponse); err != nil {
+		return err
+	}
+
+	for index, messageResponse := range vaResponse.Body {
+		// Parts of the response which are already rendered by an earlier delivery of the same response are skipped.
+		if vaResponse.RequestID != "" {
+			claimed, claimErr := p.store.ClaimWebhookResponse(vaResponse.RequestID, index)
+			if claimErr != nil {
+				p.releaseWebhookResponse(vaResponse.RequestID, ctx.posts.indexes)
+				return errors.Wrap(claimErr, "failed to claim the webhook response")
 			}
-		case *TopicPickerControl:
-			if len(res.Options) == 0 {
-				p.API.LogInfo("TopicPickerControl dropdown has no options to display.")
-				return nil
+
+			if !claimed {
+				p.API.LogDebug("Skipping the already rendered webhook response", "RequestID", vaResponse.RequestID, "Index", index)
+				continue
 			}
+		}
 
-			if _, err = p.DMWithAttachments(userID, p.CreateTopicPickerControlAttachment(res)); err != nil {
-				return err
+		if err = p.renderMessageResponse(ctx, index, messageResponse); err != nil {
+			// Release the claims of the parts which are not posted, so that a retried delivery resumes from them
+			p.releaseWebhookResponse(vaResponse.RequestID, append(ctx.posts.indexes, index))
+			return err
+		}
+	}
+
+	if err = ctx.Flush(); err != nil {
+		p.releaseWebhookResponse(vaResponse.RequestID, ctx.posts.indexes)
+		return err
+	}
+
+	return nil
+}
+
+func (p *Plugin) releaseWebhookResponse(requestID string, indexes []int) {
+	if requestID == "" {
+		return
+	}
+
+	released := map[int]bool{}
+	for _, index := range indexes {
+		if released[index] {
+			continue
+		}
+		released[index] = true
+
+		if err := p.store.ReleaseWebhookResponse(requestID, index); err != nil {
+			p.API.LogError("Failed to release the webhook response", "RequestID", requestID, "Index", index, "Error", err.Error())
+		}
+	}
+}
+
+// UpdateLiveAgentChat keeps track of the chat of the user with a live agent in the session and notifies the user when an agent joins or leaves.
+// It returns the chat if the response is sent by the live agent.
+func (p *Plugin) UpdateLiveAgentChat(ctx *RenderContext, vaResponse *VirtualAgentResponse) (*serializer.LiveAgentChat, error) {
+	chat, err := p.store.LoadLiveAgentChat(ctx.sessionKey())
+	if err != nil && err != ErrNotFound {
+		return nil, errors.Wrap(err, "failed to load the live agent chat")
+	}
+
+	if !vaResponse.AgentChat {
+		if chat != nil {
+			if err = p.EndLiveAgentChat(ctx, chat); err != nil {
+				return nil, err
 			}
-		case *Picker:
-			if _, err = p.DM(userID, res.Label); err != nil {
-				return err
+		}
+		return nil, nil
+	}
+
+	// Messages of the system, like the queue position, are sent by the bot even during a live agent chat
+	if vaResponse.AgentInfo == nil || !vaResponse.AgentInfo.SentFromAgent {
+		return nil, nil
+	}
+
+	if chat == nil || chat.AgentName != vaResponse.AgentInfo.AgentName {
+		chat = &serializer.LiveAgentChat{
+			AgentName:   vaResponse.AgentInfo.AgentName,
+			AgentAvatar: vaResponse.AgentInfo.AgentAvatar,
+			StartedAt:   time.Now(),
+		}
+		if err = p.store.StoreLiveAgentChat(ctx.sessionKey(), chat); err != nil {
+			return nil, errors.Wrap(err, "failed to store the live agent chat")
+		}
+
+		if _, err = ctx.PostMessage(fmt.Sprintf(LiveAgentJoinedMessage, chat.AgentName)); err != nil {
+			return nil, err
+		}
+	}
+
+	return chat, nil
+}
+
+// EndLiveAgentChat ends the chat of the user with the live agent, so that the responses are shown as sent by the bot again.
+func (p *Plugin) EndLiveAgentChat(ctx *RenderContext, chat *serializer.LiveAgentChat) error {
+	if err := p.store.DeleteLiveAgentChat(ctx.sessionKey()); err != nil {
+		return errors.Wrap(err, "failed to delete the live agent chat")
+	}
+
+	// The pending post is still sent by the live agent, while the rest of the response is sent by the bot
+	if err := ctx.Flush(); err != nil {
+		return err
+	}
+	ctx.LiveAgentChat = nil
+
+	if _, err := ctx.PostMessage(fmt.Sprintf(LiveAgentLeftMessage, chat.AgentName)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *Plugin) newRenderContext(userID, sessionID string) *RenderContext {
+	ctx := &RenderContext{
+		UserID:    userID,
+		SessionID: sessionID,
+		plugin:    p,
+	}
+	ctx.posts = &postCoalescer{ctx: ctx}
+	return ctx
+}
+
+// renderMessageResponse renders a part of a response. The pending post of the context is posted first,
+// unless the part can be merged into it.
+func (p *Plugin) renderMessageResponse(ctx *RenderContext, index int, messageResponse MessageResponseBody) error {
+	renderer := renderers.Get(messageResponse.UIType, messageResponse.TemplateName)
+	if !isCoalescing(renderer) {
+		if err := ctx.Flush(); err != nil {
+			return err
+		}
+	}
+
+	ctx.posts.index = index
+	return renderer.Render(p, ctx, messageResponse.Value)
+}
+
+// HandleActionMsg handles the control events of the Virtual Agent, which are not rendered as posts.
+func (p *Plugin) HandleActionMsg(ctx *RenderContext, actionMsg *ActionMsg) error {
+	switch actionMsg.ActionType {
+	case ActionTypeStartSpinner:
+		channelID := ctx.ChannelID
+		if channelID == "" {
+			channel, appErr := p.API.GetDirectChannel(ctx.UserID, p.botUserID)
+			if appErr != nil {
+				return errors.Wrap(appErr, "failed to get the bot's DM channel")
 			}
-			if len(res.Options) == 0 {
-				p.API.LogInfo("Picker dropdown has no options to display.")
+			channelID = channel.Id
+		}
+
+		// The typing indicator is cleared when the next post of the bot is created
+		if appErr := p.API.PublishUserTyping(p.botUserID, channelID, ctx.SessionID); appErr != nil {
+			p.API.LogWarn("Failed to publish the typing event", "UserID", ctx.UserID, "Error", appErr.Error())
+		}
+	case ActionTypeEndSpinner:
+		// Nothing to do, the typing indicator expires by itself
+	case ActionTypeTopicFinished:
+		if err := p.store.DeleteMaskedInputPrompt(ctx.sessionKey()); err != nil {
+			return errors.Wrap(err, "failed to delete the masked input prompt")
+		}
+
+		if err := p.EndActivePrompt(ctx.UserID, ctx.SessionID); err != nil {
+			return err
+		}
+
+		chat, err := p.store.LoadLiveAgentChat(ctx.sessionKey())
+		if err != nil {
+			if err == ErrNotFound {
 				return nil
 			}
-			if _, err = p.DMWithAttachments(userID, p.CreatePickerAttachment(res)); err != nil {
-				return err
-			}
-		case *OutputLink:
-			if _, err = p.DMWithAttachments(userID, p.CreateOutputLinkAttachment(res)); err != nil {
-				return err
-			}
-		// TODO: Modify the UI for this later.
-		case *GroupedPartsOutputControl:
-			if _, err = p.DM(userID, res.Header); err != nil {
-				return err
-			}
+			return errors.Wrap(err, "failed to load the live agent chat")
+		}
 
-			for _, value := range res.Values {
-				if _, err = p.DMWithAttachments(userID, p.CreateGroupedPartsOutputControlAttachment(value)); err != nil {
-					return err
-				}
-			}
-		case *OutputCard:
-			switch res.TemplateName {
-			case OutputCardSmallImageType, OutputCardLargeImageType:
-				var data OutputCardImageData
-				if err = json.Unmarshal([]byte(res.Data), &data); err != nil {
-					return err
-				}
-
-				if _, err = p.DMWithAttachments(userID, p.CreateOutputCardImageAttachment(&data)); err != nil {
-					return err
-				}
-			case OutputCardVideoType:
-				var data OutputCardVideoData
-				if err = json.Unmarshal([]byte(res.Data), &data); err != nil {
-					return err
-				}
-
-				if _, err = p.DMWithAttachments(userID, p.CreateOutputCardVideoAttachment(&data)); err != nil {
-					return err
-				}
-
-				if _, err = p.dm(userID, &model.Post{
-					Message: fmt.Sprintf(YoutubeURL, data.ID),
-				}); err != nil {
-					return err
-				}
-			case OutputCardRecordType:
-				var data OutputCardRecordData
-				if err = json.Unmarshal([]byte(res.Data), &data); err != nil {
-					return err
-				}
-
-				if _, err = p.DMWithAttachments(userID, p.CreateOutputCardRecordAttachment(&data)); err != nil {
-					return err
-				}
-			}
-		case *OutputImage:
-			linkContents := strings.Split(res.Value, "/")
-			if len(linkContents) < 1 {
-				if _, err = p.DM(userID, fmt.Sprintf("Image: %s", res.AltText)); err != nil {
-					return err
-				}
-
-				p.API.LogError(InvalidImageLinkError, "Link", res.Value)
-				return errors.New(InvalidImageLinkError)
-			}
+		return p.EndLiveAgentChat(ctx, chat)
+	case ActionTypeSwitchToLiveAgent:
+		message := actionMsg.Message
+		if message == "" {
+			message = LiveAgentTransferMessage
+		}
 
-			completeFileName := linkContents[len(linkContents)-1]
-			if _, err = p.DM(userID, fmt.Sprintf("![%s](%s)", completeFileName, res.Value)); err != nil {
-				return err
-			}
-		case *DefaultDate:
-			if _, err = p.DMWithAttachments(userID, p.CreateDefaultDateAttachment(res)); err != nil {
+		if _, err := ctx.PostMessage(message); err != nil {
+			return err
+		}
+
+		if actionMsg.QueuePosition > 0 {
+			if _, err := ctx.PostMessage(fmt.Sprintf(LiveAgentQueueMessage, actionMsg.QueuePosition)); err != nil {
 				return err
 			}
 		}
+	case ActionTypeQueuePosition:
+		if _, err := ctx.PostMessage(fmt.Sprintf(LiveAgentQueueMessage, actionMsg.QueuePosition)); err != nil {
+			return err
+		}
+	default:
+		p.API.LogDebug("Ignoring the unknown action message of the Virtual Agent", "ActionType", actionMsg.ActionType)
 	}
 
 	return nil
 }
 
+// renderMaskedInput asks the user to enter the sensitive value in a dialog, so that it is not stored as a post.
+func (p *Plugin) renderMaskedInput(ctx *RenderContext, body *OutputText) error {
+	if err := p.store.StoreMaskedInputPrompt(ctx.sessionKey()); err != nil {
+		return errors.Wrap(err, "failed to store the masked input prompt")
+	}
+
+	// A value posted anywhere in the DM answers the latest prompt of the DM
+	if ctx.ChannelID == "" {
+		if err := p.store.StoreDMMaskedInputSession(ctx.UserID, ctx.SessionID); err != nil {
+			return errors.Wrap(err, "failed to store the session of the masked input prompt")
+		}
+	}
+
+	return ctx.PostPrompt(p.CreateMaskedInputAttachment(body))
+}
+
+func isMaskedInput(maskType string) bool {
+	return maskType != "" && !strings.EqualFold(maskType, MaskTypeNone)
+}
+
+func (p *Plugin) CreateMaskedInputAttachment(body *OutputText) *model.SlackAttachment {
+	return &model.SlackAttachment{
+		Text: body.Label + MaskedInputMessage,
+		Actions: []*model.PostAction{
+			{
+				Name: "Enter value",
+				Integration: &model.PostActionIntegration{
+					URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathMaskedInputDialog),
+					Context: map[string]interface{}{
+						MaskedInputLabelContextKey: body.Label,
+					},
+				},
+				Type: "button",
+			},
+		},
+	}
+}
+
 func (p *Plugin) CreateDefaultDateAttachment(body *DefaultDate) *model.SlackAttachment {
 	return &model.SlackAttachment{
 		Text: body.Label,
@@ -370,31 +633,50 @@ func (p *Plugin) CreateDefaultDateAttachment(body *DefaultDate) *model.SlackAtta
 	}
 }
 
-func (p *Plugin) CreateOutputLinkAttachment(body *OutputLink) *model.SlackAttachment {
+// CreateOutputLinkAttachment shows the link, or only its label if the link is not safe to show.
+func (p *Plugin) CreateOutputLinkAttachment(body *OutputLink, instanceURL string) *model.SlackAttachment {
+	text := body.Label
+	if link := resolveURL(body.Value.Action, instanceURL); link != "" {
+		text = fmt.Sprintf("[%s](%s)", escapeMarkdownLinkText(body.Label), escapeMarkdownURL(link))
+	}
+
 	return &model.SlackAttachment{
 		Pretext: body.Header,
-		Text:    fmt.Sprintf("[%s](%s)", body.Label, body.Value.Action),
+		Text:    text,
 	}
 }
 
-func (p *Plugin) CreateOutputCardImageAttachment(body *OutputCardImageData) *model.SlackAttachment {
+// CreateOutputCardImageAttachment shows the title and the description with the image, which is left out if it is not safe to load.
+func (p *Plugin) CreateOutputCardImageAttachment(body *OutputCardImageData, instanceURL string) *model.SlackAttachment {
 	return &model.SlackAttachment{
-		Text:     fmt.Sprintf("**%s**\n%s", body.Title, body.Description),
-		ImageURL: body.Image,
+		Text:     fmt.Sprintf("**%s**\n%s", body.Title, htmlToMarkdown(body.Description, instanceURL)),
+		ImageURL: resolveURL(body.Image, instanceURL),
 	}
 }
 
-func (p *Plugin) CreateOutputCardVideoAttachment(body *OutputCardVideoData) *model.SlackAttachment {
+// CreateOutputCardVideoAttachment shows the title with the link to the video, or only the title if the link is not safe to show.
+func (p *Plugin) CreateOutputCardVideoAttachment(body *OutputCardVideoData, instanceURL string) *model.SlackAttachment {
+	title := body.Title
+	if link := resolveURL(body.Link, instanceURL); link != "" {
+		title = fmt.Sprintf("[%s](%s)", escapeMarkdownLinkText(body.Title), escapeMarkdownURL(link))
+	}
+
 	return &model.SlackAttachment{
-		Text: fmt.Sprintf("**[%s](%s)**\n%s", body.Title, body.Link, body.Description),
+		Text: fmt.Sprintf("**%s**\n%s", title, htmlToMarkdown(body.Description, instanceURL)),
 	}
 }
 
-func (p *Plugin) CreateOutputCardRecordAttachment(body *OutputCardRecordData) *model.SlackAttachment {
+// CreateOutputCardRecordAttachment shows the fields of the record with the link to it, or only its subtitle if the link is not safe to show.
+func (p *Plugin) CreateOutputCardRecordAttachment(body *OutputCardRecordData, instanceURL string) *model.SlackAttachment {
+	subtitle := body.Subtitle
+	if link := resolveURL(body.URL, instanceURL); link != "" {
+		subtitle = fmt.Sprintf("[%s](%s)", escapeMarkdownLinkText(body.Subtitle), escapeMarkdownURL(link))
+	}
+
 	fields := make([]*model.SlackAttachmentField, len(body.Fields)+1)
 	fields[0] = &model.SlackAttachmentField{
 		Title: body.Title,
-		Value: fmt.Sprintf("[%s](%s)", body.Subtitle, body.URL),
+		Value: subtitle,
 	}
 	for index, field := range body.Fields {
 		fields[index+1] = &model.SlackAttachmentField{
@@ -407,10 +689,104 @@ func (p *Plugin) CreateOutputCardRecordAttachment(body *OutputCardRecordData) *m
 	}
 }
 
-func (p *Plugin) CreateGroupedPartsOutputControlAttachment(body GroupedPartsOutputControlValue) *model.SlackAttachment {
+// CreateOutputCardGenericAttachments shows the title, the fields and the link of the cards with an unknown template.
+// The data can contain a single card or a list of cards, which are shown together in one post.
+func (p *Plugin) CreateOutputCardGenericAttachments(data, instanceURL string) ([]*model.SlackAttachment, error) {
+	var cards []*OutputCardGenericData
+	if strings.HasPrefix(strings.TrimSpace(data), "[") {
+		if err := json.Unmarshal([]byte(data), &cards); err != nil {
+			return nil, err
+		}
+	} else {
+		card := &OutputCardGenericData{}
+		if err := json.Unmarshal([]byte(data), card); err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+
+	var attachments []*model.SlackAttachment
+	for _, card := range cards {
+		if card == nil || (card.Title == "" && card.Subtitle == "" && card.Description == "" && len(card.Fields) == 0) {
+			continue
+		}
+
+		attachment := &model.SlackAttachment{
+			Title: card.Title,
+			Text:  strings.TrimSpace(fmt.Sprintf("%s\n%s", card.Subtitle, htmlToMarkdown(card.Description, instanceURL))),
+		}
+
+		if isSafeURL(card.URL) {
+			attachment.TitleLink = card.URL
+		} else if isSafeURL(card.Link) {
+			attachment.TitleLink = card.Link
+		}
+
+		if isSafeURL(card.Image) {
+			attachment.ImageURL = card.Image
+		}
+
+		for _, field := range card.Fields {
+			attachment.Fields = append(attachment.Fields, &model.SlackAttachmentField{
+				Title: field.FieldLabel,
+				Value: field.FieldValue,
+				Short: true,
+			})
+		}
+
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, nil
+}
+
+// CreateCarouselAttachments shows each option of a carousel as a card with a button for selecting it.
+func (p *Plugin) CreateCarouselAttachments(body *Picker, instanceURL string) []*model.SlackAttachment {
+	labels := p.getPostActionOptionLabels(body.Options)
+	var attachments []*model.SlackAttachment
+	for _, option := range body.Options {
+		if !option.Enabled {
+			continue
+		}
+
+		attachment := &model.SlackAttachment{
+			Title: option.Label,
+			Text:  htmlToMarkdown(option.Description, instanceURL),
+			Actions: []*model.PostAction{
+				{
+					Name: CarouselSelectButtonName,
+					Integration: &model.PostActionIntegration{
+						URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathActionOptions),
+						Context: map[string]interface{}{
+							PickerSelectedOptionContextKey: option.Value,
+							PickerOptionLabelsContextKey:   labels,
+						},
+					},
+					Type: "button",
+				},
+			},
+		}
+
+		if isSafeURL(option.Attachment) {
+			attachment.ImageURL = option.Attachment
+		}
+
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments
+}
+
+// CreateGroupedPartsOutputControlAttachment shows the link of the part, or only its label if the link is not safe to show.
+func (p *Plugin) CreateGroupedPartsOutputControlAttachment(body GroupedPartsOutputControlValue, instanceURL string) *model.SlackAttachment {
+	title := body.Label
+	if link := resolveURL(body.Action, instanceURL); link != "" {
+		title = fmt.Sprintf("[%s](%s)", escapeMarkdownLinkText(body.Label), escapeMarkdownURL(link))
+	}
+
 	return &model.SlackAttachment{
-		Title: fmt.Sprintf("[%s](%s)", body.Label, body.Action),
-		Text:  body.Description,
+		Title: title,
+		Text:  htmlToMarkdown(body.Description, instanceURL),
 	}
 }
 
@@ -422,6 +798,9 @@ func (p *Plugin) CreateTopicPickerControlAttachment(body *TopicPickerControl) *m
 				Name: "Select an option...",
 				Integration: &model.PostActionIntegration{
 					URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathActionOptions),
+					Context: map[string]interface{}{
+						PickerOptionLabelsContextKey: p.getPostActionOptionLabels(body.Options),
+					},
 				},
 				Type:    "select",
 				Options: p.getPostActionOptions(body.Options),
@@ -437,6 +816,9 @@ func (p *Plugin) CreatePickerAttachment(body *Picker) *model.SlackAttachment {
 				Name: "Select an option...",
 				Integration: &model.PostActionIntegration{
 					URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathActionOptions),
+					Context: map[string]interface{}{
+						PickerOptionLabelsContextKey: p.getPostActionOptionLabels(body.Options),
+					},
 				},
 				Type:    "select",
 				Options: p.getPostActionOptions(body.Options),
@@ -445,18 +827,104 @@ func (p *Plugin) CreatePickerAttachment(body *Picker) *model.SlackAttachment {
 	}
 }
 
+// CreateBooleanAttachment creates a button for each answer of the yes/no question.
+// The buttons are handled in the same way as the picker options.
+func (p *Plugin) CreateBooleanAttachment(body *Boolean) *model.SlackAttachment {
+	options := body.Options
+	if len(options) == 0 {
+		options = []Option{
+			{Label: BooleanYesLabel, Value: BooleanTrueValue, Enabled: true},
+			{Label: BooleanNoLabel, Value: BooleanFalseValue, Enabled: true},
+		}
+	}
+
+	labels := p.getPostActionOptionLabels(options)
+	var actions []*model.PostAction
+	for _, option := range options {
+		if !option.Enabled {
+			continue
+		}
+
+		actions = append(actions, &model.PostAction{
+			Name: option.Label,
+			Integration: &model.PostActionIntegration{
+				URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathActionOptions),
+				Context: map[string]interface{}{
+					PickerSelectedOptionContextKey: option.Value,
+					PickerOptionLabelsContextKey:   labels,
+				},
+			},
+			Type: "button",
+		})
+	}
+
+	return &model.SlackAttachment{
+		Text:    body.Label,
+		Actions: actions,
+	}
+}
+
+// CreateMultiSelectPickerAttachment creates a button which opens a dialog for selecting multiple options of the picker.
+// The options are passed along in the context of the button, as the dialog is opened from a separate request.
+func (p *Plugin) CreateMultiSelectPickerAttachment(body *Picker) (*model.SlackAttachment, error) {
+	var enabledOptions []Option
+	for _, option := range body.Options {
+		if option.Enabled {
+			enabledOptions = append(enabledOptions, option)
+		}
+	}
+
+	options, err := json.Marshal(enabledOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal the picker options")
+	}
+
+	return &model.SlackAttachment{
+		Actions: []*model.PostAction{
+			{
+				Name: "Select options",
+				Integration: &model.PostActionIntegration{
+					URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathMultiSelectDialog),
+					Context: map[string]interface{}{
+						MultiSelectOptionsContextKey:  string(options),
+						MultiSelectRequiredContextKey: body.Required,
+					},
+				},
+				Type: "button",
+			},
+		},
+	}, nil
+}
+
+// getPostActionOptions returns the enabled options, which are sent to the Virtual Agent with their value.
 func (p *Plugin) getPostActionOptions(options []Option) []*model.PostActionOptions {
 	var postOptions []*model.PostActionOptions
 	for _, option := range options {
+		if !option.Enabled {
+			continue
+		}
+
 		postOptions = append(postOptions, &model.PostActionOptions{
 			Text:  option.Label,
-			Value: option.Label,
+			Value: option.Value,
 		})
 	}
 
 	return postOptions
 }
 
+// getPostActionOptionLabels maps the values of the enabled options to their labels, which are shown once an option is selected.
+func (p *Plugin) getPostActionOptionLabels(options []Option) map[string]interface{} {
+	labels := map[string]interface{}{}
+	for _, option := range options {
+		if option.Enabled {
+			labels[option.Value] = option.Label
+		}
+	}
+
+	return labels
+}
+
 func (p *Plugin) CreateMessageAttachment(fileID, userID string) (*MessageAttachment, error) {
 	var attachment *MessageAttachment
 	fileInfo, appErr := p.API.GetFileInfo(fileID)
@@ -472,8 +940,13 @@ func (p *Plugin) CreateMessageAttachment(fileID, userID string) (*MessageAttachm
 		return nil, fmt.Errorf("file does not belong to the Mattermost user: %s", userID)
 	}
 
-	//TODO: Add a configuration setting for expiry time
-	expiryTime := time.Now().UTC().Add(time.Minute * AttachmentLinkExpiryTimeInMinutes)
+	config := p.getConfiguration()
+	// Files breaking the attachment policy are refused before anything is sent to ServiceNow
+	if err := config.checkAttachmentPolicy(fileInfo); err != nil {
+		return nil, err
+	}
+
+	expiryTime := time.Now().UTC().Add(config.getAttachmentLinkExpiryTime())
 
 	file := &FileStruct{
 		ID:     fileID,
@@ -487,7 +960,7 @@ func (p *Plugin) CreateMessageAttachment(fileID, userID string) (*MessageAttachm
 	}
 
 	var encrypted []byte
-	encrypted, err = encrypt(jsonBytes, []byte(p.getConfiguration().EncryptionSecret))
+	encrypted, err = encryptWithKeyRing(jsonBytes, config.getEncryptionKeyRing())
 	if err != nil {
 		return nil, fmt.Errorf("error occurred while encrypting the file. Error: %w", err)
 	}
@@ -4,11 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
 	"bou.ke/monkey"
+	"github.com/golang/mock/gomock"
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
 	"github.com/mattermost/mattermost-server/v5/plugin/plugintest/mock"
@@ -16,6 +19,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	mock_plugin "github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/mocks"
+	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/serializer"
 	"github.com/mattermost/mattermost-plugin-servicenow-virtual-agent/server/testutils"
 )
 
@@ -48,7 +53,7 @@ func Test_SendMessageToVirtualAgentAPI(t *testing.T) {
 			})
 			attachment := &MessageAttachment{}
 
-			err := c.SendMessageToVirtualAgentAPI("mock-userID", "mockMessage", true, attachment)
+			err := c.SendMessageToVirtualAgentAPI("mock-userID", "mockSessionID", "mockMessage", true, attachment)
 			if testCase.errMessage != nil {
 				require.Error(t, err)
 				require.EqualError(t, testCase.expectedErr, err.Error())
@@ -99,6 +104,47 @@ func Test_StartConverstaionWithVirtualAgent(t *testing.T) {
 	}
 }
 
+func Test_EndConversationWithVirtualAgent(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description string
+		errMessage  error
+		expectedErr error
+	}{
+		{
+			description: "Conversation is successfully ended with Virtual Agent",
+			errMessage:  nil,
+		},
+		{
+			description: "Error in ending conversation with Virtual Agent",
+			errMessage:  errors.New("error in calling the Virtual Agent API"),
+			expectedErr: errors.New("failed to end conversation with virtual agent bot: error in calling the Virtual Agent API"),
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			c := new(client)
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(c), "CallJSON", func(_ *client, _, _ string, in, _ interface{}, _ url.Values) (responseData []byte, err error) {
+				require.Equal(t, EndConversationAction, in.(*VirtualAgentRequestBody).Action)
+				require.Equal(t, "mock-sessionID", in.(*VirtualAgentRequestBody).ClientSessionID)
+				if testCase.errMessage != nil {
+					return nil, testCase.errMessage
+				}
+				return nil, nil
+			})
+
+			err := c.EndConversationWithVirtualAgent("mock-userID", "mock-sessionID")
+			if testCase.errMessage != nil {
+				require.Error(t, err)
+				require.EqualError(t, testCase.expectedErr, err.Error())
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
 func Test_CreateOutputLinkAttachment(t *testing.T) {
 	for _, testCase := range []struct {
 		description string
@@ -111,19 +157,43 @@ func Test_CreateOutputLinkAttachment(t *testing.T) {
 				Header: "mockHeader",
 				Label:  "mockLabel",
 				Value: OutputLinkValue{
-					Action: "mockAction",
+					Action: "https://mock.com/mockAction",
 				},
 			},
 			response: &model.SlackAttachment{
 				Pretext: "mockHeader",
-				Text:    fmt.Sprintf("[%s](%s)", "mockLabel", "mockAction"),
+				Text:    fmt.Sprintf("[%s](%s)", "mockLabel", "https://mock.com/mockAction"),
+			},
+		},
+		{
+			description: "Relative link is resolved against the instance URL and brackets in the label are escaped",
+			body: &OutputLink{
+				Label: "[mockLabel]",
+				Value: OutputLinkValue{
+					Action: "mockAction?id=1",
+				},
+			},
+			response: &model.SlackAttachment{
+				Text: "[\\[mockLabel\\]](https://mock.service-now.com/mockAction?id=1)",
+			},
+		},
+		{
+			description: "Link with an unsafe scheme is not shown",
+			body: &OutputLink{
+				Label: "mockLabel",
+				Value: OutputLinkValue{
+					Action: "javascript:alert(1)",
+				},
+			},
+			response: &model.SlackAttachment{
+				Text: "mockLabel",
 			},
 		},
 	} {
 		t.Run(testCase.description, func(t *testing.T) {
 			p := Plugin{}
 
-			res := p.CreateOutputLinkAttachment(testCase.body)
+			res := p.CreateOutputLinkAttachment(testCase.body, "https://mock.service-now.com")
 			require.EqualValues(t, testCase.response, res)
 		})
 	}
@@ -144,14 +214,25 @@ func Test_CreateOutputCardImageAttachment(t *testing.T) {
 			},
 			response: &model.SlackAttachment{
 				Text:     "**mockTitle**\nmockDescription",
-				ImageURL: "mockImage",
+				ImageURL: "https://mock.service-now.com/mockImage",
+			},
+		},
+		{
+			description: "Image with an unsafe link is not shown",
+			body: &OutputCardImageData{
+				Image:       "javascript:alert(1)",
+				Title:       "mockTitle",
+				Description: "mockDescription",
+			},
+			response: &model.SlackAttachment{
+				Text: "**mockTitle**\nmockDescription",
 			},
 		},
 	} {
 		t.Run(testCase.description, func(t *testing.T) {
 			p := Plugin{}
 
-			res := p.CreateOutputCardImageAttachment(testCase.body)
+			res := p.CreateOutputCardImageAttachment(testCase.body, "https://mock.service-now.com")
 
 			require.EqualValues(t, testCase.response, res)
 		})
@@ -168,19 +249,30 @@ func Test_CreateOutputCardVideoAttachment(t *testing.T) {
 			description: "CreateOutputCardVideoAttachment returns proper slack attachment",
 			body: &OutputCardVideoData{
 				Title:       "mockTitle",
-				Link:        "mockLink",
+				Link:        "https://mock.com/mockLink",
 				URL:         "mockURL",
 				Description: "mockDescription",
 			},
 			response: &model.SlackAttachment{
-				Text: fmt.Sprintf("**[%s](%s)**\n%s", "mockTitle", "mockLink", "mockDescription"),
+				Text: fmt.Sprintf("**[%s](%s)**\n%s", "mockTitle", "https://mock.com/mockLink", "mockDescription"),
+			},
+		},
+		{
+			description: "Video with an unsafe link is shown without the link",
+			body: &OutputCardVideoData{
+				Title:       "mockTitle",
+				Link:        "javascript:alert(1)",
+				Description: "mockDescription",
+			},
+			response: &model.SlackAttachment{
+				Text: "**mockTitle**\nmockDescription",
 			},
 		},
 	} {
 		t.Run(testCase.description, func(t *testing.T) {
 			p := Plugin{}
 
-			res := p.CreateOutputCardVideoAttachment(testCase.body)
+			res := p.CreateOutputCardVideoAttachment(testCase.body, "https://mock.service-now.com")
 
 			require.EqualValues(t, testCase.response, res)
 		})
@@ -210,7 +302,7 @@ func Test_CreateOutputCardRecordAttachment(t *testing.T) {
 				Fields: []*model.SlackAttachmentField{
 					{
 						Title: "mockTitle",
-						Value: fmt.Sprintf("[%s](%s)", "mockSubtitle", "mockURL"),
+						Value: fmt.Sprintf("[%s](%s)", "mockSubtitle", "https://mock.service-now.com/mockURL"),
 					},
 					{
 						Title: "mockLabel",
@@ -219,11 +311,187 @@ func Test_CreateOutputCardRecordAttachment(t *testing.T) {
 				},
 			},
 		},
+		{
+			description: "Subtitle of the record is escaped in the link",
+			body: &OutputCardRecordData{
+				Title:    "mockTitle",
+				Subtitle: "mock [Subtitle]",
+				URL:      "https://mock.com/mock (URL)",
+			},
+			response: &model.SlackAttachment{
+				Fields: []*model.SlackAttachmentField{
+					{
+						Title: "mockTitle",
+						Value: "[mock \\[Subtitle\\]](https://mock.com/mock%20%28URL%29)",
+					},
+				},
+			},
+		},
+		{
+			description: "Record with an unsafe link is shown without the link",
+			body: &OutputCardRecordData{
+				Title:    "mockTitle",
+				Subtitle: "mockSubtitle",
+				URL:      "javascript:alert(1)",
+			},
+			response: &model.SlackAttachment{
+				Fields: []*model.SlackAttachmentField{
+					{
+						Title: "mockTitle",
+						Value: "mockSubtitle",
+					},
+				},
+			},
+		},
 	} {
 		t.Run(testCase.description, func(t *testing.T) {
 			p := Plugin{}
 
-			res := p.CreateOutputCardRecordAttachment(testCase.body)
+			res := p.CreateOutputCardRecordAttachment(testCase.body, "https://mock.service-now.com")
+
+			require.EqualValues(t, testCase.response, res)
+		})
+	}
+}
+
+func Test_CreateOutputCardGenericAttachments(t *testing.T) {
+	p := Plugin{}
+	for _, testCase := range []struct {
+		description string
+		data        string
+		response    []*model.SlackAttachment
+		expectedErr bool
+	}{
+		{
+			description: "Card with an unknown template is shown with its title, fields and link",
+			data:        `{"title": "mockTitle", "subtitle": "mockSubtitle", "description": "<b>mockDescription</b>", "url": "https://mock.com", "image": "https://mock.com/image.png", "fields": [{"fieldLabel": "mockLabel", "fieldValue": "mockValue"}]}`,
+			response: []*model.SlackAttachment{
+				{
+					Title:     "mockTitle",
+					TitleLink: "https://mock.com",
+					Text:      "mockSubtitle\n**mockDescription**",
+					ImageURL:  "https://mock.com/image.png",
+					Fields: []*model.SlackAttachmentField{
+						{Title: "mockLabel", Value: "mockValue", Short: true},
+					},
+				},
+			},
+		},
+		{
+			description: "Multiple cards are shown together and empty cards are skipped",
+			data:        `[{"title": "mockTitle-1", "link": "javascript:alert(1)"}, {}, {"title": "mockTitle-2", "link": "https://mock.com"}]`,
+			response: []*model.SlackAttachment{
+				{Title: "mockTitle-1"},
+				{Title: "mockTitle-2", TitleLink: "https://mock.com"},
+			},
+		},
+		{
+			description: "Invalid card data",
+			data:        "invalid",
+			expectedErr: true,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			res, err := p.CreateOutputCardGenericAttachments(testCase.data, "https://mock.service-now.com")
+			if testCase.expectedErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.EqualValues(t, testCase.response, res)
+		})
+	}
+}
+
+func Test_CreateCarouselAttachments(t *testing.T) {
+	t.Run("CreateCarouselAttachments returns a card with a button for each enabled option", func(t *testing.T) {
+		p := Plugin{}
+		labels := map[string]interface{}{"mockValue-1": "mockLabel-1", "mockValue-2": "mockLabel-2"}
+		getButtons := func(value string) []*model.PostAction {
+			return []*model.PostAction{
+				{
+					Name: CarouselSelectButtonName,
+					Integration: &model.PostActionIntegration{
+						URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathActionOptions),
+						Context: map[string]interface{}{
+							PickerSelectedOptionContextKey: value,
+							PickerOptionLabelsContextKey:   labels,
+						},
+					},
+					Type: "button",
+				},
+			}
+		}
+
+		res := p.CreateCarouselAttachments(&Picker{
+			Label: "mockLabel",
+			Style: PickerStyleCarousel,
+			Options: []Option{
+				{Label: "mockLabel-1", Value: "mockValue-1", Enabled: true, Description: "mockDescription", Attachment: "https://mock.com/image.png"},
+				{Label: "mockLabel-2", Value: "mockValue-2", Enabled: true},
+				{Label: "mockLabel-3", Value: "mockValue-3"},
+			},
+		}, "https://mock.service-now.com")
+
+		require.EqualValues(t, []*model.SlackAttachment{
+			{
+				Title:    "mockLabel-1",
+				Text:     "mockDescription",
+				ImageURL: "https://mock.com/image.png",
+				Actions:  getButtons("mockValue-1"),
+			},
+			{
+				Title:   "mockLabel-2",
+				Actions: getButtons("mockValue-2"),
+			},
+		}, res)
+	})
+}
+
+func Test_CreateGroupedPartsOutputControlAttachment(t *testing.T) {
+	for _, testCase := range []struct {
+		description string
+		body        GroupedPartsOutputControlValue
+		response    *model.SlackAttachment
+	}{
+		{
+			description: "Relative link of the part is resolved against the instance URL",
+			body: GroupedPartsOutputControlValue{
+				Label:       "mockLabel",
+				Action:      "/mockAction",
+				Description: "mockDescription",
+			},
+			response: &model.SlackAttachment{
+				Title: "[mockLabel](https://mock.service-now.com/mockAction)",
+				Text:  "mockDescription",
+			},
+		},
+		{
+			description: "Label of the part is escaped in the link",
+			body: GroupedPartsOutputControlValue{
+				Label:  "mock [Label]",
+				Action: "https://mock.com/mock (Action)",
+			},
+			response: &model.SlackAttachment{
+				Title: "[mock \\[Label\\]](https://mock.com/mock%20%28Action%29)",
+			},
+		},
+		{
+			description: "Part with an unsafe link is shown without the link",
+			body: GroupedPartsOutputControlValue{
+				Label:  "mockLabel",
+				Action: "javascript:alert(1)",
+			},
+			response: &model.SlackAttachment{
+				Title: "mockLabel",
+			},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			res := p.CreateGroupedPartsOutputControlAttachment(testCase.body, "https://mock.service-now.com")
 
 			require.EqualValues(t, testCase.response, res)
 		})
@@ -243,7 +511,9 @@ func Test_CreateTopicPickerControlAttachment(t *testing.T) {
 			body: &TopicPickerControl{
 				PromptMessage: "mockPrompt",
 				Options: []Option{{
-					Label: "mockLabel",
+					Label:   "mockLabel",
+					Value:   "mockValue",
+					Enabled: true,
 				}},
 			},
 			response: &model.SlackAttachment{
@@ -253,12 +523,15 @@ func Test_CreateTopicPickerControlAttachment(t *testing.T) {
 						Name: "Select an option...",
 						Integration: &model.PostActionIntegration{
 							URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathActionOptions),
+							Context: map[string]interface{}{
+								PickerOptionLabelsContextKey: map[string]interface{}{"mockValue": "mockLabel"},
+							},
 						},
 						Type: "select",
 						Options: []*model.PostActionOptions{
 							{
 								Text:  "mockLabel",
-								Value: "mockLabel",
+								Value: "mockValue",
 							},
 						},
 					},
@@ -285,9 +558,11 @@ func Test_CreatePickerAttachment(t *testing.T) {
 			description: "CreatePickerAttachment returns proper slack attachment",
 			body: &Picker{
 				Label: "mockLabel",
-				Options: []Option{{
-					Label: "mockLabel",
-				}},
+				Options: []Option{
+					{Label: "mockLabel", Value: "mockValue", Enabled: true},
+					{Label: "mockLabel", Value: "mockValue-2", Enabled: true},
+					{Label: "mockDisabledLabel", Value: "mockDisabledValue"},
+				},
 			},
 			response: &model.SlackAttachment{
 				Actions: []*model.PostAction{
@@ -295,12 +570,19 @@ func Test_CreatePickerAttachment(t *testing.T) {
 						Name: "Select an option...",
 						Integration: &model.PostActionIntegration{
 							URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathActionOptions),
+							Context: map[string]interface{}{
+								PickerOptionLabelsContextKey: map[string]interface{}{"mockValue": "mockLabel", "mockValue-2": "mockLabel"},
+							},
 						},
 						Type: "select",
 						Options: []*model.PostActionOptions{
 							{
 								Text:  "mockLabel",
-								Value: "mockLabel",
+								Value: "mockValue",
+							},
+							{
+								Text:  "mockLabel",
+								Value: "mockValue-2",
 							},
 						},
 					},
@@ -315,6 +597,393 @@ func Test_CreatePickerAttachment(t *testing.T) {
 	}
 }
 
+func Test_OptionUnmarshalJSON(t *testing.T) {
+	for _, testCase := range []struct {
+		description string
+		data        string
+		expected    Option
+	}{
+		{
+			description: "Option is enabled when the enabled flag is missing",
+			data:        `{"label": "mockLabel", "value": "mockValue"}`,
+			expected:    Option{Label: "mockLabel", Value: "mockValue", Enabled: true},
+		},
+		{
+			description: "Option is disabled",
+			data:        `{"label": "mockLabel", "value": "mockValue", "enabled": false}`,
+			expected:    Option{Label: "mockLabel", Value: "mockValue"},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			var option Option
+			require.NoError(t, json.Unmarshal([]byte(testCase.data), &option))
+			require.Equal(t, testCase.expected, option)
+		})
+	}
+}
+
+func Test_CreateBooleanAttachment(t *testing.T) {
+	p := Plugin{}
+	labels := map[string]interface{}{BooleanTrueValue: BooleanYesLabel, BooleanFalseValue: BooleanNoLabel}
+	getButton := func(name, value string) *model.PostAction {
+		return &model.PostAction{
+			Name: name,
+			Integration: &model.PostActionIntegration{
+				URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathActionOptions),
+				Context: map[string]interface{}{
+					PickerSelectedOptionContextKey: value,
+					PickerOptionLabelsContextKey:   labels,
+				},
+			},
+			Type: "button",
+		}
+	}
+
+	for _, testCase := range []struct {
+		description string
+		body        *Boolean
+		response    *model.SlackAttachment
+	}{
+		{
+			description: "Yes and No buttons are created when the question has no options",
+			body: &Boolean{
+				Label: "mockLabel",
+			},
+			response: &model.SlackAttachment{
+				Text:    "mockLabel",
+				Actions: []*model.PostAction{getButton(BooleanYesLabel, BooleanTrueValue), getButton(BooleanNoLabel, BooleanFalseValue)},
+			},
+		},
+		{
+			description: "Buttons are created from the options of the question",
+			body: &Boolean{
+				Label: "mockLabel",
+				Options: []Option{
+					{Label: BooleanYesLabel, Value: BooleanTrueValue, Enabled: true},
+					{Label: BooleanNoLabel, Value: BooleanFalseValue, Enabled: true},
+				},
+			},
+			response: &model.SlackAttachment{
+				Text:    "mockLabel",
+				Actions: []*model.PostAction{getButton(BooleanYesLabel, BooleanTrueValue), getButton(BooleanNoLabel, BooleanFalseValue)},
+			},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			res := p.CreateBooleanAttachment(testCase.body)
+			require.EqualValues(t, testCase.response, res)
+		})
+	}
+}
+
+func Test_MessageResponseBodyUnmarshalJSON(t *testing.T) {
+	for _, testCase := range []struct {
+		description  string
+		data         string
+		expectedType interface{}
+	}{
+		{
+			description:  "Boolean is parsed as a yes/no question",
+			data:         `{"uiType": "Boolean", "label": "mockLabel"}`,
+			expectedType: &Boolean{},
+		},
+		{
+			description:  "Picker is parsed as a picker",
+			data:         `{"uiType": "Picker", "label": "mockLabel"}`,
+			expectedType: &Picker{},
+		},
+		{
+			description:  "OutputHtml is parsed as HTML",
+			data:         `{"uiType": "OutputHtml", "value": "<b>mockValue</b>"}`,
+			expectedType: &OutputHTML{},
+		},
+		{
+			description:  "ActionMsg is parsed as a control event",
+			data:         `{"uiType": "ActionMsg", "actionType": "StartSpinner"}`,
+			expectedType: &ActionMsg{},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			var body MessageResponseBody
+			require.NoError(t, json.Unmarshal([]byte(testCase.data), &body))
+			require.IsType(t, testCase.expectedType, body.Value)
+		})
+	}
+}
+
+func Test_HandleActionMsg(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description       string
+		actionMsg         *ActionMsg
+		isTyping          bool
+		isPromptDeleted   bool
+		expectedMessage   string
+		deletePromptError error
+		endPromptError    error
+		chat              *serializer.LiveAgentChat
+		loadChatError     error
+		expectedError     string
+	}{
+		{
+			description: "Typing indicator is shown when a spinner starts",
+			actionMsg:   &ActionMsg{ActionType: ActionTypeStartSpinner},
+			isTyping:    true,
+		},
+		{
+			description: "Nothing is done when a spinner ends",
+			actionMsg:   &ActionMsg{ActionType: ActionTypeEndSpinner},
+		},
+		{
+			description:     "Conversation state is cleared when a topic finishes",
+			actionMsg:       &ActionMsg{ActionType: ActionTypeTopicFinished},
+			isPromptDeleted: true,
+			loadChatError:   ErrNotFound,
+		},
+		{
+			description:     "Live agent chat is ended when a topic finishes",
+			actionMsg:       &ActionMsg{ActionType: ActionTypeTopicFinished},
+			isPromptDeleted: true,
+			chat:            &serializer.LiveAgentChat{AgentName: "mockAgent"},
+			expectedMessage: fmt.Sprintf(LiveAgentLeftMessage, "mockAgent"),
+		},
+		{
+			description:       "Error while clearing the conversation state",
+			actionMsg:         &ActionMsg{ActionType: ActionTypeTopicFinished},
+			isPromptDeleted:   true,
+			deletePromptError: errors.New("error in deleting the prompt"),
+			expectedError:     "failed to delete the masked input prompt: error in deleting the prompt",
+		},
+		{
+			description:     "Error while ending the active prompt",
+			actionMsg:       &ActionMsg{ActionType: ActionTypeTopicFinished},
+			isPromptDeleted: true,
+			endPromptError:  errors.New("failed to load the conversation state: error in loading the state"),
+			expectedError:   "failed to load the conversation state: error in loading the state",
+		},
+		{
+			description:     "User is notified about the transfer to a live agent",
+			actionMsg:       &ActionMsg{ActionType: ActionTypeSwitchToLiveAgent},
+			expectedMessage: LiveAgentTransferMessage,
+		},
+		{
+			description:     "Message of the Virtual Agent is used for the transfer to a live agent",
+			actionMsg:       &ActionMsg{ActionType: ActionTypeSwitchToLiveAgent, Message: "mockMessage"},
+			expectedMessage: "mockMessage",
+		},
+		{
+			description:     "User is notified about the position in the queue",
+			actionMsg:       &ActionMsg{ActionType: ActionTypeQueuePosition, QueuePosition: 2},
+			expectedMessage: fmt.Sprintf(LiveAgentQueueMessage, 2),
+		},
+		{
+			description: "Unknown action is ignored",
+			actionMsg:   &ActionMsg{ActionType: "mockActionType"},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{botUserID: "mock-botID"}
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("LogDebug", testutils.GetMockArgumentsWithType("string", 3)...).Return()
+			if testCase.isTyping {
+				mockAPI.On("GetDirectChannel", "mock-userID", "mock-botID").Return(&model.Channel{Id: "mockChannelID"}, nil)
+				mockAPI.On("PublishUserTyping", "mock-botID", "mockChannelID", "mockSessionID").Return(nil)
+			}
+			p.SetAPI(mockAPI)
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			if testCase.isPromptDeleted {
+				mockedStore.EXPECT().DeleteMaskedInputPrompt("mock-userID__mockSessionID").Return(testCase.deletePromptError)
+				if testCase.deletePromptError == nil && testCase.endPromptError == nil {
+					mockedStore.EXPECT().LoadLiveAgentChat("mock-userID__mockSessionID").Return(testCase.chat, testCase.loadChatError)
+				}
+			}
+			if testCase.chat != nil {
+				mockedStore.EXPECT().DeleteLiveAgentChat("mock-userID__mockSessionID").Return(nil)
+			}
+			p.store = mockedStore
+
+			var message string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DMInThread", func(_ *Plugin, _, rootID string, post *model.Post) (string, error) {
+				require.Equal(t, "mockSessionID", rootID)
+				// The messages about the live agent are sent by the bot
+				require.Nil(t, post.GetProp(PostPropOverrideUsername))
+				message = post.Message
+				return "mockPostID", nil
+			})
+
+			isPromptEnded := false
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "EndActivePrompt", func(_ *Plugin, mattermostUserID, sessionID string) error {
+				require.Equal(t, "mock-userID", mattermostUserID)
+				require.Equal(t, "mockSessionID", sessionID)
+				isPromptEnded = true
+				return testCase.endPromptError
+			})
+
+			ctx := p.newRenderContext("mock-userID", "mockSessionID")
+			ctx.LiveAgentChat = testCase.chat
+			err := p.HandleActionMsg(ctx, testCase.actionMsg)
+			if testCase.expectedError != "" {
+				require.EqualError(t, err, testCase.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, testCase.expectedMessage, message)
+			require.Equal(t, testCase.isPromptDeleted && testCase.deletePromptError == nil, isPromptEnded)
+			if testCase.isTyping {
+				mockAPI.AssertCalled(t, "PublishUserTyping", "mock-botID", "mockChannelID", "mockSessionID")
+			}
+		})
+	}
+}
+
+func Test_UpdateLiveAgentChat(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	agentInfo := &AgentInfo{SentFromAgent: true, AgentName: "mockAgent", AgentAvatar: "mockAvatarURL"}
+	for _, testCase := range []struct {
+		description      string
+		vaResponse       *VirtualAgentResponse
+		storedChat       *serializer.LiveAgentChat
+		isChatStored     bool
+		isChatDeleted    bool
+		expectedChat     *serializer.LiveAgentChat
+		expectedMessages []string
+	}{
+		{
+			description: "Response of the Virtual Agent without a live agent chat",
+			vaResponse:  &VirtualAgentResponse{},
+		},
+		{
+			description:      "Live agent joins the conversation",
+			vaResponse:       &VirtualAgentResponse{AgentChat: true, AgentInfo: agentInfo},
+			isChatStored:     true,
+			expectedChat:     &serializer.LiveAgentChat{AgentName: "mockAgent", AgentAvatar: "mockAvatarURL"},
+			expectedMessages: []string{fmt.Sprintf(LiveAgentJoinedMessage, "mockAgent")},
+		},
+		{
+			description:  "Live agent sends another message",
+			vaResponse:   &VirtualAgentResponse{AgentChat: true, AgentInfo: agentInfo},
+			storedChat:   &serializer.LiveAgentChat{AgentName: "mockAgent", AgentAvatar: "mockAvatarURL"},
+			expectedChat: &serializer.LiveAgentChat{AgentName: "mockAgent", AgentAvatar: "mockAvatarURL"},
+		},
+		{
+			description: "System message during a live agent chat is sent by the bot",
+			vaResponse:  &VirtualAgentResponse{AgentChat: true},
+			storedChat:  &serializer.LiveAgentChat{AgentName: "mockAgent"},
+		},
+		{
+			description:      "Live agent leaves the conversation",
+			vaResponse:       &VirtualAgentResponse{},
+			storedChat:       &serializer.LiveAgentChat{AgentName: "mockAgent"},
+			isChatDeleted:    true,
+			expectedMessages: []string{fmt.Sprintf(LiveAgentLeftMessage, "mockAgent")},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := Plugin{}
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			if testCase.storedChat != nil {
+				mockedStore.EXPECT().LoadLiveAgentChat("mock-userID").Return(testCase.storedChat, nil)
+			} else {
+				mockedStore.EXPECT().LoadLiveAgentChat("mock-userID").Return(nil, ErrNotFound)
+			}
+			if testCase.isChatStored {
+				mockedStore.EXPECT().StoreLiveAgentChat("mock-userID", gomock.Any()).Return(nil)
+			}
+			if testCase.isChatDeleted {
+				mockedStore.EXPECT().DeleteLiveAgentChat("mock-userID").Return(nil)
+			}
+			p.store = mockedStore
+
+			var messages []string
+			monkey.PatchInstanceMethod(reflect.TypeOf(&p), "DMInThread", func(_ *Plugin, _, _ string, post *model.Post) (string, error) {
+				messages = append(messages, post.Message)
+				return "mockPostID", nil
+			})
+
+			chat, err := p.UpdateLiveAgentChat(p.newRenderContext("mock-userID", ""), testCase.vaResponse)
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedMessages, messages)
+			if testCase.expectedChat == nil {
+				require.Nil(t, chat)
+				return
+			}
+
+			require.Equal(t, testCase.expectedChat.AgentName, chat.AgentName)
+			require.Equal(t, testCase.expectedChat.AgentAvatar, chat.AgentAvatar)
+		})
+	}
+}
+
+func Test_CreateMultiSelectPickerAttachment(t *testing.T) {
+	t.Run("CreateMultiSelectPickerAttachment returns a button with the options in its context", func(t *testing.T) {
+		p := Plugin{}
+
+		res, err := p.CreateMultiSelectPickerAttachment(&Picker{
+			Label:       "mockLabel",
+			Required:    true,
+			MultiSelect: true,
+			Options: []Option{
+				{Label: "mockLabel-1", Value: "mockValue-1", Enabled: true},
+				{Label: "mockLabel-2", Value: "mockValue-2", Enabled: true},
+				{Label: "mockLabel-3", Value: "mockValue-3"},
+			},
+		})
+
+		require.NoError(t, err)
+		require.EqualValues(t, &model.SlackAttachment{
+			Actions: []*model.PostAction{
+				{
+					Name: "Select options",
+					Integration: &model.PostActionIntegration{
+						URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathMultiSelectDialog),
+						Context: map[string]interface{}{
+							MultiSelectOptionsContextKey:  `[{"label":"mockLabel-1","value":"mockValue-1","enabled":true},{"label":"mockLabel-2","value":"mockValue-2","enabled":true}]`,
+							MultiSelectRequiredContextKey: true,
+						},
+					},
+					Type: "button",
+				},
+			},
+		}, res)
+	})
+}
+
+func Test_CreateMaskedInputAttachment(t *testing.T) {
+	t.Run("CreateMaskedInputAttachment returns a button which opens the masked input dialog", func(t *testing.T) {
+		p := Plugin{}
+
+		res := p.CreateMaskedInputAttachment(&OutputText{
+			UIType:   InputTextUIType,
+			Label:    "mockLabel",
+			MaskType: "PASSWORD",
+		})
+
+		require.EqualValues(t, &model.SlackAttachment{
+			Text: "mockLabel" + MaskedInputMessage,
+			Actions: []*model.PostAction{
+				{
+					Name: "Enter value",
+					Integration: &model.PostActionIntegration{
+						URL: fmt.Sprintf("%s%s", p.GetPluginURLPath(), PathMaskedInputDialog),
+						Context: map[string]interface{}{
+							MaskedInputLabelContextKey: "mockLabel",
+						},
+					},
+					Type: "button",
+				},
+			},
+		}, res)
+	})
+}
+
 func Test_CreateDefaultDateAttachment(t *testing.T) {
 	p := Plugin{}
 
@@ -359,19 +1028,20 @@ func Test_CreateMessageAttachment(t *testing.T) {
 	defer monkey.UnpatchAll()
 
 	for _, testCase := range []struct {
-		description   string
-		userID        string
-		response      *MessageAttachment
-		setupAPI      func(api *plugintest.API)
-		marshalError  error
-		encryptError  error
-		expectedError string
+		description        string
+		userID             string
+		response           *MessageAttachment
+		setupAPI           func(api *plugintest.API)
+		marshalError       error
+		encryptError       error
+		expectedError      string
+		allowedAttachments string
 	}{
 		{
 			description: "CreateMessageAttachment returns a valid attachment",
 			userID:      testutils.GetID(),
 			response: &MessageAttachment{
-				URL:         "mockSiteURL" + p.GetPluginURLPath() + "/file/" + encode([]byte{}),
+				URL:         "mockSiteURL" + p.GetPluginURLPath() + "/file/" + encode(append([]byte{encryptionVersion}, getEncryptionKeyID([]byte("mockEncryptionSecret"))...)),
 				ContentType: "mockMimeType",
 				FileName:    "mockName",
 			},
@@ -403,6 +1073,15 @@ func Test_CreateMessageAttachment(t *testing.T) {
 			},
 			expectedError: "file does not belong to the Mattermost user: mock-userID",
 		},
+		{
+			description:        "CreateMessageAttachment returns an error because the file type is not allowed",
+			userID:             testutils.GetID(),
+			allowedAttachments: "image/*",
+			setupAPI: func(api *plugintest.API) {
+				api.On("GetFileInfo", mock.AnythingOfType("string")).Return(testutils.GetFile(false), nil)
+			},
+			expectedError: "files of this type are not allowed. Allowed types: image/*",
+		},
 		{
 			description: "CreateMessageAttachment returns an error while marshaling file",
 			userID:      testutils.GetID(),
@@ -425,8 +1104,9 @@ func Test_CreateMessageAttachment(t *testing.T) {
 		t.Run(testCase.description, func(t *testing.T) {
 			p.setConfiguration(
 				&configuration{
-					EncryptionSecret:  "mockEncryptionSecret",
-					MattermostSiteURL: "mockSiteURL",
+					EncryptionSecret:       "mockEncryptionSecret",
+					MattermostSiteURL:      "mockSiteURL",
+					AllowedAttachmentTypes: testCase.allowedAttachments,
 				})
 
 			mockAPI := &plugintest.API{}
@@ -451,3 +1131,242 @@ func Test_CreateMessageAttachment(t *testing.T) {
 		})
 	}
 }
+
+func Test_ProcessResponse(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	for _, testCase := range []struct {
+		description      string
+		instanceName     string
+		requestID        string
+		claimedIndexes   []int
+		claimError       error
+		dmError          error
+		expectedMessages []string
+		releasedIndexes  []int
+		expectedErr      string
+	}{
+		{
+			description:      "All the parts of the response are rendered in a single post",
+			requestID:        "mock-requestID",
+			claimedIndexes:   []int{0, 1},
+			expectedMessages: []string{"mock-message-0\n\nmock-message-1"},
+		},
+		{
+			description:      "Already rendered parts of a retried response are skipped",
+			requestID:        "mock-requestID",
+			claimedIndexes:   []int{1},
+			expectedMessages: []string{"mock-message-1"},
+		},
+		{
+			description:      "Response without request ID is rendered without deduplication",
+			expectedMessages: []string{"mock-message-0\n\nmock-message-1"},
+		},
+		{
+			description:      "Claims of all the parts of the post are released when the post fails",
+			requestID:        "mock-requestID",
+			claimedIndexes:   []int{0, 1},
+			dmError:          errors.New("error in creating the post"),
+			expectedMessages: []string{"mock-message-0\n\nmock-message-1"},
+			releasedIndexes:  []int{0, 1},
+			expectedErr:      "error in creating the post",
+		},
+		{
+			description: "Error while claiming a part of the response",
+			requestID:   "mock-requestID",
+			claimError:  errors.New("error in storing the claim in KVstore"),
+			expectedErr: "failed to claim the webhook response: error in storing the claim in KVstore",
+		},
+		{
+			description:  "Response from an instance which the user is not connected to is rejected",
+			instanceName: "mock-instance",
+			requestID:    "mock-requestID",
+			expectedErr:  "the user is not connected to the ServiceNow instance. Instance: mock-instance",
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+			p := &Plugin{}
+
+			mockAPI := &plugintest.API{}
+			mockAPI.On("LogDebug", mock.AnythingOfType("string"), "RequestID", mock.AnythingOfType("string"), "Index", mock.AnythingOfType("int")).Return()
+			p.SetAPI(mockAPI)
+
+			mockCtrl := gomock.NewController(t)
+			mockedStore := mock_plugin.NewMockStore(mockCtrl)
+			mockedStore.EXPECT().LoadUserWithSysID("mock-userID").Return(&serializer.User{MattermostUserID: "mock-mattermostUserID"}, nil)
+			if testCase.requestID != "" && testCase.instanceName == "" {
+				if testCase.claimError != nil {
+					mockedStore.EXPECT().ClaimWebhookResponse(testCase.requestID, 0).Return(false, testCase.claimError)
+				} else {
+					mockedStore.EXPECT().ClaimWebhookResponse(testCase.requestID, gomock.Any()).DoAndReturn(func(_ string, index int) (bool, error) {
+						for _, claimedIndex := range testCase.claimedIndexes {
+							if claimedIndex == index {
+								return true, nil
+							}
+						}
+						return false, nil
+					}).MaxTimes(2)
+				}
+			}
+			for _, index := range testCase.releasedIndexes {
+				mockedStore.EXPECT().ReleaseWebhookResponse(testCase.requestID, index).Return(nil)
+			}
+			p.store = mockedStore
+
+			var messages []string
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "DMInThread", func(_ *Plugin, _, rootID string, post *model.Post) (string, error) {
+				require.Equal(t, "mockSessionID", rootID)
+				messages = append(messages, post.Message)
+				return "mockPostID", testCase.dmError
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "GetSessionChannelID", func(_ *Plugin, _, _ string) (string, error) {
+				return "", nil
+			})
+
+			monkey.PatchInstanceMethod(reflect.TypeOf(p), "UpdateLiveAgentChat", func(_ *Plugin, _ *RenderContext, _ *VirtualAgentResponse) (*serializer.LiveAgentChat, error) {
+				return nil, nil
+			})
+
+			data, err := json.Marshal(map[string]interface{}{
+				"requestId":       testCase.requestID,
+				"userId":          "mock-userID",
+				"clientSessionId": "mockSessionID",
+				"body": []map[string]string{
+					{"uiType": OutputTextUIType, "value": "mock-message-0"},
+					{"uiType": OutputTextUIType, "value": "mock-message-1"},
+				},
+			})
+			require.NoError(t, err)
+
+			err = p.ProcessResponse(testCase.instanceName, data)
+			if testCase.expectedErr != "" {
+				require.EqualError(t, err, testCase.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, testCase.expectedMessages, messages)
+		})
+	}
+}
+
+func Test_processWebhookRequest(t *testing.T) {
+	defer monkey.UnpatchAll()
+
+	t.Run("Failed parts of the response are released and rendered by the retried request", func(t *testing.T) {
+		p := &Plugin{}
+
+		mockAPI := &plugintest.API{}
+		defer mockAPI.AssertExpectations(t)
+		mockAPI.On("LogError", "Error occurred while processing response body.", "Error", "DMInThread: error in creating the post, ").Return().Once()
+		p.SetAPI(mockAPI)
+
+		mockCtrl := gomock.NewController(t)
+		mockedStore := mock_plugin.NewMockStore(mockCtrl)
+		mockedStore.EXPECT().LoadUserWithSysID("mock-userID").Return(&serializer.User{MattermostUserID: "mock-mattermostUserID"}, nil).Times(2)
+		gomock.InOrder(
+			mockedStore.EXPECT().ClaimWebhookResponse("mock-requestID", 0).Return(true, nil),
+			mockedStore.EXPECT().ClaimWebhookResponse("mock-requestID", 1).Return(true, nil),
+			mockedStore.EXPECT().ReleaseWebhookResponse("mock-requestID", 0).Return(nil),
+			mockedStore.EXPECT().ReleaseWebhookResponse("mock-requestID", 1).Return(nil),
+			mockedStore.EXPECT().ClaimWebhookResponse("mock-requestID", 0).Return(true, nil),
+			mockedStore.EXPECT().ClaimWebhookResponse("mock-requestID", 1).Return(true, nil),
+		)
+		p.store = mockedStore
+
+		var messages []string
+		monkey.PatchInstanceMethod(reflect.TypeOf(p), "DMInThread", func(_ *Plugin, _, _ string, post *model.Post) (string, error) {
+			messages = append(messages, post.Message)
+			if len(messages) == 1 {
+				return "", model.NewAppError("DMInThread", "error in creating the post", nil, "", http.StatusInternalServerError)
+			}
+			return "mockPostID", nil
+		})
+
+		monkey.PatchInstanceMethod(reflect.TypeOf(p), "GetSessionChannelID", func(_ *Plugin, _, _ string) (string, error) {
+			return "", nil
+		})
+
+		monkey.PatchInstanceMethod(reflect.TypeOf(p), "UpdateLiveAgentChat", func(_ *Plugin, _ *RenderContext, _ *VirtualAgentResponse) (*serializer.LiveAgentChat, error) {
+			return nil, nil
+		})
+
+		data, err := json.Marshal(map[string]interface{}{
+			"requestId":       "mock-requestID",
+			"userId":          "mock-userID",
+			"clientSessionId": "mockSessionID",
+			"body": []map[string]string{
+				{"uiType": OutputTextUIType, "value": "mock-message-0"},
+				{"uiType": OutputTextUIType, "value": "mock-message-1"},
+			},
+		})
+		require.NoError(t, err)
+
+		processed := make(chan struct{})
+		p.webhookQueue = newWebhookQueue(WebhookQueueSize, time.Minute, func(request *webhookRequest) error {
+			err := p.processWebhookRequest(request)
+			if err == nil {
+				close(processed)
+			}
+			return err
+		}, p.failWebhookRequest)
+		p.webhookQueue.retryInterval = time.Millisecond
+
+		require.NoError(t, p.webhookQueue.Enqueue("mock-userID", &webhookRequest{data: data}))
+		<-processed
+		require.True(t, p.webhookQueue.Close(time.Second))
+
+		// The post with both the parts is created again, as the claims of both were released
+		require.Equal(t, []string{"mock-message-0\n\nmock-message-1", "mock-message-0\n\nmock-message-1"}, messages)
+	})
+
+	t.Run("User is told when the response cannot be shown", func(t *testing.T) {
+		p := &Plugin{}
+
+		mockAPI := &plugintest.API{}
+		defer mockAPI.AssertExpectations(t)
+		mockAPI.On("LogError", "Error occurred while processing response body.", "Error", "DMInThread: invalid post, ").Return().Once()
+		p.SetAPI(mockAPI)
+
+		mockCtrl := gomock.NewController(t)
+		mockedStore := mock_plugin.NewMockStore(mockCtrl)
+		mockedStore.EXPECT().LoadUserWithSysID("mock-userID").Return(&serializer.User{MattermostUserID: "mock-mattermostUserID"}, nil).Times(1)
+		p.store = mockedStore
+
+		var messages []string
+		monkey.PatchInstanceMethod(reflect.TypeOf(p), "DMInThread", func(_ *Plugin, _, rootID string, post *model.Post) (string, error) {
+			require.Equal(t, "mockSessionID", rootID)
+			messages = append(messages, post.Message)
+			if len(messages) == 1 {
+				return "", model.NewAppError("DMInThread", "invalid post", nil, "", http.StatusBadRequest)
+			}
+			return "mockPostID", nil
+		})
+
+		monkey.PatchInstanceMethod(reflect.TypeOf(p), "GetSessionChannelID", func(_ *Plugin, _, _ string) (string, error) {
+			return "", nil
+		})
+
+		monkey.PatchInstanceMethod(reflect.TypeOf(p), "UpdateLiveAgentChat", func(_ *Plugin, _ *RenderContext, _ *VirtualAgentResponse) (*serializer.LiveAgentChat, error) {
+			return &serializer.LiveAgentChat{AgentName: "mock-agent"}, nil
+		})
+
+		data, err := json.Marshal(map[string]interface{}{
+			"userId":          "mock-userID",
+			"clientSessionId": "mockSessionID",
+			"body": []map[string]string{
+				{"uiType": OutputTextUIType, "value": "mock-message"},
+			},
+		})
+		require.NoError(t, err)
+
+		p.webhookQueue = newWebhookQueue(WebhookQueueSize, time.Minute, p.processWebhookRequest, p.failWebhookRequest)
+		p.webhookQueue.retryInterval = time.Millisecond
+
+		require.NoError(t, p.webhookQueue.Enqueue("mock-userID", &webhookRequest{data: data}))
+		require.True(t, p.webhookQueue.Close(time.Second))
+
+		// The request is not retried, and the user is told about it by the bot
+		require.Equal(t, []string{"mock-message", WebhookResponseNotShownMessage}, messages)
+	})
+}
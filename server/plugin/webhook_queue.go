@@ -0,0 +1,183 @@
+package plugin
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrWebhookQueueFull   = errors.New("webhook queue is full")
+	ErrWebhookQueueClosed = errors.New("webhook queue is closed")
+)
+
+// webhookRequest is a webhook request received from the ServiceNow instance with the name instanceName.
+type webhookRequest struct {
+	instanceName string
+	data         []byte
+}
+
+// webhookQueue processes the webhook requests received from ServiceNow asynchronously.
+// Each user has a bounded queue served by a single worker, so the messages of a user are posted in the order they were received.
+// The requests are acknowledged before they are processed, so ServiceNow never retries them. The worker retries a request
+// which failed with a transient error instead, which resumes from the parts of the response whose claims were released.
+// A request which cannot be processed is passed to fail, so that the user can be told about it.
+type webhookQueue struct {
+	process     func(request *webhookRequest) error
+	fail        func(err error)
+	size        int
+	idleTimeout time.Duration
+
+	retryInterval time.Duration
+	maxAttempts   int
+
+	lock   sync.Mutex
+	queues map[string]chan *webhookRequest
+	closed bool
+	// done is closed when the queue is closed, which stops the waits between the attempts.
+	done chan struct{}
+
+	workers sync.WaitGroup
+}
+
+func newWebhookQueue(size int, idleTimeout time.Duration, process func(request *webhookRequest) error, fail func(err error)) *webhookQueue {
+	return &webhookQueue{
+		process:       process,
+		fail:          fail,
+		size:          size,
+		idleTimeout:   idleTimeout,
+		retryInterval: WebhookRetryInterval * time.Second,
+		maxAttempts:   WebhookMaxAttempts,
+		queues:        make(map[string]chan *webhookRequest),
+		done:          make(chan struct{}),
+	}
+}
+
+// Enqueue adds the webhook request to the queue of the user and starts a worker for the queue if there is none.
+func (q *webhookQueue) Enqueue(userID string, request *webhookRequest) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return ErrWebhookQueueClosed
+	}
+
+	queue, ok := q.queues[userID]
+	if !ok {
+		queue = make(chan *webhookRequest, q.size)
+		q.queues[userID] = queue
+		q.workers.Add(1)
+		go q.work(userID, queue)
+	}
+
+	select {
+	case queue <- request:
+		return nil
+	default:
+		return ErrWebhookQueueFull
+	}
+}
+
+func (q *webhookQueue) work(userID string, queue chan *webhookRequest) {
+	defer q.workers.Done()
+
+	for {
+		select {
+		case request, ok := <-queue:
+			if !ok {
+				return
+			}
+
+			q.processWithRetries(request)
+		case <-time.After(q.idleTimeout):
+			// Requests are only added while holding the lock, so the queue can be safely removed if it is still empty.
+			q.lock.Lock()
+			if len(queue) == 0 && !q.closed {
+				delete(q.queues, userID)
+				q.lock.Unlock()
+				return
+			}
+			q.lock.Unlock()
+		}
+	}
+}
+
+// processWithRetries processes the request until it succeeds, fails with an error which is not transient, or the attempts run out.
+// The wait between the attempts grows linearly. A request is not retried once the queue is closed, so that closing is not delayed.
+func (q *webhookQueue) processWithRetries(request *webhookRequest) {
+	for attempt := 1; ; attempt++ {
+		err := q.process(request)
+		if err == nil {
+			return
+		}
+
+		if !isTransientWebhookError(err) || attempt >= q.maxAttempts || q.isClosed() {
+			if q.fail != nil {
+				q.fail(err)
+			}
+			return
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt) * q.retryInterval):
+		case <-q.done:
+			if q.fail != nil {
+				q.fail(err)
+			}
+			return
+		}
+	}
+}
+
+// isTransientWebhookError returns whether processing a webhook request failed with an error which may not occur when it is retried,
+// like a network error or an internal error of the server. Any other error, like an invalid response, fails the request at once.
+func isTransientWebhookError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var appErr *model.AppError
+	if errors.As(err, &appErr) {
+		return appErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	return false
+}
+
+func (q *webhookQueue) isClosed() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.closed
+}
+
+// Close stops accepting new webhook requests and waits for the queued requests to be processed.
+// It returns false if the queued requests could not be processed within the timeout.
+func (q *webhookQueue) Close(timeout time.Duration) bool {
+	q.lock.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+		for _, queue := range q.queues {
+			close(queue)
+		}
+	}
+	q.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
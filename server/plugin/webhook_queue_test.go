@@ -0,0 +1,213 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_webhookQueue(t *testing.T) {
+	t.Run("Requests are processed in order for each user", func(t *testing.T) {
+		var lock sync.Mutex
+		processed := map[string][]string{}
+		queue := newWebhookQueue(10, time.Minute, func(request *webhookRequest) error {
+			var userID, message string
+			_, _ = fmt.Sscanf(string(request.data), "%s %s", &userID, &message)
+
+			lock.Lock()
+			defer lock.Unlock()
+			processed[userID] = append(processed[userID], message)
+			return nil
+		}, nil)
+
+		expected := map[string][]string{}
+		for i := 0; i < 5; i++ {
+			for _, userID := range []string{"mock-userID-1", "mock-userID-2"} {
+				message := fmt.Sprintf("message-%d", i)
+				require.NoError(t, queue.Enqueue(userID, &webhookRequest{data: []byte(fmt.Sprintf("%s %s", userID, message))}))
+				expected[userID] = append(expected[userID], message)
+			}
+		}
+
+		require.True(t, queue.Close(time.Second))
+		require.Equal(t, expected, processed)
+	})
+
+	t.Run("Request is rejected when the queue of the user is full", func(t *testing.T) {
+		release := make(chan struct{})
+		queue := newWebhookQueue(1, time.Minute, func(_ *webhookRequest) error {
+			<-release
+			return nil
+		}, nil)
+
+		require.NoError(t, queue.Enqueue("mock-userID", &webhookRequest{data: []byte("first")}))
+		require.Eventually(t, func() bool {
+			queue.lock.Lock()
+			defer queue.lock.Unlock()
+			return len(queue.queues["mock-userID"]) == 0
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, queue.Enqueue("mock-userID", &webhookRequest{data: []byte("second")}))
+		require.Equal(t, ErrWebhookQueueFull, queue.Enqueue("mock-userID", &webhookRequest{data: []byte("third")}))
+
+		// Queues of the other users are not affected
+		require.NoError(t, queue.Enqueue("mock-userID-2", &webhookRequest{data: []byte("first")}))
+
+		close(release)
+		require.True(t, queue.Close(time.Second))
+	})
+
+	t.Run("Request is rejected when the queue is closed", func(t *testing.T) {
+		queue := newWebhookQueue(1, time.Minute, func(_ *webhookRequest) error { return nil }, nil)
+
+		require.True(t, queue.Close(time.Second))
+		require.Equal(t, ErrWebhookQueueClosed, queue.Enqueue("mock-userID", &webhookRequest{data: []byte("first")}))
+	})
+
+	t.Run("Close times out when the queued requests are not processed", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		queue := newWebhookQueue(1, time.Minute, func(_ *webhookRequest) error {
+			<-release
+			return nil
+		}, nil)
+
+		require.NoError(t, queue.Enqueue("mock-userID", &webhookRequest{data: []byte("first")}))
+		require.False(t, queue.Close(50*time.Millisecond))
+	})
+
+	t.Run("Request failed with a transient error is retried until it succeeds", func(t *testing.T) {
+		var attempts, failures int32
+		queue := newWebhookQueue(1, time.Minute, func(_ *webhookRequest) error {
+			if atomic.AddInt32(&attempts, 1) < 2 {
+				return model.NewAppError("CreatePost", "error in creating the post", nil, "", http.StatusInternalServerError)
+			}
+			return nil
+		}, func(_ error) {
+			atomic.AddInt32(&failures, 1)
+		})
+		queue.retryInterval = time.Millisecond
+
+		require.NoError(t, queue.Enqueue("mock-userID", &webhookRequest{data: []byte("first")}))
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&attempts) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		require.True(t, queue.Close(time.Second))
+		require.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+		require.Equal(t, int32(0), atomic.LoadInt32(&failures))
+	})
+
+	t.Run("Request failed with a transient error fails after the maximum attempts", func(t *testing.T) {
+		var attempts int32
+		failed := make(chan error, 1)
+		queue := newWebhookQueue(1, time.Minute, func(_ *webhookRequest) error {
+			atomic.AddInt32(&attempts, 1)
+			return errors.Wrap(&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "error in getting the file")
+		}, func(err error) {
+			failed <- err
+		})
+		queue.retryInterval = time.Millisecond
+
+		require.NoError(t, queue.Enqueue("mock-userID", &webhookRequest{data: []byte("first")}))
+		require.EqualError(t, <-failed, "error in getting the file: dial: connection refused")
+
+		require.True(t, queue.Close(time.Second))
+		require.Equal(t, int32(WebhookMaxAttempts), atomic.LoadInt32(&attempts))
+	})
+
+	t.Run("Request failed with a permanent error fails without being retried", func(t *testing.T) {
+		var attempts int32
+		failed := make(chan error, 1)
+		queue := newWebhookQueue(1, time.Minute, func(_ *webhookRequest) error {
+			atomic.AddInt32(&attempts, 1)
+			return errors.New("error in decoding the response")
+		}, func(err error) {
+			failed <- err
+		})
+		queue.retryInterval = time.Millisecond
+
+		require.NoError(t, queue.Enqueue("mock-userID", &webhookRequest{data: []byte("first")}))
+		require.EqualError(t, <-failed, "error in decoding the response")
+
+		require.True(t, queue.Close(time.Second))
+		require.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+	})
+
+	t.Run("Failed request is not retried once the queue is closed", func(t *testing.T) {
+		var attempts, failures int32
+		release := make(chan struct{})
+		queue := newWebhookQueue(1, time.Minute, func(_ *webhookRequest) error {
+			atomic.AddInt32(&attempts, 1)
+			<-release
+			return model.NewAppError("CreatePost", "error in creating the post", nil, "", http.StatusInternalServerError)
+		}, func(_ error) {
+			atomic.AddInt32(&failures, 1)
+		})
+		queue.retryInterval = time.Millisecond
+
+		require.NoError(t, queue.Enqueue("mock-userID", &webhookRequest{data: []byte("first")}))
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&attempts) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		closed := make(chan bool)
+		go func() {
+			closed <- queue.Close(time.Second)
+		}()
+		require.Eventually(t, queue.isClosed, time.Second, 10*time.Millisecond)
+
+		close(release)
+		require.True(t, <-closed)
+		require.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+		require.Equal(t, int32(1), atomic.LoadInt32(&failures))
+	})
+
+	t.Run("Wait before retrying a failed request is stopped when the queue is closed", func(t *testing.T) {
+		var attempts, failures int32
+		queue := newWebhookQueue(1, time.Minute, func(_ *webhookRequest) error {
+			atomic.AddInt32(&attempts, 1)
+			return model.NewAppError("CreatePost", "error in creating the post", nil, "", http.StatusInternalServerError)
+		}, func(_ error) {
+			atomic.AddInt32(&failures, 1)
+		})
+		queue.retryInterval = time.Hour
+
+		require.NoError(t, queue.Enqueue("mock-userID", &webhookRequest{data: []byte("first")}))
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&attempts) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		require.True(t, queue.Close(time.Second))
+		require.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+		require.Equal(t, int32(1), atomic.LoadInt32(&failures))
+	})
+
+	t.Run("Only network errors and internal errors of the server are transient", func(t *testing.T) {
+		require.True(t, isTransientWebhookError(errors.Wrap(&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "error in getting the file")))
+		require.True(t, isTransientWebhookError(errors.WithMessage(model.NewAppError("KVGet", "error in loading the key", nil, "", http.StatusInternalServerError), "failed plugin KVGet")))
+		require.False(t, isTransientWebhookError(model.NewAppError("CreatePost", "invalid post", nil, "", http.StatusBadRequest)))
+		require.False(t, isTransientWebhookError(errors.New("error in decoding the response")))
+	})
+
+	t.Run("Worker of an idle queue is stopped", func(t *testing.T) {
+		queue := newWebhookQueue(1, 10*time.Millisecond, func(_ *webhookRequest) error { return nil }, nil)
+
+		require.NoError(t, queue.Enqueue("mock-userID", &webhookRequest{data: []byte("first")}))
+		require.Eventually(t, func() bool {
+			queue.lock.Lock()
+			defer queue.lock.Unlock()
+			return len(queue.queues) == 0
+		}, time.Second, 10*time.Millisecond)
+
+		require.True(t, queue.Close(time.Second))
+	})
+}
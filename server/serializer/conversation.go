@@ -0,0 +1,12 @@
+package serializer
+
+import "time"
+
+// ConversationState is the state of the conversation of a user with the Virtual Agent.
+type ConversationState struct {
+	// ActivePromptPostID is the ID of the post of the latest question, which is the only one the user can answer.
+	ActivePromptPostID string
+	// ChannelID is the channel of the conversations started by mentioning the bot in a channel. It is empty for the DM with the bot.
+	ChannelID string
+	UpdatedAt time.Time
+}
@@ -0,0 +1,10 @@
+package serializer
+
+import "time"
+
+// LiveAgentChat is the chat of a user with the live agent, which the Virtual Agent handed the conversation off to.
+type LiveAgentChat struct {
+	AgentName   string
+	AgentAvatar string
+	StartedAt   time.Time
+}
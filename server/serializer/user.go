@@ -10,8 +10,25 @@ type ServiceNowUser struct {
 	Username string `json:"user_name"`
 }
 
+// PendingPostProgress keeps track of the parts of a post which were sent to the Virtual Agent before ServiceNow rejected the OAuth2 token.
+type PendingPostProgress struct {
+	// UnsentFileIDs are the files of the post which are not sent yet.
+	UnsentFileIDs []string
+	// IsMessageSent is set when the text of the post was sent along with one of its files.
+	IsMessageSent bool
+}
+
 type User struct {
 	MattermostUserID string
 	OAuth2Token      string
 	ServiceNowUser
+	// ReauthorizationRequired is set when ServiceNow rejects the stored OAuth2 token of the user.
+	ReauthorizationRequired bool
+	// PendingPostID is the ID of the post which couldn't be sent to the Virtual Agent because of the rejected token.
+	// It is sent again once the user reconnects their account.
+	PendingPostID string
+	// PendingPostProgress is set when the token was rejected after a part of the pending post had been sent.
+	PendingPostProgress *PendingPostProgress
+	// InstanceName is the name of the ServiceNow instance the user is connected to. It is empty for the default instance.
+	InstanceName string
 }
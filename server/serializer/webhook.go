@@ -0,0 +1,10 @@
+package serializer
+
+import "time"
+
+// WebhookSecretRotation keeps the webhook secret which was replaced by a regenerated secret,
+// so that ServiceNow requests using it can be accepted for a while after the rotation.
+type WebhookSecretRotation struct {
+	PreviousSecret string
+	RotatedAt      time.Time
+}